@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// SecretAccessKind is SecretAccess EntityのKind
+const SecretAccessKind = "SecretAccess"
+
+// secretAccessFlushInterval is Memoryに溜めたAccess記録をDatastoreに書き込む間隔
+const secretAccessFlushInterval = time.Minute
+
+// secretAccessFlushSize is この件数のSecretが溜まったら間隔を待たずに書き込む
+const secretAccessFlushSize = 100
+
+// maxSecretAccessReaders is SecretAccessに保持するReaderの最大数. 超えた場合は最後に読んだのが古いものから捨てる
+const maxSecretAccessReaders = 100
+
+// SecretAccess is Datastore Entity
+// Secretが最後に読まれた日時と、誰が何回読んだかを記録する. Key NameはSecretのKeyと同じ
+type SecretAccess struct {
+	Key            string               `json:"key" datastore:"-"`
+	LastAccessedAt time.Time            `json:"lastAccessedAt"`
+	LastAccessedBy string               `json:"lastAccessedBy"`
+	Readers        []SecretAccessReader `json:"readers"`
+}
+
+// SecretAccessReader is Secretを読んだuserと回数
+type SecretAccessReader struct {
+	Email          string    `json:"email"`
+	Count          int64     `json:"count"`
+	LastAccessedAt time.Time `json:"lastAccessedAt"`
+}
+
+// merge is Memoryに溜めたAccess記録を反映する
+func (sa *SecretAccess) merge(p *pendingSecretAccess) {
+	if p.lastAccessedAt.After(sa.LastAccessedAt) {
+		sa.LastAccessedAt = p.lastAccessedAt
+		sa.LastAccessedBy = p.lastAccessedBy
+	}
+	for email, r := range p.readers {
+		var found bool
+		for i := range sa.Readers {
+			sr := &sa.Readers[i]
+			if sr.Email != email {
+				continue
+			}
+			found = true
+			sr.Count += r.Count
+			if r.LastAccessedAt.After(sr.LastAccessedAt) {
+				sr.LastAccessedAt = r.LastAccessedAt
+			}
+		}
+		if !found {
+			sa.Readers = append(sa.Readers, SecretAccessReader{Email: email, Count: r.Count, LastAccessedAt: r.LastAccessedAt})
+		}
+	}
+	if len(sa.Readers) > maxSecretAccessReaders {
+		sort.Slice(sa.Readers, func(i, j int) bool { return sa.Readers[i].LastAccessedAt.After(sa.Readers[j].LastAccessedAt) })
+		sa.Readers = sa.Readers[:maxSecretAccessReaders]
+	}
+}
+
+// pendingSecretAccess is まだDatastoreに書き込んでいない1 SecretのAccess記録
+type pendingSecretAccess struct {
+	tenant         Tenant
+	key            string
+	lastAccessedAt time.Time
+	lastAccessedBy string
+	readers        map[string]*SecretAccessReader
+}
+
+// secretAccessBuffer is Secretを読む度にDatastoreに書き込まないように、Access記録をInstanceのMemoryに溜める
+// Instanceが停止した場合、最大でsecretAccessFlushInterval分の記録は失われる
+var secretAccessBuffer = struct {
+	sync.Mutex
+	m         map[string]*pendingSecretAccess
+	flushedAt time.Time
+}{m: map[string]*pendingSecretAccess{}, flushedAt: time.Now()}
+
+// RecordSecretAccess is Secretが読まれたことを記録する. Datastoreへの書き込みはFlushSecretAccessで行う
+func RecordSecretAccess(t *Tenant, key string, email string) {
+	now := time.Now()
+
+	secretAccessBuffer.Lock()
+	defer secretAccessBuffer.Unlock()
+
+	id := t.Namespace + "\x00" + key
+	p, ok := secretAccessBuffer.m[id]
+	if !ok {
+		p = &pendingSecretAccess{
+			tenant:  *t,
+			key:     key,
+			readers: map[string]*SecretAccessReader{},
+		}
+		secretAccessBuffer.m[id] = p
+	}
+	p.lastAccessedAt = now
+	p.lastAccessedBy = email
+	r, ok := p.readers[email]
+	if !ok {
+		r = &SecretAccessReader{Email: email}
+		p.readers[email] = r
+	}
+	r.Count++
+	r.LastAccessedAt = now
+}
+
+// FlushSecretAccess is 前回の書き込みからsecretAccessFlushInterval経過しているか、一定数溜まっている場合に、Access記録をDatastoreに書き込む
+// App Engine StandardではRequestの外でGoroutineを動かせないので、Secretを読んだRequestの中で呼ぶ
+func FlushSecretAccess(ctx context.Context) {
+	flushSecretAccess(ctx, false)
+}
+
+// flushSecretAccess is forceがtrueの場合は、間隔に関わらずAccess記録をDatastoreに書き込む
+func flushSecretAccess(ctx context.Context, force bool) {
+	secretAccessBuffer.Lock()
+	if len(secretAccessBuffer.m) == 0 || (!force &&
+		time.Since(secretAccessBuffer.flushedAt) < secretAccessFlushInterval && len(secretAccessBuffer.m) < secretAccessFlushSize) {
+		secretAccessBuffer.Unlock()
+		return
+	}
+	pending := secretAccessBuffer.m
+	secretAccessBuffer.m = map[string]*pendingSecretAccess{}
+	secretAccessBuffer.flushedAt = time.Now()
+	secretAccessBuffer.Unlock()
+
+	if err := writeSecretAccess(ctx, pending); err != nil {
+		// 分析用の記録なので、失敗してもRequestは失敗させない
+		log.Warningf(ctx, "failed flush secret access. count=%d, err=%+v", len(pending), err)
+	}
+}
+
+// writeSecretAccess is Access記録をSecretAccessにMergeして保存する
+func writeSecretAccess(ctx context.Context, pending map[string]*pendingSecretAccess) error {
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	list := make([]*pendingSecretAccess, 0, len(pending))
+	for _, p := range pending {
+		list = append(list, p)
+	}
+	// XG Transactionは25 Entity Groupまでなので分けて書き込む
+	for len(list) > 0 {
+		n := len(list)
+		if n > maxMoveEntityGroups {
+			n = maxMoveEntityGroups
+		}
+		chunk := list[:n]
+		list = list[n:]
+
+		keys := make([]datastore.Key, len(chunk))
+		for i, p := range chunk {
+			keys[i] = p.tenant.NameKey(ds, SecretAccessKind, p.key, nil)
+		}
+		_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+			sas := make([]*SecretAccess, len(chunk))
+			for i := range sas {
+				sas[i] = &SecretAccess{}
+			}
+			if err := tx.GetMulti(keys, sas); err != nil {
+				if merr, ok := err.(datastore.MultiError); ok {
+					for _, e := range merr {
+						if e != nil && e != datastore.ErrNoSuchEntity {
+							return e
+						}
+					}
+				} else {
+					return err
+				}
+			}
+			for i, p := range chunk {
+				sas[i].merge(p)
+			}
+			_, err := tx.PutMulti(keys, sas)
+			return err
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed put SecretAccess. count=%d", len(chunk))
+		}
+	}
+	return nil
+}
+
+// ListSecretAccess is TenantのSecretAccessを全て返す
+func ListSecretAccess(ctx context.Context, ds datastore.Client, t *Tenant) (map[string]*SecretAccess, error) {
+	var list []*SecretAccess
+	keys, err := ds.GetAll(ctx, t.NewQuery(ds, SecretAccessKind), &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list SecretAccess")
+	}
+	m := make(map[string]*SecretAccess, len(keys))
+	for i, k := range keys {
+		list[i].Key = k.Name()
+		m[k.Name()] = list[i]
+	}
+	return m, nil
+}
@@ -0,0 +1,196 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/user"
+)
+
+func setupAccessAPI(swPlugin *swagger.Plugin) {
+	api := &AccessAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Access", Description: "Secret access report API list"})
+
+	handleTenantAPI(http.MethodGet, "/access/report", api.Report, "report unused secrets, unexpected readers and top readers", tag)
+}
+
+// AccessAPI is API to report Secret access
+type AccessAPI struct{}
+
+// AccessAPIReportRequest is AccessAPI Report Request
+type AccessAPIReportRequest struct {
+	UnusedDays int `json:"unusedDays" swagger:",in=query"`
+	Top        int `json:"top" swagger:",in=query"`
+}
+
+// AccessAPIReportResponse is AccessAPI Report Response
+type AccessAPIReportResponse struct {
+	// Since is Unusedの判定に利用した日時. これ以降読まれていないSecretをUnusedとする
+	Since      time.Time             `json:"since"`
+	Unused     []*UnusedSecret       `json:"unused"`
+	Unexpected []*UnexpectedAccess   `json:"unexpected"`
+	TopReaders []*SecretAccessReader `json:"topReaders"`
+}
+
+// UnusedSecret is 一定期間読まれていないSecret
+// LastAccessedAtが空の場合は、記録を始めてから一度も読まれていない
+type UnusedSecret struct {
+	Key            string     `json:"key"`
+	LastAccessedAt *time.Time `json:"lastAccessedAt,omitempty"`
+	LastAccessedBy string     `json:"lastAccessedBy,omitempty"`
+	UpdatedAt      time.Time  `json:"updatedAt"`
+}
+
+// UnexpectedAccess is 現在のSecretACLとTenantの設定では読めないuserによるAccess
+// ACLから外された後も読まれていた場合や、Tenantの管理者ではないApp Engineの管理者が読んだ場合に現れる
+type UnexpectedAccess struct {
+	Key    string             `json:"key"`
+	Reader SecretAccessReader `json:"reader"`
+}
+
+// Report is Secretのアクセス状況を返すhandler. Tenantの管理者のみ実行できる
+func (api *AccessAPI) Report(ctx context.Context, form *AccessAPIReportRequest) (*AccessAPIReportResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	if form.UnusedDays <= 0 {
+		form.UnusedDays = 90
+	}
+	if form.Top <= 0 {
+		form.Top = 10
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 自分のInstanceに溜まっている分は反映してからReportを作る
+	flushSecretAccess(ctx, true)
+
+	keys, err := platform.SecretStore.List(ctx, t, "")
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := platform.SecretStore.GetMulti(ctx, t, keys)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list secrets")
+	}
+	accesses, err := ListSecretAccess(ctx, ds, t)
+	if err != nil {
+		return nil, err
+	}
+	acls, err := listSecretACL(ctx, ds, t)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &AccessAPIReportResponse{
+		Since:      time.Now().AddDate(0, 0, -form.UnusedDays),
+		Unused:     []*UnusedSecret{},
+		Unexpected: []*UnexpectedAccess{},
+		TopReaders: []*SecretAccessReader{},
+	}
+	readers := map[string]*SecretAccessReader{}
+	for i, key := range keys {
+		s := secrets[i]
+		sa, ok := accesses[key]
+		if !ok {
+			// 一度も読まれていなくても、最近作られたSecretはUnusedとしない
+			if s.UpdatedAt.Before(resp.Since) {
+				resp.Unused = append(resp.Unused, &UnusedSecret{Key: key, UpdatedAt: s.UpdatedAt})
+			}
+			continue
+		}
+		if sa.LastAccessedAt.Before(resp.Since) && s.UpdatedAt.Before(resp.Since) {
+			lastAccessedAt := sa.LastAccessedAt
+			resp.Unused = append(resp.Unused, &UnusedSecret{
+				Key:            key,
+				LastAccessedAt: &lastAccessedAt,
+				LastAccessedBy: sa.LastAccessedBy,
+				UpdatedAt:      s.UpdatedAt,
+			})
+		}
+
+		acl := nearestSecretACL(acls, key)
+		for _, r := range sa.Readers {
+			if !expectedReader(t, acl, r.Email) {
+				resp.Unexpected = append(resp.Unexpected, &UnexpectedAccess{Key: key, Reader: r})
+			}
+
+			tr, ok := readers[r.Email]
+			if !ok {
+				tr = &SecretAccessReader{Email: r.Email}
+				readers[r.Email] = tr
+				resp.TopReaders = append(resp.TopReaders, tr)
+			}
+			tr.Count += r.Count
+			if r.LastAccessedAt.After(tr.LastAccessedAt) {
+				tr.LastAccessedAt = r.LastAccessedAt
+			}
+		}
+	}
+
+	sort.Slice(resp.TopReaders, func(i, j int) bool {
+		if resp.TopReaders[i].Count != resp.TopReaders[j].Count {
+			return resp.TopReaders[i].Count > resp.TopReaders[j].Count
+		}
+		return resp.TopReaders[i].Email < resp.TopReaders[j].Email
+	})
+	if len(resp.TopReaders) > form.Top {
+		resp.TopReaders = resp.TopReaders[:form.Top]
+	}
+
+	return resp, nil
+}
+
+// expectedReader is 現在の設定でemailがSecretを読めるかを返す. Authorizeと同じ判定をEmailだけで行う
+func expectedReader(t *Tenant, acl *SecretACL, email string) bool {
+	u := &user.User{Email: email}
+	if t.IsAdmin(u) {
+		return true
+	}
+	if acl == nil {
+		return t.CanAccess(u)
+	}
+	return acl.Allowed(email, PermissionRead)
+}
+
+// listSecretACL is TenantのSecretACLをPrefix毎に返す
+func listSecretACL(ctx context.Context, ds datastore.Client, t *Tenant) (map[string]*SecretACL, error) {
+	var list []*SecretACL
+	keys, err := ds.GetAll(ctx, t.NewQuery(ds, SecretACLKind), &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list SecretACL")
+	}
+	m := make(map[string]*SecretACL, len(keys))
+	for i, k := range keys {
+		list[i].Prefix = aclPrefix(k.Name())
+		m[list[i].Prefix] = list[i]
+	}
+	return m, nil
+}
+
+// nearestSecretACL is FindSecretACLと同じく、keyに最も近い祖先のSecretACLを返す
+func nearestSecretACL(acls map[string]*SecretACL, key string) *SecretACL {
+	for _, p := range KeyPathAncestors(key) {
+		if acl, ok := acls[p]; ok {
+			return acl
+		}
+	}
+	return nil
+}
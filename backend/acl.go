@@ -0,0 +1,209 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// SecretACLKind is SecretACL EntityのKind
+const SecretACLKind = "SecretACL"
+
+// rootACLName is RootのSecretACLのKey Name. Datastore Keyは空文字を使えないため / を使う
+const rootACLName = KeyPathSeparator
+
+// Permission is Secretに対する操作の種類
+type Permission int
+
+// Permission List
+const (
+	PermissionRead Permission = iota
+	PermissionWrite
+)
+
+// String is Permissionの名前を返す
+func (p Permission) String() string {
+	switch p {
+	case PermissionRead:
+		return "read"
+	case PermissionWrite:
+		return "write"
+	}
+	return fmt.Sprintf("Permission(%d)", int(p))
+}
+
+// SecretACL is Datastore Entity
+// Prefix配下のSecretに対するアクセス権を表す. 最も近い祖先のSecretACLが適用される
+// RequiredApprovalsが1以上のPrefixは保護されていて、Secretの更新にはApproversの承認が必要になる
+// BreakGlassはPrefix配下のSecretに、Break-glassで一時的な読み込み権限を依頼できるuser
+type SecretACL struct {
+	Prefix            string    `json:"prefix" datastore:"-"`
+	Readers           []string  `json:"readers"`
+	Writers           []string  `json:"writers"`
+	Approvers         []string  `json:"approvers"`
+	RequiredApprovals int       `json:"requiredApprovals"`
+	BreakGlass        []string  `json:"breakGlass"`
+	UpdatedBy         string    `json:"updatedBy"`
+	UpdatedAt         time.Time `json:"updatedAt"`
+}
+
+// Protected is Secretの更新に承認が必要かどうかを返す
+func (acl *SecretACL) Protected() bool {
+	return acl != nil && acl.RequiredApprovals > 0
+}
+
+// CanApprove is emailが承認者かどうかを返す. 承認者に "*" は使えない
+func (acl *SecretACL) CanApprove(email string) bool {
+	if acl == nil {
+		return false
+	}
+	for _, a := range acl.Approvers {
+		if a == email {
+			return true
+		}
+	}
+	return false
+}
+
+// CanBreakGlass is emailがBreak-glassを依頼できるかを返す. SecretACLがない場合と "*" は許可しない
+func (acl *SecretACL) CanBreakGlass(email string) bool {
+	if acl == nil {
+		return false
+	}
+	for _, a := range acl.BreakGlass {
+		if a == email {
+			return true
+		}
+	}
+	return false
+}
+
+// Allowed is emailがpermissionを持っているかを返す
+// Writerは読み込みもできる. "*" はログインしている全てのuserを表す
+func (acl *SecretACL) Allowed(email string, permission Permission) bool {
+	principals := acl.Writers
+	if permission == PermissionRead {
+		principals = append(append([]string{}, acl.Readers...), acl.Writers...)
+	}
+	for _, p := range principals {
+		if p == "*" || p == email {
+			return true
+		}
+	}
+	return false
+}
+
+// aclName is PrefixからSecretACLのKey Nameを返す
+func aclName(prefix string) string {
+	if prefix == "" {
+		return rootACLName
+	}
+	return prefix
+}
+
+// aclPrefix is SecretACLのKey NameからPrefixを返す
+func aclPrefix(name string) string {
+	if name == rootACLName {
+		return ""
+	}
+	return name
+}
+
+// SecretACLKey is PrefixのSecretACLのKeyを返す
+func SecretACLKey(ds datastore.Client, t *Tenant, prefix string) datastore.Key {
+	return t.NameKey(ds, SecretACLKind, aclName(prefix), nil)
+}
+
+// FindSecretACL is keyに適用されるSecretACLを返す. 祖先のどこにもSecretACLがない場合はnilを返す
+func FindSecretACL(ctx context.Context, ds datastore.Client, t *Tenant, key string) (*SecretACL, error) {
+	prefixes := KeyPathAncestors(key)
+	keys := make([]datastore.Key, len(prefixes))
+	for i, p := range prefixes {
+		keys[i] = SecretACLKey(ds, t, p)
+	}
+
+	acls := make([]*SecretACL, len(keys))
+	for i := range acls {
+		acls[i] = &SecretACL{}
+	}
+	err := ds.GetMulti(ctx, keys, acls)
+	merr, ok := err.(datastore.MultiError)
+	if err != nil && !ok {
+		return nil, errors.Wrapf(err, "failed get SecretACL. key=%s", key)
+	}
+	for i, acl := range acls {
+		if ok && merr[i] != nil {
+			if merr[i] == datastore.ErrNoSuchEntity {
+				continue
+			}
+			return nil, errors.Wrapf(merr[i], "failed get SecretACL. prefix=%s", prefixes[i])
+		}
+		acl.Prefix = prefixes[i]
+		return acl, nil
+	}
+	return nil, nil
+}
+
+// Authorize is userがkeyに対してpermissionを持っているかを確認する
+// Tenantの管理者は常に許可する. SecretACLがない場合はTenantの設定に従う
+// Break-glassはSecretの値を読む時だけ許可するので、ここでは見ない. 値を返す場合はAuthorizeSecretValueを使う
+func Authorize(ctx context.Context, ds datastore.Client, t *Tenant, u *user.User, key string, permission Permission) error {
+	if u == nil {
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	ok, err := authorizeByACL(ctx, ds, t, u, key, permission)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	return &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("You do not have %s permission to %s.", permission, key)}
+}
+
+// AuthorizeSecretValue is userがkeyのSecretの値を読めるかを確認する
+// Authorizeに加えてBreak-glassで一時的に許可されている場合も許可し、breakglass.usedをAuditLogに記録する
+// Metadataのように値を返さない読み込みにはAuthorizeを使い、AuditLogに記録しない
+func AuthorizeSecretValue(ctx context.Context, ds datastore.Client, t *Tenant, u *user.User, key string) error {
+	if u == nil {
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	ok, err := authorizeByACL(ctx, ds, t, u, key, PermissionRead)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+	ok, err = authorizeBreakGlass(ctx, ds, t, u, key)
+	if err != nil {
+		return err
+	}
+	if ok {
+		return nil
+	}
+
+	return &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("You do not have %s permission to %s.", PermissionRead, key)}
+}
+
+// authorizeByACL is Tenantの設定とSecretACLだけで、userがkeyに対してpermissionを持っているかを返す
+func authorizeByACL(ctx context.Context, ds datastore.Client, t *Tenant, u *user.User, key string, permission Permission) (bool, error) {
+	if t.IsAdmin(u) {
+		return true, nil
+	}
+
+	acl, err := FindSecretACL(ctx, ds, t, key)
+	if err != nil {
+		return false, err
+	}
+	if acl == nil {
+		return t.CanAccess(u), nil
+	}
+	return acl.Allowed(u.Email, permission), nil
+}
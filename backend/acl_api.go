@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/favclip/ucon/swagger"
+)
+
+func setupACLAPI(swPlugin *swagger.Plugin) {
+	api := &ACLAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "ACL", Description: "Secret ACL API list"})
+
+	handleTenantAPI(http.MethodPut, "/acl", api.Put, "put acl to prefix", tag)
+	handleTenantAPI(http.MethodGet, "/acl", api.Get, "get effective acl of key", tag)
+}
+
+// ACLAPI is API to manage SecretACL
+type ACLAPI struct{}
+
+// ACLAPIPutRequest is ACLAPI Put Request
+// RequiredApprovalsを指定すると、Prefix配下のSecretの更新にApproversの承認が必要になる
+type ACLAPIPutRequest struct {
+	Prefix            string   `json:"prefix" swagger:",keyPrefix"`
+	Readers           []string `json:"readers"`
+	Writers           []string `json:"writers"`
+	Approvers         []string `json:"approvers"`
+	RequiredApprovals int      `json:"requiredApprovals"`
+	BreakGlass        []string `json:"breakGlass"`
+}
+
+// Put is SecretACL registration handler. Tenantの管理者のみ実行できる
+func (api *ACLAPI) Put(ctx context.Context, form *ACLAPIPutRequest) (*SecretACL, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	prefix := NormalizeKeyPrefix(form.Prefix)
+	if form.RequiredApprovals < 0 || form.RequiredApprovals > len(form.Approvers) {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("requiredApprovals must be between 0 and %d.", len(form.Approvers))}
+	}
+	for _, a := range form.Approvers {
+		if a == "*" {
+			return nil, &HTTPError{Code: http.StatusBadRequest, Message: "approvers must be email addresses."}
+		}
+	}
+	for _, a := range form.BreakGlass {
+		if a == "*" {
+			return nil, &HTTPError{Code: http.StatusBadRequest, Message: "breakGlass must be email addresses."}
+		}
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &SecretACL{
+		Prefix:            prefix,
+		Readers:           form.Readers,
+		Writers:           form.Writers,
+		Approvers:         form.Approvers,
+		RequiredApprovals: form.RequiredApprovals,
+		BreakGlass:        form.BreakGlass,
+		UpdatedBy:         u.Email,
+		UpdatedAt:         time.Now(),
+	}
+	if _, err := ds.Put(ctx, SecretACLKey(ds, t, prefix), acl); err != nil {
+		return nil, err
+	}
+
+	return acl, nil
+}
+
+// ACLAPIGetRequest is ACLAPI Get Request
+type ACLAPIGetRequest struct {
+	Key string `json:"key" swagger:",in=query,keyPrefix"`
+}
+
+// Get is keyに適用されるSecretACLを返すhandler
+func (api *ACLAPI) Get(ctx context.Context, form *ACLAPIGetRequest) (*SecretACL, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	key := NormalizeKeyPrefix(form.Key)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	acl, err := FindSecretACL(ctx, ds, t, key)
+	if err != nil {
+		return nil, err
+	}
+	if acl == nil {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("acl for %s is not found.", key)}
+	}
+
+	return acl, nil
+}
@@ -0,0 +1,248 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// AuditLogKind is AuditLog EntityのKind
+const AuditLogKind = "AuditLog"
+
+// AuditChainHeadKind is AuditChainHead EntityのKind
+const AuditChainHeadKind = "AuditChainHead"
+
+// maxAuditLogs is AuditLogを1度に返す最大件数
+const maxAuditLogs = 100
+
+// AuditAction is AuditLogに記録する操作の種類
+type AuditAction string
+
+// AuditAction List
+const (
+	AuditChangeRequested AuditAction = "change.requested"
+	AuditChangeApproved  AuditAction = "change.approved"
+	AuditChangeRejected  AuditAction = "change.rejected"
+	AuditChangeExpired   AuditAction = "change.expired"
+	AuditChangeCommitted AuditAction = "change.committed"
+	AuditChangeConflict  AuditAction = "change.conflict"
+
+	AuditBreakGlassGranted AuditAction = "breakglass.granted"
+	AuditBreakGlassUsed    AuditAction = "breakglass.used"
+	AuditBreakGlassRevoked AuditAction = "breakglass.revoked"
+
+	AuditQuorumCreated   AuditAction = "quorum.created"
+	AuditQuorumRequested AuditAction = "quorum.requested"
+	AuditQuorumSubmitted AuditAction = "quorum.submitted"
+	AuditQuorumRecovered AuditAction = "quorum.recovered"
+	AuditQuorumExpired   AuditAction = "quorum.expired"
+
+	AuditReencrypted AuditAction = "secret.reencrypted"
+	AuditRolledBack  AuditAction = "secret.rolledback"
+	AuditRevealed    AuditAction = "secret.revealed"
+
+	AuditBackupCreated  AuditAction = "backup.created"
+	AuditBackupRestored AuditAction = "backup.restored"
+
+	AuditReplicationConflict AuditAction = "replication.conflict"
+	AuditReplicationForced   AuditAction = "replication.forced"
+)
+
+// AuditLog is Datastore Entity
+// 承認のように、後から誰が何をしたかを確認する必要のある操作の記録. 値は記録しない
+// BreakGlassは通常の権限を越えたAccessに関する記録で、確認が必要なものとして区別する
+// Key毎のHash Chainになっていて、HashはPrevHashと全ての項目のSHA-256. Hash Chainを導入する前のAuditLogはHashが空になる
+type AuditLog struct {
+	ID         string      `json:"id" datastore:"-"`
+	Action     AuditAction `json:"action"`
+	Key        string      `json:"key"`
+	Actor      string      `json:"actor"`
+	Target     string      `json:"target,omitempty"`
+	Comment    string      `json:"comment,omitempty" datastore:",noindex"`
+	BreakGlass bool        `json:"breakGlass,omitempty"`
+	OccurredAt time.Time   `json:"occurredAt"`
+	PrevHash   string      `json:"prevHash,omitempty" datastore:",noindex"`
+	Hash       string      `json:"hash,omitempty" datastore:",noindex"`
+}
+
+// AuditChainHead is Datastore Entity
+// KeyのAuditLogのHash Chainの先頭. 最後に記録したAuditLogのHashと、Hash Chainの長さを持つ
+// Entityの名前は / + Key で、Keyが空のAuditLog (Backupなど) のHash Chainは / になる
+type AuditChainHead struct {
+	Key       string    `json:"key" datastore:"-"`
+	Hash      string    `json:"hash" datastore:",noindex"`
+	Length    int64     `json:"length" datastore:",noindex"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// AuditChainHeadKey is keyのAuditLogのHash Chainの先頭のKeyを返す
+func AuditChainHeadKey(ds datastore.Client, t *Tenant, key string) datastore.Key {
+	return t.NameKey(ds, AuditChainHeadKind, "/"+key, nil)
+}
+
+// auditChainKey is AuditChainHead EntityのKeyの名前から、AuditLogのKeyを返す
+func auditChainKey(name string) string {
+	return strings.TrimPrefix(name, "/")
+}
+
+// computeHash is PrevHashと全ての項目のSHA-256を返す
+// OccurredAtはDatastoreに保存すると精度がMicrosecondになるので、Microsecondで切り捨てた値を使う
+func (a *AuditLog) computeHash() string {
+	h := sha256.New()
+	for _, v := range []string{a.PrevHash, a.ID, string(a.Action), a.Key, a.Actor, a.Target, a.Comment} {
+		h.Write([]byte(v))
+		h.Write([]byte{0})
+	}
+	var b [9]byte
+	if a.BreakGlass {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint64(b[1:], uint64(a.OccurredAt.Truncate(time.Microsecond).UnixNano()))
+	h.Write(b[:])
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// link is AuditLogにIDを付けてheadの後に繋ぎ、headを進める
+func (a *AuditLog) link(head *AuditChainHead) {
+	a.ID = newRandomID()
+	if a.OccurredAt.IsZero() {
+		a.OccurredAt = time.Now()
+	}
+	a.OccurredAt = a.OccurredAt.Truncate(time.Microsecond)
+	a.PrevHash = head.Hash
+	a.Hash = a.computeHash()
+
+	head.Key = a.Key
+	head.Hash = a.Hash
+	head.Length++
+	head.UpdatedAt = a.OccurredAt
+}
+
+// putAuditLog is Transaction内でAuditLogを保存する. 記録できない場合は操作自体を失敗させる
+// 同じTransactionで同じKeyのAuditLogを記録する場合は、Hash Chainが分かれないように1回で渡すこと
+func putAuditLog(tx datastore.Transaction, ds datastore.Client, t *Tenant, logs ...*AuditLog) error {
+	heads := map[string]*AuditChainHead{}
+	for _, a := range logs {
+		head, ok := heads[a.Key]
+		if !ok {
+			head = &AuditChainHead{}
+			if err := tx.Get(AuditChainHeadKey(ds, t, a.Key), head); err != nil && err != datastore.ErrNoSuchEntity {
+				return errors.Wrapf(err, "failed get AuditChainHead. key=%s", a.Key)
+			}
+			heads[a.Key] = head
+		}
+		a.link(head)
+		if _, err := tx.Put(t.NameKey(ds, AuditLogKind, a.ID, nil), a); err != nil {
+			return errors.Wrapf(err, "failed put AuditLog. action=%s, key=%s", a.Action, a.Key)
+		}
+	}
+	for key, head := range heads {
+		if _, err := tx.Put(AuditChainHeadKey(ds, t, key), head); err != nil {
+			return errors.Wrapf(err, "failed put AuditChainHead. key=%s", key)
+		}
+	}
+	return nil
+}
+
+// WriteAuditLog is Transaction外でAuditLogを保存する. Hash Chainの先頭を更新するためにTransactionを使う
+func WriteAuditLog(ctx context.Context, ds datastore.Client, t *Tenant, a *AuditLog) error {
+	_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		return putAuditLog(tx, ds, t, a)
+	})
+	return err
+}
+
+// ListAuditChainHeads is TenantのAuditLogのHash Chainの先頭を全て返す
+func ListAuditChainHeads(ctx context.Context, ds datastore.Client, t *Tenant) ([]*AuditChainHead, error) {
+	heads := []*AuditChainHead{}
+	keys, err := ds.GetAll(ctx, t.NewQuery(ds, AuditChainHeadKind), &heads)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list AuditChainHead")
+	}
+	for i, k := range keys {
+		heads[i].Key = auditChainKey(k.Name())
+	}
+	return heads, nil
+}
+
+// walkAuditChains is headsからPrevHashを辿り、Hash Chainに含まれるAuditLogを返す
+// 改竄されたAuditLogや、途中のAuditLogがない場合、長さが合わない場合はErrorにする
+func walkAuditChains(heads []*AuditChainHead, logs []*AuditLog) (map[*AuditLog]bool, error) {
+	byHash := map[string]*AuditLog{}
+	for _, a := range logs {
+		if a.Hash != "" {
+			byHash[a.Hash] = a
+		}
+	}
+	chained := map[*AuditLog]bool{}
+	for _, head := range heads {
+		var n int64
+		for h := head.Hash; h != ""; n++ {
+			a, ok := byHash[h]
+			if !ok {
+				return nil, fmt.Errorf("audit chain of %q is broken. missing=%s", head.Key, h)
+			}
+			if a.Key != head.Key || a.computeHash() != a.Hash || chained[a] {
+				return nil, fmt.Errorf("audit log is tampered. key=%q, id=%s", head.Key, a.ID)
+			}
+			chained[a] = true
+			h = a.PrevHash
+		}
+		if n != head.Length {
+			return nil, fmt.Errorf("audit chain of %q has %d logs, want %d", head.Key, n, head.Length)
+		}
+	}
+	return chained, nil
+}
+
+// VerifyAuditChains is Hash Chainを持つ全てのAuditLogが、headsから辿れて改竄されていないかを確認する
+func VerifyAuditChains(heads []*AuditChainHead, logs []*AuditLog) error {
+	chained, err := walkAuditChains(heads, logs)
+	if err != nil {
+		return err
+	}
+	for _, a := range logs {
+		if a.Hash != "" && !chained[a] {
+			return fmt.Errorf("audit log is not in the chain. key=%q, id=%s", a.Key, a.ID)
+		}
+	}
+	return nil
+}
+
+// ListAuditLogs is prefix配下のKeyに対するAuditLogを新しい順に最大maxAuditLogs件返す
+// prefixを指定した場合は、Tenant全体の新しいものから探すと古いAuditLogが見つからないので、Keyの範囲で絞り込む
+// Keyの不等号を使うQueryはKeyの順にしか並べられないので、範囲内を全て読んでから新しい順に並べる
+func ListAuditLogs(ctx context.Context, ds datastore.Client, t *Tenant, prefix string) ([]*AuditLog, error) {
+	q := t.NewQuery(ds, AuditLogKind)
+	if prefix == "" {
+		q = q.Order("-OccurredAt").Limit(maxAuditLogs)
+	} else {
+		// prefix自身とprefix/配下. KeyPathSeparatorの次の文字は0
+		q = q.Filter("Key >=", prefix).Filter("Key <", prefix+"0")
+	}
+	var list []*AuditLog
+	keys, err := ds.GetAll(ctx, q, &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list AuditLog")
+	}
+	logs := []*AuditLog{}
+	for i, k := range keys {
+		list[i].ID = k.Name()
+		if HasKeyPrefix(list[i].Key, prefix) {
+			logs = append(logs, list[i])
+		}
+	}
+	sort.SliceStable(logs, func(i, j int) bool { return logs[i].OccurredAt.After(logs[j].OccurredAt) })
+	if len(logs) > maxAuditLogs {
+		logs = logs[:maxAuditLogs]
+	}
+	return logs, nil
+}
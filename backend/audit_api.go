@@ -0,0 +1,56 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/favclip/ucon/swagger"
+)
+
+func setupAuditAPI(swPlugin *swagger.Plugin) {
+	api := &AuditAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Audit", Description: "Audit Log API list"})
+
+	handleTenantAPI(http.MethodGet, "/audit", api.List, "list audit logs under prefix", tag)
+}
+
+// AuditAPI is API to read AuditLog
+type AuditAPI struct{}
+
+// AuditAPIListRequest is AuditAPI List Request
+type AuditAPIListRequest struct {
+	Prefix string `json:"prefix" swagger:",in=query,keyPrefix"`
+}
+
+// AuditAPIListResponse is AuditAPI List Response
+type AuditAPIListResponse struct {
+	List []*AuditLog `json:"list"`
+}
+
+// List is AuditLogを新しい順に返すhandler. Tenantの管理者のみ実行できる
+func (api *AuditAPI) List(ctx context.Context, form *AuditAPIListRequest) (*AuditAPIListResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := ListAuditLogs(ctx, ds, t, NormalizeKeyPrefix(form.Prefix))
+	if err != nil {
+		return nil, err
+	}
+	return &AuditAPIListResponse{
+		List: list,
+	}, nil
+}
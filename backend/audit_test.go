@@ -0,0 +1,283 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestAuditChains is keys毎にAuditLogを繋いだHash Chainを作る
+func newTestAuditChains(keys ...string) ([]*AuditChainHead, []*AuditLog) {
+	heads := map[string]*AuditChainHead{}
+	var order []*AuditChainHead
+	var logs []*AuditLog
+	at := time.Date(2018, 4, 1, 12, 0, 0, 123456789, time.UTC)
+	for i, key := range keys {
+		head, ok := heads[key]
+		if !ok {
+			head = &AuditChainHead{}
+			heads[key] = head
+			order = append(order, head)
+		}
+		a := &AuditLog{Action: AuditRevealed, Key: key, Actor: "test@example.com", OccurredAt: at.Add(time.Duration(i) * time.Second)}
+		a.link(head)
+		logs = append(logs, a)
+	}
+	return order, logs
+}
+
+func TestAuditChain(t *testing.T) {
+	heads, logs := newTestAuditChains("a", "b", "a", "", "a")
+	if g, e := len(heads), 3; g != e {
+		t.Fatalf("heads: got %d, want %d", g, e)
+	}
+	if g, e := heads[0].Length, int64(3); g != e {
+		t.Errorf("length of a: got %d, want %d", g, e)
+	}
+	if logs[0].PrevHash != "" || logs[2].PrevHash != logs[0].Hash || logs[4].PrevHash != logs[2].Hash {
+		t.Errorf("chain of a is not linked")
+	}
+	// OccurredAtはDatastoreと同じMicrosecondの精度で記録する
+	if g := logs[0].OccurredAt.Nanosecond() % 1000; g != 0 {
+		t.Errorf("occurredAt is not truncated: %d", g)
+	}
+	// Hash Chainを導入する前のAuditLogは確認しない
+	logs = append(logs, &AuditLog{ID: "legacy", Action: AuditChangeApproved, Key: "a"})
+	if err := VerifyAuditChains(heads, logs); err != nil {
+		t.Errorf("VerifyAuditChains: %v", err)
+	}
+}
+
+func TestAuditChainTampered(t *testing.T) {
+	cases := []struct {
+		name   string
+		tamper func(heads []*AuditChainHead, logs []*AuditLog) ([]*AuditChainHead, []*AuditLog)
+		want   string
+	}{
+		{"altered comment", func(heads []*AuditChainHead, logs []*AuditLog) ([]*AuditChainHead, []*AuditLog) {
+			logs[2].Comment = "changed"
+			return heads, logs
+		}, "tampered"},
+		{"altered actor and hash", func(heads []*AuditChainHead, logs []*AuditLog) ([]*AuditChainHead, []*AuditLog) {
+			logs[0].Actor = "other@example.com"
+			logs[0].Hash = logs[0].computeHash()
+			return heads, logs
+		}, "broken"},
+		{"moved to another key", func(heads []*AuditChainHead, logs []*AuditLog) ([]*AuditChainHead, []*AuditLog) {
+			logs[1].Key = "a"
+			return heads, logs
+		}, "tampered"},
+		{"removed middle", func(heads []*AuditChainHead, logs []*AuditLog) ([]*AuditChainHead, []*AuditLog) {
+			return heads, append(logs[:2:2], logs[3:]...)
+		}, "broken"},
+		{"removed last", func(heads []*AuditChainHead, logs []*AuditLog) ([]*AuditChainHead, []*AuditLog) {
+			return heads, logs[:3]
+		}, "broken"},
+		{"removed head", func(heads []*AuditChainHead, logs []*AuditLog) ([]*AuditChainHead, []*AuditLog) {
+			return heads[:1], logs
+		}, "not in the chain"},
+		{"rolled back head", func(heads []*AuditChainHead, logs []*AuditLog) ([]*AuditChainHead, []*AuditLog) {
+			heads[0].Hash = logs[2].Hash
+			return heads, logs
+		}, "has 2 logs, want 3"},
+	}
+	for _, c := range cases {
+		heads, logs := newTestAuditChains("a", "b", "a", "a")
+		heads, logs = c.tamper(heads, logs)
+		err := VerifyAuditChains(heads, logs)
+		if err == nil || !strings.Contains(err.Error(), c.want) {
+			t.Errorf("%s: got %v, want %q", c.name, err, c.want)
+		}
+	}
+}
+
+func TestBackupVerifyAuditChain(t *testing.T) {
+	heads, logs := newTestAuditChains("a", "b", "a")
+	b := &Backup{Format: backupFormat, Tenants: []*TenantBackup{{
+		Tenant:          testTenant(),
+		AuditLogs:       logs,
+		AuditChainHeads: heads,
+	}}}
+	sum, err := tenantsChecksum(b.Tenants)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Checksum = sum
+	summary, err := b.Verify()
+	if err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if g, e := summary.Tenants[0].AuditChainHeads, 2; g != e {
+		t.Errorf("audit chain heads: got %d, want %d", g, e)
+	}
+
+	// Checksumを計算し直しても、AuditLogを消せばVerifyで失敗する
+	b.Tenants[0].AuditLogs = logs[1:]
+	if b.Checksum, err = tenantsChecksum(b.Tenants); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Verify(); err == nil || !strings.Contains(err.Error(), "audit chain") {
+		t.Errorf("Verify without the first log: got %v, want audit chain error", err)
+	}
+}
+
+func TestRestoreBackupKeepsLongerAuditChain(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	tenant := &Tenant{ID: "audit-restore", Namespace: "audit-restore", CryptKey: testCryptKey}
+	write := func() {
+		if err := WriteAuditLog(ctx, ds, tenant, &AuditLog{Action: AuditRevealed, Key: "app/db", Actor: "test@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write()
+	b, err := CreateBackup(ctx, ds, []*Tenant{tenant}, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Backupの後に記録したAuditLogは、Overwriteで復元しても先頭から辿れる
+	write()
+	if _, err := RestoreBackup(ctx, ds, b, &RestoreOptions{Overwrite: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := RecordBackup(ctx, ds, b, AuditBackupRestored, "test@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	heads, err := ListAuditChainHeads(ctx, ds, tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lengths := map[string]int64{}
+	for _, h := range heads {
+		lengths[h.Key] = h.Length
+	}
+	if g, e := lengths["app/db"], int64(2); g != e {
+		t.Errorf("app/db chain length: got %d, want %d", g, e)
+	}
+	after, err := CreateBackup(ctx, ds, []*Tenant{tenant}, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := after.Verify(); err != nil {
+		t.Errorf("Verify after restore: %v", err)
+	}
+}
+
+func TestSealOpenBackup(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	heads, logs := newTestAuditChains("a")
+	b := &Backup{Format: backupFormat, Tenants: []*TenantBackup{{
+		Tenant:          testTenant(),
+		Secrets:         []*BackupSecret{{Key: "app/db", Value: "secret"}},
+		AuditLogs:       logs,
+		AuditChainHeads: heads,
+	}}}
+	data, err := SealBackup(&priv.PublicKey, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("sealed backup contains the plain value")
+	}
+
+	fp, err := BackupFingerprint(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := fp, PublicKeyFingerprint(&priv.PublicKey); g != e {
+		t.Errorf("fingerprint: got %s, want %s", g, e)
+	}
+	opened, err := OpenBackup(priv, data)
+	if err != nil {
+		t.Fatalf("OpenBackup: %v", err)
+	}
+	if g, e := opened.Tenants[0].Secrets[0].Value, "secret"; g != e {
+		t.Errorf("secret: got %q, want %q", g, e)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenBackup(other, data); err == nil {
+		t.Error("OpenBackup with another key: want error")
+	}
+
+	// HeaderはAADなので、どのbyteを書き換えても復号できない
+	p := len(backupMagic) + 1 + 32
+	header := p + 2 + int(binary.BigEndian.Uint16(data[p:])) + 12
+	for i := 0; i < header; i++ {
+		tampered := append([]byte{}, data...)
+		tampered[i] ^= 1
+		if _, err := OpenBackup(priv, tampered); err == nil {
+			t.Fatalf("OpenBackup with tampered header byte %d: want error", i)
+		}
+	}
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := OpenBackup(priv, tampered); err == nil {
+		t.Error("OpenBackup with tampered body: want error")
+	}
+
+	for n := 0; n < len(data); n++ {
+		if _, err := OpenBackup(priv, data[:n]); err == nil {
+			t.Fatalf("OpenBackup with %d bytes: want error", n)
+		}
+	}
+	if _, err := BackupFingerprint([]byte("not a backup")); err == nil {
+		t.Error("BackupFingerprint with garbage: want error")
+	}
+}
+
+func TestListAuditLogs(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	tenant := testTenant()
+	at := time.Date(2018, 4, 1, 12, 0, 0, 0, time.UTC)
+	put := func(id string, key string, occurredAt time.Time) {
+		a := &AuditLog{Action: AuditRevealed, Key: key, Actor: "test@example.com", OccurredAt: occurredAt}
+		if _, err := ds.Put(ctx, tenant.NameKey(ds, AuditLogKind, id, nil), a); err != nil {
+			t.Fatal(err)
+		}
+	}
+	put("old-prefix", "app", at)
+	put("old-child", "app/db", at.Add(time.Second))
+	put("sibling", "app-old/db", at.Add(2*time.Second))
+	// prefix配下のAuditLogより新しいものがmaxAuditLogsを越えても、prefix配下のものは返す
+	for i := 0; i < maxAuditLogs+1; i++ {
+		put(fmt.Sprintf("other-%d", i), "other", at.Add(time.Hour+time.Duration(i)*time.Second))
+	}
+
+	logs, err := ListAuditLogs(ctx, ds, tenant, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, a := range logs {
+		ids = append(ids, a.ID)
+	}
+	if g, e := strings.Join(ids, ","), "old-child,old-prefix"; g != e {
+		t.Errorf("got %s, want %s", g, e)
+	}
+
+	logs, err = ListAuditLogs(ctx, ds, tenant, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := len(logs), maxAuditLogs; g != e {
+		t.Errorf("all: got %d, want %d", g, e)
+	}
+	if g, e := logs[0].ID, fmt.Sprintf("other-%d", maxAuditLogs); g != e {
+		t.Errorf("latest: got %s, want %s", g, e)
+	}
+}
@@ -0,0 +1,665 @@
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// backupFormat is Backupの形式のVersion
+const backupFormat = 1
+
+// backupMagic is Backup Fileの先頭に書く文字列
+var backupMagic = []byte("gcpsm-backup\x00")
+
+// backupLabel is RSA-OAEPのLabel. 別の用途で暗号化されたものをBackupとして扱わないようにする
+var backupLabel = []byte("gcpsm-backup")
+
+// datastoreBatchSize is 1回のPutMultiで保存するEntityの数の上限
+const datastoreBatchSize = 500
+
+// Backup is KMSを使わずに復元できる全てのTenantの情報. 値は平文で持つので、SealBackupで暗号化してから外に出す
+// Checksumは全てのTenantのJSONのSHA-256で、復元の前に改竄や破損がないかを確認する
+type Backup struct {
+	Format    int             `json:"format"`
+	CreatedBy string          `json:"createdBy"`
+	CreatedAt time.Time       `json:"createdAt"`
+	Checksum  string          `json:"checksum"`
+	Tenants   []*TenantBackup `json:"tenants"`
+}
+
+// TenantBackup is 1つのTenantのBackup. Default TenantはTenant.IDが空になる
+// AuditLogはHash Chainの先頭 (AuditChainHead) と一緒に含め、Verifyで全てのAuditLogが先頭から辿れるかを確認する
+// SecretVersionsはSecretの履歴で、履歴を含まない以前のBackupのChecksumが変わらないようにomitemptyにする
+// 承認待ちのSecretChangeRequest, QuorumRecovery, Webhookの配信履歴は一時的なものなので含めない
+type TenantBackup struct {
+	Tenant           *Tenant               `json:"tenant"`
+	Secrets          []*BackupSecret       `json:"secrets"`
+	SecretVersions   []*BackupSecret       `json:"secretVersions,omitempty"`
+	ACLs             []*SecretACL          `json:"acls"`
+	AuditLogs        []*AuditLog           `json:"auditLogs"`
+	AuditChainHeads  []*AuditChainHead     `json:"auditChainHeads"`
+	Webhooks         []*BackupWebhook      `json:"webhooks"`
+	QuorumCustodians []*QuorumCustodian    `json:"quorumCustodians"`
+	QuorumSecrets    []*BackupQuorumSecret `json:"quorumSecrets"`
+}
+
+// BackupSecret is SecretのBackup. ValueはDecryptした値で、ChecksumはKeyと値のSHA-256
+type BackupSecret struct {
+	Key       string    `json:"key"`
+	Value     string    `json:"value,omitempty"`
+	AliasOf   string    `json:"aliasOf,omitempty"`
+	Version   int64     `json:"version"`
+	UpdatedBy string    `json:"updatedBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	Checksum  string    `json:"checksum"`
+}
+
+// BackupWebhook is WebhookSubscriptionのBackup. SigningSecretはDecryptした値
+type BackupWebhook struct {
+	*WebhookSubscription
+	SigningSecret string `json:"signingSecret"`
+}
+
+// BackupQuorumSecret is QuorumSecretのBackup. HashesはShareのHashをDecryptしたもので、Sharesと同じ順に並べる
+type BackupQuorumSecret struct {
+	*QuorumSecret
+	Hashes []string `json:"hashes"`
+}
+
+// BackupSummary is BackupまたはRestoreの結果
+type BackupSummary struct {
+	Checksum string                `json:"checksum"`
+	DryRun   bool                  `json:"dryRun"`
+	Tenants  []*TenantBackupCounts `json:"tenants"`
+}
+
+// TenantBackupCounts is TenantのBackupに含まれるEntityの数
+type TenantBackupCounts struct {
+	Tenant           string `json:"tenant"`
+	CryptKey         string `json:"cryptKey"`
+	Secrets          int    `json:"secrets"`
+	SecretVersions   int    `json:"secretVersions"`
+	ACLs             int    `json:"acls"`
+	AuditLogs        int    `json:"auditLogs"`
+	AuditChainHeads  int    `json:"auditChainHeads"`
+	Webhooks         int    `json:"webhooks"`
+	QuorumCustodians int    `json:"quorumCustodians"`
+	QuorumSecrets    int    `json:"quorumSecrets"`
+}
+
+func secretChecksum(key string, value string, aliasOf string) string {
+	h := sha256.New()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(value))
+	h.Write([]byte{0})
+	h.Write([]byte(aliasOf))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func tenantsChecksum(tenants []*TenantBackup) (string, error) {
+	b, err := json.Marshal(tenants)
+	if err != nil {
+		return "", errors.Wrap(err, "failed marshal tenants")
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// CreateBackup is tenantsの全てのSecretと関連するEntityを読み込み、値をDecryptしたBackupを作成する
+func CreateBackup(ctx context.Context, ds datastore.Client, tenants []*Tenant, actor string) (*Backup, error) {
+	kms := NewCrypter()
+	b := &Backup{
+		Format:    backupFormat,
+		CreatedBy: actor,
+		CreatedAt: time.Now(),
+	}
+	for _, t := range tenants {
+		tb, err := backupTenant(ctx, ds, kms, t)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed backup tenant. tenant=%s", t.ID)
+		}
+		b.Tenants = append(b.Tenants, tb)
+	}
+	sum, err := tenantsChecksum(b.Tenants)
+	if err != nil {
+		return nil, err
+	}
+	b.Checksum = sum
+	return b, nil
+}
+
+func backupTenant(ctx context.Context, ds datastore.Client, kms *Crypter, t *Tenant) (*TenantBackup, error) {
+	tb := &TenantBackup{
+		Tenant:           t,
+		Secrets:          []*BackupSecret{},
+		SecretVersions:   []*BackupSecret{},
+		ACLs:             []*SecretACL{},
+		AuditLogs:        []*AuditLog{},
+		AuditChainHeads:  []*AuditChainHead{},
+		Webhooks:         []*BackupWebhook{},
+		QuorumCustodians: []*QuorumCustodian{},
+		QuorumSecrets:    []*BackupQuorumSecret{},
+	}
+
+	keys, err := platform.SecretStore.List(ctx, t, "")
+	if err != nil {
+		return nil, err
+	}
+	list, err := platform.SecretStore.GetMulti(ctx, t, keys)
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range list {
+		bs, err := backupSecret(ctx, kms, t, keys[i], s)
+		if err != nil {
+			return nil, err
+		}
+		tb.Secrets = append(tb.Secrets, bs)
+
+		versions, err := listSecretVersions(ctx, ds, t, keys[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range versions {
+			bv, err := backupSecret(ctx, kms, t, keys[i], v)
+			if err != nil {
+				return nil, err
+			}
+			tb.SecretVersions = append(tb.SecretVersions, bv)
+		}
+	}
+
+	aclKeys, err := ds.GetAll(ctx, t.NewQuery(ds, SecretACLKind), &tb.ACLs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list SecretACL")
+	}
+	for i, k := range aclKeys {
+		tb.ACLs[i].Prefix = aclPrefix(k.Name())
+	}
+
+	// Hash Chainの先頭を先に読み、その後に記録されたAuditLogは含めない
+	// Transactionの途中だったAuditLogは先頭から辿れないことがあるので、1分より前のものだけをErrorにする
+	headsReadAt := time.Now()
+	tb.AuditChainHeads, err = ListAuditChainHeads(ctx, ds, t)
+	if err != nil {
+		return nil, err
+	}
+	var logs []*AuditLog
+	auditKeys, err := ds.GetAll(ctx, t.NewQuery(ds, AuditLogKind).Order("OccurredAt"), &logs)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list AuditLog")
+	}
+	for i, k := range auditKeys {
+		logs[i].ID = k.Name()
+	}
+	chained, err := walkAuditChains(tb.AuditChainHeads, logs)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range logs {
+		if a.Hash == "" || chained[a] {
+			tb.AuditLogs = append(tb.AuditLogs, a)
+		} else if a.OccurredAt.Before(headsReadAt.Add(-time.Minute)) {
+			return nil, fmt.Errorf("audit log is not in the chain. key=%q, id=%s", a.Key, a.ID)
+		}
+	}
+
+	subs, err := ListWebhookSubscriptions(ctx, ds, t)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		secret, err := kms.DecryptMulti(ctx, t.CryptKeys(), sub.SigningSecret)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed decrypt webhook signing secret. id=%s", sub.ID)
+		}
+		tb.Webhooks = append(tb.Webhooks, &BackupWebhook{WebhookSubscription: sub, SigningSecret: secret})
+	}
+
+	custodianKeys, err := ds.GetAll(ctx, t.NewQuery(ds, QuorumCustodianKind), &tb.QuorumCustodians)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list QuorumCustodian")
+	}
+	for i, k := range custodianKeys {
+		tb.QuorumCustodians[i].Email = k.Name()
+	}
+
+	var qsList []*QuorumSecret
+	qsKeys, err := ds.GetAll(ctx, t.NewQuery(ds, QuorumSecretKind), &qsList)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list QuorumSecret")
+	}
+	for i, qs := range qsList {
+		qs.Key = qsKeys[i].Name()
+		bq := &BackupQuorumSecret{QuorumSecret: qs, Hashes: make([]string, len(qs.Shares))}
+		for j, share := range qs.Shares {
+			bq.Hashes[j], err = kms.DecryptMulti(ctx, t.CryptKeys(), share.Hash)
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed decrypt quorum share hash. key=%s, custodian=%s", qs.Key, share.Custodian)
+			}
+		}
+		tb.QuorumSecrets = append(tb.QuorumSecrets, bq)
+	}
+
+	return tb, nil
+}
+
+// backupSecret is keyのSecretまたはその履歴の1 Versionを、値をDecryptしたBackupSecretにする
+func backupSecret(ctx context.Context, kms *Crypter, t *Tenant, key string, s *Secret) (*BackupSecret, error) {
+	bs := &BackupSecret{
+		Key:       key,
+		AliasOf:   s.AliasOf,
+		Version:   s.Version,
+		UpdatedBy: s.UpdatedBy,
+		UpdatedAt: s.UpdatedAt,
+	}
+	if s.AliasOf == "" {
+		var err error
+		bs.Value, err = kms.DecryptMulti(ctx, t.CryptKeys(), s.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed decrypt secret. key=%s, version=%d", key, s.Version)
+		}
+	}
+	bs.Checksum = secretChecksum(bs.Key, bs.Value, bs.AliasOf)
+	return bs, nil
+}
+
+// SealBackup is BackupをgzipしてAES-256-GCMで暗号化し、その鍵を運用者の公開鍵でRSA-OAEPで暗号化する
+// magic | version(1) | fingerprint(32) | len(wrapped)(2) | wrapped | nonce | AES-256-GCM(gzip(json), aad=ここまで)
+func SealBackup(pub *rsa.PublicKey, b *Backup) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	if err := json.NewEncoder(zw).Encode(b); err != nil {
+		return nil, errors.Wrap(err, "failed marshal backup")
+	}
+	if err := zw.Close(); err != nil {
+		return nil, errors.Wrap(err, "failed compress backup")
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, errors.Wrap(err, "failed generate backup key")
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, backupLabel)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed wrap backup key")
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &bytes.Buffer{}
+	header.Write(backupMagic)
+	header.WriteByte(backupFormat)
+	fp, _ := hex.DecodeString(PublicKeyFingerprint(pub))
+	header.Write(fp)
+	binary.Write(header, binary.BigEndian, uint16(len(wrapped)))
+	header.Write(wrapped)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "failed generate nonce")
+	}
+	header.Write(nonce)
+
+	return aead.Seal(header.Bytes(), nonce, buf.Bytes(), header.Bytes()), nil
+}
+
+// BackupFingerprint is Backupを暗号化した公開鍵のFingerprintを返す. 秘密鍵を探すために利用する
+func BackupFingerprint(data []byte) (string, error) {
+	n := len(backupMagic)
+	if len(data) < n+1+32 || !bytes.Equal(data[:n], backupMagic) {
+		return "", errors.New("not a gcpsm backup")
+	}
+	if data[n] != backupFormat {
+		return "", fmt.Errorf("unsupported backup format %d", data[n])
+	}
+	return hex.EncodeToString(data[n+1 : n+1+32]), nil
+}
+
+// OpenBackup is SealBackupで暗号化したBackupを秘密鍵で復号する. Checksumの確認はVerifyで行う
+func OpenBackup(priv *rsa.PrivateKey, data []byte) (*Backup, error) {
+	fp, err := BackupFingerprint(data)
+	if err != nil {
+		return nil, err
+	}
+	if fp != PublicKeyFingerprint(&priv.PublicKey) {
+		return nil, fmt.Errorf("backup is encrypted with another key. fingerprint=%s", fp)
+	}
+	p := len(backupMagic) + 1 + 32
+	if len(data) < p+2 {
+		return nil, errors.New("backup is truncated")
+	}
+	n := int(binary.BigEndian.Uint16(data[p:]))
+	p += 2
+	if len(data) < p+n {
+		return nil, errors.New("backup is truncated")
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, data[p:p+n], backupLabel)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed unwrap backup key")
+	}
+	p += n
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < p+aead.NonceSize() {
+		return nil, errors.New("backup is truncated")
+	}
+	nonce := data[p : p+aead.NonceSize()]
+	p += aead.NonceSize()
+	compressed, err := aead.Open(nil, nonce, data[p:], data[:p])
+	if err != nil {
+		return nil, errors.Wrap(err, "failed decrypt backup")
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed decompress backup")
+	}
+	plain, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed decompress backup")
+	}
+	b := &Backup{}
+	if err := json.Unmarshal(plain, b); err != nil {
+		return nil, errors.Wrap(err, "failed parse backup")
+	}
+	if b.Format != backupFormat {
+		return nil, fmt.Errorf("unsupported backup format %d", b.Format)
+	}
+	return b, nil
+}
+
+// Verify is BackupのChecksumとSecret毎のChecksumを確認し、含まれているEntityの数を返す
+func (b *Backup) Verify() (*BackupSummary, error) {
+	sum, err := tenantsChecksum(b.Tenants)
+	if err != nil {
+		return nil, err
+	}
+	if sum != b.Checksum {
+		return nil, fmt.Errorf("backup checksum mismatch. expected=%s, actual=%s", b.Checksum, sum)
+	}
+	summary := &BackupSummary{Checksum: sum, DryRun: true}
+	for _, tb := range b.Tenants {
+		if tb.Tenant == nil {
+			return nil, errors.New("backup contains a tenant without settings")
+		}
+		for _, s := range tb.Secrets {
+			if secretChecksum(s.Key, s.Value, s.AliasOf) != s.Checksum {
+				return nil, fmt.Errorf("secret checksum mismatch. tenant=%s, key=%s", tb.Tenant.ID, s.Key)
+			}
+		}
+		for _, s := range tb.SecretVersions {
+			if secretChecksum(s.Key, s.Value, s.AliasOf) != s.Checksum {
+				return nil, fmt.Errorf("secret version checksum mismatch. tenant=%s, key=%s, version=%d", tb.Tenant.ID, s.Key, s.Version)
+			}
+		}
+		if err := VerifyAuditChains(tb.AuditChainHeads, tb.AuditLogs); err != nil {
+			return nil, errors.Wrapf(err, "tenant=%s", tb.Tenant.ID)
+		}
+		for _, qs := range tb.QuorumSecrets {
+			if len(qs.Hashes) != len(qs.Shares) {
+				return nil, fmt.Errorf("quorum secret hashes mismatch. tenant=%s, key=%s", tb.Tenant.ID, qs.Key)
+			}
+		}
+		summary.Tenants = append(summary.Tenants, tb.counts(tb.Tenant.CryptKey))
+	}
+	return summary, nil
+}
+
+func (tb *TenantBackup) counts(cryptKey CryptKey) *TenantBackupCounts {
+	return &TenantBackupCounts{
+		Tenant:           tb.Tenant.ID,
+		CryptKey:         cryptKey.Name(),
+		Secrets:          len(tb.Secrets),
+		SecretVersions:   len(tb.SecretVersions),
+		ACLs:             len(tb.ACLs),
+		AuditLogs:        len(tb.AuditLogs),
+		AuditChainHeads:  len(tb.AuditChainHeads),
+		Webhooks:         len(tb.Webhooks),
+		QuorumCustodians: len(tb.QuorumCustodians),
+		QuorumSecrets:    len(tb.QuorumSecrets),
+	}
+}
+
+// RestoreOptions is RestoreBackupの設定
+type RestoreOptions struct {
+	// CryptKey is 復元した値をEncryptするCryptKey. 空の場合はBackupしたTenantの設定を使う
+	// 指定した場合はRedundantCryptKeysを引き継がない
+	CryptKey *CryptKey
+	// Tenant is 指定した場合はこのTenantだけを復元する. Default Tenantは空文字ではなく DefaultTenantID で指定する
+	Tenant string
+	// Overwrite is 既に存在するSecretを上書きする. falseの場合は1つでも存在すれば何も書き込まずに失敗する
+	// AuditLogのHash Chainの先頭は、既存の方が長い場合は上書きしない
+	Overwrite bool
+	// DryRun is Checksumを確認するだけで、KMSもDatastoreも使わない
+	DryRun bool
+}
+
+// DefaultTenantID is RestoreOptions.TenantでDefault Tenantを指定する時の名前
+const DefaultTenantID = "default"
+
+// RestoreBackup is Backupを確認した後、TenantのCryptKeyで値をEncryptし直して保存する
+// Secretの値が変わらないように、VersionとUpdatedBy, UpdatedAtはBackupの時点のものを保存する
+func RestoreBackup(ctx context.Context, ds datastore.Client, b *Backup, opts *RestoreOptions) (*BackupSummary, error) {
+	summary, err := b.Verify()
+	if err != nil {
+		return nil, err
+	}
+	var targets []*TenantBackup
+	for _, tb := range b.Tenants {
+		if opts.Tenant == "" || opts.Tenant == tb.Tenant.ID || (opts.Tenant == DefaultTenantID && tb.Tenant.ID == "") {
+			targets = append(targets, tb)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("tenant %s is not in the backup", opts.Tenant)
+	}
+
+	summary = &BackupSummary{Checksum: summary.Checksum, DryRun: opts.DryRun}
+	for _, tb := range targets {
+		// CryptKeyを指定しないDryRunはPlatformの設定を使わずに、BackupのCryptKeyを表示する
+		ck := tb.Tenant.CryptKey
+		if !opts.DryRun || opts.CryptKey != nil {
+			ck = restoredTenant(ctx, tb.Tenant, opts.CryptKey).CryptKey
+		}
+		summary.Tenants = append(summary.Tenants, tb.counts(ck))
+	}
+	if opts.DryRun {
+		return summary, nil
+	}
+
+	if !opts.Overwrite {
+		for _, tb := range targets {
+			t := restoredTenant(ctx, tb.Tenant, opts.CryptKey)
+			keys, err := platform.SecretStore.List(ctx, t, "")
+			if err != nil {
+				return nil, err
+			}
+			if len(keys) > 0 {
+				return nil, fmt.Errorf("tenant %s already has %d secrets. use overwrite to restore into it", tb.Tenant.ID, len(keys))
+			}
+		}
+	}
+	for _, tb := range targets {
+		t := restoredTenant(ctx, tb.Tenant, opts.CryptKey)
+		if err := restoreTenant(ctx, ds, t, tb); err != nil {
+			return nil, errors.Wrapf(err, "failed restore tenant. tenant=%s", t.ID)
+		}
+	}
+	return summary, nil
+}
+
+// restoredTenant is 復元先のTenant. cryptKeyを指定した場合はそのCryptKeyだけを使う
+func restoredTenant(ctx context.Context, t *Tenant, cryptKey *CryptKey) *Tenant {
+	rt := *t
+	if cryptKey != nil {
+		rt.CryptKey = tenantCryptKey(ctx, *cryptKey)
+		rt.RedundantCryptKeys = nil
+	}
+	if rt.ID == "" {
+		// Default Tenantの設定はPlatformで決まるので、CryptKeyの指定がなければ現在の設定を使う
+		d := DefaultTenant(ctx)
+		if cryptKey == nil {
+			rt.CryptKey, rt.RedundantCryptKeys = d.CryptKey, d.RedundantCryptKeys
+		}
+	}
+	return &rt
+}
+
+func restoreTenant(ctx context.Context, ds datastore.Client, t *Tenant, tb *TenantBackup) error {
+	kms := NewCrypter()
+
+	if t.ID != "" {
+		t.UpdatedAt = time.Now()
+		if _, err := ds.Put(ctx, ds.NameKey(TenantKind, t.ID, nil), t); err != nil {
+			return errors.Wrap(err, "failed put tenant")
+		}
+		invalidateTenantCache(t.ID)
+	}
+
+	// Entity Groupの上限を越えないよう、Secretは25件ずつTransactionで保存する
+	for i := 0; i < len(tb.Secrets); i += maxMoveEntityGroups {
+		j := i + maxMoveEntityGroups
+		if j > len(tb.Secrets) {
+			j = len(tb.Secrets)
+		}
+		list := make([]*Secret, 0, j-i)
+		for _, bs := range tb.Secrets[i:j] {
+			s := &Secret{
+				AliasOf:   bs.AliasOf,
+				Version:   bs.Version,
+				UpdatedBy: bs.UpdatedBy,
+				UpdatedAt: bs.UpdatedAt,
+			}
+			if bs.AliasOf == "" {
+				ct, err := kms.EncryptMulti(ctx, t.CryptKeys(), bs.Value)
+				if err != nil {
+					return err
+				}
+				s.Value = ct
+			}
+			list = append(list, s)
+		}
+		err := platform.SecretStore.RunInTransaction(ctx, t, func(tx SecretTx) error {
+			for n, s := range list {
+				if err := tx.Put(tb.Secrets[i+n].Key, s); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed put secrets")
+		}
+	}
+
+	var keys []datastore.Key
+	var entities []interface{}
+	for _, bv := range tb.SecretVersions {
+		s := &Secret{
+			AliasOf:   bv.AliasOf,
+			Version:   bv.Version,
+			UpdatedBy: bv.UpdatedBy,
+			UpdatedAt: bv.UpdatedAt,
+		}
+		if bv.AliasOf == "" {
+			ct, err := kms.EncryptMulti(ctx, t.CryptKeys(), bv.Value)
+			if err != nil {
+				return err
+			}
+			s.Value = ct
+		}
+		keys = append(keys, secretVersionKey(ds, t, bv.Key, bv.Version))
+		entities = append(entities, s)
+	}
+	for _, acl := range tb.ACLs {
+		keys = append(keys, SecretACLKey(ds, t, acl.Prefix))
+		entities = append(entities, acl)
+	}
+	for _, a := range tb.AuditLogs {
+		keys = append(keys, t.NameKey(ds, AuditLogKind, a.ID, nil))
+		entities = append(entities, a)
+	}
+	for _, w := range tb.Webhooks {
+		sub := *w.WebhookSubscription
+		ct, err := kms.EncryptMulti(ctx, t.CryptKeys(), w.SigningSecret)
+		if err != nil {
+			return err
+		}
+		sub.SigningSecret = ct
+		keys = append(keys, t.NameKey(ds, WebhookSubscriptionKind, sub.ID, nil))
+		entities = append(entities, &sub)
+	}
+	for _, c := range tb.QuorumCustodians {
+		keys = append(keys, t.NameKey(ds, QuorumCustodianKind, c.Email, nil))
+		entities = append(entities, c)
+	}
+	for _, bq := range tb.QuorumSecrets {
+		qs := *bq.QuorumSecret
+		qs.Shares = make([]QuorumShare, len(bq.Shares))
+		copy(qs.Shares, bq.Shares)
+		for i, h := range bq.Hashes {
+			ct, err := kms.EncryptMulti(ctx, t.CryptKeys(), h)
+			if err != nil {
+				return err
+			}
+			qs.Shares[i].Hash = ct
+		}
+		keys = append(keys, t.NameKey(ds, QuorumSecretKind, qs.Key, nil))
+		entities = append(entities, &qs)
+	}
+	for i := 0; i < len(keys); i += datastoreBatchSize {
+		j := i + datastoreBatchSize
+		if j > len(keys) {
+			j = len(keys)
+		}
+		if _, err := ds.PutMulti(ctx, keys[i:j], entities[i:j]); err != nil {
+			return errors.Wrap(err, "failed put entities")
+		}
+	}
+	for _, h := range tb.AuditChainHeads {
+		if err := restoreAuditChainHead(ctx, ds, t, h); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreAuditChainHead is BackupのHash Chainの先頭を復元する
+// 既に同じKeyの先頭があり、Backupの時点と同じかそれより長い場合は、Backupの後に記録したAuditLogを辿れなくならないように既存の先頭を残す
+func restoreAuditChainHead(ctx context.Context, ds datastore.Client, t *Tenant, h *AuditChainHead) error {
+	_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		key := AuditChainHeadKey(ds, t, h.Key)
+		current := &AuditChainHead{}
+		err := tx.Get(key, current)
+		if err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if err == nil && current.Length >= h.Length {
+			if current.Length == h.Length && current.Hash != h.Hash {
+				log.Warningf(ctx, "audit chain head differs from the backup. keep current head. key=%s, length=%d", h.Key, h.Length)
+			}
+			return nil
+		}
+		_, err = tx.Put(key, h)
+		return err
+	})
+	return errors.Wrapf(err, "failed restore AuditChainHead. key=%s", h.Key)
+}
@@ -0,0 +1,118 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+func setupBackupAPI(swPlugin *swagger.Plugin) {
+	api := &BackupAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Backup", Description: "Backup admin API list"})
+
+	hInfo := swagger.NewHandlerInfo(api.Post)
+	ucon.Handle(http.MethodPost, "/api/admin/backup", hInfo)
+	hInfo.Description, hInfo.Tags = "create backup encrypted with the operator's public key", []string{tag.Name}
+}
+
+// BackupAPI is KMSを使わずに復元できるBackupを作成するAPI
+type BackupAPI struct{}
+
+// BackupAPIPostRequest is BackupAPI Post Request
+// PublicKeyはPEM形式(PUBLIC KEY)のRSA公開鍵. Tenantを指定しない場合はDefault Tenantと全てのTenantを含める
+type BackupAPIPostRequest struct {
+	PublicKey string `json:"publicKey" swagger:",req"`
+	Tenant    string `json:"tenant"`
+}
+
+// Post is 値をDecryptしたBackupを作成し、公開鍵で暗号化して返すhandler. App Engineの管理者だけが利用できる
+// 復元は gcpsm-server restore で行う
+func (api *BackupAPI) Post(ctx context.Context, w http.ResponseWriter, form *BackupAPIPostRequest) error {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	u := CurrentUser(ctx)
+	if u == nil || !u.Admin {
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	le.Tenant = form.Tenant
+
+	pub, err := ParseCustodianPublicKey(form.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	tenants, err := BackupTenants(ctx, ds, form.Tenant)
+	if err != nil {
+		return err
+	}
+
+	b, err := CreateBackup(ctx, ds, tenants, u.Email)
+	if err != nil {
+		return err
+	}
+	data, err := SealBackup(pub, b)
+	if err != nil {
+		return err
+	}
+	if err := RecordBackup(ctx, ds, b, AuditBackupCreated, u.Email); err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="gcpsm-%s.backup"`, b.CreatedAt.UTC().Format("20060102T150405Z")))
+	_, err = w.Write(data)
+	return err
+}
+
+// BackupTenants is Backupの対象のTenantを返す. idが空の場合はDefault Tenantと全てのTenant
+func BackupTenants(ctx context.Context, ds datastore.Client, id string) ([]*Tenant, error) {
+	switch id {
+	case "":
+		tenants, err := ListTenants(ctx, ds)
+		if err != nil {
+			return nil, err
+		}
+		return append([]*Tenant{DefaultTenant(ctx)}, tenants...), nil
+	case DefaultTenantID:
+		return []*Tenant{DefaultTenant(ctx)}, nil
+	}
+	t := &Tenant{}
+	if err := ds.Get(ctx, ds.NameKey(TenantKind, id, nil), t); err == datastore.ErrNoSuchEntity {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("tenant %s is not found.", id)}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed get tenant. id=%s", id)
+	}
+	t.ID = id
+	return []*Tenant{t}, nil
+}
+
+// RecordBackup is BackupのTenant毎にAuditLogを記録する. CommentにはBackupのChecksumを残す
+func RecordBackup(ctx context.Context, ds datastore.Client, b *Backup, action AuditAction, actor string) error {
+	now := time.Now()
+	for _, tb := range b.Tenants {
+		_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+			return putAuditLog(tx, ds, tb.Tenant, &AuditLog{
+				Action:     action,
+				Actor:      actor,
+				Comment:    fmt.Sprintf("checksum=%s, secrets=%d", b.Checksum, len(tb.Secrets)),
+				OccurredAt: now,
+			})
+		})
+		if err != nil {
+			return errors.Wrapf(err, "failed put audit log. tenant=%s", tb.Tenant.ID)
+		}
+	}
+	return nil
+}
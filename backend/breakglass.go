@@ -0,0 +1,120 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// BreakGlassGrantKind is BreakGlassGrant EntityのKind
+const BreakGlassGrantKind = "BreakGlassGrant"
+
+// Break-glass List
+const (
+	// defaultBreakGlassDuration is 時間を指定しない場合に読み込み権限を与える時間
+	defaultBreakGlassDuration = time.Hour
+	// maxBreakGlassDuration is 読み込み権限を与える時間の上限
+	maxBreakGlassDuration = 4 * time.Hour
+	// minJustificationLength is 理由として求める最低限の文字数
+	minJustificationLength = 20
+)
+
+// BreakGlassGrant is Datastore Entity
+// 通常は読めないSecretを、理由を記録した上でExpiresAtまで一時的に読めるようにする
+type BreakGlassGrant struct {
+	ID            string    `json:"id" datastore:"-"`
+	Key           string    `json:"key"`
+	Email         string    `json:"email"`
+	Justification string    `json:"justification" datastore:",noindex"`
+	GrantedAt     time.Time `json:"grantedAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	RevokedBy     string    `json:"revokedBy,omitempty"`
+	// RevokedAt is 取り消した時刻. 取り消していない場合はJSONに含めない
+	// go.mercari.io/datastoreはtime.Timeのポインタを保存できないので、Revokedを保存してsetIDで設定する
+	RevokedAt *time.Time `json:"revokedAt,omitempty" datastore:"-"`
+	Revoked   time.Time  `json:"-" datastore:"RevokedAt"`
+}
+
+// Active is 読み込み権限が有効かどうかを返す
+func (g *BreakGlassGrant) Active(now time.Time) bool {
+	return g.Revoked.IsZero() && now.Before(g.ExpiresAt)
+}
+
+// setID is Datastoreから読み込んだBreakGlassGrantに、保存しない項目を設定する
+func (g *BreakGlassGrant) setID(id string) {
+	g.ID = id
+	if !g.Revoked.IsZero() {
+		revoked := g.Revoked
+		g.RevokedAt = &revoked
+	}
+}
+
+// BreakGlassDuration is Clientが指定した時間(分)を、利用できる範囲に収める
+func BreakGlassDuration(minutes int) time.Duration {
+	if minutes <= 0 {
+		return defaultBreakGlassDuration
+	}
+	d := time.Duration(minutes) * time.Minute
+	if d > maxBreakGlassDuration {
+		return maxBreakGlassDuration
+	}
+	return d
+}
+
+// findBreakGlassGrant is emailがkeyに対して持っている有効なBreakGlassGrantを返す. ない場合はnilを返す
+func findBreakGlassGrant(ctx context.Context, ds datastore.Client, t *Tenant, email string, key string) (*BreakGlassGrant, error) {
+	q := t.NewQuery(ds, BreakGlassGrantKind).
+		Filter("Email =", email).
+		Filter("Key =", key)
+	var list []*BreakGlassGrant
+	keys, err := ds.GetAll(ctx, q, &list)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed list BreakGlassGrant. key=%s", key)
+	}
+	now := time.Now()
+	for i, k := range keys {
+		if list[i].Active(now) {
+			list[i].setID(k.Name())
+			return list[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// authorizeBreakGlass is 有効なBreakGlassGrantがあれば読み込みを許可し、利用したことをAuditLogに記録する
+// 記録できない場合は許可しない
+func authorizeBreakGlass(ctx context.Context, ds datastore.Client, t *Tenant, u *user.User, key string) (bool, error) {
+	g, err := findBreakGlassGrant(ctx, ds, t, u.Email, key)
+	if err != nil || g == nil {
+		return false, err
+	}
+	err = WriteAuditLog(ctx, ds, t, &AuditLog{
+		Action:     AuditBreakGlassUsed,
+		Key:        key,
+		Actor:      u.Email,
+		Target:     g.ID,
+		BreakGlass: true,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// getBreakGlassGrant is BreakGlassGrantを取得する
+func getBreakGlassGrant(ctx context.Context, ds datastore.Client, t *Tenant, id string) (datastore.Key, *BreakGlassGrant, error) {
+	k := t.NameKey(ds, BreakGlassGrantKind, id, nil)
+	g := &BreakGlassGrant{}
+	if err := ds.Get(ctx, k, g); err == datastore.ErrNoSuchEntity {
+		return nil, nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("break-glass grant %s is not found.", id)}
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed get BreakGlassGrant. id=%s", id)
+	}
+	g.setID(id)
+	return k, g, nil
+}
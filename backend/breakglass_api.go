@@ -0,0 +1,210 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// maxBreakGlassGrants is BreakGlassGrantを1度に返す最大件数
+const maxBreakGlassGrants = 100
+
+func setupBreakGlassAPI(swPlugin *swagger.Plugin) {
+	api := &BreakGlassAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "BreakGlass", Description: "Break-glass API list"})
+
+	handleTenantAPI(http.MethodPost, "/breakglass", api.Post, "request temporary read access with justification", tag)
+	handleTenantAPI(http.MethodGet, "/breakglass", api.List, "list break-glass grants", tag)
+	handleTenantAPI(http.MethodDelete, "/breakglass/{id}", api.Delete, "revoke break-glass grant", tag)
+}
+
+// BreakGlassAPI is API to grant temporary read access
+type BreakGlassAPI struct{}
+
+// BreakGlassAPIPostRequest is BreakGlassAPI Post Request
+type BreakGlassAPIPostRequest struct {
+	Key           string `json:"key" swagger:",req,secretKey"`
+	Justification string `json:"justification" swagger:",req"`
+	Minutes       int    `json:"minutes"`
+}
+
+// Post is Break-glass handler. 理由を記録し、通常は読めないSecretの読み込み権限を一時的に与える
+// 依頼できるのはSecretACLのBreakGlassに含まれるuserだけ
+// 与えた時点でWebhookとLogで通知する
+func (api *BreakGlassAPI) Post(ctx context.Context, form *BreakGlassAPIPostRequest) (*BreakGlassGrant, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
+
+	justification := strings.TrimSpace(form.Justification)
+	if len(justification) < minJustificationLength {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("justification must be at least %d characters.", minJustificationLength)}
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Break-glassできるのは、keyに適用されるSecretACLのBreakGlassにTenantの管理者が指定したuserだけ
+	acl, err := FindSecretACL(ctx, ds, t, form.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !acl.CanBreakGlass(u.Email) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("You are not allowed to break glass for %s.", form.Key)}
+	}
+
+	ok, err := authorizeByACL(ctx, ds, t, u, form.Key, PermissionRead)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("You already have read permission to %s.", form.Key)}
+	}
+
+	now := time.Now()
+	g := &BreakGlassGrant{
+		ID:            newRandomID(),
+		Key:           form.Key,
+		Email:         u.Email,
+		Justification: justification,
+		GrantedAt:     now,
+		ExpiresAt:     now.Add(BreakGlassDuration(form.Minutes)),
+	}
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		if _, err := tx.Put(t.NameKey(ds, BreakGlassGrantKind, g.ID, nil), g); err != nil {
+			return err
+		}
+		return putAuditLog(tx, ds, t, &AuditLog{Action: AuditBreakGlassGranted, Key: g.Key, Actor: u.Email, Target: g.ID, Comment: justification, BreakGlass: true, OccurredAt: now})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed put BreakGlassGrant. key=%s", form.Key)
+	}
+
+	log.Criticalf(ctx, "break-glass access granted. tenant=%s, key=%s, user=%s, expiresAt=%s, justification=%q", t.ID, g.Key, g.Email, g.ExpiresAt.Format(time.RFC3339), g.Justification)
+	PublishSecretEvent(ctx, ds, t, &SecretEvent{Type: SecretEventBreakGlass, Key: g.Key, Actor: g.Email, Justification: g.Justification, ExpiresAt: g.ExpiresAt})
+
+	return g, nil
+}
+
+// BreakGlassAPIListRequest is BreakGlassAPI List Request
+type BreakGlassAPIListRequest struct {
+	Active bool `json:"active" swagger:",in=query"`
+}
+
+// BreakGlassAPIListResponse is BreakGlassAPI List Response
+type BreakGlassAPIListResponse struct {
+	List []*BreakGlassGrant `json:"list"`
+}
+
+// List is BreakGlassGrantを新しい順に返すhandler. Tenantの管理者以外は自分のものだけを返す
+func (api *BreakGlassAPI) List(ctx context.Context, form *BreakGlassAPIListRequest) (*BreakGlassAPIListResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := t.NewQuery(ds, BreakGlassGrantKind)
+	if !t.IsAdmin(u) {
+		q = q.Filter("Email =", u.Email)
+	}
+	q = q.Order("-GrantedAt").Limit(maxBreakGlassGrants)
+	var list []*BreakGlassGrant
+	keys, err := ds.GetAll(ctx, q, &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list BreakGlassGrant")
+	}
+
+	now := time.Now()
+	resp := &BreakGlassAPIListResponse{
+		List: []*BreakGlassGrant{},
+	}
+	for i, k := range keys {
+		list[i].setID(k.Name())
+		if form.Active && !list[i].Active(now) {
+			continue
+		}
+		resp.List = append(resp.List, list[i])
+	}
+	return resp, nil
+}
+
+// BreakGlassAPIDeleteRequest is BreakGlassAPI Delete Request
+type BreakGlassAPIDeleteRequest struct {
+	ID string `json:"id" swagger:",in=path"`
+}
+
+// Delete is BreakGlassGrantを期限前に取り消すhandler. Tenantの管理者と本人が実行できる
+func (api *BreakGlassAPI) Delete(ctx context.Context, form *BreakGlassAPIDeleteRequest) (*BreakGlassGrant, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	k, g, err := getBreakGlassGrant(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	if g.Email != u.Email && !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	now := time.Now()
+	if !g.Active(now) {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("break-glass grant %s is not active.", g.ID)}
+	}
+
+	g.RevokedBy = u.Email
+	g.Revoked = now
+	g.RevokedAt = &now
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		if _, err := tx.Put(k, g); err != nil {
+			return err
+		}
+		return putAuditLog(tx, ds, t, &AuditLog{Action: AuditBreakGlassRevoked, Key: g.Key, Actor: u.Email, Target: g.ID, BreakGlass: true, OccurredAt: now})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed revoke BreakGlassGrant. id=%s", g.ID)
+	}
+
+	return g, nil
+}
@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBreakGlass(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	defer useFakeDatastore(ds)()
+	tenant := &Tenant{ID: "breakglass", Namespace: "breakglass", CryptKey: testCryptKey, Admins: []string{"admin@example.com"}}
+	acl := &SecretACL{Readers: []string{"app@example.com"}, BreakGlass: []string{"oncall@example.com", "app@example.com"}}
+	if _, err := ds.Put(ctx, SecretACLKey(ds, tenant, "prod"), acl); err != nil {
+		t.Fatal(err)
+	}
+	const key = "prod/db"
+	postTestSecret(t, tenant, "admin@example.com", key, "password")
+
+	api := &BreakGlassAPI{}
+	secrets := &SecretAPI{}
+	oncall := testUserContext(t, tenant, "oncall@example.com")
+	const justification = "INC-1234 primary db is down, need to connect manually"
+	get := func() error {
+		r := httptest.NewRequest(http.MethodGet, "/api/1/secret/"+key, nil)
+		_, err := secrets.Get(oncall, httptest.NewRecorder(), &SecretAPIGetRequest{Key: key}, r)
+		return err
+	}
+	usedCount := func() int {
+		logs, err := ListAuditLogs(ctx, ds, tenant, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var n int
+		for _, a := range logs {
+			if a.Action == AuditBreakGlassUsed {
+				n++
+			}
+		}
+		return n
+	}
+
+	if _, err := api.Post(testUserContext(t, tenant, "dev@example.com"), &BreakGlassAPIPostRequest{Key: key, Justification: justification}); httpStatus(err) != http.StatusForbidden {
+		t.Errorf("break glass by user not in the ACL: got %v, want 403", err)
+	}
+	if _, err := api.Post(testUserContext(t, tenant, "app@example.com"), &BreakGlassAPIPostRequest{Key: key, Justification: justification}); httpStatus(err) != http.StatusConflict {
+		t.Errorf("break glass by reader: got %v, want 409", err)
+	}
+	if _, err := api.Post(oncall, &BreakGlassAPIPostRequest{Key: key, Justification: "need it"}); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("short justification: got %v, want 400", err)
+	}
+	if err := get(); httpStatus(err) != http.StatusForbidden {
+		t.Errorf("get before grant: got %v, want 403", err)
+	}
+
+	g, err := api.Post(oncall, &BreakGlassAPIPostRequest{Key: key, Justification: justification})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); err != nil {
+		t.Errorf("get with grant: %v", err)
+	}
+	if g, e := usedCount(), 1; g != e {
+		t.Errorf("%s after get: got %d, want %d", AuditBreakGlassUsed, g, e)
+	}
+	// 値を返さない読み込みにはGrantを使わず、AuditLogにも記録しない
+	if _, err := secrets.Metadata(oncall, httptest.NewRecorder(), &SecretAPIMetadataRequest{Key: key}); httpStatus(err) != http.StatusForbidden {
+		t.Errorf("metadata with grant: got %v, want 403", err)
+	}
+	if g, e := usedCount(), 1; g != e {
+		t.Errorf("%s after metadata: got %d, want %d", AuditBreakGlassUsed, g, e)
+	}
+
+	if _, err := api.Delete(oncall, &BreakGlassAPIDeleteRequest{ID: g.ID}); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); httpStatus(err) != http.StatusForbidden {
+		t.Errorf("get after revoke: got %v, want 403", err)
+	}
+
+	g, err = api.Post(oncall, &BreakGlassAPIPostRequest{Key: key, Justification: justification})
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, grant, err := getBreakGlassGrant(ctx, ds, tenant, g.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant.ExpiresAt = time.Now().Add(-time.Minute)
+	if _, err := ds.Put(ctx, k, grant); err != nil {
+		t.Fatal(err)
+	}
+	if err := get(); httpStatus(err) != http.StatusForbidden {
+		t.Errorf("get after expiry: got %v, want 403", err)
+	}
+	if g, e := usedCount(), 1; g != e {
+		t.Errorf("%s after denied reads: got %d, want %d", AuditBreakGlassUsed, g, e)
+	}
+}
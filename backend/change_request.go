@@ -0,0 +1,165 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// SecretChangeRequestKind is SecretChangeRequest EntityのKind
+const SecretChangeRequestKind = "SecretChangeRequest"
+
+// changeRequestTTL is SecretChangeRequestが承認を待つ時間. 過ぎるとExpiredになる
+const changeRequestTTL = 72 * time.Hour
+
+// maxChangeRequests is SecretChangeRequestを1度に返す最大件数
+const maxChangeRequests = 100
+
+// ChangeRequestStatus is SecretChangeRequestの状態
+type ChangeRequestStatus string
+
+// ChangeRequestStatus List
+const (
+	ChangeRequestPending   ChangeRequestStatus = "pending"
+	ChangeRequestCommitted ChangeRequestStatus = "committed"
+	ChangeRequestRejected  ChangeRequestStatus = "rejected"
+	ChangeRequestExpired   ChangeRequestStatus = "expired"
+	// ChangeRequestConflict is 承認されたが、Request後にSecretが更新されていたため反映しなかった
+	ChangeRequestConflict ChangeRequestStatus = "conflict"
+)
+
+// SecretChangeApproval is SecretChangeRequestに対する1人の承認
+type SecretChangeApproval struct {
+	Email      string    `json:"email"`
+	ApprovedAt time.Time `json:"approvedAt"`
+}
+
+// SecretChangeRequest is Datastore Entity
+// 保護されたPrefixのSecretへの変更で、必要な数の承認が集まった時にSecretに反映する
+// ValueはKMSで暗号化していて、承認者にも返さない
+type SecretChangeRequest struct {
+	ID                string                 `json:"id" datastore:"-"`
+	Key               string                 `json:"key"`
+	Value             string                 `json:"-" datastore:",noindex"`
+	AliasOf           string                 `json:"aliasOf,omitempty" datastore:",noindex"`
+	BaseVersion       int64                  `json:"baseVersion"`
+	Status            ChangeRequestStatus    `json:"status"`
+	RequiredApprovals int                    `json:"requiredApprovals"`
+	Approvals         []SecretChangeApproval `json:"approvals"`
+	RequestedBy       string                 `json:"requestedBy"`
+	RequestedAt       time.Time              `json:"requestedAt"`
+	ExpiresAt         time.Time              `json:"expiresAt"`
+	ResolvedBy        string                 `json:"resolvedBy,omitempty"`
+	ResolvedAt        time.Time              `json:"resolvedAt,omitempty"`
+	Comment           string                 `json:"comment,omitempty" datastore:",noindex"`
+}
+
+// Expired is 承認待ちのまま期限を過ぎているかを返す
+func (cr *SecretChangeRequest) Expired(now time.Time) bool {
+	return cr.Status == ChangeRequestPending && now.After(cr.ExpiresAt)
+}
+
+// ApprovedBy is emailが既に承認しているかを返す
+func (cr *SecretChangeRequest) ApprovedBy(email string) bool {
+	for _, a := range cr.Approvals {
+		if a.Email == email {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve is SecretChangeRequestを承認待ちから終了した状態にする
+func (cr *SecretChangeRequest) resolve(status ChangeRequestStatus, by string, now time.Time) {
+	cr.Status = status
+	cr.ResolvedBy = by
+	cr.ResolvedAt = now
+}
+
+// getSecretChangeRequest is SecretChangeRequestを取得する
+func getSecretChangeRequest(ctx context.Context, ds datastore.Client, t *Tenant, id string) (datastore.Key, *SecretChangeRequest, error) {
+	k := t.NameKey(ds, SecretChangeRequestKind, id, nil)
+	cr := &SecretChangeRequest{}
+	if err := ds.Get(ctx, k, cr); err == datastore.ErrNoSuchEntity {
+		return nil, nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("change request %s is not found.", id)}
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed get SecretChangeRequest. id=%s", id)
+	}
+	cr.ID = id
+	return k, cr, nil
+}
+
+// expireInTransaction is 期限を過ぎていればTransaction内でExpiredにしてAuditLogに記録する. Expiredにした場合はtrueを返す
+func expireInTransaction(tx datastore.Transaction, ds datastore.Client, t *Tenant, k datastore.Key, cr *SecretChangeRequest, now time.Time) (bool, error) {
+	if !cr.Expired(now) {
+		return false, nil
+	}
+	cr.resolve(ChangeRequestExpired, "", now)
+	if _, err := tx.Put(k, cr); err != nil {
+		return false, err
+	}
+	return true, putAuditLog(tx, ds, t, &AuditLog{Action: AuditChangeExpired, Key: cr.Key, Target: cr.ID, OccurredAt: now})
+}
+
+// ExpireSecretChangeRequests is 期限を過ぎたSecretChangeRequestを全てExpiredにする. Expiredにした件数を返す
+func ExpireSecretChangeRequests(ctx context.Context, ds datastore.Client, t *Tenant) (int, error) {
+	now := time.Now()
+	q := t.NewQuery(ds, SecretChangeRequestKind).
+		Filter("Status =", string(ChangeRequestPending)).
+		Filter("ExpiresAt <", now).
+		KeysOnly()
+	keys, err := ds.GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed list expired SecretChangeRequest")
+	}
+
+	var n int
+	for _, k := range keys {
+		var expired bool
+		_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+			cr := &SecretChangeRequest{}
+			if err := tx.Get(k, cr); err != nil {
+				return err
+			}
+			cr.ID = k.Name()
+			var err error
+			expired, err = expireInTransaction(tx, ds, t, k, cr, now)
+			return err
+		})
+		if err != nil {
+			return n, errors.Wrapf(err, "failed expire SecretChangeRequest. id=%s", k.Name())
+		}
+		if expired {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// ProtectedSecretACL is keyが保護されたPrefix配下にある場合に、適用されるSecretACLを返す. 保護されていない場合はnilを返す
+func ProtectedSecretACL(ctx context.Context, ds datastore.Client, t *Tenant, key string) (*SecretACL, error) {
+	acl, err := FindSecretACL(ctx, ds, t, key)
+	if err != nil {
+		return nil, err
+	}
+	if !acl.Protected() {
+		return nil, nil
+	}
+	return acl, nil
+}
+
+// requireUnprotected is 承認なしで変更できないkeyの場合にErrorを返す. DeleteやMoveのような承認の仕組みがない操作で利用する
+func requireUnprotected(ctx context.Context, ds datastore.Client, t *Tenant, key string) error {
+	acl, err := ProtectedSecretACL(ctx, ds, t, key)
+	if err != nil {
+		return err
+	}
+	if acl != nil {
+		return &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("%s is protected by %q and requires approval.", key, acl.Prefix)}
+	}
+	return nil
+}
@@ -0,0 +1,398 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/user"
+)
+
+func setupChangeRequestAPI(swPlugin *swagger.Plugin) {
+	api := &ChangeRequestAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "ChangeRequest", Description: "Change Request API list"})
+
+	handleTenantAPI(http.MethodGet, "/change", api.List, "list change requests to protected secrets", tag)
+	handleTenantAPI(http.MethodGet, "/change/{id}", api.Get, "get change request", tag)
+	handleTenantAPI(http.MethodPost, "/change/{id}/approve", api.Approve, "approve change request", tag)
+	handleTenantAPI(http.MethodPost, "/change/{id}/reject", api.Reject, "reject change request", tag)
+
+	// Cronから呼ばれるHandler. app.yamlでlogin: adminにしている
+	ucon.HandleFunc(http.MethodGet, "/api/internal/change/expire", api.Expire)
+}
+
+// ChangeRequestAPI is API to approve SecretChangeRequest
+type ChangeRequestAPI struct{}
+
+// ChangeRequestAPIListRequest is ChangeRequestAPI List Request
+type ChangeRequestAPIListRequest struct {
+	Prefix string              `json:"prefix" swagger:",in=query,keyPrefix"`
+	Status ChangeRequestStatus `json:"status" swagger:",in=query"`
+}
+
+// ChangeRequestAPIListResponse is ChangeRequestAPI List Response
+type ChangeRequestAPIListResponse struct {
+	List []*SecretChangeRequest `json:"list"`
+}
+
+// List is SecretChangeRequestを新しい順に返すhandler. statusを省略した場合は承認待ちのものを返す
+// 依頼者、承認者、Secretを読めるuserにだけ返す
+func (api *ChangeRequestAPI) List(ctx context.Context, form *ChangeRequestAPIListRequest) (*ChangeRequestAPIListResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	prefix := NormalizeKeyPrefix(form.Prefix)
+	status := form.Status
+	if status == "" {
+		status = ChangeRequestPending
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := t.NewQuery(ds, SecretChangeRequestKind).
+		Filter("Status =", string(status)).
+		Order("-RequestedAt").
+		Limit(maxChangeRequests)
+	var list []*SecretChangeRequest
+	keys, err := ds.GetAll(ctx, q, &list)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed list SecretChangeRequest. status=%s", status)
+	}
+
+	now := time.Now()
+	resp := &ChangeRequestAPIListResponse{
+		List: []*SecretChangeRequest{},
+	}
+	for i, k := range keys {
+		cr := list[i]
+		cr.ID = k.Name()
+		if !HasKeyPrefix(cr.Key, prefix) {
+			continue
+		}
+		// 期限切れはCronでExpiredにするが、それまでの間も承認待ちとしては返さない
+		if cr.Expired(now) {
+			continue
+		}
+		ok, err := canViewChangeRequest(ctx, ds, t, u, cr)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			resp.List = append(resp.List, cr)
+		}
+	}
+	return resp, nil
+}
+
+// ChangeRequestAPIGetRequest is ChangeRequestAPI Get Request
+type ChangeRequestAPIGetRequest struct {
+	ID string `json:"id" swagger:",in=path"`
+}
+
+// Get is SecretChangeRequestを返すhandler. 値は返さない
+func (api *ChangeRequestAPI) Get(ctx context.Context, form *ChangeRequestAPIGetRequest) (*SecretChangeRequest, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, cr, err := getSecretChangeRequest(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	ok, err := canViewChangeRequest(ctx, ds, t, u, cr)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	if cr.Expired(time.Now()) {
+		cr.Status = ChangeRequestExpired
+	}
+	return cr, nil
+}
+
+// ChangeRequestAPIResolveRequest is ChangeRequestAPI Approve, Reject Request
+type ChangeRequestAPIResolveRequest struct {
+	ID      string `json:"id" swagger:",in=path"`
+	Comment string `json:"comment"`
+}
+
+// Approve is SecretChangeRequestを承認するhandler
+// 必要な数の承認が集まった場合は、同じTransactionでSecretに反映する. 依頼後にSecretが更新されていた場合はConflictとして反映しない
+func (api *ChangeRequestAPI) Approve(ctx context.Context, form *ChangeRequestAPIResolveRequest) (*SecretChangeRequest, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	k, cr, err := getSecretChangeRequest(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, cr.Key)
+	acl, err := FindSecretACL(ctx, ds, t, cr.Key)
+	if err != nil {
+		return nil, err
+	}
+	if !acl.CanApprove(u.Email) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("You are not an approver of %s.", cr.Key)}
+	}
+	if cr.RequestedBy == u.Email {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You cannot approve your own change request."}
+	}
+	// 依頼後にSecretACLで必要な承認の数が増えた場合は、増えた数に従う
+	required := cr.RequiredApprovals
+	if acl.RequiredApprovals > required {
+		required = acl.RequiredApprovals
+	}
+
+	s := &Secret{}
+	var expired bool
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		// Approvalsが重複して読み込まれないよう、Transactionの度に空のEntityに読み直す
+		*cr = SecretChangeRequest{ID: cr.ID}
+		if err := tx.Get(k, cr); err != nil {
+			return err
+		}
+		now := time.Now()
+		var err error
+		if expired, err = expireInTransaction(tx, ds, t, k, cr, now); expired || err != nil {
+			return err
+		}
+		if cr.Status != ChangeRequestPending {
+			return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("change request %s is %s.", cr.ID, cr.Status)}
+		}
+		if cr.ApprovedBy(u.Email) {
+			return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("You have already approved change request %s.", cr.ID)}
+		}
+
+		cr.Approvals = append(cr.Approvals, SecretChangeApproval{Email: u.Email, ApprovedAt: now})
+		logs := []*AuditLog{{Action: AuditChangeApproved, Key: cr.Key, Actor: u.Email, Target: cr.ID, Comment: form.Comment, OccurredAt: now}}
+		if len(cr.Approvals) >= required {
+			a, err := commitInTransaction(ctx, tx, ds, t, cr, s, u.Email, now)
+			if err != nil {
+				return err
+			}
+			logs = append(logs, a)
+		}
+		if err := putAuditLog(tx, ds, t, logs...); err != nil {
+			return err
+		}
+		_, err = tx.Put(k, cr)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed approve change request. id=%s", form.ID)
+	}
+	if expired {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("change request %s has expired.", cr.ID)}
+	}
+	if cr.Status == ChangeRequestCommitted {
+		recordSecretVersion(ctx, ds, t, cr.Key, s)
+		PublishSecretEvent(ctx, ds, t, &SecretEvent{Type: SecretEventUpdated, Key: cr.Key, Version: s.Version, Actor: cr.RequestedBy})
+	}
+
+	return cr, nil
+}
+
+// commitInTransaction is 承認されたSecretChangeRequestをTransaction内でSecretに反映し、記録するAuditLogを返す
+// 依頼後にSecretが更新されていた場合は反映せずにConflictにする
+func commitInTransaction(ctx context.Context, tx datastore.Transaction, ds datastore.Client, t *Tenant, cr *SecretChangeRequest, s *Secret, approver string, now time.Time) (*AuditLog, error) {
+	var version int64
+	var conflict bool
+	err := platform.SecretStore.RunInTransaction(withDatastoreTransaction(ctx, tx), t, func(stx SecretTx) error {
+		cur, err := stx.Get(cr.Key)
+		if err == ErrSecretNotFound {
+			cur = nil
+		} else if err != nil {
+			return err
+		}
+		version = 0
+		if cur != nil {
+			version = cur.Version
+		}
+		// Datastore以外のSecretStoreでは、DatastoreのTransactionがRetryされると反映済みのSecretを読むことがある
+		if cur != nil && version == cr.BaseVersion+1 && cur.Value == cr.Value && cur.AliasOf == cr.AliasOf && cur.UpdatedBy == cr.RequestedBy {
+			*s, conflict = *cur, false
+			return nil
+		}
+		if conflict = version != cr.BaseVersion; conflict {
+			return nil
+		}
+
+		*s = Secret{
+			Value:     cr.Value,
+			AliasOf:   cr.AliasOf,
+			Version:   version + 1,
+			UpdatedBy: cr.RequestedBy,
+			UpdatedAt: now,
+		}
+		return stx.Put(cr.Key, s)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if conflict {
+		cr.resolve(ChangeRequestConflict, approver, now)
+		return &AuditLog{Action: AuditChangeConflict, Key: cr.Key, Actor: approver, Target: cr.ID, Comment: fmt.Sprintf("secret has been updated from version %d to %d.", cr.BaseVersion, version), OccurredAt: now}, nil
+	}
+
+	cr.resolve(ChangeRequestCommitted, approver, now)
+	return &AuditLog{Action: AuditChangeCommitted, Key: cr.Key, Actor: approver, Target: cr.ID, Comment: fmt.Sprintf("version %d", s.Version), OccurredAt: now}, nil
+}
+
+// Reject is SecretChangeRequestを却下するhandler. 承認者の他に、依頼者も取り下げとして実行できる
+func (api *ChangeRequestAPI) Reject(ctx context.Context, form *ChangeRequestAPIResolveRequest) (*SecretChangeRequest, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	k, cr, err := getSecretChangeRequest(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, cr.Key)
+	if cr.RequestedBy != u.Email {
+		acl, err := FindSecretACL(ctx, ds, t, cr.Key)
+		if err != nil {
+			return nil, err
+		}
+		if !acl.CanApprove(u.Email) {
+			return nil, &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("You are not an approver of %s.", cr.Key)}
+		}
+	}
+
+	var expired bool
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		// Approvalsが重複して読み込まれないよう、Transactionの度に空のEntityに読み直す
+		*cr = SecretChangeRequest{ID: cr.ID}
+		if err := tx.Get(k, cr); err != nil {
+			return err
+		}
+		now := time.Now()
+		var err error
+		if expired, err = expireInTransaction(tx, ds, t, k, cr, now); expired || err != nil {
+			return err
+		}
+		if cr.Status != ChangeRequestPending {
+			return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("change request %s is %s.", cr.ID, cr.Status)}
+		}
+
+		cr.resolve(ChangeRequestRejected, u.Email, now)
+		cr.Comment = form.Comment
+		if _, err := tx.Put(k, cr); err != nil {
+			return err
+		}
+		return putAuditLog(tx, ds, t, &AuditLog{Action: AuditChangeRejected, Key: cr.Key, Actor: u.Email, Target: cr.ID, Comment: form.Comment, OccurredAt: now})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed reject change request. id=%s", form.ID)
+	}
+	if expired {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("change request %s has expired.", cr.ID)}
+	}
+
+	return cr, nil
+}
+
+// Expire is Cronから全てのTenantの期限切れのSecretChangeRequestをExpiredにするhandler
+func (api *ChangeRequestAPI) Expire(ctx context.Context, r *http.Request) error {
+	if r.Header.Get("X-Appengine-Cron") == "" {
+		// X-Appengine-CronはApp Engineの外から付けることができない
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	tenants, err := ListTenants(ctx, ds)
+	if err != nil {
+		return err
+	}
+	for _, t := range append([]*Tenant{DefaultTenant(ctx)}, tenants...) {
+		n, err := ExpireSecretChangeRequests(ctx, ds, t)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Infof(ctx, "expired %d change requests. tenant=%s", n, t.ID)
+		}
+	}
+	return nil
+}
+
+// canViewChangeRequest is userがSecretChangeRequestを見ることができるかを返す
+func canViewChangeRequest(ctx context.Context, ds datastore.Client, t *Tenant, u *user.User, cr *SecretChangeRequest) (bool, error) {
+	if cr.RequestedBy == u.Email || t.IsAdmin(u) {
+		return true, nil
+	}
+	acl, err := FindSecretACL(ctx, ds, t, cr.Key)
+	if err != nil {
+		return false, err
+	}
+	if acl.CanApprove(u.Email) {
+		return true, nil
+	}
+	if acl == nil {
+		return t.CanAccess(u), nil
+	}
+	return acl.Allowed(u.Email, PermissionRead), nil
+}
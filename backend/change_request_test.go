@@ -0,0 +1,187 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// postTestSecret is emailのuserとしてSecretAPI.Postを呼ぶ
+func postTestSecret(t *testing.T, tenant *Tenant, email string, key string, value string) *SecretAPIPostResponse {
+	t.Helper()
+	api := &SecretAPI{}
+	r := httptest.NewRequest(http.MethodPost, "/api/1/secret", nil)
+	resp, err := api.Post(testUserContext(t, tenant, email), httptest.NewRecorder(), r, &SecretAPIPostRequest{Key: key, Value: value})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// getTestSecretValue is keyのSecretのVersionと復号した値を返す
+func getTestSecretValue(t *testing.T, tenant *Tenant, key string) (int64, string) {
+	t.Helper()
+	ctx := context.Background()
+	s, err := platform.SecretStore.Get(ctx, tenant, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := NewCrypter().DecryptMulti(ctx, tenant.CryptKeys(), s.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.Version, v
+}
+
+func TestChangeRequestApproval(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	defer useFakeDatastore(ds)()
+	tenant := &Tenant{ID: "change", Namespace: "change", CryptKey: testCryptKey}
+	acl := &SecretACL{
+		Writers:           []string{"dev@example.com"},
+		Approvers:         []string{"dev@example.com", "ops1@example.com", "ops2@example.com", "ops3@example.com"},
+		RequiredApprovals: 2,
+	}
+	if _, err := ds.Put(ctx, SecretACLKey(ds, tenant, "prod"), acl); err != nil {
+		t.Fatal(err)
+	}
+
+	api := &ChangeRequestAPI{}
+	approve := func(email string, id string) (*SecretChangeRequest, error) {
+		return api.Approve(testUserContext(t, tenant, email), &ChangeRequestAPIResolveRequest{ID: id})
+	}
+
+	const key = "prod/db"
+	resp := postTestSecret(t, tenant, "dev@example.com", key, "v1")
+	if resp.ChangeRequest == "" {
+		t.Fatal("protected secret is updated without a change request")
+	}
+	if _, err := platform.SecretStore.Get(ctx, tenant, key); err != ErrSecretNotFound {
+		t.Fatalf("secret before approval: got %v, want ErrSecretNotFound", err)
+	}
+
+	if _, err := approve("dev@example.com", resp.ChangeRequest); httpStatus(err) != http.StatusForbidden {
+		t.Errorf("self approval: got %v, want 403", err)
+	}
+	cr, err := approve("ops1@example.com", resp.ChangeRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Status != ChangeRequestPending {
+		t.Errorf("status after 1 of 2 approvals: got %s, want %s", cr.Status, ChangeRequestPending)
+	}
+	if _, err := approve("ops1@example.com", resp.ChangeRequest); httpStatus(err) != http.StatusConflict {
+		t.Errorf("duplicate approval: got %v, want 409", err)
+	}
+	cr, err = approve("ops2@example.com", resp.ChangeRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Status != ChangeRequestCommitted {
+		t.Errorf("status after 2 of 2 approvals: got %s, want %s", cr.Status, ChangeRequestCommitted)
+	}
+	if version, value := getTestSecretValue(t, tenant, key); version != 1 || value != "v1" {
+		t.Errorf("committed secret: got version=%d, value=%q", version, value)
+	}
+	if _, err := approve("ops3@example.com", resp.ChangeRequest); httpStatus(err) != http.StatusConflict {
+		t.Errorf("approve committed request: got %v, want 409", err)
+	}
+
+	// 同じVersionから作った依頼は、先に反映された方だけが反映され、後の方はConflictになる
+	first := postTestSecret(t, tenant, "dev@example.com", key, "v2")
+	second := postTestSecret(t, tenant, "dev@example.com", key, "v3")
+	for _, id := range []string{first.ChangeRequest, second.ChangeRequest} {
+		for _, email := range []string{"ops1@example.com", "ops2@example.com"} {
+			if cr, err = approve(email, id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if cr.Status != ChangeRequestConflict {
+		t.Errorf("status of stale request: got %s, want %s", cr.Status, ChangeRequestConflict)
+	}
+	if version, value := getTestSecretValue(t, tenant, key); version != 2 || value != "v2" {
+		t.Errorf("secret after conflict: got version=%d, value=%q, want version=2, value=v2", version, value)
+	}
+
+	// 依頼者は取り下げられる
+	withdrawn := postTestSecret(t, tenant, "dev@example.com", key, "v4")
+	if _, err := api.Reject(testUserContext(t, tenant, "other@example.com"), &ChangeRequestAPIResolveRequest{ID: withdrawn.ChangeRequest}); httpStatus(err) != http.StatusForbidden {
+		t.Errorf("reject by non approver: got %v, want 403", err)
+	}
+	cr, err = api.Reject(testUserContext(t, tenant, "dev@example.com"), &ChangeRequestAPIResolveRequest{ID: withdrawn.ChangeRequest, Comment: "typo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cr.Status != ChangeRequestRejected || cr.ResolvedBy != "dev@example.com" {
+		t.Errorf("rejected request: got status=%s, resolvedBy=%s", cr.Status, cr.ResolvedBy)
+	}
+	if _, err := approve("ops1@example.com", withdrawn.ChangeRequest); httpStatus(err) != http.StatusConflict {
+		t.Errorf("approve rejected request: got %v, want 409", err)
+	}
+}
+
+func TestExpireSecretChangeRequests(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	defer useFakeDatastore(ds)()
+	tenant := &Tenant{ID: "change-expire", Namespace: "change-expire", CryptKey: testCryptKey}
+	acl := &SecretACL{Writers: []string{"dev@example.com"}, Approvers: []string{"ops@example.com"}, RequiredApprovals: 1}
+	if _, err := ds.Put(ctx, SecretACLKey(ds, tenant, "prod"), acl); err != nil {
+		t.Fatal(err)
+	}
+
+	const key = "prod/db"
+	expiring := postTestSecret(t, tenant, "dev@example.com", key, "v1")
+	pending := postTestSecret(t, tenant, "dev@example.com", key, "v2")
+	k, cr, err := getSecretChangeRequest(ctx, ds, tenant, expiring.ChangeRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cr.ExpiresAt = time.Now().Add(-time.Minute)
+	if _, err := ds.Put(ctx, k, cr); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ExpireSecretChangeRequests(ctx, ds, tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("expired: got %d, want 1", n)
+	}
+	if _, cr, err = getSecretChangeRequest(ctx, ds, tenant, expiring.ChangeRequest); err != nil {
+		t.Fatal(err)
+	}
+	if cr.Status != ChangeRequestExpired {
+		t.Errorf("status: got %s, want %s", cr.Status, ChangeRequestExpired)
+	}
+	if _, cr, err = getSecretChangeRequest(ctx, ds, tenant, pending.ChangeRequest); err != nil {
+		t.Fatal(err)
+	}
+	if cr.Status != ChangeRequestPending {
+		t.Errorf("status of unexpired request: got %s, want %s", cr.Status, ChangeRequestPending)
+	}
+
+	logs, err := ListAuditLogs(ctx, ds, tenant, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, a := range logs {
+		if a.Action == AuditChangeExpired && a.Target == expiring.ChangeRequest {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("%s is not in the audit log", AuditChangeExpired)
+	}
+
+	api := &ChangeRequestAPI{}
+	if _, err := api.Approve(testUserContext(t, tenant, "ops@example.com"), &ChangeRequestAPIResolveRequest{ID: expiring.ChangeRequest}); httpStatus(err) != http.StatusConflict {
+		t.Errorf("approve expired request: got %v, want 409", err)
+	}
+}
@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+)
+
+// customMethods is Handler毎のCustom Method. /secret/{key}:watch のように、最後のPath Parameterに :verb を付けて呼び出す
+// uconのPathTemplateは {key}:watch のようなSegmentを扱えないので、UseCustomMethodで元のHandlerから差し替える
+var customMethods = map[uintptr]map[string]ucon.HandlerContainer{}
+
+// handleTenantCustomMethod is baseのPathに :verb を付けたCustom Methodを登録する
+// baseはhandleTenantAPIで登録済みのHandlerで、Swaggerには {key}:verb のPathで記載する
+func handleTenantCustomMethod(method string, path string, base interface{}, verb string, handler interface{}, description string, tag *swagger.Tag) {
+	handleTenantAPI(method, path+":"+verb, handler, description, tag)
+
+	p := reflect.ValueOf(base).Pointer()
+	if customMethods[p] == nil {
+		customMethods[p] = map[string]ucon.HandlerContainer{}
+	}
+	customMethods[p][verb] = swagger.NewHandlerInfo(handler)
+}
+
+// UseCustomMethod is Middleware, 最後のPath Parameterの末尾の :verb を取り除き、登録されているCustom MethodのHandlerに差し替える
+// :verb はEscapeされていない : の場合だけ扱うので、末尾が :verb のKeyは : を %3A にEscapeすれば元のHandlerで読める
+// Handlerを差し替えるので、HandlerのArgumentsを扱うMiddlewareより前に置くこと
+func UseCustomMethod(b *ucon.Bubble) error {
+	if b.R.Method != http.MethodGet && b.R.Method != http.MethodPost {
+		return b.Next()
+	}
+	params, ok := b.Context.Value(ucon.PathParameterKey).(map[string]string)
+	if !ok || b.RequestHandler == nil {
+		return b.Next()
+	}
+	methods, ok := customMethods[reflect.ValueOf(b.RequestHandler.Handler()).Pointer()]
+	if !ok {
+		return b.Next()
+	}
+
+	path := b.R.URL.EscapedPath()
+	i := strings.LastIndex(path, ":")
+	if i < 0 {
+		return b.Next()
+	}
+	verb := path[i+1:]
+	hc, ok := methods[verb]
+	if !ok {
+		return b.Next()
+	}
+	for name, v := range params {
+		// Pathの末尾にある、最後のPath Parameterだけを対象にする
+		if !strings.HasSuffix(v, ":"+verb) || !strings.HasSuffix(b.R.URL.Path, v) {
+			continue
+		}
+		params[name] = strings.TrimSuffix(v, ":"+verb)
+
+		b.RequestHandler = hc
+		ht := reflect.TypeOf(hc.Handler())
+		b.ArgumentTypes = make([]reflect.Type, ht.NumIn())
+		for i := range b.ArgumentTypes {
+			b.ArgumentTypes[i] = ht.In(i)
+		}
+		b.Arguments = make([]reflect.Value, ht.NumIn())
+		break
+	}
+
+	return b.Next()
+}
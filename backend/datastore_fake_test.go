@@ -0,0 +1,680 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+// fakeDatastore is TestでDatastoreの代わりに利用するMemory上のdatastore.Client
+// backendが利用するGet, Put, Delete, GetAll, RunInTransactionだけを実装し、それ以外のMethodを呼ぶとpanicする
+// Transactionは書き込みをCommitまで溜めるだけで、競合は検出しない
+type fakeDatastore struct {
+	datastore.Client
+
+	mu       sync.Mutex
+	entities map[string]*fakeEntity
+	lastID   int64
+}
+
+type fakeEntity struct {
+	key   *fakeKey
+	props []datastore.Property
+}
+
+func newFakeDatastore() *fakeDatastore {
+	return &fakeDatastore{entities: map[string]*fakeEntity{}}
+}
+
+// Get is datastore.Clientを実装
+func (ds *fakeDatastore) Get(ctx context.Context, key datastore.Key, dst interface{}) error {
+	ds.mu.Lock()
+	e, ok := ds.entities[entityID(key)]
+	ds.mu.Unlock()
+	if !ok {
+		return datastore.ErrNoSuchEntity
+	}
+	return datastore.LoadStruct(ctx, dst, e.props)
+}
+
+// GetMulti is datastore.Clientを実装
+func (ds *fakeDatastore) GetMulti(ctx context.Context, keys []datastore.Key, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return fmt.Errorf("fakeDatastore: dst must be a slice of len %d", len(keys))
+	}
+	merr := make(datastore.MultiError, len(keys))
+	var failed bool
+	for i, k := range keys {
+		if err := ds.Get(ctx, k, structPtr(v.Index(i))); err != nil {
+			merr[i] = err
+			failed = true
+		}
+	}
+	if failed {
+		return merr
+	}
+	return nil
+}
+
+// Put is datastore.Clientを実装
+func (ds *fakeDatastore) Put(ctx context.Context, key datastore.Key, src interface{}) (datastore.Key, error) {
+	props, err := datastore.SaveStruct(ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	return ds.put(key, props), nil
+}
+
+func (ds *fakeDatastore) put(key datastore.Key, props []datastore.Property) datastore.Key {
+	k := *key.(*fakeKey)
+	if k.Incomplete() {
+		ds.lastID++
+		k.id = ds.lastID
+	}
+	ds.entities[entityID(&k)] = &fakeEntity{key: &k, props: props}
+	return &k
+}
+
+// PutMulti is datastore.Clientを実装
+func (ds *fakeDatastore) PutMulti(ctx context.Context, keys []datastore.Key, src interface{}) ([]datastore.Key, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, fmt.Errorf("fakeDatastore: src must be a slice of len %d", len(keys))
+	}
+	list := make([]datastore.Key, len(keys))
+	for i, k := range keys {
+		var err error
+		if list[i], err = ds.Put(ctx, k, structPtr(v.Index(i))); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+// Delete is datastore.Clientを実装
+func (ds *fakeDatastore) Delete(ctx context.Context, key datastore.Key) error {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	delete(ds.entities, entityID(key))
+	return nil
+}
+
+// DeleteMulti is datastore.Clientを実装
+func (ds *fakeDatastore) DeleteMulti(ctx context.Context, keys []datastore.Key) error {
+	for _, k := range keys {
+		if err := ds.Delete(ctx, k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RunInTransaction is datastore.Clientを実装. fがErrorを返さなければ、溜めた書き込みをまとめて反映する
+func (ds *fakeDatastore) RunInTransaction(ctx context.Context, f func(tx datastore.Transaction) error) (datastore.Commit, error) {
+	tx := &fakeTransaction{ctx: ctx, ds: ds}
+	if err := f(tx); err != nil {
+		return nil, err
+	}
+	return tx.Commit()
+}
+
+// GetAll is datastore.Clientを実装. dstは *[]*T または *[]T で、KeysOnlyの場合はnilでもよい
+func (ds *fakeDatastore) GetAll(ctx context.Context, q datastore.Query, dst interface{}) ([]datastore.Key, error) {
+	qd := q.Dump()
+	list, err := ds.query(qd)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]datastore.Key, len(list))
+	for i, e := range list {
+		keys[i] = e.key
+	}
+	if qd.KeysOnly || dst == nil {
+		return keys, nil
+	}
+
+	sv := reflect.ValueOf(dst)
+	if sv.Kind() != reflect.Ptr || sv.Elem().Kind() != reflect.Slice {
+		return nil, errors.New("fakeDatastore: dst must be a pointer to a slice")
+	}
+	sv = sv.Elem()
+	et := sv.Type().Elem()
+	for _, e := range list {
+		var ev reflect.Value
+		if et.Kind() == reflect.Ptr {
+			ev = reflect.New(et.Elem())
+		} else {
+			ev = reflect.New(et)
+		}
+		if err := datastore.LoadStruct(ctx, ev.Interface(), e.props); err != nil {
+			return nil, err
+		}
+		if et.Kind() != reflect.Ptr {
+			ev = ev.Elem()
+		}
+		sv.Set(reflect.Append(sv, ev))
+	}
+	return keys, nil
+}
+
+// Count is datastore.Clientを実装
+func (ds *fakeDatastore) Count(ctx context.Context, q datastore.Query) (int, error) {
+	list, err := ds.query(q.Dump())
+	return len(list), err
+}
+
+func (ds *fakeDatastore) query(qd *datastore.QueryDump) ([]*fakeEntity, error) {
+	ds.mu.Lock()
+	var list []*fakeEntity
+	for _, e := range ds.entities {
+		if e.key.kind != qd.Kind || e.key.namespace != qd.Namespace {
+			continue
+		}
+		if qd.Ancestor != nil && !e.key.hasAncestor(qd.Ancestor.(*fakeKey)) {
+			continue
+		}
+		ok, err := e.matches(qd.Filter)
+		if err != nil {
+			ds.mu.Unlock()
+			return nil, err
+		}
+		if ok {
+			list = append(list, e)
+		}
+	}
+	ds.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool {
+		for _, o := range qd.Order {
+			name := strings.TrimPrefix(o, "-")
+			c, _ := compareValues(list[i].value(name), list[j].value(name))
+			if strings.HasPrefix(o, "-") {
+				c = -c
+			}
+			if c != 0 {
+				return c < 0
+			}
+		}
+		return compareKeys(list[i].key, list[j].key) < 0
+	})
+
+	if qd.Offset > 0 {
+		if qd.Offset >= len(list) {
+			return nil, nil
+		}
+		list = list[qd.Offset:]
+	}
+	if qd.Limit > 0 && len(list) > qd.Limit {
+		list = list[:qd.Limit]
+	}
+	return list, nil
+}
+
+// value is nameのPropertyの値を返す. __key__ の場合はKey
+func (e *fakeEntity) value(name string) interface{} {
+	if name == "__key__" {
+		return e.key
+	}
+	for _, p := range e.props {
+		if p.Name == name {
+			return p.Value
+		}
+	}
+	return nil
+}
+
+// matches is 全てのFilterを満たすかを返す. 配列のPropertyはいずれかの要素が満たせばよい
+func (e *fakeEntity) matches(filters []*datastore.QueryFilterCondition) (bool, error) {
+	for _, f := range filters {
+		fields := strings.Fields(f.Filter)
+		if len(fields) != 2 {
+			return false, fmt.Errorf("fakeDatastore: invalid filter %q", f.Filter)
+		}
+		values := []interface{}{e.value(fields[0])}
+		if vs, ok := values[0].([]interface{}); ok {
+			values = vs
+		}
+		var ok bool
+		for _, v := range values {
+			c, comparable := compareValues(v, f.Value)
+			if !comparable {
+				continue
+			}
+			switch fields[1] {
+			case "=":
+				ok = c == 0
+			case ">":
+				ok = c > 0
+			case ">=":
+				ok = c >= 0
+			case "<":
+				ok = c < 0
+			case "<=":
+				ok = c <= 0
+			default:
+				return false, fmt.Errorf("fakeDatastore: unsupported operator %q", fields[1])
+			}
+			if ok {
+				break
+			}
+		}
+		if !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// compareValues is aとbを比較する. 型が異なり比較できない場合はfalseを返す
+func compareValues(a interface{}, b interface{}) (int, bool) {
+	a, b = normalizeValue(a), normalizeValue(b)
+	switch av := a.(type) {
+	case int64:
+		bv, ok := b.(int64)
+		if !ok {
+			return 0, false
+		}
+		return compareInt64(av, bv), true
+	case float64:
+		bv, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av < bv:
+			return -1, true
+		case av > bv:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		bv, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(av, bv), true
+	case bool:
+		bv, ok := b.(bool)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av == bv:
+			return 0, true
+		case !av:
+			return -1, true
+		}
+		return 1, true
+	case time.Time:
+		bv, ok := b.(time.Time)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case av.Before(bv):
+			return -1, true
+		case av.After(bv):
+			return 1, true
+		}
+		return 0, true
+	case *fakeKey:
+		bv, ok := b.(*fakeKey)
+		if !ok {
+			return 0, false
+		}
+		return compareKeys(av, bv), true
+	}
+	return 0, false
+}
+
+func normalizeValue(v interface{}) interface{} {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return rv.Int()
+	case reflect.Float32, reflect.Float64:
+		return rv.Float()
+	case reflect.String:
+		return rv.String()
+	}
+	return v
+}
+
+func compareInt64(a int64, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// structPtr is GetMulti, PutMultiのSliceの要素をStructのPointerにする
+func structPtr(v reflect.Value) interface{} {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return v.Interface()
+	}
+	return v.Addr().Interface()
+}
+
+// IncompleteKey is datastore.Clientを実装
+func (ds *fakeDatastore) IncompleteKey(kind string, parent datastore.Key) datastore.Key {
+	return newFakeKey(kind, 0, "", parent)
+}
+
+// NameKey is datastore.Clientを実装
+func (ds *fakeDatastore) NameKey(kind string, name string, parent datastore.Key) datastore.Key {
+	return newFakeKey(kind, 0, name, parent)
+}
+
+// IDKey is datastore.Clientを実装
+func (ds *fakeDatastore) IDKey(kind string, id int64, parent datastore.Key) datastore.Key {
+	return newFakeKey(kind, id, "", parent)
+}
+
+// NewQuery is datastore.Clientを実装
+func (ds *fakeDatastore) NewQuery(kind string) datastore.Query {
+	return &fakeQuery{dump: datastore.QueryDump{Kind: kind}}
+}
+
+// fakeTransaction is fakeDatastoreのTransaction. 読み込みはCommit済みの値を返す
+type fakeTransaction struct {
+	ctx context.Context
+	ds  *fakeDatastore
+	ops []func()
+}
+
+func (tx *fakeTransaction) Get(key datastore.Key, dst interface{}) error {
+	return tx.ds.Get(tx.ctx, key, dst)
+}
+
+func (tx *fakeTransaction) GetMulti(keys []datastore.Key, dst interface{}) error {
+	return tx.ds.GetMulti(tx.ctx, keys, dst)
+}
+
+func (tx *fakeTransaction) Put(key datastore.Key, src interface{}) (datastore.PendingKey, error) {
+	props, err := datastore.SaveStruct(tx.ctx, src)
+	if err != nil {
+		return nil, err
+	}
+	pk := &fakePendingKey{ctx: tx.ctx}
+	tx.ops = append(tx.ops, func() {
+		pk.key = tx.ds.put(key, props)
+	})
+	return pk, nil
+}
+
+func (tx *fakeTransaction) PutMulti(keys []datastore.Key, src interface{}) ([]datastore.PendingKey, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice || v.Len() != len(keys) {
+		return nil, fmt.Errorf("fakeDatastore: src must be a slice of len %d", len(keys))
+	}
+	list := make([]datastore.PendingKey, len(keys))
+	for i, k := range keys {
+		var err error
+		if list[i], err = tx.Put(k, structPtr(v.Index(i))); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func (tx *fakeTransaction) Delete(key datastore.Key) error {
+	tx.ops = append(tx.ops, func() {
+		delete(tx.ds.entities, entityID(key))
+	})
+	return nil
+}
+
+func (tx *fakeTransaction) DeleteMulti(keys []datastore.Key) error {
+	for _, k := range keys {
+		if err := tx.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (tx *fakeTransaction) Commit() (datastore.Commit, error) {
+	tx.ds.mu.Lock()
+	defer tx.ds.mu.Unlock()
+	for _, op := range tx.ops {
+		op()
+	}
+	tx.ops = nil
+	return &fakeCommit{}, nil
+}
+
+func (tx *fakeTransaction) Rollback() error {
+	tx.ops = nil
+	return nil
+}
+
+func (tx *fakeTransaction) Batch() *datastore.TransactionBatch {
+	panic("fakeDatastore: Batch is not supported")
+}
+
+type fakePendingKey struct {
+	ctx context.Context
+	key datastore.Key
+}
+
+func (pk *fakePendingKey) StoredContext() context.Context {
+	return pk.ctx
+}
+
+type fakeCommit struct{}
+
+func (c *fakeCommit) Key(p datastore.PendingKey) datastore.Key {
+	return p.(*fakePendingKey).key
+}
+
+// fakeQuery is fakeDatastoreのQuery. 条件はQueryDumpに記録するだけ
+type fakeQuery struct {
+	dump datastore.QueryDump
+}
+
+func (q *fakeQuery) clone(f func(d *datastore.QueryDump)) datastore.Query {
+	c := &fakeQuery{dump: q.dump}
+	c.dump.Filter = append([]*datastore.QueryFilterCondition{}, q.dump.Filter...)
+	c.dump.Order = append([]string{}, q.dump.Order...)
+	f(&c.dump)
+	return c
+}
+
+func (q *fakeQuery) Ancestor(ancestor datastore.Key) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Ancestor = ancestor })
+}
+
+func (q *fakeQuery) EventualConsistency() datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.EventualConsistency = true })
+}
+
+func (q *fakeQuery) Namespace(ns string) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Namespace = ns })
+}
+
+func (q *fakeQuery) Transaction(t datastore.Transaction) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Transaction = t })
+}
+
+func (q *fakeQuery) Filter(filterStr string, value interface{}) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) {
+		d.Filter = append(d.Filter, &datastore.QueryFilterCondition{Filter: filterStr, Value: value})
+	})
+}
+
+func (q *fakeQuery) Order(fieldName string) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Order = append(d.Order, fieldName) })
+}
+
+func (q *fakeQuery) Project(fieldNames ...string) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Project = fieldNames })
+}
+
+func (q *fakeQuery) Distinct() datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Distinct = true })
+}
+
+func (q *fakeQuery) KeysOnly() datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.KeysOnly = true })
+}
+
+func (q *fakeQuery) Limit(limit int) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Limit = limit })
+}
+
+func (q *fakeQuery) Offset(offset int) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Offset = offset })
+}
+
+func (q *fakeQuery) Start(c datastore.Cursor) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.Start = c })
+}
+
+func (q *fakeQuery) End(c datastore.Cursor) datastore.Query {
+	return q.clone(func(d *datastore.QueryDump) { d.End = c })
+}
+
+func (q *fakeQuery) Dump() *datastore.QueryDump {
+	d := q.dump
+	return &d
+}
+
+// fakeKey is fakeDatastoreのKey
+type fakeKey struct {
+	kind      string
+	id        int64
+	name      string
+	parent    *fakeKey
+	namespace string
+}
+
+func newFakeKey(kind string, id int64, name string, parent datastore.Key) *fakeKey {
+	k := &fakeKey{kind: kind, id: id, name: name}
+	if parent != nil {
+		k.parent = parent.(*fakeKey)
+		k.namespace = k.parent.namespace
+	}
+	return k
+}
+
+// entityID is fakeDatastore.entitiesのKey
+func entityID(key datastore.Key) string {
+	return key.Namespace() + "|" + key.String()
+}
+
+func (k *fakeKey) Kind() string { return k.kind }
+
+func (k *fakeKey) ID() int64 { return k.id }
+
+func (k *fakeKey) Name() string { return k.name }
+
+func (k *fakeKey) ParentKey() datastore.Key {
+	if k.parent == nil {
+		return nil
+	}
+	return k.parent
+}
+
+func (k *fakeKey) Namespace() string { return k.namespace }
+
+func (k *fakeKey) SetNamespace(namespace string) {
+	k.namespace = namespace
+	if k.parent != nil {
+		k.parent.SetNamespace(namespace)
+	}
+}
+
+func (k *fakeKey) String() string {
+	s := k.kind + ","
+	if k.name != "" {
+		s += k.name
+	} else {
+		s += fmt.Sprint(k.id)
+	}
+	if k.parent != nil {
+		s = k.parent.String() + "/" + s
+	}
+	return s
+}
+
+func (k *fakeKey) GobEncode() ([]byte, error) { return []byte(k.String()), nil }
+
+func (k *fakeKey) GobDecode(buf []byte) error {
+	return errors.New("fakeDatastore: GobDecode is not supported")
+}
+
+func (k *fakeKey) MarshalJSON() ([]byte, error) { return []byte(fmt.Sprintf("%q", k.String())), nil }
+
+func (k *fakeKey) UnmarshalJSON(buf []byte) error {
+	return errors.New("fakeDatastore: UnmarshalJSON is not supported")
+}
+
+func (k *fakeKey) Encode() string { return k.String() }
+
+func (k *fakeKey) Equal(o datastore.Key) bool {
+	ok, _ := o.(*fakeKey)
+	return ok != nil && k.namespace == ok.namespace && compareKeys(k, ok) == 0
+}
+
+func (k *fakeKey) Incomplete() bool { return k.id == 0 && k.name == "" }
+
+// hasAncestor is aがkの祖先、またはk自身かを返す
+func (k *fakeKey) hasAncestor(a *fakeKey) bool {
+	for p := k; p != nil; p = p.parent {
+		if compareKeys(p, a) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// path is RootからkまでのKeyを返す
+func (k *fakeKey) path() []*fakeKey {
+	var path []*fakeKey
+	for p := k; p != nil; p = p.parent {
+		path = append([]*fakeKey{p}, path...)
+	}
+	return path
+}
+
+// compareKeys is Datastoreと同じくRootから順にKind, ID, Nameで比較する. IDはNameより前になる
+func compareKeys(a *fakeKey, b *fakeKey) int {
+	ap, bp := a.path(), b.path()
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		if c := strings.Compare(ap[i].kind, bp[i].kind); c != 0 {
+			return c
+		}
+		switch {
+		case ap[i].name == "" && bp[i].name != "":
+			return -1
+		case ap[i].name != "" && bp[i].name == "":
+			return 1
+		}
+		if c := compareInt64(ap[i].id, bp[i].id); c != 0 {
+			return c
+		}
+		if c := strings.Compare(ap[i].name, bp[i].name); c != 0 {
+			return c
+		}
+	}
+	return compareInt64(int64(len(ap)), int64(len(bp)))
+}
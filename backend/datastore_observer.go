@@ -0,0 +1,112 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"go.mercari.io/datastore"
+)
+
+// maxTracedKeys is SpanのAttributeに記録するKeyの最大数
+const maxTracedKeys = 10
+
+// datastoreObserver is Datastoreの操作のLatencyをMetricsに記録し、Spanを作成するdatastore.Middleware
+type datastoreObserver struct{}
+
+var _ datastore.Middleware = &datastoreObserver{}
+
+// observeDatastore is Datastoreの操作を開始し、終了時に呼ぶFuncを返す
+func observeDatastore(ctx context.Context, op string, kind string, keys []datastore.Key) func() {
+	start := time.Now()
+	_, span := StartSpan(ctx, "datastore."+op, SpanKindClient)
+	if kind == "" && len(keys) > 0 {
+		kind = keys[0].Kind()
+	}
+	if kind != "" {
+		span.SetAttribute(AttrDatastoreKind, kind)
+	}
+	if len(keys) > 0 {
+		span.SetAttribute(AttrDatastoreKeys, formatTracedKeys(keys))
+	}
+
+	return func() {
+		datastoreOpDuration.Observe(time.Since(start).Seconds(), op)
+		span.End()
+	}
+}
+
+func formatTracedKeys(keys []datastore.Key) string {
+	var names []string
+	for i, k := range keys {
+		if i >= maxTracedKeys {
+			names = append(names, "...")
+			break
+		}
+		names = append(names, k.String())
+	}
+	return strings.Join(names, ",")
+}
+
+func (*datastoreObserver) AllocateIDs(info *datastore.MiddlewareInfo, keys []datastore.Key) ([]datastore.Key, error) {
+	defer observeDatastore(info.Context, "AllocateIDs", "", keys)()
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (*datastoreObserver) PutMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.Key, error) {
+	defer observeDatastore(info.Context, "Put", "", keys)()
+	return info.Next.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (*datastoreObserver) PutMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) ([]datastore.PendingKey, error) {
+	defer observeDatastore(info.Context, "TxPut", "", keys)()
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (*datastoreObserver) GetMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	defer observeDatastore(info.Context, "Get", "", keys)()
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func (*datastoreObserver) GetMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key, psList []datastore.PropertyList) error {
+	defer observeDatastore(info.Context, "TxGet", "", keys)()
+	return info.Next.GetMultiWithTx(info, keys, psList)
+}
+
+func (*datastoreObserver) DeleteMultiWithoutTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	defer observeDatastore(info.Context, "Delete", "", keys)()
+	return info.Next.DeleteMultiWithoutTx(info, keys)
+}
+
+func (*datastoreObserver) DeleteMultiWithTx(info *datastore.MiddlewareInfo, keys []datastore.Key) error {
+	defer observeDatastore(info.Context, "TxDelete", "", keys)()
+	return info.Next.DeleteMultiWithTx(info, keys)
+}
+
+func (*datastoreObserver) PostCommit(info *datastore.MiddlewareInfo, tx datastore.Transaction, commit datastore.Commit) error {
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (*datastoreObserver) PostRollback(info *datastore.MiddlewareInfo, tx datastore.Transaction) error {
+	return info.Next.PostRollback(info, tx)
+}
+
+func (*datastoreObserver) Run(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) datastore.Iterator {
+	defer observeDatastore(info.Context, "Run", qDump.Kind, nil)()
+	return info.Next.Run(info, q, qDump)
+}
+
+func (*datastoreObserver) GetAll(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, psList *[]datastore.PropertyList) ([]datastore.Key, error) {
+	defer observeDatastore(info.Context, "GetAll", qDump.Kind, nil)()
+	return info.Next.GetAll(info, q, qDump, psList)
+}
+
+func (*datastoreObserver) Next(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump, iter datastore.Iterator, ps *datastore.PropertyList) (datastore.Key, error) {
+	defer observeDatastore(info.Context, "Next", qDump.Kind, nil)()
+	return info.Next.Next(info, q, qDump, iter, ps)
+}
+
+func (*datastoreObserver) Count(info *datastore.MiddlewareInfo, q datastore.Query, qDump *datastore.QueryDump) (int, error) {
+	defer observeDatastore(info.Context, "Count", qDump.Kind, nil)()
+	return info.Next.Count(info, q, qDump)
+}
@@ -0,0 +1,225 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeyProviderEnvelope is 複数のCryptKeyでData Keyを包んだCiphertextを表すProviderの名前
+// Tenantに設定するProviderではなく、CiphertextにだけCrypterが記録する
+const KeyProviderEnvelope = "envelope"
+
+// envelopeFormat is Envelopeの形式のVersion
+const envelopeFormat = 1
+
+// envelope is 値をランダムなData Key (AES-256-GCM) でEncryptし、Data KeyをCryptKey毎にEncryptしたもの
+// どれか1つのCryptKeyでData KeyをDecryptできれば、値をDecryptできる
+// CryptKeyを記録しているので、Tenantの設定を変更した後もDecryptできる
+type envelope struct {
+	Format     int            `json:"format"`
+	Keys       []*envelopeKey `json:"keys"`
+	Nonce      []byte         `json:"nonce"`
+	Ciphertext []byte         `json:"ciphertext"`
+}
+
+// envelopeKey is CryptKeyでEncryptしたData Key. WrappedはCrypterのCiphertext
+type envelopeKey struct {
+	CryptKey CryptKey `json:"cryptKey"`
+	Wrapped  string   `json:"wrapped"`
+}
+
+func parseEnvelope(raw string) (*envelope, error) {
+	b, err := base64.StdEncoding.DecodeString(raw)
+	if err != nil {
+		return nil, errors.Wrap(err, "envelope: failed base64 decode")
+	}
+	env := &envelope{}
+	if err := json.Unmarshal(b, env); err != nil {
+		return nil, errors.Wrap(err, "envelope: failed parse")
+	}
+	if env.Format != envelopeFormat {
+		return nil, fmt.Errorf("envelope: unsupported format %d", env.Format)
+	}
+	return env, nil
+}
+
+// wrappedBy is keysと同じCryptKeyで同じ順にData KeyをEncryptしているかを返す
+func (env *envelope) wrappedBy(keys []CryptKey) bool {
+	if len(env.Keys) != len(keys) {
+		return false
+	}
+	for i, k := range env.Keys {
+		if !sameCryptKey(k.CryptKey, keys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// open is Data KeyでCiphertextをDecryptする
+func (env *envelope) open(dataKey []byte) (string, error) {
+	aead, err := newAESGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	pt, err := aead.Open(nil, env.Nonce, env.Ciphertext, []byte(KeyProviderEnvelope))
+	if err != nil {
+		return "", errors.Wrap(err, "envelope: failed to decrypt with data key")
+	}
+	return string(pt), nil
+}
+
+// sameCryptKey is 同じKeyを指しているかを返す. Providerの省略はCloud KMSとして扱う
+func sameCryptKey(a, b CryptKey) bool {
+	return keyProviderName(a) == keyProviderName(b) && a.Name() == b.Name()
+}
+
+// EncryptMulti is keysが1つの場合はEncryptと同じCiphertextを返し、複数の場合はData Keyを全てのCryptKeyでEncryptしたEnvelopeを返す
+// 冗長性を保証するため、どれか1つのCryptKeyでEncryptできない場合は失敗する
+func (c *Crypter) EncryptMulti(ctx context.Context, keys []CryptKey, plaintext string) (string, error) {
+	if len(keys) == 0 {
+		return "", errors.New("encrypt: no crypt key")
+	}
+	if len(keys) == 1 {
+		ct, _, err := c.Encrypt(ctx, keys[0], plaintext)
+		return ct, err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", errors.Wrap(err, "encrypt: failed generate data key")
+	}
+	aead, err := newAESGCM(dataKey)
+	if err != nil {
+		return "", err
+	}
+	env := &envelope{
+		Format: envelopeFormat,
+		Nonce:  make([]byte, aead.NonceSize()),
+	}
+	if _, err := rand.Read(env.Nonce); err != nil {
+		return "", errors.Wrap(err, "encrypt: failed generate nonce")
+	}
+	env.Ciphertext = aead.Seal(nil, env.Nonce, []byte(plaintext), []byte(KeyProviderEnvelope))
+
+	encodedKey := base64.StdEncoding.EncodeToString(dataKey)
+	for _, k := range keys {
+		wrapped, _, err := c.Encrypt(ctx, k, encodedKey)
+		if err != nil {
+			return "", err
+		}
+		env.Keys = append(env.Keys, &envelopeKey{CryptKey: k, Wrapped: wrapped})
+	}
+	b, err := json.Marshal(env)
+	if err != nil {
+		return "", errors.Wrap(err, "encrypt: failed marshal envelope")
+	}
+	return KeyProviderEnvelope + ":" + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// DecryptMulti is EnvelopeでないCiphertextを、keysの中でCiphertextと同じProviderのCryptKeyで順にDecryptする
+// gcpkmsとvaultのCiphertextはCryptKeyを記録していないので、CryptKeyを変更してRedundantCryptKeysに残した以前のKeyでも読めるようにする
+// Envelopeは記録されているCryptKeyでDecryptする
+func (c *Crypter) DecryptMulti(ctx context.Context, keys []CryptKey, ciphertext string) (string, error) {
+	name, _ := SplitCiphertext(ciphertext)
+	if name == KeyProviderEnvelope {
+		return c.Decrypt(ctx, CryptKey{}, ciphertext)
+	}
+	if len(keys) == 0 {
+		return "", errors.New("decrypt: no crypt key")
+	}
+	var first error
+	for i, k := range keys {
+		if i > 0 && keyProviderName(k) != name {
+			continue
+		}
+		pt, err := c.Decrypt(ctx, k, ciphertext)
+		if err == nil {
+			if i > 0 {
+				log.Warningf(ctx, "decrypted with %s instead of %s. reencrypt the value", k.Name(), keys[0].Name())
+			}
+			return pt, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+	return "", first
+}
+
+// unwrap is keyのCryptKeyでData KeyをDecryptする
+func (c *Crypter) unwrap(ctx context.Context, key *envelopeKey) ([]byte, error) {
+	encodedKey, err := c.Decrypt(ctx, key.CryptKey, key.Wrapped)
+	if err != nil {
+		return nil, err
+	}
+	dataKey, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "envelope: failed base64 decode data key")
+	}
+	return dataKey, nil
+}
+
+// decryptEnvelope is 記録されている順にCryptKeyを試し、最初にDecryptできたData Keyで値をDecryptする
+func (c *Crypter) decryptEnvelope(ctx context.Context, raw string) (string, error) {
+	env, err := parseEnvelope(raw)
+	if err != nil {
+		return "", err
+	}
+	var errs []string
+	for _, k := range env.Keys {
+		dataKey, err := c.unwrap(ctx, k)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		if len(errs) > 0 {
+			log.Warningf(ctx, "envelope: decrypted with %s after %d crypt keys failed. %s", k.CryptKey.Name(), len(errs), strings.Join(errs, "; "))
+		}
+		return env.open(dataKey)
+	}
+	return "", fmt.Errorf("decrypt: no crypt key could decrypt the data key. %s", strings.Join(errs, "; "))
+}
+
+// CryptKeyCheck is 1つのCryptKeyで値をDecryptできるかを確認した結果
+type CryptKeyCheck struct {
+	CryptKey string `json:"cryptKey"`
+	Error    string `json:"error,omitempty"`
+}
+
+// CheckCiphertext is 値を記録されている全てのCryptKeyでDecryptできるかを確認する
+// Envelopeでない値はcryptKeyでDecryptできるかを確認する
+func (c *Crypter) CheckCiphertext(ctx context.Context, cryptKey CryptKey, ciphertext string) []*CryptKeyCheck {
+	name, raw := SplitCiphertext(ciphertext)
+	if name != KeyProviderEnvelope {
+		check := &CryptKeyCheck{CryptKey: cryptKey.Name()}
+		if _, err := c.Decrypt(ctx, cryptKey, ciphertext); err != nil {
+			check.Error = err.Error()
+		}
+		return []*CryptKeyCheck{check}
+	}
+
+	env, err := parseEnvelope(raw)
+	if err != nil {
+		return []*CryptKeyCheck{{CryptKey: KeyProviderEnvelope, Error: err.Error()}}
+	}
+	checks := make([]*CryptKeyCheck, len(env.Keys))
+	for i, k := range env.Keys {
+		checks[i] = &CryptKeyCheck{CryptKey: k.CryptKey.Name()}
+		dataKey, err := c.unwrap(ctx, k)
+		if err == nil {
+			// 別のData KeyでEncryptされていないかも確認する
+			_, err = env.open(dataKey)
+		}
+		if err != nil {
+			checks[i].Error = err.Error()
+		}
+	}
+	return checks
+}
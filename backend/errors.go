@@ -0,0 +1,139 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+
+	"github.com/favclip/ucon"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/appengine"
+)
+
+// ErrorReason is Clientが判定に利用する、変わらないError Code
+type ErrorReason string
+
+// ErrorReason List
+const (
+	ReasonInvalidArgument    ErrorReason = "INVALID_ARGUMENT"
+	ReasonUnauthenticated    ErrorReason = "UNAUTHENTICATED"
+	ReasonPermissionDenied   ErrorReason = "PERMISSION_DENIED"
+	ReasonNotFound           ErrorReason = "NOT_FOUND"
+	ReasonConflict           ErrorReason = "CONFLICT"
+	ReasonFailedPrecondition ErrorReason = "FAILED_PRECONDITION"
+	ReasonResourceExhausted  ErrorReason = "RESOURCE_EXHAUSTED"
+	ReasonKMSPermission      ErrorReason = "KMS_PERMISSION_DENIED"
+	ReasonKMSUnavailable     ErrorReason = "KMS_UNAVAILABLE"
+	ReasonKMSError           ErrorReason = "KMS_ERROR"
+	ReasonUnavailable        ErrorReason = "UNAVAILABLE"
+	ReasonDeadlineExceeded   ErrorReason = "DEADLINE_EXCEEDED"
+	ReasonInternal           ErrorReason = "INTERNAL"
+)
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+
+// reasonFromStatus is HTTP Status CodeからErrorReasonを決める
+func reasonFromStatus(code int) ErrorReason {
+	switch code {
+	case http.StatusBadRequest:
+		return ReasonInvalidArgument
+	case http.StatusUnauthorized:
+		return ReasonUnauthenticated
+	case http.StatusForbidden:
+		return ReasonPermissionDenied
+	case http.StatusNotFound:
+		return ReasonNotFound
+	case http.StatusConflict:
+		return ReasonConflict
+	case http.StatusPreconditionFailed:
+		return ReasonFailedPrecondition
+	case http.StatusTooManyRequests:
+		return ReasonResourceExhausted
+	case http.StatusServiceUnavailable:
+		return ReasonUnavailable
+	case http.StatusGatewayTimeout:
+		return ReasonDeadlineExceeded
+	}
+	return ReasonInternal
+}
+
+// TranslateError is 内部のErrorをClientに返すHTTPErrorに変換する
+// Clientには内部の詳細を返さないので、元のErrorはLogで確認する
+func TranslateError(err error) *HTTPError {
+	cause := errors.Cause(err)
+
+	if he, ok := cause.(*HTTPError); ok {
+		if he.Reason == "" {
+			he.Reason = reasonFromStatus(he.Code)
+		}
+		return he
+	}
+
+	switch {
+	case cause == datastore.ErrNoSuchEntity, cause == ErrSecretNotFound:
+		return &HTTPError{Code: http.StatusNotFound, Reason: ReasonNotFound, Message: "not found."}
+	case cause == context.DeadlineExceeded, appengine.IsTimeoutError(cause):
+		return &HTTPError{Code: http.StatusGatewayTimeout, Reason: ReasonDeadlineExceeded, Message: "deadline exceeded.", Retriable: true}
+	case cause == ErrCircuitOpen:
+		return &HTTPError{Code: http.StatusServiceUnavailable, Reason: ReasonKMSUnavailable, Message: "kms is unavailable.", Retriable: true}
+	case cause == context.Canceled:
+		return &HTTPError{Code: http.StatusServiceUnavailable, Reason: ReasonUnavailable, Message: "request canceled.", Retriable: true}
+	}
+
+	if gerr, ok := cause.(*googleapi.Error); ok {
+		return translateKMSError(gerr.Code)
+	}
+	if kerr, ok := cause.(*KeyProviderError); ok {
+		return translateKMSError(kerr.Code)
+	}
+
+	return &HTTPError{Code: http.StatusInternalServerError, Reason: ReasonInternal, Message: "internal server error."}
+}
+
+// translateKMSError is Cloud KMS, またはKeyProviderのHTTP APIが返したStatus CodeのErrorを変換する
+// KMSのErrorはClientのRequestの問題ではないので、4xxではなく502/503として返す
+func translateKMSError(code int) *HTTPError {
+	switch code {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &HTTPError{Code: http.StatusBadGateway, Reason: ReasonKMSPermission, Message: "kms permission denied."}
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return &HTTPError{Code: http.StatusServiceUnavailable, Reason: ReasonKMSUnavailable, Message: "kms is unavailable.", Retriable: true}
+	}
+	return &HTTPError{Code: http.StatusBadGateway, Reason: ReasonKMSError, Message: "kms error."}
+}
+
+// UseErrorTranslation is Middleware, Handlerが返したErrorをTranslateErrorで変換し、元のErrorをLogに出力する
+// ResponseMapperより後に置くこと
+func UseErrorTranslation(b *ucon.Bubble) error {
+	err := b.Next()
+	if err != nil {
+		if _, ok := err.(ucon.HTTPErrorResponse); ok {
+			if _, ours := errors.Cause(err).(*HTTPError); !ours {
+				// ucon内部のError(CSRF, Request Bodyの不正等)はそのまま返す
+				return err
+			}
+		}
+		return translateAndLog(b.Context, err)
+	}
+
+	for idx, rv := range b.Returns {
+		if !rv.Type().AssignableTo(errorType) || rv.IsNil() {
+			continue
+		}
+		he := translateAndLog(b.Context, rv.Interface().(error))
+		b.Returns[idx] = reflect.ValueOf(he)
+	}
+	return nil
+}
+
+func translateAndLog(ctx context.Context, err error) *HTTPError {
+	he := TranslateError(err)
+	if he.Code >= http.StatusInternalServerError {
+		log.Errorf(ctx, "%s %d: %+v", he.Reason, he.Code, err)
+	} else {
+		log.Infof(ctx, "%s %d: %+v", he.Reason, he.Code, err)
+	}
+	return he
+}
@@ -0,0 +1,327 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// maxMoveEntityGroups is 1 Transactionで扱えるEntity Groupの上限
+// Cross Group Transactionは25 Entity Groupまでなので、移動元と移動先の両方を数える
+const maxMoveEntityGroups = 25
+
+func setupFolderAPI(swPlugin *swagger.Plugin) {
+	api := &FolderAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Folder", Description: "Folder API list"})
+
+	handleTenantAPI(http.MethodGet, "/folder", api.List, "list folder children", tag)
+	handleTenantAPI(http.MethodGet, "/folder:watch", api.Watch, "wait until secrets under prefix are updated", tag)
+	handleTenantAPI(http.MethodGet, "/export", api.Export, "export secrets under prefix", tag)
+	handleTenantAPI(http.MethodPost, "/move", api.Move, "move secrets under prefix", tag)
+}
+
+// FolderAPI is API to handle Secret Key as hierarchy
+type FolderAPI struct{}
+
+// FolderAPIListRequest is FolderAPI List Request
+type FolderAPIListRequest struct {
+	Prefix string `json:"prefix" swagger:",in=query,keyPrefix"`
+}
+
+// List is Folder直下のFolderとSecretの一覧を返すhandler
+func (api *FolderAPI) List(ctx context.Context, form *FolderAPIListRequest) (*Folder, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	prefix := NormalizeKeyPrefix(form.Prefix)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, prefix, PermissionRead); err != nil {
+		return nil, err
+	}
+
+	keys, err := platform.SecretStore.List(ctx, t, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFolder(prefix, keys), nil
+}
+
+// FolderAPIExportRequest is FolderAPI Export Request
+type FolderAPIExportRequest struct {
+	Prefix string `json:"prefix" swagger:",in=query,keyPrefix"`
+}
+
+// FolderAPIExportResponse is FolderAPI Export Response
+type FolderAPIExportResponse struct {
+	Prefix  string                  `json:"prefix"`
+	Secrets []*SecretAPIGetResponse `json:"secrets"`
+}
+
+// Export is Prefix配下の全てのSecretをDecryptして返すhandler
+func (api *FolderAPI) Export(ctx context.Context, form *FolderAPIExportRequest) (*FolderAPIExportResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+	defer FlushSecretAccess(ctx)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	prefix := NormalizeKeyPrefix(form.Prefix)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	keys, err := platform.SecretStore.List(ctx, t, prefix)
+	if err != nil {
+		return nil, err
+	}
+	// 配下に別のSecretACLがあるかもしれないので、Key毎に確認する
+	for _, key := range keys {
+		if err := AuthorizeSecretValue(ctx, ds, t, u, key); err != nil {
+			return nil, err
+		}
+	}
+
+	list, err := platform.SecretStore.GetMulti(ctx, t, keys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed get secrets. prefix=%s", prefix)
+	}
+
+	kms := NewCrypter()
+	resp := &FolderAPIExportResponse{
+		Prefix:  prefix,
+		Secrets: make([]*SecretAPIGetResponse, len(keys)),
+	}
+	for i, s := range list {
+		// ExportはAliasとReferenceを解決せず、登録されている値をそのまま返す
+		resp.Secrets[i], err = rawSecretResponse(ctx, kms, t, keys[i], s)
+		if err != nil {
+			return nil, err
+		}
+		RecordSecretAccess(t, keys[i], u.Email)
+	}
+
+	return resp, nil
+}
+
+// FolderAPIMoveRequest is FolderAPI Move Request
+type FolderAPIMoveRequest struct {
+	From string `json:"from" swagger:",req,secretKey"`
+	To   string `json:"to" swagger:",req,secretKey"`
+}
+
+// FolderAPIMoveResponse is FolderAPI Move Response
+type FolderAPIMoveResponse struct {
+	Moved []*MovedKey `json:"moved"`
+}
+
+// MovedKey is 移動したSecretの移動元と移動先
+// swaggerがmapを扱えないため、structのsliceで返す
+type MovedKey struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Move is Prefix配下のSecretとSecretACLを別のPrefixにTransactionで移動するhandler
+func (api *FolderAPI) Move(ctx context.Context, form *FolderAPIMoveRequest) (*FolderAPIMoveResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	from, to := NormalizeKeyPrefix(form.From), NormalizeKeyPrefix(form.To)
+	if HasKeyPrefix(to, from) || HasKeyPrefix(from, to) {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: "from and to must not overlap."}
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, from, PermissionWrite); err != nil {
+		return nil, err
+	}
+	if err := Authorize(ctx, ds, t, u, to, PermissionWrite); err != nil {
+		return nil, err
+	}
+	// 保護されたPrefixへの出し入れは承認を経ずにSecretを変更できてしまうので許可しない
+	if err := requireUnprotected(ctx, ds, t, from); err != nil {
+		return nil, err
+	}
+	if err := requireUnprotected(ctx, ds, t, to); err != nil {
+		return nil, err
+	}
+
+	secretKeys, err := platform.SecretStore.List(ctx, t, from)
+	if err != nil {
+		return nil, err
+	}
+	aclKeys, err := listKeysUnder(ctx, ds, t, SecretACLKind, from)
+	if err != nil {
+		return nil, err
+	}
+	if len(secretKeys) == 0 {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("%s is not found.", from)}
+	}
+	if n := (len(secretKeys) + len(aclKeys)) * 2; n > maxMoveEntityGroups {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("too many entities to move in one transaction. entity groups=%d, max=%d", n, maxMoveEntityGroups)}
+	}
+	// SecretACLを移動するとACLを書き換えたのと同じになるので、ACLを設定できるTenantの管理者に限る
+	if len(aclKeys) > 0 && !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("%s has %d acls under it. only tenant admins can move them.", from, len(aclKeys))}
+	}
+
+	rename := func(name string) string {
+		return to + strings.TrimPrefix(name, from)
+	}
+	// 配下に別のSecretACLがあるかもしれないので、Exportと同じくKey毎に移動元と移動先を確認する
+	for _, key := range secretKeys {
+		if err := Authorize(ctx, ds, t, u, key, PermissionWrite); err != nil {
+			return nil, err
+		}
+		if err := Authorize(ctx, ds, t, u, rename(key), PermissionWrite); err != nil {
+			return nil, err
+		}
+		if err := requireUnprotected(ctx, ds, t, rename(key)); err != nil {
+			return nil, err
+		}
+	}
+	// fromが保護されていなくても、配下の保護されたSecretを承認なしで移動することになる
+	for _, k := range aclKeys {
+		acl := &SecretACL{}
+		if err := ds.Get(ctx, k, acl); err != nil {
+			return nil, errors.Wrapf(err, "failed get acl. prefix=%s", k.Name())
+		}
+		if acl.Protected() {
+			return nil, &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("%s is protected and requires approval.", k.Name())}
+		}
+	}
+	var moved []*MovedKey
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		// Datastore以外のSecretStoreでは、SecretとSecretACLの移動は別のTransactionになる
+		err := platform.SecretStore.RunInTransaction(withDatastoreTransaction(ctx, tx), t, func(stx SecretTx) error {
+			for _, key := range secretKeys {
+				if err := moveSecret(stx, key, rename(key)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range aclKeys {
+			if err := moveEntity(tx, k, t.NameKey(ds, SecretACLKind, rename(k.Name()), nil), &SecretACL{}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range secretKeys {
+		moved = append(moved, &MovedKey{From: key, To: rename(key)})
+		moveSecretVersions(ctx, ds, t, key, rename(key))
+	}
+	// 移動元は削除、移動先は更新として通知する
+	for _, m := range moved {
+		PublishSecretEvent(ctx, ds, t, &SecretEvent{Type: SecretEventDeleted, Key: m.From, Actor: u.Email})
+		PublishSecretEvent(ctx, ds, t, &SecretEvent{Type: SecretEventUpdated, Key: m.To, Actor: u.Email})
+	}
+
+	return &FolderAPIMoveResponse{
+		Moved: moved,
+	}, nil
+}
+
+// moveEntity is Transaction内でEntityを別のKeyに移動する. 移動先が既に存在する場合はConflictとする
+func moveEntity(tx datastore.Transaction, from datastore.Key, to datastore.Key, dst interface{}) error {
+	if err := tx.Get(to, dst); err == nil {
+		return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("%s already exists.", to.Name())}
+	} else if err != datastore.ErrNoSuchEntity {
+		return errors.Wrapf(err, "failed get. key=%s", to.Name())
+	}
+	if err := tx.Get(from, dst); err != nil {
+		return errors.Wrapf(err, "failed get. key=%s", from.Name())
+	}
+	if _, err := tx.Put(to, dst); err != nil {
+		return errors.Wrapf(err, "failed put. key=%s", to.Name())
+	}
+	if err := tx.Delete(from); err != nil {
+		return errors.Wrapf(err, "failed delete. key=%s", from.Name())
+	}
+	return nil
+}
+
+// moveSecret is Transaction内でSecretを別のKeyに移動する. 移動先が既に存在する場合はConflictとする
+func moveSecret(tx SecretTx, from string, to string) error {
+	if _, err := tx.Get(to); err == nil {
+		return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("%s already exists.", to)}
+	} else if err != ErrSecretNotFound {
+		return err
+	}
+	s, err := tx.Get(from)
+	if err != nil {
+		return err
+	}
+	if err := tx.Put(to, s); err != nil {
+		return err
+	}
+	return tx.Delete(from)
+}
+
+// listKeysUnder is prefix自身とprefix配下のKeyを返す
+func listKeysUnder(ctx context.Context, ds datastore.Client, t *Tenant, kind string, prefix string) ([]datastore.Key, error) {
+	keys, err := ListKeysByPrefix(ctx, ds, t, kind, prefix)
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		return keys, nil
+	}
+
+	k := t.NameKey(ds, kind, prefix, nil)
+	q := t.NewQuery(ds, kind).KeysOnly().Filter("__key__ =", k)
+	exact, err := ds.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed get key. kind=%s, key=%s", kind, prefix)
+	}
+	return append(exact, keys...), nil
+}
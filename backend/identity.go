@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"google.golang.org/appengine/user"
+)
+
+// Identity is Requestを送ったuserを判定する. 認証されていない場合はnilを返す
+type Identity interface {
+	CurrentUser(ctx context.Context, r *http.Request) *user.User
+}
+
+// AppEngineIdentity is App EngineのUsers APIでuserを判定するIdentity
+type AppEngineIdentity struct{}
+
+// CurrentUser is Identityを実装
+func (i *AppEngineIdentity) CurrentUser(ctx context.Context, r *http.Request) *user.User {
+	return user.Current(ctx)
+}
+
+// HeaderIdentity is 前段のProxyが付けたHeaderでuserを判定するIdentity
+// Cloud IAPやoauth2-proxyのように、外から来たHeaderを取り除くProxyの後ろでのみ利用すること
+type HeaderIdentity struct {
+	// Header is userのEmailが入っているHeader. 例: X-Goog-Authenticated-User-Email
+	Header string
+	// Prefix is Headerの値から取り除くPrefix. 例: accounts.google.com:
+	Prefix string
+	// Admins is App Engineの管理者と同じく、全てのTenantの管理者として扱うuserのEmail
+	Admins []string
+}
+
+// CurrentUser is Identityを実装
+func (i *HeaderIdentity) CurrentUser(ctx context.Context, r *http.Request) *user.User {
+	email := strings.TrimPrefix(r.Header.Get(i.Header), i.Prefix)
+	if email == "" {
+		return nil
+	}
+	u := &user.User{Email: email}
+	for _, admin := range i.Admins {
+		if admin == email {
+			u.Admin = true
+		}
+	}
+	return u
+}
+
+// StaticIdentity is 全てのRequestを同じuserとして扱うIdentity. Localでの開発用
+type StaticIdentity struct {
+	Email string
+	Admin bool
+}
+
+// CurrentUser is Identityを実装
+func (i *StaticIdentity) CurrentUser(ctx context.Context, r *http.Request) *user.User {
+	return &user.User{Email: i.Email, Admin: i.Admin}
+}
+
+// TokenIdentity is Authorization: Bearer {token} でuserを判定するIdentity
+// 別のgcpsmからの複製のように、Proxyを通らずに呼び出すServer用に利用する. Tokenを持たないRequestはNextで判定する
+type TokenIdentity struct {
+	// Tokens is TokenのSHA-256(hex)からuserのEmailへのMap. Token自体は保存しない
+	Tokens map[string]string
+	Next   Identity
+}
+
+// CurrentUser is Identityを実装. Tokenで判定したuserは管理者として扱わない
+func (i *TokenIdentity) CurrentUser(ctx context.Context, r *http.Request) *user.User {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token != "" {
+		sum := sha256.Sum256([]byte(token))
+		if email, ok := i.Tokens[hex.EncodeToString(sum[:])]; ok {
+			return &user.User{Email: email}
+		}
+	}
+	if i.Next == nil {
+		return nil
+	}
+	return i.Next.CurrentUser(ctx, r)
+}
+
+// ReadTokens is 1行に "{email} {TokenのSHA-256(hex)}" を書いたものを読み込む. 空行と#で始まる行は無視する
+func ReadTokens(r io.Reader) (map[string]string, error) {
+	tokens := map[string]string{}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 || len(fields[1]) != sha256.Size*2 {
+			return nil, fmt.Errorf("invalid token at line %d. {email} {sha256 of token} is expected", n)
+		}
+		tokens[strings.ToLower(fields[1])] = fields[0]
+	}
+	return tokens, sc.Err()
+}
+
+type currentUserContextKey struct{}
+
+func withCurrentUser(ctx context.Context, u *user.User) context.Context {
+	return context.WithValue(ctx, currentUserContextKey{}, u)
+}
+
+// CurrentUser is UsePlatformContextで判定した、Requestを送ったuserを返す. 認証されていない場合はnil
+func CurrentUser(ctx context.Context) *user.User {
+	u, _ := ctx.Value(currentUserContextKey{}).(*user.User)
+	return u
+}
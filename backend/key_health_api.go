@@ -0,0 +1,126 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+)
+
+func setupKeyHealthAPI(swPlugin *swagger.Plugin) {
+	api := &KeyHealthAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "KeyHealth", Description: "Crypt key health check API list"})
+
+	handleTenantAPI(http.MethodGet, "/cryptkey/health", api.Get, "check every secret can be decrypted by enough crypt keys", tag)
+}
+
+// KeyHealthAPI is 全てのSecretを十分な数のCryptKeyでDecryptできるかを確認するAPI
+// CryptKeyの破棄やLocationの障害でSecretを取り出せなくなる前に、冗長性が失われていることを検知する
+type KeyHealthAPI struct{}
+
+// KeyHealthAPIGetRequest is KeyHealthAPI Get Request
+// MinはSecret毎にDecryptできる必要のあるCryptKeyの数で、省略した場合はTenantに設定されている全てのCryptKey
+type KeyHealthAPIGetRequest struct {
+	Min    int    `json:"min" swagger:",in=query"`
+	Prefix string `json:"prefix" swagger:",in=query,keyPrefix"`
+}
+
+// KeyHealthAPIGetResponse is KeyHealthAPI Get Response
+// UnhealthyにはMin未満のCryptKeyでしかDecryptできないSecretだけを返す
+type KeyHealthAPIGetResponse struct {
+	Min       int                `json:"min"`
+	Checked   int                `json:"checked"`
+	Healthy   bool               `json:"healthy"`
+	Keys      []*CryptKeyHealth  `json:"keys"`
+	Unhealthy []*SecretKeyHealth `json:"unhealthy"`
+}
+
+// CryptKeyHealth is CryptKey毎にDecryptできたSecretとできなかったSecretの数
+type CryptKeyHealth struct {
+	CryptKey string `json:"cryptKey"`
+	OK       int    `json:"ok"`
+	Failed   int    `json:"failed"`
+}
+
+// SecretKeyHealth is SecretをDecryptできたCryptKeyの数と、CryptKey毎の結果
+type SecretKeyHealth struct {
+	Key         string           `json:"key"`
+	Decryptable int              `json:"decryptable"`
+	Checks      []*CryptKeyCheck `json:"checks"`
+}
+
+// Get is Prefix配下の全てのSecretについて、記録されている全てのCryptKeyでDecryptできるかを確認するhandler
+// Tenantの管理者だけが利用できる. Secretの数 x CryptKeyの数だけKMSを呼ぶので、定期的な確認はPrefixを分けて行う
+func (api *KeyHealthAPI) Get(ctx context.Context, form *KeyHealthAPIGetRequest) (*KeyHealthAPIGetResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+
+	min := form.Min
+	if min <= 0 {
+		min = len(t.CryptKeys())
+	}
+	prefix := NormalizeKeyPrefix(form.Prefix)
+
+	keys, err := platform.SecretStore.List(ctx, t, prefix)
+	if err != nil {
+		return nil, err
+	}
+	list, err := platform.SecretStore.GetMulti(ctx, t, keys)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed get secrets. prefix=%s", prefix)
+	}
+
+	kms := NewCrypter()
+	resp := &KeyHealthAPIGetResponse{
+		Min:       min,
+		Keys:      []*CryptKeyHealth{},
+		Unhealthy: []*SecretKeyHealth{},
+	}
+	byName := map[string]*CryptKeyHealth{}
+	for i, s := range list {
+		if s.AliasOf != "" {
+			continue
+		}
+		resp.Checked++
+		h := &SecretKeyHealth{
+			Key:    keys[i],
+			Checks: kms.CheckCiphertext(ctx, t.CryptKey, s.Value),
+		}
+		for _, c := range h.Checks {
+			kh, ok := byName[c.CryptKey]
+			if !ok {
+				kh = &CryptKeyHealth{CryptKey: c.CryptKey}
+				byName[c.CryptKey] = kh
+				resp.Keys = append(resp.Keys, kh)
+			}
+			if c.Error != "" {
+				kh.Failed++
+				continue
+			}
+			kh.OK++
+			h.Decryptable++
+		}
+		if h.Decryptable < min {
+			resp.Unhealthy = append(resp.Unhealthy, h)
+		}
+	}
+	resp.Healthy = len(resp.Unhealthy) == 0
+	if !resp.Healthy {
+		log.Warningf(ctx, "crypt key health check failed. tenant=%s, prefix=%s, unhealthy=%d/%d", t.ID, prefix, len(resp.Unhealthy), resp.Checked)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,170 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// KeyProvider is SecretのEncryptとDecryptを行うKey Management Service
+// KMSService, LocalKeyRing, VaultTransitProvider, AWSKMSProviderが実装する
+type KeyProvider interface {
+	// Encrypt is cryptKeyでEncryptし、Ciphertextと利用したKey Versionの名前を返す
+	Encrypt(ctx context.Context, cryptKey CryptKey, plaintext string) (ciphertext string, cryptoKey string, err error)
+	// Decrypt is cryptKeyでEncryptされたCiphertextをDecryptする
+	Decrypt(ctx context.Context, cryptKey CryptKey, ciphertext string) (plaintext string, err error)
+}
+
+// KeyProvider List
+const (
+	// KeyProviderCloudKMS is Cloud KMS. CryptKey.Providerを省略した場合もこれになる
+	KeyProviderCloudKMS = "gcpkms"
+	// KeyProviderLocal is LocalKeyRing
+	KeyProviderLocal = "local"
+	// KeyProviderVault is HashiCorp VaultのTransit Secrets Engine
+	KeyProviderVault = "vault"
+	// KeyProviderAWSKMS is AWS KMS, またはAWS KMSと同じAPIを持つService
+	KeyProviderAWSKMS = "awskms"
+)
+
+// KeyProviderError is KeyProviderのHTTP APIが返したError. CodeでRetryするかを判断する
+type KeyProviderError struct {
+	Provider string
+	Code     int
+	Message  string
+}
+
+// Error is errorを実装
+func (e *KeyProviderError) Error() string {
+	return fmt.Sprintf("%s: status=%d, %s", e.Provider, e.Code, e.Message)
+}
+
+// keyProviders is 利用できるKeyProviderを作成するFunc
+var keyProviders = map[string]func(ctx context.Context) (KeyProvider, error){
+	KeyProviderCloudKMS: func(ctx context.Context) (KeyProvider, error) {
+		return NewKMSService(ctx)
+	},
+}
+
+// RegisterKeyProvider is nameのKeyProviderを登録する. Requestを処理する前に呼ぶこと
+func RegisterKeyProvider(name string, f func(ctx context.Context) (KeyProvider, error)) {
+	keyProviders[name] = f
+}
+
+// KeyProviderRegistered is nameのKeyProviderが登録されているかを返す. 空の場合はCloud KMSとする
+func KeyProviderRegistered(name string) bool {
+	if name == "" {
+		name = KeyProviderCloudKMS
+	}
+	_, ok := keyProviders[name]
+	return ok
+}
+
+// SplitCiphertext is CiphertextをEncryptしたProviderと、ProviderのCiphertextに分ける
+// Providerを記録していないCiphertextは、Providerを導入する前にCloud KMSでEncryptしたもの
+func SplitCiphertext(ciphertext string) (provider string, raw string) {
+	i := strings.Index(ciphertext, ":")
+	if i < 0 {
+		return KeyProviderCloudKMS, ciphertext
+	}
+	return ciphertext[:i], ciphertext[i+1:]
+}
+
+// Crypter is CryptKey.ProviderのKeyProviderでEncryptし、Ciphertextに記録したProviderでDecryptするKeyProvider
+// Ciphertextは {provider}:{ProviderのCiphertext} の形になる. KeyProviderは必要になった時に作成する
+// 複数のCryptKeyを利用する場合はEncryptMultiでEnvelopeを作成する
+type Crypter struct {
+	providers map[string]KeyProvider
+}
+
+// NewCrypter is Crypterを作成
+func NewCrypter() *Crypter {
+	return &Crypter{
+		providers: map[string]KeyProvider{},
+	}
+}
+
+func (c *Crypter) provider(ctx context.Context, name string) (KeyProvider, error) {
+	if p, ok := c.providers[name]; ok {
+		return p, nil
+	}
+	f, ok := keyProviders[name]
+	if !ok {
+		return nil, fmt.Errorf("key provider %s is not registered", name)
+	}
+	p, err := f(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.providers[name] = p
+	return p, nil
+}
+
+// keyProviderName is CryptKeyのProviderの名前を返す. 省略した場合はCloud KMS
+func keyProviderName(cryptKey CryptKey) string {
+	if cryptKey.Provider == "" {
+		return KeyProviderCloudKMS
+	}
+	return cryptKey.Provider
+}
+
+// Encrypt is KeyProviderを実装
+func (c *Crypter) Encrypt(ctx context.Context, cryptKey CryptKey, plaintext string) (string, string, error) {
+	name := keyProviderName(cryptKey)
+	p, err := c.provider(ctx, name)
+	if err != nil {
+		return "", "", err
+	}
+	ciphertext, cryptoKey, err := p.Encrypt(ctx, cryptKey, plaintext)
+	if err != nil {
+		return "", "", err
+	}
+	return name + ":" + ciphertext, cryptoKey, nil
+}
+
+// Decrypt is KeyProviderを実装. EnvelopeはCiphertextに記録したCryptKeyでDecryptするので、cryptKeyは使わない
+func (c *Crypter) Decrypt(ctx context.Context, cryptKey CryptKey, ciphertext string) (string, error) {
+	name, raw := SplitCiphertext(ciphertext)
+	if name == KeyProviderEnvelope {
+		return c.decryptEnvelope(ctx, raw)
+	}
+	p, err := c.provider(ctx, name)
+	if err != nil {
+		return "", err
+	}
+	return p.Decrypt(ctx, cryptKey, raw)
+}
+
+// keyProviderHTTPClient is KeyProviderのHTTP APIの呼び出しに利用するhttp.Clientを返す
+// fがnilの場合はPlatform.HTTPClientを利用し、Requestにtraceparentを付ける
+func keyProviderHTTPClient(ctx context.Context, f func(ctx context.Context) *http.Client) *http.Client {
+	client := platform.HTTPClient(ctx)
+	if f != nil {
+		client = f(ctx)
+	}
+	base := client.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c := *client
+	c.Transport = &traceTransport{Base: base}
+	return &c
+}
+
+// readKeyProviderResponse is KeyProviderのHTTP APIのResponseを読み込む. 2xx以外はKeyProviderErrorにする
+func readKeyProviderResponse(provider string, resp *http.Response) ([]byte, error) {
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s: failed read response", provider)
+	}
+	if resp.StatusCode/100 != 2 {
+		return b, &KeyProviderError{Provider: provider, Code: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+	}
+	return b, nil
+}
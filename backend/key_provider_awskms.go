@@ -0,0 +1,229 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// AWSKMSProvider is AWS KMSのEncryptとDecryptを利用するKeyProvider
+// CryptKey.LocationIDをRegion、CryptKey.KeyNameをKey ID, Alias (alias/xxx) またはARNとする
+// Endpointを指定すると、LocalStackなどAWS KMSと同じAPIを持つServiceを利用できる
+// CiphertextBlobはKeyを含んでいるので、DecryptではCryptKeyを使わない
+type AWSKMSProvider struct {
+	// Endpoint is APIのURL. 空の場合は https://kms.{region}.amazonaws.com
+	Endpoint string
+	// Region is CryptKey.LocationIDが空の場合に利用するRegion
+	Region          string
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is 一時的なCredentialの場合に設定する
+	SessionToken string
+	// Client is 呼び出しに利用するhttp.Clientを返す. nilの場合はPlatform.HTTPClientを利用する
+	Client      func(ctx context.Context) *http.Client
+	RetryPolicy RetryPolicy
+}
+
+// NewAWSKMSProvider is AWSKMSProviderを作成
+func NewAWSKMSProvider(region string, accessKeyID string, secretAccessKey string) *AWSKMSProvider {
+	return &AWSKMSProvider{
+		Region:          region,
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretAccessKey,
+		RetryPolicy:     DefaultRetryPolicy,
+	}
+}
+
+// Encrypt is KeyProviderを実装. Key Versionの名前は利用したKeyのARNになる
+func (p *AWSKMSProvider) Encrypt(ctx context.Context, cryptKey CryptKey, plaintext string) (string, string, error) {
+	res := struct {
+		CiphertextBlob string
+		KeyID          string `json:"KeyId"`
+	}{}
+	err := callKeyProvider(ctx, p.RetryPolicy, cryptKey, "Encrypt", func(ctx context.Context) error {
+		return p.call(ctx, p.region(cryptKey), "Encrypt", map[string]string{
+			"KeyId":     cryptKey.KeyName,
+			"Plaintext": base64.StdEncoding.EncodeToString([]byte(plaintext)),
+		}, &res)
+	})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "encrypt: failed to encrypt. CryptoKey=%s", cryptKey.Name())
+	}
+	if res.CiphertextBlob == "" {
+		return "", "", fmt.Errorf("encrypt: aws kms returned empty ciphertext. CryptoKey=%s", cryptKey.Name())
+	}
+	return res.CiphertextBlob, res.KeyID, nil
+}
+
+// Decrypt is KeyProviderを実装
+func (p *AWSKMSProvider) Decrypt(ctx context.Context, cryptKey CryptKey, ciphertext string) (string, error) {
+	res := struct {
+		Plaintext string
+	}{}
+	err := callKeyProvider(ctx, p.RetryPolicy, cryptKey, "Decrypt", func(ctx context.Context) error {
+		return p.call(ctx, p.region(cryptKey), "Decrypt", map[string]string{
+			"CiphertextBlob": ciphertext,
+		}, &res)
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "decrypt: failed to decrypt. CryptoKey=%s", cryptKey.Name())
+	}
+	pt, err := base64.StdEncoding.DecodeString(res.Plaintext)
+	if err != nil {
+		return "", errors.Wrap(err, "decrypt: failed base64 decode")
+	}
+	return string(pt), nil
+}
+
+func (p *AWSKMSProvider) region(cryptKey CryptKey) string {
+	if cryptKey.LocationID != "" && cryptKey.LocationID != "global" {
+		return cryptKey.LocationID
+	}
+	return p.Region
+}
+
+// call is AWS JSON 1.1 ProtocolでTrentService.{action}を呼び出す
+func (p *AWSKMSProvider) call(ctx context.Context, region string, action string, body interface{}, res interface{}) error {
+	if region == "" {
+		return errors.New("awskms: region is empty")
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "awskms: failed marshal request")
+	}
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://kms.%s.amazonaws.com/", region)
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(b))
+	if err != nil {
+		return errors.Wrap(err, "awskms: failed create request")
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	if p.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", p.SessionToken)
+	}
+	SignAWSRequestV4(req, b, region, "kms", p.AccessKeyID, p.SecretAccessKey, time.Now())
+
+	resp, err := keyProviderHTTPClient(ctx, p.Client).Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	b, err = readKeyProviderResponse(KeyProviderAWSKMS, resp)
+	if err != nil {
+		// AWSは {"__type": "...", "message": "..."} を返す. Throttlingは400で返るので429として扱う
+		if perr, ok := err.(*KeyProviderError); ok {
+			e := struct {
+				Type    string `json:"__type"`
+				Message string `json:"message"`
+			}{}
+			if json.Unmarshal(b, &e) == nil && e.Type != "" {
+				perr.Message = strings.TrimSpace(e.Type + " " + e.Message)
+				if strings.HasSuffix(e.Type, "ThrottlingException") {
+					perr.Code = http.StatusTooManyRequests
+				}
+			}
+		}
+		return err
+	}
+	if err := json.Unmarshal(b, res); err != nil {
+		return errors.Wrap(err, "awskms: failed parse response")
+	}
+	return nil
+}
+
+// SignAWSRequestV4 is RequestにAWS Signature Version 4の署名を付ける. X-Amz-Dateもnowで設定する
+// https://docs.aws.amazon.com/general/latest/gr/sigv4_signing.html
+func SignAWSRequestV4(req *http.Request, body []byte, region string, service string, accessKeyID string, secretAccessKey string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+
+	// 署名するHeaderは小文字にして昇順に並べる
+	headers := map[string]string{"host": req.URL.Host}
+	names := []string{"host"}
+	for k, v := range req.Header {
+		name := strings.ToLower(k)
+		if name == "content-type" || strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(strings.Join(v, ","))
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	var canonicalHeaders bytes.Buffer
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		canonicalQuery(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		hexSHA256(body),
+	}, "\n")
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hexSHA256([]byte(canonicalRequest))}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKeyID, scope, signedHeaders, signature))
+}
+
+func canonicalQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := q[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, awsURIEscape(k)+"="+awsURIEscape(v))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// awsURIEscape is SigV4のURI Encode. 空白は+ではなく%20にする
+func awsURIEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+func hexSHA256(b []byte) string {
+	h := sha256.Sum256(b)
+	return hex.EncodeToString(h[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
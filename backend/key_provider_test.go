@@ -0,0 +1,284 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// testRetryPolicy is TestでRetryを待たないRetryPolicy
+var testRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     time.Millisecond,
+	Multiplier:     2,
+}
+
+// fakeKeyProvider is 指定したErrorを順に返し、その後はhandlerで応答するKeyProviderのHTTP APIのFake
+type fakeKeyProvider struct {
+	mu       sync.Mutex
+	faults   []func(w http.ResponseWriter)
+	requests []*http.Request
+	handler  func(w http.ResponseWriter, r *http.Request, body map[string]string)
+}
+
+func (f *fakeKeyProvider) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests = append(f.requests, r)
+	var fault func(w http.ResponseWriter)
+	if len(f.faults) > 0 {
+		fault, f.faults = f.faults[0], f.faults[1:]
+	}
+	f.mu.Unlock()
+
+	if fault != nil {
+		fault(w)
+		return
+	}
+	body := map[string]string{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.handler(w, r, body)
+}
+
+func (f *fakeKeyProvider) fail(code int, body string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, func(w http.ResponseWriter) {
+		w.WriteHeader(code)
+		fmt.Fprint(w, body)
+	})
+}
+
+func (f *fakeKeyProvider) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.requests)
+}
+
+// newFakeVault is Transit Secrets EngineのFake. ciphertextは vault:v1:{base64(plaintext)} になる
+func newFakeVault(t *testing.T) (*fakeKeyProvider, *VaultTransitProvider, CryptKey, func()) {
+	f := &fakeKeyProvider{}
+	f.handler = func(w http.ResponseWriter, r *http.Request, body map[string]string) {
+		if r.Header.Get("X-Vault-Token") != "token" {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `{"errors":["permission denied"]}`)
+			return
+		}
+		res := &vaultResponse{}
+		switch {
+		case strings.HasPrefix(r.URL.Path, "/v1/transit/encrypt/"):
+			res.Data.Ciphertext = "vault:v1:" + body["plaintext"]
+			res.Data.KeyVersion = 1
+		case strings.HasPrefix(r.URL.Path, "/v1/transit/decrypt/"):
+			res.Data.Plaintext = strings.TrimPrefix(body["ciphertext"], "vault:v1:")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"errors":[]}`)
+			return
+		}
+		json.NewEncoder(w).Encode(res)
+	}
+	srv := httptest.NewServer(f)
+	p := NewVaultTransitProvider(srv.URL+"/", "token")
+	p.Client = func(ctx context.Context) *http.Client { return srv.Client() }
+	p.RetryPolicy = testRetryPolicy
+	ck := CryptKey{Provider: KeyProviderVault, KeyName: strings.Replace(t.Name(), "/", "-", -1)}
+	return f, p, ck, srv.Close
+}
+
+func TestVaultTransitProvider(t *testing.T) {
+	f, p, ck, done := newFakeVault(t)
+	defer done()
+
+	ctx := context.Background()
+	ct, version, err := p.Encrypt(ctx, ck, "hello")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if g, e := version, "transit/keys/"+ck.KeyName+"/versions/1"; g != e {
+		t.Errorf("version: got %q, want %q", g, e)
+	}
+	pt, err := p.Decrypt(ctx, ck, ct)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if pt != "hello" {
+		t.Errorf("plaintext: got %q, want hello", pt)
+	}
+	if g, e := f.requests[0].URL.Path, "/v1/transit/encrypt/"+ck.KeyName; g != e {
+		t.Errorf("path: got %q, want %q", g, e)
+	}
+}
+
+func TestVaultTransitProviderErrors(t *testing.T) {
+	f, p, ck, done := newFakeVault(t)
+	defer done()
+	ctx := context.Background()
+
+	// 5xxはRetryする
+	f.fail(http.StatusServiceUnavailable, `{"errors":["Vault is sealed"]}`)
+	if _, _, err := p.Encrypt(ctx, ck, "hello"); err != nil {
+		t.Fatalf("Encrypt after 503: %v", err)
+	}
+	if g, e := f.count(), 2; g != e {
+		t.Errorf("requests: got %d, want %d", g, e)
+	}
+
+	// 403はRetryせず、Vaultのerrorsを含むKeyProviderErrorになる
+	p.Token = "wrong"
+	_, _, err := p.Encrypt(ctx, ck, "hello")
+	perr, ok := errors.Cause(err).(*KeyProviderError)
+	if !ok || perr.Code != http.StatusForbidden || perr.Message != "permission denied" {
+		t.Fatalf("err: got %#v, want 403 permission denied", errors.Cause(err))
+	}
+	if g, e := f.count(), 3; g != e {
+		t.Errorf("requests: got %d, want %d", g, e)
+	}
+	if he := TranslateError(err); he.Code != http.StatusBadGateway || he.Reason != ReasonKMSPermission {
+		t.Errorf("TranslateError: got %d %s, want %d %s", he.Code, he.Reason, http.StatusBadGateway, ReasonKMSPermission)
+	}
+
+	// Retryしても5xxの場合はKMS_UNAVAILABLEになる
+	p.Token = "token"
+	for i := 0; i < p.RetryPolicy.MaxAttempts; i++ {
+		f.fail(http.StatusServiceUnavailable, `{"errors":["Vault is sealed"]}`)
+	}
+	_, err = p.Decrypt(ctx, ck, "vault:v1:aGVsbG8=")
+	if he := TranslateError(err); he.Code != http.StatusServiceUnavailable || he.Reason != ReasonKMSUnavailable || !he.Retriable {
+		t.Errorf("TranslateError: got %d %s, want %d %s", he.Code, he.Reason, http.StatusServiceUnavailable, ReasonKMSUnavailable)
+	}
+}
+
+// newFakeAWSKMS is AWS KMSのEncryptとDecryptのFake. CiphertextBlobは base64({KeyId}:{plaintext}) になる
+func newFakeAWSKMS(t *testing.T) (*fakeKeyProvider, *AWSKMSProvider, CryptKey, func()) {
+	f := &fakeKeyProvider{}
+	f.handler = func(w http.ResponseWriter, r *http.Request, body map[string]string) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/") {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"UnrecognizedClientException","message":"invalid signature"}`)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			pt, _ := base64.StdEncoding.DecodeString(body["Plaintext"])
+			json.NewEncoder(w).Encode(map[string]string{
+				"CiphertextBlob": base64.StdEncoding.EncodeToString([]byte(body["KeyId"] + ":" + string(pt))),
+				"KeyId":          "arn:aws:kms:us-east-1:123456789012:key/" + body["KeyId"],
+			})
+		case "TrentService.Decrypt":
+			blob, _ := base64.StdEncoding.DecodeString(body["CiphertextBlob"])
+			pt := string(blob[strings.Index(string(blob), ":")+1:])
+			json.NewEncoder(w).Encode(map[string]string{
+				"Plaintext": base64.StdEncoding.EncodeToString([]byte(pt)),
+			})
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"__type":"UnknownOperationException"}`)
+		}
+	}
+	srv := httptest.NewServer(f)
+	p := NewAWSKMSProvider("us-east-1", "AKID", "secret")
+	p.Endpoint = srv.URL + "/"
+	p.Client = func(ctx context.Context) *http.Client { return srv.Client() }
+	p.RetryPolicy = testRetryPolicy
+	ck := CryptKey{Provider: KeyProviderAWSKMS, KeyName: strings.Replace(t.Name(), "/", "-", -1)}
+	return f, p, ck, srv.Close
+}
+
+func TestAWSKMSProvider(t *testing.T) {
+	f, p, ck, done := newFakeAWSKMS(t)
+	defer done()
+
+	ctx := context.Background()
+	ct, keyID, err := p.Encrypt(ctx, ck, "hello")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if g, e := keyID, "arn:aws:kms:us-east-1:123456789012:key/"+ck.KeyName; g != e {
+		t.Errorf("key id: got %q, want %q", g, e)
+	}
+	pt, err := p.Decrypt(ctx, ck, ct)
+	if err != nil {
+		t.Fatalf("Decrypt: %v", err)
+	}
+	if pt != "hello" {
+		t.Errorf("plaintext: got %q, want hello", pt)
+	}
+	if g, e := f.requests[0].Header.Get("Content-Type"), "application/x-amz-json-1.1"; g != e {
+		t.Errorf("content type: got %q, want %q", g, e)
+	}
+}
+
+func TestAWSKMSProviderErrors(t *testing.T) {
+	f, p, ck, done := newFakeAWSKMS(t)
+	defer done()
+	ctx := context.Background()
+
+	// ThrottlingExceptionは400で返るが、429としてRetryする
+	f.fail(http.StatusBadRequest, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+	if _, _, err := p.Encrypt(ctx, ck, "hello"); err != nil {
+		t.Fatalf("Encrypt after throttling: %v", err)
+	}
+	if g, e := f.count(), 2; g != e {
+		t.Errorf("requests: got %d, want %d", g, e)
+	}
+
+	// AccessDeniedExceptionはRetryしない
+	f.fail(http.StatusBadRequest, `{"__type":"AccessDeniedException","message":"not authorized"}`)
+	_, err := p.Decrypt(ctx, ck, "eA==")
+	perr, ok := errors.Cause(err).(*KeyProviderError)
+	if !ok || perr.Code != http.StatusBadRequest || perr.Message != "AccessDeniedException not authorized" {
+		t.Fatalf("err: got %#v, want 400 AccessDeniedException", errors.Cause(err))
+	}
+	if g, e := f.count(), 3; g != e {
+		t.Errorf("requests: got %d, want %d", g, e)
+	}
+	if he := TranslateError(err); he.Code != http.StatusBadGateway || he.Reason != ReasonKMSError {
+		t.Errorf("TranslateError: got %d %s, want %d %s", he.Code, he.Reason, http.StatusBadGateway, ReasonKMSError)
+	}
+
+	// Throttlingが続く場合はKMS_UNAVAILABLEになる
+	for i := 0; i < p.RetryPolicy.MaxAttempts; i++ {
+		f.fail(http.StatusBadRequest, `{"__type":"ThrottlingException","message":"Rate exceeded"}`)
+	}
+	_, _, err = p.Encrypt(ctx, ck, "hello")
+	if he := TranslateError(err); he.Code != http.StatusServiceUnavailable || he.Reason != ReasonKMSUnavailable || !he.Retriable {
+		t.Errorf("TranslateError: got %d %s, want %d %s", he.Code, he.Reason, http.StatusServiceUnavailable, ReasonKMSUnavailable)
+	}
+}
+
+func TestTranslateKeyProviderError(t *testing.T) {
+	cases := []struct {
+		code   int
+		want   int
+		reason ErrorReason
+	}{
+		{http.StatusUnauthorized, http.StatusBadGateway, ReasonKMSPermission},
+		{http.StatusForbidden, http.StatusBadGateway, ReasonKMSPermission},
+		{http.StatusTooManyRequests, http.StatusServiceUnavailable, ReasonKMSUnavailable},
+		{http.StatusInternalServerError, http.StatusServiceUnavailable, ReasonKMSUnavailable},
+		{http.StatusServiceUnavailable, http.StatusServiceUnavailable, ReasonKMSUnavailable},
+		{http.StatusBadRequest, http.StatusBadGateway, ReasonKMSError},
+		{http.StatusNotFound, http.StatusBadGateway, ReasonKMSError},
+	}
+	for _, c := range cases {
+		err := errors.Wrap(&KeyProviderError{Provider: KeyProviderVault, Code: c.code}, "decrypt: failed to decrypt")
+		he := TranslateError(err)
+		if he.Code != c.want || he.Reason != c.reason {
+			t.Errorf("status %d: got %d %s, want %d %s", c.code, he.Code, he.Reason, c.want, c.reason)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// VaultTransitProvider is HashiCorp VaultのTransit Secrets EngineでEncryptとDecryptを行うKeyProvider
+// CryptKey.KeyRingIDをMount Path (省略時は transit)、CryptKey.KeyNameをTransit Keyの名前とする
+// Vaultのciphertext (vault:v1:...) はKeyの名前を含まないので、DecryptにもCryptKeyが必要になる
+type VaultTransitProvider struct {
+	// Address is VaultのURL. 例: https://vault.example.com:8200
+	Address string
+	// Token is X-Vault-Tokenに設定するToken
+	Token string
+	// Namespace is Vault EnterpriseのNamespace. 空の場合は送らない
+	Namespace string
+	// Client is 呼び出しに利用するhttp.Clientを返す. nilの場合はPlatform.HTTPClientを利用する
+	Client      func(ctx context.Context) *http.Client
+	RetryPolicy RetryPolicy
+}
+
+// NewVaultTransitProvider is VaultTransitProviderを作成
+func NewVaultTransitProvider(address string, token string) *VaultTransitProvider {
+	return &VaultTransitProvider{
+		Address:     strings.TrimRight(address, "/"),
+		Token:       token,
+		RetryPolicy: DefaultRetryPolicy,
+	}
+}
+
+// vaultResponse is Transit SecretsのAPIのResponse
+type vaultResponse struct {
+	Data struct {
+		Ciphertext string `json:"ciphertext"`
+		Plaintext  string `json:"plaintext"`
+		KeyVersion int    `json:"key_version"`
+	} `json:"data"`
+	Errors []string `json:"errors"`
+}
+
+// Encrypt is KeyProviderを実装. Key Versionの名前は {mount}/keys/{name}/versions/{version} になる
+func (p *VaultTransitProvider) Encrypt(ctx context.Context, cryptKey CryptKey, plaintext string) (string, string, error) {
+	var res *vaultResponse
+	err := callKeyProvider(ctx, p.RetryPolicy, cryptKey, "Encrypt", func(ctx context.Context) error {
+		var err error
+		res, err = p.post(ctx, cryptKey, "encrypt", map[string]string{
+			"plaintext": base64.StdEncoding.EncodeToString([]byte(plaintext)),
+		})
+		return err
+	})
+	if err != nil {
+		return "", "", errors.Wrapf(err, "encrypt: failed to encrypt. CryptoKey=%s", cryptKey.Name())
+	}
+	if res.Data.Ciphertext == "" {
+		return "", "", fmt.Errorf("encrypt: vault returned empty ciphertext. CryptoKey=%s", cryptKey.Name())
+	}
+	return res.Data.Ciphertext, fmt.Sprintf("%s/keys/%s/versions/%d", vaultMount(cryptKey), cryptKey.KeyName, res.Data.KeyVersion), nil
+}
+
+// Decrypt is KeyProviderを実装
+func (p *VaultTransitProvider) Decrypt(ctx context.Context, cryptKey CryptKey, ciphertext string) (string, error) {
+	var res *vaultResponse
+	err := callKeyProvider(ctx, p.RetryPolicy, cryptKey, "Decrypt", func(ctx context.Context) error {
+		var err error
+		res, err = p.post(ctx, cryptKey, "decrypt", map[string]string{
+			"ciphertext": ciphertext,
+		})
+		return err
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "decrypt: failed to decrypt. CryptoKey=%s", cryptKey.Name())
+	}
+	pt, err := base64.StdEncoding.DecodeString(res.Data.Plaintext)
+	if err != nil {
+		return "", errors.Wrap(err, "decrypt: failed base64 decode")
+	}
+	return string(pt), nil
+}
+
+// post is /v1/{mount}/{op}/{name} にPOSTする
+func (p *VaultTransitProvider) post(ctx context.Context, cryptKey CryptKey, op string, body interface{}) (*vaultResponse, error) {
+	if cryptKey.KeyName == "" {
+		return nil, errors.New("vault: keyName is empty")
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "vault: failed marshal request")
+	}
+	u := fmt.Sprintf("%s/v1/%s/%s/%s", p.Address, vaultMount(cryptKey), op, url.PathEscape(cryptKey.KeyName))
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(b))
+	if err != nil {
+		return nil, errors.Wrap(err, "vault: failed create request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Vault-Token", p.Token)
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	resp, err := keyProviderHTTPClient(ctx, p.Client).Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	b, err = readKeyProviderResponse(KeyProviderVault, resp)
+	if err != nil {
+		// Vaultは {"errors": [...]} を返すので、Messageを読みやすくする
+		res := &vaultResponse{}
+		if perr, ok := err.(*KeyProviderError); ok && json.Unmarshal(b, res) == nil && len(res.Errors) > 0 {
+			perr.Message = strings.Join(res.Errors, ", ")
+		}
+		return nil, err
+	}
+	res := &vaultResponse{}
+	if err := json.Unmarshal(b, res); err != nil {
+		return nil, errors.Wrap(err, "vault: failed parse response")
+	}
+	return res, nil
+}
+
+func vaultMount(cryptKey CryptKey) string {
+	if cryptKey.KeyRingID == "" {
+		return "transit"
+	}
+	return strings.Trim(cryptKey.KeyRingID, "/")
+}
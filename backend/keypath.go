@@ -0,0 +1,134 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// KeyPathSeparator is Secret Keyの階層の区切り文字
+// prod/payments/stripe のように、Keyを / 区切りのPathとして扱う
+const KeyPathSeparator = "/"
+
+// maxKeyPathLength is Secret Keyの最大長. Datastore Key Nameの上限(1500byte)より十分小さくしている
+const maxKeyPathLength = 500
+
+// ValidateKeyPath is Secret KeyがPathとして正しい形式かを確認する
+// 空のSegment(先頭・末尾の / や //)と . .. は階層が壊れるので許可しない
+func ValidateKeyPath(key string) error {
+	if key == "" {
+		return &HTTPError{Code: http.StatusBadRequest, Message: "key is required."}
+	}
+	if len(key) > maxKeyPathLength {
+		return &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("key must be %d bytes or less.", maxKeyPathLength)}
+	}
+	for _, seg := range strings.Split(key, KeyPathSeparator) {
+		switch seg {
+		case "":
+			return &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("key %q contains empty segment.", key)}
+		case ".", "..":
+			return &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("key %q contains relative segment.", key)}
+		}
+	}
+	return nil
+}
+
+// NormalizeKeyPrefix is 末尾の / を取り除いたPrefixを返す
+func NormalizeKeyPrefix(prefix string) string {
+	return strings.TrimRight(prefix, KeyPathSeparator)
+}
+
+// KeyPathAncestors is Keyの祖先のPrefixを近い順に返す. 最後は必ずRoot("")になる
+// prod/payments/stripe -> [prod/payments/stripe, prod/payments, prod, ""]
+func KeyPathAncestors(key string) []string {
+	var list []string
+	for key != "" {
+		list = append(list, key)
+		i := strings.LastIndex(key, KeyPathSeparator)
+		if i < 0 {
+			break
+		}
+		key = key[:i]
+	}
+	return append(list, "")
+}
+
+// HasKeyPrefix is keyがprefix自身、またはprefix配下のKeyかを返す
+func HasKeyPrefix(key string, prefix string) bool {
+	if prefix == "" {
+		return true
+	}
+	return key == prefix || strings.HasPrefix(key, prefix+KeyPathSeparator)
+}
+
+// KeyPathChild is prefix直下の子の名前を返す
+// prefix=prod, key=prod/payments/stripe -> prod/payments, false
+// prefix=prod, key=prod/stripe -> prod/stripe, true
+func KeyPathChild(prefix string, key string) (child string, leaf bool) {
+	rest := key
+	if prefix != "" {
+		rest = strings.TrimPrefix(key, prefix+KeyPathSeparator)
+	}
+	i := strings.Index(rest, KeyPathSeparator)
+	if i < 0 {
+		return key, true
+	}
+	if prefix == "" {
+		return rest[:i], false
+	}
+	return prefix + KeyPathSeparator + rest[:i], false
+}
+
+// ListKeysByPrefix is prefix配下の全てのKeyを返す
+// / の次の文字が 0 であることを利用して、Keyの範囲でQueryする
+func ListKeysByPrefix(ctx context.Context, ds datastore.Client, t *Tenant, kind string, prefix string) ([]datastore.Key, error) {
+	q := t.NewQuery(ds, kind).KeysOnly()
+	if prefix != "" {
+		q = q.Filter("__key__ >=", t.NameKey(ds, kind, prefix+KeyPathSeparator, nil)).
+			Filter("__key__ <", t.NameKey(ds, kind, prefix+"0", nil))
+	}
+	keys, err := ds.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed list keys. kind=%s, prefix=%s", kind, prefix)
+	}
+	return keys, nil
+}
+
+// Folder is Secret Keyの階層の1階層分の一覧
+type Folder struct {
+	Prefix  string   `json:"prefix"`
+	Folders []string `json:"folders"`
+	Secrets []string `json:"secrets"`
+}
+
+// NewFolder is Key一覧からprefix直下のFolderとSecretを集める
+func NewFolder(prefix string, keys []string) *Folder {
+	f := &Folder{
+		Prefix:  prefix,
+		Folders: []string{},
+		Secrets: []string{},
+	}
+	folders := map[string]bool{}
+	for _, key := range keys {
+		if !HasKeyPrefix(key, prefix) || key == prefix {
+			continue
+		}
+		child, leaf := KeyPathChild(prefix, key)
+		if leaf {
+			f.Secrets = append(f.Secrets, child)
+			continue
+		}
+		if !folders[child] {
+			folders[child] = true
+			f.Folders = append(f.Folders, child)
+		}
+	}
+	sort.Strings(f.Folders)
+	sort.Strings(f.Secrets)
+	return f
+}
@@ -0,0 +1,300 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/scrypt"
+)
+
+// LocalKeyRing is PassphraseでEncryptしたFileに保存するAES-256 Keyの集まり. Cloud KMSを使えない開発環境やAir-Gapped環境用
+// Cloud KMSと同じくKeyはVersionを持ち、EncryptはPrimary Versionで行い、DecryptはCiphertextに記録したVersionで行う
+// 読み込んだ後は変更しないので、RotateはFileに対して行い、Serverを再起動する
+type LocalKeyRing struct {
+	Keys map[string]*LocalKey `json:"keys"`
+}
+
+// LocalKey is LocalKeyRingのKey. IDは {KeyRingID}/{KeyName}
+type LocalKey struct {
+	Primary  int                `json:"primary"`
+	Versions []*LocalKeyVersion `json:"versions"`
+}
+
+// LocalKeyVersion is LocalKeyのVersion. DisabledのVersionではDecryptできない
+type LocalKeyVersion struct {
+	Version   int       `json:"version"`
+	Key       []byte    `json:"key"`
+	Disabled  bool      `json:"disabled,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// localKeyRingFile is LocalKeyRingを保存するFileの形式. CiphertextはLocalKeyRingのJSONをAES-256-GCMでEncryptしたもの
+type localKeyRingFile struct {
+	Format     int    `json:"format"`
+	KDF        string `json:"kdf"`
+	Salt       []byte `json:"salt"`
+	N          int    `json:"n"`
+	R          int    `json:"r"`
+	P          int    `json:"p"`
+	Nonce      []byte `json:"nonce"`
+	Ciphertext []byte `json:"ciphertext"`
+}
+
+// scryptのParameter. 2017年時点の対話的なLoginの推奨値
+const (
+	keyRingScryptN = 1 << 15
+	keyRingScryptR = 8
+	keyRingScryptP = 1
+)
+
+// localCiphertextFormat is LocalKeyRingのCiphertextの形式のVersion
+const localCiphertextFormat = 1
+
+// NewLocalKeyRing is 空のLocalKeyRingを作成
+func NewLocalKeyRing() *LocalKeyRing {
+	return &LocalKeyRing{
+		Keys: map[string]*LocalKey{},
+	}
+}
+
+// OpenLocalKeyRing is pathのFileをpassphraseでDecryptして読み込む
+func OpenLocalKeyRing(path string, passphrase string) (*LocalKeyRing, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed read keyring. path=%s", path)
+	}
+	f := &localKeyRingFile{}
+	if err := json.Unmarshal(b, f); err != nil {
+		return nil, errors.Wrapf(err, "failed parse keyring. path=%s", path)
+	}
+	if f.Format != 1 || f.KDF != "scrypt" {
+		return nil, fmt.Errorf("unsupported keyring format. format=%d, kdf=%s", f.Format, f.KDF)
+	}
+	aead, err := keyRingAEAD(passphrase, f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		return nil, err
+	}
+	pt, err := aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("failed decrypt keyring. passphrase may be wrong")
+	}
+	kr := NewLocalKeyRing()
+	if err := json.Unmarshal(pt, kr); err != nil {
+		return nil, errors.Wrap(err, "failed parse keys")
+	}
+	return kr, nil
+}
+
+// Save is passphraseでEncryptしてpathに保存する. Saltは保存の度に作り直す
+func (kr *LocalKeyRing) Save(path string, passphrase string) error {
+	if passphrase == "" {
+		return errors.New("passphrase is empty")
+	}
+	pt, err := json.Marshal(kr)
+	if err != nil {
+		return errors.Wrap(err, "failed marshal keys")
+	}
+	f := &localKeyRingFile{
+		Format: 1,
+		KDF:    "scrypt",
+		Salt:   make([]byte, 32),
+		N:      keyRingScryptN,
+		R:      keyRingScryptR,
+		P:      keyRingScryptP,
+	}
+	if _, err := rand.Read(f.Salt); err != nil {
+		return errors.Wrap(err, "failed generate salt")
+	}
+	aead, err := keyRingAEAD(passphrase, f.Salt, f.N, f.R, f.P)
+	if err != nil {
+		return err
+	}
+	f.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(f.Nonce); err != nil {
+		return errors.Wrap(err, "failed generate nonce")
+	}
+	f.Ciphertext = aead.Seal(nil, f.Nonce, pt, nil)
+
+	b, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed marshal keyring")
+	}
+	// 途中で失敗しても元のFileが壊れないよう、別のFileに書いてから置き換える
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return errors.Wrapf(err, "failed write keyring. path=%s", tmp)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return errors.Wrapf(err, "failed rename keyring. path=%s", path)
+	}
+	return nil
+}
+
+func keyRingAEAD(passphrase string, salt []byte, n, r, p int) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, n, r, p, 32)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed derive key from passphrase")
+	}
+	return newAESGCM(key)
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// IDs is KeyのIDを昇順で返す
+func (kr *LocalKeyRing) IDs() []string {
+	ids := make([]string, 0, len(kr.Keys))
+	for id := range kr.Keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// CreateKey is Version 1だけを持つKeyを作成する
+func (kr *LocalKeyRing) CreateKey(id string) error {
+	if _, ok := kr.Keys[id]; ok {
+		return fmt.Errorf("key %s already exists", id)
+	}
+	kr.Keys[id] = &LocalKey{}
+	_, err := kr.Rotate(id)
+	return err
+}
+
+// Rotate is Keyに新しいVersionを追加してPrimaryにする. 古いVersionはDecryptに使える
+func (kr *LocalKeyRing) Rotate(id string) (int, error) {
+	k, ok := kr.Keys[id]
+	if !ok {
+		return 0, fmt.Errorf("key %s is not found", id)
+	}
+	v := &LocalKeyVersion{
+		Version:   len(k.Versions) + 1,
+		Key:       make([]byte, 32),
+		CreatedAt: time.Now(),
+	}
+	if _, err := rand.Read(v.Key); err != nil {
+		return 0, errors.Wrap(err, "failed generate key")
+	}
+	k.Versions = append(k.Versions, v)
+	k.Primary = v.Version
+	return v.Version, nil
+}
+
+// SetVersionDisabled is Versionを無効化、または有効に戻す. Primary Versionは無効化できない
+func (kr *LocalKeyRing) SetVersionDisabled(id string, version int, disabled bool) error {
+	k, ok := kr.Keys[id]
+	if !ok {
+		return fmt.Errorf("key %s is not found", id)
+	}
+	if disabled && version == k.Primary {
+		return fmt.Errorf("primary version %d of %s cannot be disabled. rotate first", version, id)
+	}
+	v := k.version(version)
+	if v == nil {
+		return fmt.Errorf("version %d of %s is not found", version, id)
+	}
+	v.Disabled = disabled
+	return nil
+}
+
+func (k *LocalKey) version(version int) *LocalKeyVersion {
+	for _, v := range k.Versions {
+		if v.Version == version {
+			return v
+		}
+	}
+	return nil
+}
+
+// LocalKeyID is CryptKeyに対応するLocalKeyRingのKeyのID
+func LocalKeyID(cryptKey CryptKey) string {
+	return cryptKey.KeyRingID + "/" + cryptKey.KeyName
+}
+
+// Encrypt is KeyProviderを実装. CiphertextにはKeyのIDとVersionを含める
+// format(1) | len(id)(2) | id | version(4) | nonce | AES-256-GCM(plaintext, aad=id)
+func (kr *LocalKeyRing) Encrypt(ctx context.Context, cryptKey CryptKey, plaintext string) (string, string, error) {
+	id := LocalKeyID(cryptKey)
+	k, ok := kr.Keys[id]
+	if !ok {
+		return "", "", fmt.Errorf("local key %s is not found", id)
+	}
+	v := k.version(k.Primary)
+	aead, err := newAESGCM(v.Key)
+	if err != nil {
+		return "", "", err
+	}
+
+	buf := &bytes.Buffer{}
+	buf.WriteByte(localCiphertextFormat)
+	binary.Write(buf, binary.BigEndian, uint16(len(id)))
+	buf.WriteString(id)
+	binary.Write(buf, binary.BigEndian, uint32(v.Version))
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", errors.Wrap(err, "failed generate nonce")
+	}
+	buf.Write(nonce)
+	buf.Write(aead.Seal(nil, nonce, []byte(plaintext), []byte(id)))
+
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), fmt.Sprintf("%s/cryptoKeyVersions/%d", id, v.Version), nil
+}
+
+// Decrypt is KeyProviderを実装. Ciphertextに記録したKeyとVersionでDecryptするので、cryptKeyは使わない
+func (kr *LocalKeyRing) Decrypt(ctx context.Context, cryptKey CryptKey, ciphertext string) (string, error) {
+	b, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", errors.Wrap(err, "decrypt: failed base64 decode")
+	}
+	if len(b) < 3 || b[0] != localCiphertextFormat {
+		return "", errors.New("decrypt: unsupported local ciphertext")
+	}
+	n := int(binary.BigEndian.Uint16(b[1:3]))
+	if len(b) < 3+n+4 {
+		return "", errors.New("decrypt: local ciphertext is too short")
+	}
+	id := string(b[3 : 3+n])
+	version := int(binary.BigEndian.Uint32(b[3+n:]))
+	b = b[3+n+4:]
+
+	k, ok := kr.Keys[id]
+	if !ok {
+		return "", fmt.Errorf("decrypt: local key %s is not found", id)
+	}
+	v := k.version(version)
+	if v == nil {
+		return "", fmt.Errorf("decrypt: version %d of %s is not found", version, id)
+	}
+	if v.Disabled {
+		return "", fmt.Errorf("decrypt: version %d of %s is disabled", version, id)
+	}
+	aead, err := newAESGCM(v.Key)
+	if err != nil {
+		return "", err
+	}
+	if len(b) < aead.NonceSize() {
+		return "", errors.New("decrypt: local ciphertext is too short")
+	}
+	pt, err := aead.Open(nil, b[:aead.NonceSize()], b[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", errors.Wrapf(err, "decrypt: failed to decrypt. key=%s, version=%d", id, version)
+	}
+	return string(pt), nil
+}
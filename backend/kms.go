@@ -4,23 +4,32 @@ import (
 	"context"
 	"encoding/base64"
 	"fmt"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/pkg/errors"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 	cloudkms "google.golang.org/api/cloudkms/v1"
 )
 
 // KMSService is KMS Serviceを提供するstruct
+// KMSの呼び出しはRetryPolicyに従ってRetryし、CryptKey毎のCircuitBreakerがOpenの間は呼び出さずに失敗する
 type KMSService struct {
-	S *cloudkms.Service
+	S           *cloudkms.Service
+	RetryPolicy RetryPolicy
 }
 
 // NewKMSService is KMS Serviceを作成
 func NewKMSService(ctx context.Context) (*KMSService, error) {
-	client, err := google.DefaultClient(ctx, cloudkms.CloudPlatformScope)
+	ts, err := google.DefaultTokenSource(ctx, cloudkms.CloudPlatformScope)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed create google.DefaultClient: ")
+		return nil, errors.Wrap(err, "failed create google.DefaultTokenSource: ")
 	}
+	// Token取得とKMS呼び出しを別のSpanとして記録し、KMSへのRequestにtraceparentを付ける
+	client := oauth2.NewClient(ctx, &traceTokenSource{ctx: ctx, ts: ts})
+	client.Transport = &traceTransport{Base: client.Transport}
 
 	// Create the KMS client.
 	kmsService, err := cloudkms.New(client)
@@ -29,28 +38,100 @@ func NewKMSService(ctx context.Context) (*KMSService, error) {
 	}
 
 	return &KMSService{
-		S: kmsService,
+		S:           kmsService,
+		RetryPolicy: DefaultRetryPolicy,
+	}, nil
+}
+
+// NewKMSServiceWithClient is 指定したhttp.ClientとEndpointでKMS Serviceを作成. Emulatorや試験用のServerに向ける時に利用する
+func NewKMSServiceWithClient(client *http.Client, basePath string) (*KMSService, error) {
+	kmsService, err := cloudkms.New(client)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed cloudkms.New: ")
+	}
+	if basePath != "" {
+		kmsService.BasePath = basePath
+	}
+
+	return &KMSService{
+		S:           kmsService,
+		RetryPolicy: DefaultRetryPolicy,
 	}, nil
 }
 
 // CryptKey is Cloud KMSのCryptKey Resourceの情報を保持
+// ProviderはEncryptに利用するKeyProviderで、LocalKeyRingの場合はKeyRingIDとKeyNameだけを使う
+// Vault TransitではKeyRingIDをSecrets EngineのMount Path、KeyNameをTransit Keyの名前とする
+// AWS KMSではLocationIDをRegion、KeyNameをKey ID, Alias (alias/xxx) またはARNとする
 type CryptKey struct {
-	ProjectID  string
-	LocationID string
-	KeyRingID  string
-	KeyName    string
+	Provider   string `json:"provider,omitempty"`
+	ProjectID  string `json:"projectId"`
+	LocationID string `json:"locationId"`
+	KeyRingID  string `json:"keyRingId"`
+	KeyName    string `json:"keyName"`
 }
 
 // Name is API実行時のCryptKey Resource文字列を返す
+// Cloud KMS以外のProviderでは、MetricsとCircuit Breakerで区別するための名前を返す
 func (cryptKey *CryptKey) Name() string {
+	switch cryptKey.Provider {
+	case KeyProviderVault:
+		return fmt.Sprintf("vault:%s/keys/%s", vaultMount(*cryptKey), cryptKey.KeyName)
+	case KeyProviderAWSKMS:
+		if strings.HasPrefix(cryptKey.KeyName, "arn:") {
+			return cryptKey.KeyName
+		}
+		return fmt.Sprintf("awskms:%s/%s", cryptKey.LocationID, cryptKey.KeyName)
+	}
 	return fmt.Sprintf("projects/%s/locations/%s/keyRings/%s/cryptoKeys/%s", cryptKey.ProjectID, cryptKey.LocationID, cryptKey.KeyRingID, cryptKey.KeyName)
 }
 
+// ParseCryptKey is [{provider}:]projects/{projectId}/locations/{locationId}/keyRings/{keyRingId}/cryptoKeys/{keyName} の形の文字列をCryptKeyにする
+// 設定FileやFlagでCryptKeyを指定するための形式で、Cloud KMS以外のProviderも同じ形で指定する. 空の項目はDefaultの値を使う
+func ParseCryptKey(s string) (CryptKey, error) {
+	ck := CryptKey{}
+	if !strings.HasPrefix(s, "projects/") {
+		i := strings.Index(s, ":")
+		if i < 0 {
+			return ck, fmt.Errorf("invalid crypt key %q", s)
+		}
+		ck.Provider, s = s[:i], s[i+1:]
+	}
+	// KeyNameはAWS KMSのAliasやARNのように / を含むことがある
+	parts := strings.SplitN(s, "/", 8)
+	if len(parts) != 8 || parts[0] != "projects" || parts[2] != "locations" || parts[4] != "keyRings" || parts[6] != "cryptoKeys" || parts[7] == "" {
+		return ck, fmt.Errorf("invalid crypt key %q", s)
+	}
+	ck.ProjectID, ck.LocationID, ck.KeyRingID, ck.KeyName = parts[1], parts[3], parts[5], parts[7]
+	return ck, nil
+}
+
+// ParseCryptKeys is カンマ区切りのCryptKeyをParseCryptKeyで読み込む
+func ParseCryptKeys(s string) ([]CryptKey, error) {
+	var list []CryptKey
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		ck, err := ParseCryptKey(v)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, ck)
+	}
+	return list, nil
+}
+
 // Encrypt is Cloud KMSでEncryptを行う
-func (service *KMSService) Encrypt(cryptKey CryptKey, plaintext string) (ciphertext string, cryptoKey string, err error) {
-	response, err := service.S.Projects.Locations.KeyRings.CryptoKeys.Encrypt(cryptKey.Name(), &cloudkms.EncryptRequest{
-		Plaintext: base64.StdEncoding.EncodeToString([]byte(plaintext)),
-	}).Do()
+func (service *KMSService) Encrypt(ctx context.Context, cryptKey CryptKey, plaintext string) (ciphertext string, cryptoKey string, err error) {
+	var response *cloudkms.EncryptResponse
+	err = service.call(ctx, cryptKey, "Encrypt", func(ctx context.Context) error {
+		var err error
+		response, err = service.S.Projects.Locations.KeyRings.CryptoKeys.Encrypt(cryptKey.Name(), &cloudkms.EncryptRequest{
+			Plaintext: base64.StdEncoding.EncodeToString([]byte(plaintext)),
+		}).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
 		return "", "", errors.Wrapf(err, "encrypt: failed to encrypt. CryptoKey=%s", cryptKey.Name())
 	}
@@ -59,10 +140,15 @@ func (service *KMSService) Encrypt(cryptKey CryptKey, plaintext string) (ciphert
 }
 
 // Decrypt is Cloud KMSでEncryptされた文字列をDecryptする
-func (service *KMSService) Decrypt(cryptKey CryptKey, ciphertext string) (plaintext string, err error) {
-	response, err := service.S.Projects.Locations.KeyRings.CryptoKeys.Decrypt(cryptKey.Name(), &cloudkms.DecryptRequest{
-		Ciphertext: ciphertext,
-	}).Do()
+func (service *KMSService) Decrypt(ctx context.Context, cryptKey CryptKey, ciphertext string) (plaintext string, err error) {
+	var response *cloudkms.DecryptResponse
+	err = service.call(ctx, cryptKey, "Decrypt", func(ctx context.Context) error {
+		var err error
+		response, err = service.S.Projects.Locations.KeyRings.CryptoKeys.Decrypt(cryptKey.Name(), &cloudkms.DecryptRequest{
+			Ciphertext: ciphertext,
+		}).Context(ctx).Do()
+		return err
+	})
 	if err != nil {
 		return "", errors.Wrapf(err, "decrypt: failed to decrypt. CryptoKey=%s", cryptKey.Name())
 	}
@@ -73,3 +159,26 @@ func (service *KMSService) Decrypt(cryptKey CryptKey, ciphertext string) (plaint
 	}
 	return string(t), nil
 }
+
+// call is CryptKeyのCircuitBreakerとRetryPolicyに従ってfを実行し、LatencyとErrorをMetricsとSpanに記録する
+func (service *KMSService) call(ctx context.Context, cryptKey CryptKey, op string, f func(ctx context.Context) error) error {
+	return callKeyProvider(ctx, service.RetryPolicy, cryptKey, op, f)
+}
+
+// callKeyProvider is KeyProviderのAPI呼び出しをCryptKeyのCircuitBreakerとRetryPolicyに従って実行する
+// Cloud KMS以外のProviderも同じMetricsとSpanに記録する
+func callKeyProvider(ctx context.Context, policy RetryPolicy, cryptKey CryptKey, op string, f func(ctx context.Context) error) (err error) {
+	ctx, span := StartSpan(ctx, "kms."+op, SpanKindClient)
+	span.SetAttribute(AttrCryptKey, cryptKey.Name())
+	defer func(start time.Time) {
+		observeKMS(cryptKey, op, start, err)
+		span.SetError(err)
+		span.End()
+	}(time.Now())
+
+	return callWithRetry(ctx, policy, kmsBreaker(cryptKey), func(err error) {
+		log.Warningf(ctx, "kms circuit breaker opened. CryptoKey=%s, err=%v", cryptKey.Name(), err)
+	}, func() error {
+		return f(ctx)
+	})
+}
@@ -0,0 +1,285 @@
+package backend
+
+import (
+	"context"
+	"math/rand"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// ErrCircuitOpen is Circuit BreakerがOpenのため、KMSを呼ばずに失敗した時のError
+var ErrCircuitOpen = errors.New("kms: circuit breaker is open")
+
+// RetryPolicy is KMS呼び出しのRetryの設定
+type RetryPolicy struct {
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+}
+
+// DefaultRetryPolicy is KMSServiceがDefaultで利用するRetryPolicy
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: 100 * time.Millisecond,
+	MaxBackoff:     2 * time.Second,
+	Multiplier:     2,
+}
+
+// Backoff is attempt回目(1始まり)の失敗後に待つ時間を返す. Full Jitterで0から上限までの間でランダムにする
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	d := float64(p.InitialBackoff)
+	for i := 1; i < attempt; i++ {
+		d *= p.Multiplier
+		if d > float64(p.MaxBackoff) {
+			d = float64(p.MaxBackoff)
+			break
+		}
+	}
+	return time.Duration(rand.Int63n(int64(d) + 1))
+}
+
+// IsRetriableKMSError is RetryすればKMS呼び出しが成功する可能性のあるErrorかを返す
+func IsRetriableKMSError(err error) bool {
+	cause := errors.Cause(err)
+	if gerr, ok := cause.(*googleapi.Error); ok {
+		switch gerr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if perr, ok := cause.(*KeyProviderError); ok {
+		switch perr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	if nerr, ok := cause.(net.Error); ok {
+		return nerr.Timeout() || nerr.Temporary()
+	}
+	return false
+}
+
+// CircuitState is Circuit Breakerの状態
+type CircuitState int
+
+// CircuitState List
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+// String is CircuitStateの名前を返す
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half_open"
+	}
+	return "unknown"
+}
+
+// CircuitBreaker is KMSが落ちている時にRequestを待たせずに失敗させるためのCircuit Breaker
+// Retryし尽くした呼び出しがFailureThreshold回連続するとOpenになり、OpenDuration経過後に1 RequestだけHalfOpenで試す
+type CircuitBreaker struct {
+	FailureThreshold int
+	OpenDuration     time.Duration
+
+	mu       sync.Mutex
+	state    CircuitState
+	failures int
+	openedAt time.Time
+	probing  bool
+
+	// metrics
+	retries  int64
+	rejected int64
+	opened   int64
+}
+
+// NewCircuitBreaker is CircuitBreakerを作成
+func NewCircuitBreaker(failureThreshold int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{
+		FailureThreshold: failureThreshold,
+		OpenDuration:     openDuration,
+	}
+}
+
+// Allow is Requestを実行してよいかを返す. Openの場合はErrCircuitOpenを返す
+func (cb *CircuitBreaker) Allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.OpenDuration {
+			cb.rejected++
+			return ErrCircuitOpen
+		}
+		cb.state = CircuitHalfOpen
+		cb.probing = true
+		return nil
+	case CircuitHalfOpen:
+		if cb.probing {
+			cb.rejected++
+			return ErrCircuitOpen
+		}
+		cb.probing = true
+	}
+	return nil
+}
+
+// Success is Requestの成功を記録する
+func (cb *CircuitBreaker) Success() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.state = CircuitClosed
+	cb.failures = 0
+	cb.probing = false
+}
+
+// Failure is Requestの失敗を記録する. Stateが変わった場合はtrueを返す
+func (cb *CircuitBreaker) Failure() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+	cb.failures++
+	if cb.state == CircuitHalfOpen || (cb.state == CircuitClosed && cb.failures >= cb.FailureThreshold) {
+		cb.state = CircuitOpen
+		cb.openedAt = time.Now()
+		cb.opened++
+		return true
+	}
+	return false
+}
+
+// Release is 成功も失敗も記録せずにRequestを終える. HalfOpenで試していた場合は、次のRequestで試し直す
+func (cb *CircuitBreaker) Release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.probing = false
+}
+
+// Retried is Retryした回数を記録する
+func (cb *CircuitBreaker) Retried() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.retries++
+}
+
+// State is 現在のStateを返す
+func (cb *CircuitBreaker) State() CircuitState {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	return cb.state
+}
+
+// KMSBreakerStat is CryptKey毎のCircuit BreakerとRetryの統計
+type KMSBreakerStat struct {
+	CryptKey string `json:"cryptKey"`
+	State    string `json:"state"`
+	Retries  int64  `json:"retries"`
+	Rejected int64  `json:"rejected"`
+	Opened   int64  `json:"opened"`
+}
+
+// kmsBreakers is CryptKey毎のCircuitBreaker. Instance内の全てのRequestで共有する
+var kmsBreakers = struct {
+	sync.Mutex
+	m map[string]*CircuitBreaker
+}{m: map[string]*CircuitBreaker{}}
+
+// kmsBreaker is CryptKeyのCircuitBreakerを返す
+func kmsBreaker(cryptKey CryptKey) *CircuitBreaker {
+	kmsBreakers.Lock()
+	defer kmsBreakers.Unlock()
+
+	name := cryptKey.Name()
+	cb, ok := kmsBreakers.m[name]
+	if !ok {
+		cb = NewCircuitBreaker(5, 30*time.Second)
+		kmsBreakers.m[name] = cb
+	}
+	return cb
+}
+
+// KMSBreakerStats is 全てのCryptKeyのCircuit BreakerとRetryの統計を返す
+func KMSBreakerStats() []*KMSBreakerStat {
+	kmsBreakers.Lock()
+	defer kmsBreakers.Unlock()
+
+	list := make([]*KMSBreakerStat, 0, len(kmsBreakers.m))
+	for name, cb := range kmsBreakers.m {
+		cb.mu.Lock()
+		list = append(list, &KMSBreakerStat{
+			CryptKey: name,
+			State:    cb.state.String(),
+			Retries:  cb.retries,
+			Rejected: cb.rejected,
+			Opened:   cb.opened,
+		})
+		cb.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].CryptKey < list[j].CryptKey })
+	return list
+}
+
+// callWithRetry is RetryPolicyとCircuitBreakerに従ってfを実行する
+// Breakerには1回の呼び出しにつき1回だけ結果を記録する. Retryし尽くした場合を失敗とし、途中の失敗は数えない
+// ContextのDeadlineまでにBackoffが終わらない場合は、Retryせずに最後のErrorを返す
+func callWithRetry(ctx context.Context, policy RetryPolicy, cb *CircuitBreaker, onStateChange func(err error), f func() error) error {
+	if err := cb.Allow(); err != nil {
+		return err
+	}
+	err := retry(ctx, policy, cb, f)
+	switch {
+	case err == nil:
+		cb.Success()
+	case IsRetriableKMSError(err):
+		if cb.Failure() && onStateChange != nil {
+			onStateChange(err)
+		}
+	default:
+		// Clientの問題でKMSが動いているかは分からないので、Breakerの状態は変えない
+		cb.Release()
+	}
+	return err
+}
+
+// retry is fをRetryPolicyに従って、成功するかRetryできないErrorになるまで実行する
+func retry(ctx context.Context, policy RetryPolicy, cb *CircuitBreaker, f func() error) error {
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !IsRetriableKMSError(err) || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		backoff := policy.Backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		cb.Retried()
+	}
+}
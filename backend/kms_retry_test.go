@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"google.golang.org/api/googleapi"
+)
+
+// fakeKMS is 指定したStatus Codeを順に返し、その後は成功するCloud KMSのEncrypt APIのFake
+type fakeKMS struct {
+	mu       sync.Mutex
+	faults   []int
+	requests int
+}
+
+func (f *fakeKMS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests++
+	var code int
+	if len(f.faults) > 0 {
+		code, f.faults = f.faults[0], f.faults[1:]
+	}
+	f.mu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if code != 0 {
+		w.WriteHeader(code)
+		fmt.Fprintf(w, `{"error":{"code":%d,"message":"%s"}}`, code, http.StatusText(code))
+		return
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/v1/"), ":encrypt")
+	json.NewEncoder(w).Encode(map[string]string{"name": name + "/cryptoKeyVersions/1", "ciphertext": "Y2lwaGVydGV4dA=="})
+}
+
+func (f *fakeKMS) fail(codes ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.faults = append(f.faults, codes...)
+}
+
+func (f *fakeKMS) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests
+}
+
+// newFakeKMSService is fakeKMSに向けたKMSServiceを作る. CryptKeyはTest毎に別のCircuitBreakerになるようにする
+func newFakeKMSService(t *testing.T) (*fakeKMS, *KMSService, CryptKey, func()) {
+	f := &fakeKMS{}
+	srv := httptest.NewServer(f)
+	service, err := NewKMSServiceWithClient(srv.Client(), srv.URL+"/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.RetryPolicy = RetryPolicy{
+		MaxAttempts:    4,
+		InitialBackoff: time.Millisecond,
+		MaxBackoff:     time.Millisecond,
+		Multiplier:     2,
+	}
+	ck := CryptKey{ProjectID: "test-project", LocationID: "global", KeyRingID: "test", KeyName: t.Name()}
+	return f, service, ck, srv.Close
+}
+
+func TestKMSRetryTransientErrors(t *testing.T) {
+	f, service, ck, done := newFakeKMSService(t)
+	defer done()
+
+	f.fail(http.StatusServiceUnavailable, http.StatusTooManyRequests)
+	if _, _, err := service.Encrypt(context.Background(), ck, "hello"); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if g, e := f.count(), 3; g != e {
+		t.Errorf("requests: got %d, want %d", g, e)
+	}
+	cb := kmsBreaker(ck)
+	if g, e := cb.State(), CircuitClosed; g != e {
+		t.Errorf("state: got %s, want %s", g, e)
+	}
+	if g, e := cb.retries, int64(2); g != e {
+		t.Errorf("retries: got %d, want %d", g, e)
+	}
+}
+
+func TestKMSRetryNonRetriableError(t *testing.T) {
+	f, service, ck, done := newFakeKMSService(t)
+	defer done()
+
+	f.fail(http.StatusForbidden)
+	_, _, err := service.Encrypt(context.Background(), ck, "hello")
+	gerr, ok := errors.Cause(err).(*googleapi.Error)
+	if !ok || gerr.Code != http.StatusForbidden {
+		t.Fatalf("err: got %v, want 403", err)
+	}
+	if g, e := f.count(), 1; g != e {
+		t.Errorf("requests: got %d, want %d", g, e)
+	}
+}
+
+func TestKMSRetryBreakerCountsExhaustedCalls(t *testing.T) {
+	f, service, ck, done := newFakeKMSService(t)
+	defer done()
+
+	cb := kmsBreaker(ck)
+	ctx := context.Background()
+	for i := 1; i <= cb.FailureThreshold; i++ {
+		f.fail(http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+		if _, _, err := service.Encrypt(ctx, ck, "hello"); err == nil {
+			t.Fatalf("call %d: want error", i)
+		}
+		want := CircuitClosed
+		if i == cb.FailureThreshold {
+			want = CircuitOpen
+		}
+		if g := cb.State(); g != want {
+			t.Fatalf("call %d: state got %s, want %s", i, g, want)
+		}
+	}
+	if g, e := f.count(), cb.FailureThreshold*service.RetryPolicy.MaxAttempts; g != e {
+		t.Errorf("requests: got %d, want %d", g, e)
+	}
+
+	_, _, err := service.Encrypt(ctx, ck, "hello")
+	if errors.Cause(err) != ErrCircuitOpen {
+		t.Fatalf("err: got %v, want %v", err, ErrCircuitOpen)
+	}
+	if g, e := f.count(), cb.FailureThreshold*service.RetryPolicy.MaxAttempts; g != e {
+		t.Errorf("requests while open: got %d, want %d", g, e)
+	}
+}
+
+func TestKMSRetryNonRetriableErrorKeepsBreakerState(t *testing.T) {
+	f, service, ck, done := newFakeKMSService(t)
+	defer done()
+
+	cb := kmsBreaker(ck)
+	cb.OpenDuration = 10 * time.Millisecond
+	ctx := context.Background()
+	for i := 0; i < cb.FailureThreshold; i++ {
+		cb.Failure()
+	}
+	if g, e := cb.State(), CircuitOpen; g != e {
+		t.Fatalf("state: got %s, want %s", g, e)
+	}
+
+	// Open中の403はKMSを呼ばずにErrCircuitOpenになり、Breakerは閉じない
+	f.fail(http.StatusForbidden)
+	if _, _, err := service.Encrypt(ctx, ck, "hello"); errors.Cause(err) != ErrCircuitOpen {
+		t.Fatalf("err: got %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// HalfOpenで試したRequestが403でもClosedにはならず、次のRequestで試し直す
+	time.Sleep(cb.OpenDuration)
+	_, _, err := service.Encrypt(ctx, ck, "hello")
+	if gerr, ok := errors.Cause(err).(*googleapi.Error); !ok || gerr.Code != http.StatusForbidden {
+		t.Fatalf("err: got %v, want 403", err)
+	}
+	if g, e := cb.State(), CircuitHalfOpen; g != e {
+		t.Fatalf("state after 403: got %s, want %s", g, e)
+	}
+	if _, _, err := service.Encrypt(ctx, ck, "hello"); err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if g, e := cb.State(), CircuitClosed; g != e {
+		t.Errorf("state after success: got %s, want %s", g, e)
+	}
+}
@@ -0,0 +1,127 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	aelog "google.golang.org/appengine/log"
+)
+
+// Logger is Logの出力先. appengine/logと同じMethodを持つ
+type Logger interface {
+	Debugf(ctx context.Context, format string, args ...interface{})
+	Infof(ctx context.Context, format string, args ...interface{})
+	Warningf(ctx context.Context, format string, args ...interface{})
+	Errorf(ctx context.Context, format string, args ...interface{})
+	Criticalf(ctx context.Context, format string, args ...interface{})
+}
+
+// log is Platform.Loggerに出力する. appengine/logと同じように log.Infof(ctx, ...) と書ける
+var log Logger = &platformLogger{}
+
+type platformLogger struct{}
+
+func (l *platformLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	platform.Logger.Debugf(ctx, format, args...)
+}
+
+func (l *platformLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	platform.Logger.Infof(ctx, format, args...)
+}
+
+func (l *platformLogger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	platform.Logger.Warningf(ctx, format, args...)
+}
+
+func (l *platformLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	platform.Logger.Errorf(ctx, format, args...)
+}
+
+func (l *platformLogger) Criticalf(ctx context.Context, format string, args ...interface{}) {
+	platform.Logger.Criticalf(ctx, format, args...)
+}
+
+// AppEngineLogger is App EngineのRequest Logに出力するLogger
+type AppEngineLogger struct{}
+
+// Debugf is Loggerを実装
+func (l *AppEngineLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	aelog.Debugf(ctx, format, args...)
+}
+
+// Infof is Loggerを実装
+func (l *AppEngineLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	aelog.Infof(ctx, format, args...)
+}
+
+// Warningf is Loggerを実装
+func (l *AppEngineLogger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	aelog.Warningf(ctx, format, args...)
+}
+
+// Errorf is Loggerを実装
+func (l *AppEngineLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	aelog.Errorf(ctx, format, args...)
+}
+
+// Criticalf is Loggerを実装
+func (l *AppEngineLogger) Criticalf(ctx context.Context, format string, args ...interface{}) {
+	aelog.Criticalf(ctx, format, args...)
+}
+
+// StreamLogger is Writerに1行ずつ出力するLogger
+// JSONの場合はCloud Run, GKEのCloud Loggingが解釈できるseverityを含むJSONで出力する
+type StreamLogger struct {
+	W    io.Writer
+	JSON bool
+
+	mu sync.Mutex
+}
+
+// Debugf is Loggerを実装
+func (l *StreamLogger) Debugf(ctx context.Context, format string, args ...interface{}) {
+	l.output("DEBUG", format, args...)
+}
+
+// Infof is Loggerを実装
+func (l *StreamLogger) Infof(ctx context.Context, format string, args ...interface{}) {
+	l.output("INFO", format, args...)
+}
+
+// Warningf is Loggerを実装
+func (l *StreamLogger) Warningf(ctx context.Context, format string, args ...interface{}) {
+	l.output("WARNING", format, args...)
+}
+
+// Errorf is Loggerを実装
+func (l *StreamLogger) Errorf(ctx context.Context, format string, args ...interface{}) {
+	l.output("ERROR", format, args...)
+}
+
+// Criticalf is Loggerを実装
+func (l *StreamLogger) Criticalf(ctx context.Context, format string, args ...interface{}) {
+	l.output("CRITICAL", format, args...)
+}
+
+func (l *StreamLogger) output(severity string, format string, args ...interface{}) {
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+	var line []byte
+	if l.JSON {
+		line, _ = json.Marshal(struct {
+			Severity string    `json:"severity"`
+			Message  string    `json:"message"`
+			Time     time.Time `json:"time"`
+		}{severity, msg, now})
+	} else {
+		line = []byte(fmt.Sprintf("%s %s %s", now.Format(time.RFC3339Nano), severity, msg))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.W.Write(append(line, '\n'))
+}
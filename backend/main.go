@@ -1,7 +1,6 @@
 package backend
 
 import (
-	"context"
 	"fmt"
 	"net/http"
 	"reflect"
@@ -9,15 +8,25 @@ import (
 
 	"github.com/favclip/ucon"
 	"github.com/favclip/ucon/swagger"
-	"go.mercari.io/datastore"
-	"go.mercari.io/datastore/aedatastore"
-	"google.golang.org/appengine"
 )
 
 func init() {
-	ucon.Middleware(UseAppengineContext)
-	ucon.Orthodox()
-	ucon.Middleware(swagger.RequestValidator())
+	ucon.Middleware(UsePlatformContext)
+	ucon.Middleware(UseSecurityHeaders)
+	// NOTE UseCustomMethodはHandlerを差し替えるので、Handlerを参照するMiddlewareより前に置く
+	ucon.Middleware(UseCustomMethod)
+	ucon.Middleware(UseTracing)
+	ucon.Middleware(UseMetrics)
+	// NOTE UseTenantはContextを差し替えるので、ContextDIより前に置く
+	// また、Errorを返すことがあるのでResponseMapper, UseErrorTranslationより後に置く
+	ucon.Middleware(ucon.ResponseMapper())
+	ucon.Middleware(UseErrorTranslation)
+	ucon.Middleware(UseCSRFProtect)
+	ucon.Middleware(ucon.HTTPRWDI())
+	ucon.Middleware(UseTenant)
+	ucon.Middleware(ucon.ContextDI())
+	ucon.Middleware(ucon.RequestObjectMapper())
+	ucon.Middleware(ucon.RequestValidator(NewRequestValidator()))
 
 	swPlugin := swagger.NewPlugin(&swagger.Options{
 		Object: &swagger.Object{
@@ -37,31 +46,53 @@ func init() {
 	ucon.Plugin(swPlugin)
 
 	setupSecretAPI(swPlugin)
+	setupFolderAPI(swPlugin)
+	setupACLAPI(swPlugin)
+	setupTenantAPI(swPlugin)
+	setupMetricsAPI(swPlugin)
+	setupAccessAPI(swPlugin)
+	setupWebhookAPI(swPlugin)
+	setupChangeRequestAPI(swPlugin)
+	setupAuditAPI(swPlugin)
+	setupBreakGlassAPI(swPlugin)
+	setupQuorumAPI(swPlugin)
+	setupReencryptAPI(swPlugin)
+	setupKeyHealthAPI(swPlugin)
+	setupBackupAPI(swPlugin)
+	setupReplicationAPI(swPlugin)
 
 	ucon.DefaultMux.Prepare()
 	http.Handle("/api/", ucon.DefaultMux)
+	setupUI(http.DefaultServeMux)
 }
 
-// UseAppengineContext is UseAppengineContext
-func UseAppengineContext(b *ucon.Bubble) error {
-	if b.Context == nil {
-		b.Context = appengine.NewContext(b.R)
-	} else {
-		b.Context = appengine.WithContext(b.Context, b.R)
-	}
-
-	return b.Next()
-}
+// handleTenantAPI is /api/1 と /api/1/t/{tenant} の両方にHandlerを登録する
+func handleTenantAPI(method string, path string, handler interface{}, description string, tag *swagger.Tag) {
+	hInfo := swagger.NewHandlerInfo(handler)
+	ucon.Handle(method, "/api/1"+path, hInfo)
+	hInfo.Description, hInfo.Tags = description, []string{tag.Name}
 
-// FromContext is Create Datastore Client from Context
-func FromContext(ctx context.Context) (datastore.Client, error) {
-	return aedatastore.FromContext(ctx)
+	hInfo = swagger.NewHandlerInfo(handler)
+	ucon.Handle(method, "/api/1/t/{tenant}"+path, hInfo)
+	hInfo.Description, hInfo.Tags = description+" in tenant", []string{tag.Name}
+	// {tenant}はUseTenantで処理されRequest Structには含まれないため、明示的に定義する
+	hInfo.Parameters = []*swagger.Parameter{
+		{
+			Name:     "tenant",
+			In:       "path",
+			Required: true,
+			Type:     "string",
+		},
+	}
 }
 
 // HTTPError is API Resposeとして返すError
+// ReasonはClientが判定に利用するError Codeで、Retriableは同じRequestをRetryすれば成功する可能性があることを表す
 type HTTPError struct {
-	Code    int         `json:"code"`
-	Message interface{} `json:"message"`
+	Code      int         `json:"code"`
+	Reason    ErrorReason `json:"reason,omitempty"`
+	Message   interface{} `json:"message"`
+	Retriable bool        `json:"retriable,omitempty"`
 }
 
 // StatusCode is Http Response Status Codeを返す
@@ -76,5 +107,5 @@ func (he *HTTPError) ErrorMessage() interface{} {
 
 // Error is error interfaceを実装
 func (he *HTTPError) Error() string {
-	return fmt.Sprintf("status code %d: %s", he.StatusCode(), he.ErrorMessage())
+	return fmt.Sprintf("status code %d: %v", he.StatusCode(), he.Message)
 }
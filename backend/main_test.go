@@ -0,0 +1,96 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	pkgerrors "github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// testKeyRing is TestでKMSの代わりに利用するLocalKeyRing
+var testKeyRing = NewLocalKeyRing()
+
+// testCryptKey is testKeyRingにKeyを作成したCryptKey
+var testCryptKey = CryptKey{Provider: KeyProviderLocal, KeyRingID: "test", KeyName: "secret"}
+
+// testTenant is testCryptKeyを利用するTenant
+func testTenant() *Tenant {
+	return &Tenant{ID: "test", Namespace: "test", CryptKey: testCryptKey}
+}
+
+// TestMain is App Engineの外でTestを実行するため、Datastoreを使わないPlatformに差し替える
+func TestMain(m *testing.M) {
+	if err := testKeyRing.CreateKey(LocalKeyID(testCryptKey)); err != nil {
+		panic(err)
+	}
+	RegisterKeyProvider(KeyProviderLocal, func(ctx context.Context) (KeyProvider, error) {
+		return testKeyRing, nil
+	})
+
+	SetPlatform(&Platform{
+		NewContext: func(parent context.Context, r *http.Request) context.Context {
+			if parent == nil {
+				return r.Context()
+			}
+			return parent
+		},
+		Datastore: func(ctx context.Context) (datastore.Client, error) {
+			return nil, errors.New("datastore is not available in tests")
+		},
+		SecretStore: NewMemorySecretStore(),
+		Identity:    &StaticIdentity{Email: "test@example.com", Admin: true},
+		Logger:      &StreamLogger{W: ioutil.Discard},
+		HTTPClient: func(ctx context.Context) *http.Client {
+			return http.DefaultClient
+		},
+		ProjectID: func(ctx context.Context) string {
+			return "test-project"
+		},
+		KeyProvider: KeyProviderCloudKMS,
+	})
+	os.Exit(m.Run())
+}
+
+// useFakeDatastore is PlatformのDatastoreをdsに、SecretStoreをDatastoreSecretStoreに差し替え、元に戻す関数を返す
+// Default TenantのCryptKeyはtestCryptKeyにする
+func useFakeDatastore(ds *fakeDatastore) func() {
+	org := platform
+	p := *org
+	p.Datastore = func(ctx context.Context) (datastore.Client, error) {
+		return ds, nil
+	}
+	p.SecretStore = &DatastoreSecretStore{}
+	p.KeyProvider = testCryptKey.Provider
+	p.CryptKey = testCryptKey
+	SetPlatform(&p)
+	return func() {
+		SetPlatform(org)
+	}
+}
+
+// testUserContext is tenantに対してemailのuserがRequestした時のContextを返す
+func testUserContext(t *testing.T, tenant *Tenant, email string) context.Context {
+	t.Helper()
+	ctx, err := WithTenant(context.Background(), tenant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return withCurrentUser(ctx, &user.User{Email: email})
+}
+
+// httpStatus is errがHTTPErrorの場合はそのStatus Codeを返す. それ以外のErrorは0, nilは200を返す
+func httpStatus(err error) int {
+	if err == nil {
+		return http.StatusOK
+	}
+	if he, ok := pkgerrors.Cause(err).(*HTTPError); ok {
+		return he.Code
+	}
+	return 0
+}
@@ -0,0 +1,300 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultLatencyBuckets is Latency Histogramで利用するBucket(秒)
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// MetricsCollector is Prometheus Text Formatで出力するMetrics
+type MetricsCollector interface {
+	WriteMetrics(w io.Writer) error
+}
+
+// MetricsRegistry is MetricsCollectorの一覧
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	collectors []MetricsCollector
+}
+
+// DefaultMetrics is gcpsmのMetricsを登録するRegistry. Instance毎の値となる
+var DefaultMetrics = &MetricsRegistry{}
+
+// Register is MetricsCollectorを登録する
+func (r *MetricsRegistry) Register(c MetricsCollector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// WriteMetrics is 登録されている全てのMetricsをPrometheus Text Formatで書き出す
+func (r *MetricsRegistry) WriteMetrics(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]MetricsCollector{}, r.collectors...)
+	r.mu.Unlock()
+
+	for _, c := range collectors {
+		if err := c.WriteMetrics(w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelKey is Label Valueの組み合わせを1つの文字列にする
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// formatLabels is Label NameとValueを {a="b",c="d"} の形にする
+func formatLabels(names []string, values []string, extra ...string) string {
+	var pairs []string
+	for i, n := range names {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", n, strconv.Quote(values[i])))
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", extra[i], strconv.Quote(extra[i+1])))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// CounterVec is Labelを持つCounter
+type CounterVec struct {
+	Name   string
+	Help   string
+	Labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+	labels map[string][]string
+}
+
+// NewCounterVec is CounterVecを作成し、DefaultMetricsに登録する
+func NewCounterVec(name string, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		Name:   name,
+		Help:   help,
+		Labels: labels,
+		values: map[string]float64{},
+		labels: map[string][]string{},
+	}
+	DefaultMetrics.Register(c)
+	return c
+}
+
+// Inc is Counterを1増やす
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add is Counterをv増やす
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	k := labelKey(labelValues)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.labels[k]; !ok {
+		c.labels[k] = append([]string{}, labelValues...)
+	}
+	c.values[k] += v
+}
+
+// WriteMetrics is MetricsCollectorを実装
+func (c *CounterVec) WriteMetrics(w io.Writer) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.Name, c.Help, c.Name); err != nil {
+		return err
+	}
+	for _, k := range sortedKeys(c.labels) {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", c.Name, formatLabels(c.Labels, c.labels[k]), formatFloat(c.values[k])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HistogramVec is Labelを持つHistogram
+type HistogramVec struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Buckets []float64
+
+	mu     sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogramVec is HistogramVecを作成し、DefaultMetricsに登録する
+func NewHistogramVec(name string, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		Buckets: buckets,
+		values:  map[string]*histogramValue{},
+	}
+	DefaultMetrics.Register(h)
+	return h
+}
+
+// Observe is 値を記録する
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	k := labelKey(labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hv, ok := h.values[k]
+	if !ok {
+		hv = &histogramValue{
+			labels: append([]string{}, labelValues...),
+			counts: make([]uint64, len(h.Buckets)),
+		}
+		h.values[k] = hv
+	}
+	for i, b := range h.Buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+	hv.count++
+	hv.sum += v
+}
+
+// WriteMetrics is MetricsCollectorを実装
+func (h *HistogramVec) WriteMetrics(w io.Writer) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.Name, h.Help, h.Name); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		hv := h.values[k]
+		for i, b := range h.Buckets {
+			if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, hv.labels, "le", formatFloat(b)), hv.counts[i]); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", h.Name, formatLabels(h.Labels, hv.labels, "le", "+Inf"), hv.count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum%s %s\n", h.Name, formatLabels(h.Labels, hv.labels), formatFloat(hv.sum)); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_count%s %d\n", h.Name, formatLabels(h.Labels, hv.labels), hv.count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GaugeFunc is 出力する時に値を集めるGauge
+type GaugeFunc struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Collect func() (labelValues [][]string, values []float64)
+}
+
+// NewGaugeFunc is GaugeFuncを作成し、DefaultMetricsに登録する
+func NewGaugeFunc(name string, help string, collect func() ([][]string, []float64), labels ...string) *GaugeFunc {
+	g := &GaugeFunc{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		Collect: collect,
+	}
+	DefaultMetrics.Register(g)
+	return g
+}
+
+// WriteMetrics is MetricsCollectorを実装
+func (g *GaugeFunc) WriteMetrics(w io.Writer) error {
+	return writeCollected(w, "gauge", g.Name, g.Help, g.Labels, g.Collect)
+}
+
+// CounterFunc is 出力する時に値を集めるCounter
+// 単調増加する値を、別の場所で数えている場合に利用する
+type CounterFunc struct {
+	Name    string
+	Help    string
+	Labels  []string
+	Collect func() (labelValues [][]string, values []float64)
+}
+
+// NewCounterFunc is CounterFuncを作成し、DefaultMetricsに登録する
+func NewCounterFunc(name string, help string, collect func() ([][]string, []float64), labels ...string) *CounterFunc {
+	c := &CounterFunc{
+		Name:    name,
+		Help:    help,
+		Labels:  labels,
+		Collect: collect,
+	}
+	DefaultMetrics.Register(c)
+	return c
+}
+
+// WriteMetrics is MetricsCollectorを実装
+func (c *CounterFunc) WriteMetrics(w io.Writer) error {
+	return writeCollected(w, "counter", c.Name, c.Help, c.Labels, c.Collect)
+}
+
+// writeCollected is collectで集めた値をtypeのMetricsとして書き出す
+func writeCollected(w io.Writer, typ string, name string, help string, labels []string, collect func() ([][]string, []float64)) error {
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ); err != nil {
+		return err
+	}
+	labelValues, values := collect()
+	for i, lv := range labelValues {
+		if _, err := fmt.Fprintf(w, "%s%s %s\n", name, formatLabels(labels, lv), formatFloat(values[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func sortedKeys(m map[string][]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+)
+
+// Metrics List
+var (
+	httpRequestsTotal = NewCounterVec("gcpsm_http_requests_total",
+		"Number of HTTP requests handled by ucon handlers.", "handler", "method", "status")
+	httpRequestDuration = NewHistogramVec("gcpsm_http_request_duration_seconds",
+		"Latency of HTTP requests handled by ucon handlers.", DefaultLatencyBuckets, "handler", "method", "status")
+	kmsRequestDuration = NewHistogramVec("gcpsm_kms_request_duration_seconds",
+		"Latency of Cloud KMS calls including retries.", DefaultLatencyBuckets, "crypt_key", "op")
+	kmsErrorsTotal = NewCounterVec("gcpsm_kms_errors_total",
+		"Number of failed Cloud KMS calls.", "crypt_key", "op")
+	datastoreOpDuration = NewHistogramVec("gcpsm_datastore_op_duration_seconds",
+		"Latency of Datastore operations.", DefaultLatencyBuckets, "op")
+	cacheRequestsTotal = NewCounterVec("gcpsm_cache_requests_total",
+		"Number of cache lookups. Hit rate is hit / (hit + miss).", "cache", "result")
+	secretReadsTotal = NewCounterVec("gcpsm_secret_reads_total",
+		"Number of successful secret reads per tenant.", "tenant")
+)
+
+func init() {
+	NewGaugeFunc("gcpsm_kms_circuit_open",
+		"1 if the KMS circuit breaker of the CryptKey is not closed.",
+		func() ([][]string, []float64) {
+			return kmsBreakerValues(func(s *KMSBreakerStat) []string { return []string{s.CryptKey, s.State} },
+				func(s *KMSBreakerStat) float64 {
+					if s.State == CircuitClosed.String() {
+						return 0
+					}
+					return 1
+				})
+		}, "crypt_key", "state")
+	// Retries, RejectedはStateが変わっても数え続けるので、stateをlabelにするとSeriesが途切れる
+	NewCounterFunc("gcpsm_kms_retries_total",
+		"Number of KMS call retries since the instance started.",
+		func() ([][]string, []float64) {
+			return kmsBreakerValues(kmsBreakerCryptKey, func(s *KMSBreakerStat) float64 { return float64(s.Retries) })
+		}, "crypt_key")
+	NewCounterFunc("gcpsm_kms_rejected_total",
+		"Number of KMS calls rejected by the open circuit breaker since the instance started.",
+		func() ([][]string, []float64) {
+			return kmsBreakerValues(kmsBreakerCryptKey, func(s *KMSBreakerStat) float64 { return float64(s.Rejected) })
+		}, "crypt_key")
+}
+
+func kmsBreakerCryptKey(s *KMSBreakerStat) []string {
+	return []string{s.CryptKey}
+}
+
+func kmsBreakerValues(label func(s *KMSBreakerStat) []string, f func(s *KMSBreakerStat) float64) ([][]string, []float64) {
+	var labels [][]string
+	var values []float64
+	for _, s := range KMSBreakerStats() {
+		labels = append(labels, label(s))
+		values = append(values, f(s))
+	}
+	return labels, values
+}
+
+// statusRecorder is Handlerが書いたStatus Codeを記録するhttp.ResponseWriter
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// UseMetrics is Middleware, 全てのHandlerのRequest数とLatencyをHandler, Method, Status毎に記録する
+// Status CodeはResponseMapperが書き込むので、ResponseMapperより前に置くこと
+func UseMetrics(b *ucon.Bubble) error {
+	rec := &statusRecorder{ResponseWriter: b.W}
+	b.W = rec
+	handler := handlerName(b.RequestHandler)
+
+	start := time.Now()
+	err := b.Next()
+	status := rec.status
+	if err != nil {
+		// Errorはucon.ServeMuxが500で返す
+		status = http.StatusInternalServerError
+	} else if status == 0 {
+		status = http.StatusOK
+	}
+
+	s := strconv.Itoa(status)
+	httpRequestsTotal.Inc(handler, b.R.Method, s)
+	httpRequestDuration.Observe(time.Since(start).Seconds(), handler, b.R.Method, s)
+
+	return err
+}
+
+// handlerName is Metricsのlabelに利用するHandlerの名前を返す
+// github.com/sinmetal/gcpsm/backend.(*SecretAPI).Get-fm -> SecretAPI.Get
+func handlerName(hc ucon.HandlerContainer) string {
+	if hc == nil {
+		return "unknown"
+	}
+	hv := reflect.ValueOf(hc.Handler())
+	if hv.Kind() != reflect.Func {
+		return "unknown"
+	}
+	f := runtime.FuncForPC(hv.Pointer())
+	if f == nil {
+		return "unknown"
+	}
+	name := f.Name()
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	if i := strings.Index(name, "."); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.TrimSuffix(name, "-fm")
+	return strings.NewReplacer("(", "", ")", "", "*", "").Replace(name)
+}
+
+// observeKMS is KMS呼び出しのLatencyとErrorを記録する
+func observeKMS(cryptKey CryptKey, op string, start time.Time, err error) {
+	name := cryptKey.Name()
+	kmsRequestDuration.Observe(time.Since(start).Seconds(), name, op)
+	if err != nil {
+		kmsErrorsTotal.Inc(name, op)
+	}
+}
+
+func setupMetricsAPI(swPlugin *swagger.Plugin) {
+	api := &MetricsAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Metrics", Description: "Metrics admin API list"})
+
+	hInfo := swagger.NewHandlerInfo(api.Get)
+	ucon.Handle(http.MethodGet, "/api/admin/metrics", hInfo)
+	hInfo.Description, hInfo.Tags = "metrics in prometheus text format", []string{tag.Name}
+}
+
+// MetricsAPI is API to expose Metrics
+type MetricsAPI struct{}
+
+// Get is Prometheus Text Formatで、このInstanceのMetricsを返す
+func (api *MetricsAPI) Get(ctx context.Context, w http.ResponseWriter) error {
+	u := CurrentUser(ctx)
+	if u == nil || !u.Admin {
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	return DefaultMetrics.WriteMetrics(w)
+}
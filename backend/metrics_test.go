@@ -0,0 +1,159 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricValues is DefaultMetricsの出力を、Label付きのMetrics名から値へのmapにする
+func metricValues(t *testing.T) map[string]float64 {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := DefaultMetrics.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]float64{}
+	s := bufio.NewScanner(&buf)
+	for s.Scan() {
+		line := s.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("invalid line %q: %v", line, err)
+		}
+		m[line[:i]] = v
+	}
+	return m
+}
+
+func TestMetricsRegistryWriteMetrics(t *testing.T) {
+	c := &CounterVec{Name: "test_requests_total", Help: "Test counter.", Labels: []string{"code"}, values: map[string]float64{}, labels: map[string][]string{}}
+	h := &HistogramVec{Name: "test_duration_seconds", Help: "Test histogram.", Labels: []string{"op"}, Buckets: []float64{0.1, 1}, values: map[string]*histogramValue{}}
+	g := &GaugeFunc{Name: "test_open", Help: "Test gauge.", Labels: []string{"name"}, Collect: func() ([][]string, []float64) {
+		return [][]string{{"a"}}, []float64{1}
+	}}
+	cf := &CounterFunc{Name: "test_retries_total", Help: "Test counter func.", Labels: []string{"name"}, Collect: func() ([][]string, []float64) {
+		return [][]string{{"a"}, {"b"}}, []float64{3, 0}
+	}}
+	r := &MetricsRegistry{}
+	for _, mc := range []MetricsCollector{c, h, g, cf} {
+		r.Register(mc)
+	}
+
+	c.Inc("500")
+	c.Add(2, "200")
+	c.Inc("200")
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(5, "get")
+
+	var buf bytes.Buffer
+	if err := r.WriteMetrics(&buf); err != nil {
+		t.Fatal(err)
+	}
+	e := `# HELP test_requests_total Test counter.
+# TYPE test_requests_total counter
+test_requests_total{code="200"} 3
+test_requests_total{code="500"} 1
+# HELP test_duration_seconds Test histogram.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{op="get",le="0.1"} 1
+test_duration_seconds_bucket{op="get",le="1"} 2
+test_duration_seconds_bucket{op="get",le="+Inf"} 3
+test_duration_seconds_sum{op="get"} 5.55
+test_duration_seconds_count{op="get"} 3
+# HELP test_open Test gauge.
+# TYPE test_open gauge
+test_open{name="a"} 1
+# HELP test_retries_total Test counter func.
+# TYPE test_retries_total counter
+test_retries_total{name="a"} 3
+test_retries_total{name="b"} 0
+`
+	if g := buf.String(); g != e {
+		t.Errorf("got:\n%s\nwant:\n%s", g, e)
+	}
+}
+
+func TestKMSBreakerMetrics(t *testing.T) {
+	cryptKey := CryptKey{Provider: KeyProviderLocal, KeyRingID: "metrics", KeyName: "breaker"}
+	cb := kmsBreaker(cryptKey)
+	cb.Retried()
+	cb.Retried()
+	for i := 0; i < cb.FailureThreshold; i++ {
+		cb.Failure()
+	}
+	if err := cb.Allow(); err != ErrCircuitOpen {
+		t.Fatalf("Allow: got %v, want ErrCircuitOpen", err)
+	}
+
+	label := `{crypt_key="` + cryptKey.Name() + `"}`
+	m := metricValues(t)
+	for k, e := range map[string]float64{
+		"gcpsm_kms_retries_total" + label:                                          2,
+		"gcpsm_kms_rejected_total" + label:                                         1,
+		`gcpsm_kms_circuit_open{crypt_key="` + cryptKey.Name() + `",state="open"}`: 1,
+	} {
+		if g, ok := m[k]; !ok || g != e {
+			t.Errorf("%s: got %v (exists=%v), want %v", k, g, ok, e)
+		}
+	}
+
+	// Stateが変わってもCounterは同じSeriesで数え続ける
+	cb.OpenDuration = 0
+	if err := cb.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	cb.Success()
+	m = metricValues(t)
+	if g := m["gcpsm_kms_retries_total"+label]; g != 2 {
+		t.Errorf("retries after close: got %v, want 2", g)
+	}
+	if g, ok := m[`gcpsm_kms_circuit_open{crypt_key="`+cryptKey.Name()+`",state="closed"}`]; !ok || g != 0 {
+		t.Errorf("circuit open after close: got %v (exists=%v), want 0", g, ok)
+	}
+}
+
+func TestUseMetrics(t *testing.T) {
+	defer useFakeDatastore(newFakeDatastore())()
+
+	const notFound = `gcpsm_http_requests_total{handler="SecretAPI.Get",method="GET",status="404"}`
+	const duration = `gcpsm_http_request_duration_seconds_count{handler="SecretAPI.Get",method="GET",status="404"}`
+	before := metricValues(t)
+	start := time.Now()
+	if w := serveTestRequest(t, http.MethodGet, "/api/1/secret/metrics/missing", nil, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("status: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+	elapsed := time.Since(start).Seconds()
+
+	after := metricValues(t)
+	if g, e := after[notFound]-before[notFound], float64(1); g != e {
+		t.Errorf("%s: got +%v, want +%v", notFound, g, e)
+	}
+	if g, e := after[duration]-before[duration], float64(1); g != e {
+		t.Errorf("%s: got +%v, want +%v", duration, g, e)
+	}
+	sum := strings.Replace(duration, "_count{", "_sum{", 1)
+	if g := after[sum] - before[sum]; g < 0 || g > elapsed {
+		t.Errorf("%s: got +%v, want between 0 and %v", sum, g, elapsed)
+	}
+
+	w := serveTestRequest(t, http.MethodGet, "/api/admin/metrics", nil, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /api/admin/metrics: got %d, want %d. body=%s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if g, e := w.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8"; g != e {
+		t.Errorf("Content-Type: got %q, want %q", g, e)
+	}
+	if !strings.Contains(w.Body.String(), notFound+" ") {
+		t.Errorf("metrics API does not return %s", notFound)
+	}
+}
@@ -0,0 +1,129 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/favclip/ucon"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"go.mercari.io/datastore/aedatastore"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// Platform is 実行環境に依存する処理をまとめたもの
+// DefaultはApp Engine Standardで、それ以外 (Cloud Run, GKE, Local) で動かす場合はSetPlatformで差し替える
+type Platform struct {
+	// NewContext is Requestの処理に利用するContextを作成する. parentはnilのことがある
+	NewContext func(parent context.Context, r *http.Request) context.Context
+	// Datastore is Datastore Clientを返す. 返すClientにはdatastoreObserverを追加しておくこと
+	Datastore func(ctx context.Context) (datastore.Client, error)
+	// SecretStore is Secretの保存先. Secret以外のEntityはDatastoreに保存する
+	SecretStore SecretStore
+	// Identity is Requestを送ったuserを判定する
+	Identity Identity
+	// Logger is Logの出力先
+	Logger Logger
+	// HTTPClient is WebhookやTraceの送信に利用するhttp.Clientを返す
+	HTTPClient func(ctx context.Context) *http.Client
+	// ProjectID is DefaultCryptKeyに利用するGCP Project IDを返す
+	ProjectID func(ctx context.Context) string
+	// KeyProvider is DefaultCryptKeyのKeyProvider
+	KeyProvider string
+	// CryptKey is DefaultCryptKeyのLocationID, KeyRingID, KeyNameを上書きする. 空の項目はDefaultの値を使う
+	CryptKey CryptKey
+	// RedundantCryptKeys is DefaultTenantのRedundantCryptKeys
+	RedundantCryptKeys []CryptKey
+	// ReplicationPeers is DefaultTenantのReplicationPeers
+	ReplicationPeers []string
+	// ConfigError is 環境変数の設定の誤り. 誤った値は使わずに起動し、Logを出力できる最初のRequestでCriticalとして出力する
+	ConfigError error
+}
+
+var platform = AppEnginePlatform()
+
+// SetPlatform is 実行環境を差し替える. Requestを処理する前に呼ぶこと
+func SetPlatform(p *Platform) {
+	platform = p
+}
+
+// AppEnginePlatform is App Engine StandardのAPIを利用するPlatformを返す
+func AppEnginePlatform() *Platform {
+	p := &Platform{
+		NewContext: func(parent context.Context, r *http.Request) context.Context {
+			if parent == nil {
+				return appengine.NewContext(r)
+			}
+			return appengine.WithContext(parent, r)
+		},
+		Datastore: func(ctx context.Context) (datastore.Client, error) {
+			client, err := aedatastore.FromContext(ctx)
+			if err != nil {
+				return nil, err
+			}
+			client.AppendMiddleware(&datastoreObserver{})
+			return client, nil
+		},
+		SecretStore: &DatastoreSecretStore{},
+		Identity:    &AppEngineIdentity{},
+		Logger:      &AppEngineLogger{},
+		HTTPClient:  urlfetch.Client,
+		ProjectID:   appengine.AppID,
+		KeyProvider: KeyProviderCloudKMS,
+		// app.yamlのenv_variablesで設定する
+		ReplicationPeers: SplitList(os.Getenv("GCPSM_REPLICATION_PEERS")),
+	}
+	// package変数の初期化でpanicするとInstanceが起動しなくなるので、Errorを残して値は使わない
+	redundant, err := ParseCryptKeys(os.Getenv("GCPSM_REDUNDANT_CRYPT_KEYS"))
+	if err != nil {
+		p.ConfigError = errors.Wrap(err, "invalid GCPSM_REDUNDANT_CRYPT_KEYS. redundant crypt keys of the default tenant are not used")
+	} else {
+		p.RedundantCryptKeys = redundant
+	}
+	return p
+}
+
+// SharedDatastore is 起動時に作成したClientを全てのRequestで共有するPlatform.Datastoreを返す
+// App Engine以外ではRequestごとにClientを作るとConnectionが増え続けるので、こちらを使う
+func SharedDatastore(client datastore.Client) func(ctx context.Context) (datastore.Client, error) {
+	client.AppendMiddleware(&datastoreObserver{})
+	return func(ctx context.Context) (datastore.Client, error) {
+		return client, nil
+	}
+}
+
+// reportConfigError is Platform.ConfigErrorをInstance毎に1度だけLogに出力する
+var reportConfigError sync.Once
+
+// UsePlatformContext is Requestの処理に利用するContextを作成し、Requestを送ったuserを設定する
+func UsePlatformContext(b *ucon.Bubble) error {
+	b.Context = platform.NewContext(b.Context, b.R)
+	b.Context = withCurrentUser(b.Context, platform.Identity.CurrentUser(b.Context, b.R))
+	if platform.ConfigError != nil {
+		reportConfigError.Do(func() {
+			log.Criticalf(b.Context, "%v", platform.ConfigError)
+		})
+	}
+
+	return b.Next()
+}
+
+// SplitList is カンマ区切りの設定値を分割する. 空の項目は除く
+func SplitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+// FromContext is Create Datastore Client from Context
+func FromContext(ctx context.Context) (datastore.Client, error) {
+	return platform.Datastore(ctx)
+}
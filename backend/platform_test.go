@@ -0,0 +1,36 @@
+package backend
+
+import (
+	"os"
+	"testing"
+)
+
+func TestAppEnginePlatformRedundantCryptKeys(t *testing.T) {
+	org, ok := os.LookupEnv("GCPSM_REDUNDANT_CRYPT_KEYS")
+	defer func() {
+		if ok {
+			os.Setenv("GCPSM_REDUNDANT_CRYPT_KEYS", org)
+		} else {
+			os.Unsetenv("GCPSM_REDUNDANT_CRYPT_KEYS")
+		}
+	}()
+
+	os.Setenv("GCPSM_REDUNDANT_CRYPT_KEYS", "projects/p/locations/global/keyRings/r/cryptoKeys/k")
+	p := AppEnginePlatform()
+	if p.ConfigError != nil {
+		t.Fatalf("valid keys: %v", p.ConfigError)
+	}
+	if len(p.RedundantCryptKeys) != 1 || p.RedundantCryptKeys[0].KeyName != "k" {
+		t.Errorf("valid keys: got %+v", p.RedundantCryptKeys)
+	}
+
+	// 誤った値でもpanicせずに起動し、値は使わない
+	os.Setenv("GCPSM_REDUNDANT_CRYPT_KEYS", "invalid")
+	p = AppEnginePlatform()
+	if p.ConfigError == nil {
+		t.Error("invalid keys: want ConfigError")
+	}
+	if len(p.RedundantCryptKeys) != 0 {
+		t.Errorf("invalid keys: got %+v, want none", p.RedundantCryptKeys)
+	}
+}
@@ -0,0 +1,69 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Precondition is If-Match, If-None-Match Headerによる条件付きRequestの条件
+type Precondition struct {
+	IfMatch     []string
+	IfNoneMatch []string
+}
+
+// PreconditionFromRequest is RequestのHeaderからPreconditionを作成する
+func PreconditionFromRequest(r *http.Request) *Precondition {
+	return &Precondition{
+		IfMatch:     parseETagList(r.Header.Get("If-Match")),
+		IfNoneMatch: parseETagList(r.Header.Get("If-None-Match")),
+	}
+}
+
+// Check is 現在のSecretに対して条件を満たしているかを確認する. currentがnilの場合はSecretが存在しないことを表す
+// 条件を満たしていない場合は412 Precondition FailedのHTTPErrorを返す
+func (p *Precondition) Check(current *Secret) error {
+	if len(p.IfMatch) > 0 {
+		if current == nil {
+			return &HTTPError{Code: http.StatusPreconditionFailed, Message: "secret does not exist."}
+		}
+		if !matchETag(p.IfMatch, current.ETag()) {
+			return &HTTPError{Code: http.StatusPreconditionFailed, Message: fmt.Sprintf("secret has been updated. current etag is %s.", current.ETag())}
+		}
+	}
+	if len(p.IfNoneMatch) > 0 && current != nil {
+		if matchETag(p.IfNoneMatch, current.ETag()) {
+			return &HTTPError{Code: http.StatusPreconditionFailed, Message: "secret already exists."}
+		}
+	}
+	return nil
+}
+
+// ETag is SecretのVersionから作るETag
+func (s *Secret) ETag() string {
+	return fmt.Sprintf(`"%d"`, s.Version)
+}
+
+// parseETagList is , 区切りのETag Listを分解する
+func parseETagList(v string) []string {
+	var list []string
+	for _, s := range strings.Split(v, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		list = append(list, s)
+	}
+	return list
+}
+
+// matchETag is list内にetagと一致するものがあるかを返す. * は全てに一致する
+// Weak ETagは扱わず、W/ 付きのものは一致しないものとする
+func matchETag(list []string, etag string) bool {
+	for _, v := range list {
+		if v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
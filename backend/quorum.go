@@ -0,0 +1,312 @@
+package backend
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// Quorum Kind List
+const (
+	// QuorumCustodianKind is QuorumCustodian EntityのKind
+	QuorumCustodianKind = "QuorumCustodian"
+	// QuorumSecretKind is QuorumSecret EntityのKind
+	QuorumSecretKind = "QuorumSecret"
+	// QuorumRecoveryKind is QuorumRecovery EntityのKind
+	QuorumRecoveryKind = "QuorumRecovery"
+)
+
+// Quorum List
+const (
+	// maxQuorumCustodians is 1つのQuorumSecretに指定できるCustodianの最大数. Entityの1MBの制限に収めるため
+	maxQuorumCustodians = 10
+	// minCustodianKeyBits is Custodianの公開鍵に求めるRSAの鍵長
+	minCustodianKeyBits = 2048
+	// quorumRecoveryWindow is 復元を依頼してから、必要な数のShareを集めるまでの時間
+	quorumRecoveryWindow = time.Hour
+	// sealedShareVersion is SealShareの形式のVersion
+	sealedShareVersion = 1
+)
+
+// sealedShareLabel is RSA-OAEPのLabel. 別の用途で暗号化されたものをShareとして扱わないようにする
+var sealedShareLabel = []byte("gcpsm-quorum-share")
+
+// ParseCustodianPublicKey is PEM形式(PUBLIC KEY)のRSA公開鍵を読み込む
+func ParseCustodianPublicKey(s string) (*rsa.PublicKey, error) {
+	b, _ := pem.Decode([]byte(s))
+	if b == nil || b.Type != "PUBLIC KEY" {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: "public key must be PEM encoded PUBLIC KEY."}
+	}
+	k, err := x509.ParsePKIXPublicKey(b.Bytes)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid public key: %s", err)}
+	}
+	pub, ok := k.(*rsa.PublicKey)
+	if !ok || pub.N.BitLen() < minCustodianKeyBits {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("public key must be RSA %d bits or more.", minCustodianKeyBits)}
+	}
+	return pub, nil
+}
+
+// PublicKeyFingerprint is 公開鍵のSHA-256 Fingerprint
+func PublicKeyFingerprint(pub *rsa.PublicKey) string {
+	der, _ := x509.MarshalPKIXPublicKey(pub)
+	sum := sha256.Sum256(der)
+	return hex.EncodeToString(sum[:])
+}
+
+// SealShare is ShareをCustodianの公開鍵で暗号化する
+// ShareはRSAで直接暗号化できる長さを超えるので、AES-256-GCMで暗号化し、その鍵をRSA-OAEPで暗号化する
+func SealShare(pub *rsa.PublicKey, share []byte) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", errors.Wrap(err, "failed generate share key")
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, sealedShareLabel)
+	if err != nil {
+		return "", errors.Wrap(err, "failed wrap share key")
+	}
+	gcm, err := newShareGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", errors.Wrap(err, "failed generate nonce")
+	}
+
+	// version | len(wrapped) | wrapped | nonce | ciphertext
+	b := []byte{sealedShareVersion, 0, 0}
+	binary.BigEndian.PutUint16(b[1:], uint16(len(wrapped)))
+	b = append(b, wrapped...)
+	b = append(b, nonce...)
+	b = gcm.Seal(b, nonce, share, nil)
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// OpenShare is SealShareで暗号化したShareをCustodianの秘密鍵で復号する. CustodianがOfflineで利用する
+func OpenShare(priv *rsa.PrivateKey, sealed string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed decode sealed share")
+	}
+	if len(b) < 3 || b[0] != sealedShareVersion {
+		return nil, errors.New("unknown sealed share format")
+	}
+	n := int(binary.BigEndian.Uint16(b[1:3]))
+	b = b[3:]
+	if len(b) < n {
+		return nil, errors.New("sealed share is truncated")
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, b[:n], sealedShareLabel)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed unwrap share key")
+	}
+	gcm, err := newShareGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	b = b[n:]
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("sealed share is truncated")
+	}
+	share, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed decrypt share")
+	}
+	return share, nil
+}
+
+func newShareGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed create cipher")
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed create gcm")
+	}
+	return gcm, nil
+}
+
+// shareHash is 提出されたShareが正しいかを確認するためのHash. 保存する時はKMSで暗号化する
+func shareHash(key string, share []byte) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00", key)
+	h.Write(share)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// QuorumCustodian is Datastore Entity
+// Shareを預かるuserの公開鍵. 秘密鍵はCustodianが手元で管理し、Serviceには渡さない
+type QuorumCustodian struct {
+	Email        string    `json:"email" datastore:"-"`
+	PublicKey    string    `json:"publicKey" datastore:",noindex"`
+	Fingerprint  string    `json:"fingerprint"`
+	RegisteredAt time.Time `json:"registeredAt"`
+}
+
+// QuorumShare is 1人のCustodianに預けたShare
+type QuorumShare struct {
+	Custodian   string `json:"custodian"`
+	Fingerprint string `json:"fingerprint"`
+	Sealed      string `json:"sealed" datastore:",noindex"`
+	// Hash is ShareのHashをKMSで暗号化したもの
+	Hash string `json:"-" datastore:",noindex"`
+}
+
+// QuorumSecret is Datastore Entity
+// Shamir's Secret Sharingで分割し、Custodian毎に暗号化して保存するSecret. 平文もKMSで暗号化した値も保存しない
+// Threshold人のCustodianがShareを提出するまで、誰も値を取り出すことができない
+type QuorumSecret struct {
+	Key       string        `json:"key" datastore:"-"`
+	Threshold int           `json:"threshold"`
+	Shares    []QuorumShare `json:"shares"`
+	Version   int64         `json:"version"`
+	CreatedBy string        `json:"createdBy"`
+	CreatedAt time.Time     `json:"createdAt"`
+}
+
+// share is CustodianのShareを返す
+func (qs *QuorumSecret) share(custodian string) *QuorumShare {
+	for i := range qs.Shares {
+		if qs.Shares[i].Custodian == custodian {
+			return &qs.Shares[i]
+		}
+	}
+	return nil
+}
+
+// QuorumRecoveryStatus is QuorumRecoveryの状態
+type QuorumRecoveryStatus string
+
+// QuorumRecoveryStatus List
+const (
+	QuorumRecoveryPending   QuorumRecoveryStatus = "pending"
+	QuorumRecoveryCompleted QuorumRecoveryStatus = "completed"
+	QuorumRecoveryExpired   QuorumRecoveryStatus = "expired"
+)
+
+// QuorumSubmission is Custodianが提出したShare. 復元するまでの間だけ、KMSで暗号化して保存する
+type QuorumSubmission struct {
+	Custodian   string    `json:"custodian"`
+	Share       string    `json:"-" datastore:",noindex"`
+	SubmittedAt time.Time `json:"submittedAt"`
+}
+
+// QuorumRecovery is Datastore Entity
+// QuorumSecretの復元の依頼. ExpiresAtまでにThreshold人のCustodianがShareを提出すると、依頼者だけが1度だけ値を取り出せる
+type QuorumRecovery struct {
+	ID          string               `json:"id" datastore:"-"`
+	Key         string               `json:"key"`
+	Version     int64                `json:"version"`
+	Threshold   int                  `json:"threshold"`
+	Status      QuorumRecoveryStatus `json:"status"`
+	Submissions []QuorumSubmission   `json:"submissions"`
+	RequestedBy string               `json:"requestedBy"`
+	RequestedAt time.Time            `json:"requestedAt"`
+	ExpiresAt   time.Time            `json:"expiresAt"`
+	CompletedAt time.Time            `json:"completedAt,omitempty"`
+}
+
+// Expired is 期限を過ぎているかを返す
+func (r *QuorumRecovery) Expired(now time.Time) bool {
+	return r.Status == QuorumRecoveryPending && now.After(r.ExpiresAt)
+}
+
+// submitted is CustodianがShareを提出済みかを返す
+func (r *QuorumRecovery) submitted(custodian string) bool {
+	for _, s := range r.Submissions {
+		if s.Custodian == custodian {
+			return true
+		}
+	}
+	return false
+}
+
+// getQuorumSecret is QuorumSecretを取得する
+func getQuorumSecret(ctx context.Context, ds datastore.Client, t *Tenant, key string) (*QuorumSecret, error) {
+	qs := &QuorumSecret{}
+	if err := ds.Get(ctx, t.NameKey(ds, QuorumSecretKind, key, nil), qs); err == datastore.ErrNoSuchEntity {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("quorum secret %s is not found.", key)}
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed get QuorumSecret. key=%s", key)
+	}
+	qs.Key = key
+	return qs, nil
+}
+
+// getQuorumRecovery is QuorumRecoveryを取得する
+func getQuorumRecovery(ctx context.Context, ds datastore.Client, t *Tenant, id string) (datastore.Key, *QuorumRecovery, error) {
+	k := t.NameKey(ds, QuorumRecoveryKind, id, nil)
+	r := &QuorumRecovery{}
+	if err := ds.Get(ctx, k, r); err == datastore.ErrNoSuchEntity {
+		return nil, nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("quorum recovery %s is not found.", id)}
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed get QuorumRecovery. id=%s", id)
+	}
+	r.ID = id
+	return k, r, nil
+}
+
+// expireQuorumRecoveryInTransaction is 期限を過ぎていればTransaction内でExpiredにし、提出されたShareを消す. Expiredにした場合はtrueを返す
+func expireQuorumRecoveryInTransaction(tx datastore.Transaction, ds datastore.Client, t *Tenant, k datastore.Key, r *QuorumRecovery, now time.Time) (bool, error) {
+	if !r.Expired(now) {
+		return false, nil
+	}
+	r.Status = QuorumRecoveryExpired
+	r.Submissions = nil
+	r.CompletedAt = now
+	if _, err := tx.Put(k, r); err != nil {
+		return false, err
+	}
+	return true, putAuditLog(tx, ds, t, &AuditLog{Action: AuditQuorumExpired, Key: r.Key, Target: r.ID, OccurredAt: now})
+}
+
+// ExpireQuorumRecoveries is 期限を過ぎたQuorumRecoveryを全てExpiredにする. Expiredにした件数を返す
+func ExpireQuorumRecoveries(ctx context.Context, ds datastore.Client, t *Tenant) (int, error) {
+	now := time.Now()
+	q := t.NewQuery(ds, QuorumRecoveryKind).
+		Filter("Status =", string(QuorumRecoveryPending)).
+		Filter("ExpiresAt <", now).
+		KeysOnly()
+	keys, err := ds.GetAll(ctx, q, nil)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed list expired QuorumRecovery")
+	}
+
+	var n int
+	for _, k := range keys {
+		var expired bool
+		_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+			r := &QuorumRecovery{ID: k.Name()}
+			if err := tx.Get(k, r); err != nil {
+				return err
+			}
+			var err error
+			expired, err = expireQuorumRecoveryInTransaction(tx, ds, t, k, r, now)
+			return err
+		})
+		if err != nil {
+			return n, errors.Wrapf(err, "failed expire QuorumRecovery. id=%s", k.Name())
+		}
+		if expired {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,605 @@
+package backend
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+func setupQuorumAPI(swPlugin *swagger.Plugin) {
+	api := &QuorumAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Quorum", Description: "Quorum (Shamir's Secret Sharing) API list"})
+
+	handleTenantAPI(http.MethodPut, "/quorum/custodian", api.PutCustodian, "register own public key as custodian", tag)
+	handleTenantAPI(http.MethodGet, "/quorum/custodian", api.ListCustodian, "list custodians", tag)
+	handleTenantAPI(http.MethodPost, "/quorum/secret", api.PostSecret, "split secret into shares for custodians", tag)
+	handleTenantAPI(http.MethodGet, "/quorum/secret", api.GetSecret, "get sealed shares of quorum secret", tag)
+	handleTenantAPI(http.MethodPost, "/quorum/recovery", api.PostRecovery, "request recovery of quorum secret", tag)
+	handleTenantAPI(http.MethodGet, "/quorum/recovery/{id}", api.GetRecovery, "get recovery", tag)
+	handleTenantAPI(http.MethodPost, "/quorum/recovery/{id}/share", api.SubmitShare, "submit decrypted share", tag)
+	handleTenantAPI(http.MethodPost, "/quorum/recovery/{id}/reconstruct", api.Reconstruct, "reconstruct quorum secret", tag)
+
+	// Cronから呼ばれるHandler. app.yamlでlogin: adminにしている
+	ucon.HandleFunc(http.MethodGet, "/api/internal/quorum/expire", api.Expire)
+}
+
+// QuorumAPI is API to handle QuorumSecret
+type QuorumAPI struct{}
+
+// QuorumAPIPutCustodianRequest is QuorumAPI PutCustodian Request
+type QuorumAPIPutCustodianRequest struct {
+	PublicKey string `json:"publicKey" swagger:",req"`
+}
+
+// PutCustodian is 自分の公開鍵をCustodianとして登録するhandler
+// 既に預かっているShareは古い公開鍵で暗号化されたままなので、鍵を替えた場合はQuorumSecretを作り直すこと
+func (api *QuorumAPI) PutCustodian(ctx context.Context, form *QuorumAPIPutCustodianRequest) (*QuorumCustodian, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	pub, err := ParseCustodianPublicKey(form.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &QuorumCustodian{
+		Email:        u.Email,
+		PublicKey:    form.PublicKey,
+		Fingerprint:  PublicKeyFingerprint(pub),
+		RegisteredAt: time.Now(),
+	}
+	if _, err := ds.Put(ctx, t.NameKey(ds, QuorumCustodianKind, c.Email, nil), c); err != nil {
+		return nil, errors.Wrapf(err, "failed put QuorumCustodian. email=%s", c.Email)
+	}
+	return c, nil
+}
+
+// QuorumAPIListCustodianResponse is QuorumAPI ListCustodian Response
+type QuorumAPIListCustodianResponse struct {
+	List []*QuorumCustodian `json:"list"`
+}
+
+// ListCustodian is 登録されているCustodianを返すhandler
+func (api *QuorumAPI) ListCustodian(ctx context.Context) (*QuorumAPIListCustodianResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*QuorumCustodian
+	keys, err := ds.GetAll(ctx, t.NewQuery(ds, QuorumCustodianKind), &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list QuorumCustodian")
+	}
+	for i, k := range keys {
+		list[i].Email = k.Name()
+	}
+	if list == nil {
+		list = []*QuorumCustodian{}
+	}
+	return &QuorumAPIListCustodianResponse{
+		List: list,
+	}, nil
+}
+
+// QuorumAPIPostSecretRequest is QuorumAPI PostSecret Request
+type QuorumAPIPostSecretRequest struct {
+	Key        string   `json:"key" swagger:",req,secretKey"`
+	Value      string   `json:"value" swagger:",secretValue"`
+	Threshold  int      `json:"threshold" swagger:",req"`
+	Custodians []string `json:"custodians" swagger:",req"`
+	// Replace is 既に存在するQuorumSecretを作り直す. 承認が必要なKeyは作り直せない
+	Replace bool `json:"replace"`
+}
+
+func (form *QuorumAPIPostSecretRequest) secretKeyValue() (string, string, string) {
+	return form.Key, form.Value, ""
+}
+
+// PostSecret is Secretを分割し、Custodian毎に暗号化して保存するhandler
+// 平文は保存しないので、同じKeyで作り直した場合は以前の値を取り出せなくなる
+// そのため既に存在する場合はReplaceを指定しない限り409を返す
+func (api *QuorumAPI) PostSecret(ctx context.Context, form *QuorumAPIPostSecretRequest) (*QuorumSecret, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
+
+	n := len(form.Custodians)
+	if n < 2 || n > maxQuorumCustodians {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("custodians must be between 2 and %d.", maxQuorumCustodians)}
+	}
+	if form.Threshold < 2 || form.Threshold > n {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("threshold must be between 2 and %d.", n)}
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, form.Key, PermissionWrite); err != nil {
+		return nil, err
+	}
+	if form.Replace {
+		if err := requireUnprotected(ctx, ds, t, form.Key); err != nil {
+			return nil, err
+		}
+	}
+
+	keys := make([]datastore.Key, n)
+	custodians := make([]*QuorumCustodian, n)
+	seen := map[string]bool{}
+	for i, email := range form.Custodians {
+		if seen[email] {
+			return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("custodian %s is duplicated.", email)}
+		}
+		seen[email] = true
+		keys[i] = t.NameKey(ds, QuorumCustodianKind, email, nil)
+		custodians[i] = &QuorumCustodian{Email: email}
+	}
+	if err := ds.GetMulti(ctx, keys, custodians); err != nil {
+		if merr, ok := err.(datastore.MultiError); ok {
+			for i, e := range merr {
+				if e == datastore.ErrNoSuchEntity {
+					return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("custodian %s is not registered.", form.Custodians[i])}
+				}
+			}
+		}
+		return nil, errors.Wrap(err, "failed get QuorumCustodian")
+	}
+
+	shares, err := SplitSecret([]byte(form.Value), n, form.Threshold)
+	if err != nil {
+		return nil, err
+	}
+	kms := NewCrypter()
+	qs := &QuorumSecret{
+		Key:       form.Key,
+		Threshold: form.Threshold,
+		Shares:    make([]QuorumShare, n),
+		CreatedBy: u.Email,
+		CreatedAt: time.Now(),
+	}
+	for i, c := range custodians {
+		pub, err := ParseCustodianPublicKey(c.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := SealShare(pub, shares[i])
+		if err != nil {
+			return nil, err
+		}
+		// 値が短い場合、k-1個のShareとHashから残りを総当たりできるので、HashもKMSで暗号化する
+		hash, err := kms.EncryptMulti(ctx, t.CryptKeys(), shareHash(form.Key, shares[i]))
+		if err != nil {
+			return nil, err
+		}
+		qs.Shares[i] = QuorumShare{
+			Custodian:   form.Custodians[i],
+			Fingerprint: c.Fingerprint,
+			Sealed:      sealed,
+			Hash:        hash,
+		}
+	}
+
+	k := t.NameKey(ds, QuorumSecretKind, form.Key, nil)
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		cur := &QuorumSecret{}
+		if err := tx.Get(k, cur); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		comment := fmt.Sprintf("%d of %d", qs.Threshold, n)
+		if cur.Version > 0 {
+			if !form.Replace {
+				return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("quorum secret %s already exists. use replace to recreate it.", form.Key)}
+			}
+			comment = fmt.Sprintf("%s, replaced version %d", comment, cur.Version)
+		}
+		qs.Version = cur.Version + 1
+		if _, err := tx.Put(k, qs); err != nil {
+			return err
+		}
+		return putAuditLog(tx, ds, t, &AuditLog{Action: AuditQuorumCreated, Key: form.Key, Actor: u.Email, Comment: comment, OccurredAt: qs.CreatedAt})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed put QuorumSecret. key=%s", form.Key)
+	}
+
+	return qs, nil
+}
+
+// QuorumAPIGetSecretRequest is QuorumAPI GetSecret Request
+type QuorumAPIGetSecretRequest struct {
+	Key string `json:"key" swagger:",in=query,req,secretKey"`
+}
+
+// GetSecret is QuorumSecretを返すhandler. ShareはCustodianの公開鍵で暗号化されたまま返す
+// CustodianとSecretを読めるuserが実行できる
+func (api *QuorumAPI) GetSecret(ctx context.Context, form *QuorumAPIGetSecretRequest) (*QuorumSecret, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	qs, err := getQuorumSecret(ctx, ds, t, form.Key)
+	if err != nil {
+		return nil, err
+	}
+	if qs.share(u.Email) == nil {
+		if err := Authorize(ctx, ds, t, u, form.Key, PermissionRead); err != nil {
+			return nil, err
+		}
+	}
+	return qs, nil
+}
+
+// QuorumAPIPostRecoveryRequest is QuorumAPI PostRecovery Request
+type QuorumAPIPostRecoveryRequest struct {
+	Key string `json:"key" swagger:",req,secretKey"`
+}
+
+// PostRecovery is QuorumSecretの復元を依頼するhandler. Secretを読めるuserが実行できる
+// quorumRecoveryWindowの間にThreshold人のCustodianがShareを提出する必要がある
+func (api *QuorumAPI) PostRecovery(ctx context.Context, form *QuorumAPIPostRecoveryRequest) (*QuorumRecovery, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, form.Key, PermissionRead); err != nil {
+		return nil, err
+	}
+	qs, err := getQuorumSecret(ctx, ds, t, form.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	r := &QuorumRecovery{
+		ID:          newRandomID(),
+		Key:         qs.Key,
+		Version:     qs.Version,
+		Threshold:   qs.Threshold,
+		Status:      QuorumRecoveryPending,
+		Submissions: []QuorumSubmission{},
+		RequestedBy: u.Email,
+		RequestedAt: now,
+		ExpiresAt:   now.Add(quorumRecoveryWindow),
+	}
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		if _, err := tx.Put(t.NameKey(ds, QuorumRecoveryKind, r.ID, nil), r); err != nil {
+			return err
+		}
+		return putAuditLog(tx, ds, t, &AuditLog{Action: AuditQuorumRequested, Key: r.Key, Actor: u.Email, Target: r.ID, OccurredAt: now})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed put QuorumRecovery. key=%s", form.Key)
+	}
+
+	return r, nil
+}
+
+// QuorumAPIGetRecoveryRequest is QuorumAPI GetRecovery Request
+type QuorumAPIGetRecoveryRequest struct {
+	ID string `json:"id" swagger:",in=path"`
+}
+
+// GetRecovery is QuorumRecoveryを返すhandler. 提出されたShareは返さない
+func (api *QuorumAPI) GetRecovery(ctx context.Context, form *QuorumAPIGetRecoveryRequest) (*QuorumRecovery, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, r, err := getQuorumRecovery(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	if r.RequestedBy != u.Email {
+		qs, err := getQuorumSecret(ctx, ds, t, r.Key)
+		if err != nil {
+			return nil, err
+		}
+		if qs.share(u.Email) == nil && !t.IsAdmin(u) {
+			return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+		}
+	}
+	if r.Expired(time.Now()) {
+		r.Status = QuorumRecoveryExpired
+	}
+	return r, nil
+}
+
+// QuorumAPISubmitShareRequest is QuorumAPI SubmitShare Request
+// ShareはSealedをCustodianの秘密鍵で復号したものを、Base64で指定する
+type QuorumAPISubmitShareRequest struct {
+	ID    string `json:"id" swagger:",in=path"`
+	Share string `json:"share" swagger:",req"`
+}
+
+// SubmitShare is Custodianが復号したShareを提出するhandler
+// 提出されたShareは復元するまでの間、KMSで暗号化して保存する
+func (api *QuorumAPI) SubmitShare(ctx context.Context, form *QuorumAPISubmitShareRequest) (*QuorumRecovery, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	share, err := base64.StdEncoding.DecodeString(form.Share)
+	if err != nil {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: "share must be base64 encoded."}
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	k, r, err := getQuorumRecovery(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	qs, err := getQuorumSecret(ctx, ds, t, r.Key)
+	if err != nil {
+		return nil, err
+	}
+	if qs.Version != r.Version {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("quorum secret %s has been replaced after the recovery was requested.", r.Key)}
+	}
+	qsh := qs.share(u.Email)
+	if qsh == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("You are not a custodian of %s.", r.Key)}
+	}
+
+	kms := NewCrypter()
+	hash, err := kms.DecryptMulti(ctx, t.CryptKeys(), qsh.Hash)
+	if err != nil {
+		return nil, err
+	}
+	if shareHash(qs.Key, share) != hash {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: "share does not match."}
+	}
+	es, err := kms.EncryptMulti(ctx, t.CryptKeys(), form.Share)
+	if err != nil {
+		return nil, err
+	}
+
+	var expired bool
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		// Submissionsが重複して読み込まれないよう、Transactionの度に空のEntityに読み直す
+		*r = QuorumRecovery{ID: r.ID}
+		if err := tx.Get(k, r); err != nil {
+			return err
+		}
+		now := time.Now()
+		var err error
+		if expired, err = expireQuorumRecoveryInTransaction(tx, ds, t, k, r, now); expired || err != nil {
+			return err
+		}
+		if r.Status != QuorumRecoveryPending {
+			return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("quorum recovery %s is %s.", r.ID, r.Status)}
+		}
+		if r.submitted(u.Email) {
+			return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("You have already submitted a share to %s.", r.ID)}
+		}
+
+		r.Submissions = append(r.Submissions, QuorumSubmission{Custodian: u.Email, Share: es, SubmittedAt: now})
+		if _, err := tx.Put(k, r); err != nil {
+			return err
+		}
+		return putAuditLog(tx, ds, t, &AuditLog{Action: AuditQuorumSubmitted, Key: r.Key, Actor: u.Email, Target: r.ID, Comment: fmt.Sprintf("%d of %d", len(r.Submissions), r.Threshold), OccurredAt: now})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed submit share. recovery=%s", form.ID)
+	}
+	if expired {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("quorum recovery %s has expired.", r.ID)}
+	}
+
+	return r, nil
+}
+
+// QuorumAPIReconstructRequest is QuorumAPI Reconstruct Request
+type QuorumAPIReconstructRequest struct {
+	ID string `json:"id" swagger:",in=path"`
+}
+
+// QuorumAPIReconstructResponse is QuorumAPI Reconstruct Response
+type QuorumAPIReconstructResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Reconstruct is 提出されたShareからSecretを復元して返すhandler. 依頼者が1度だけ実行できる
+// 復元した後は提出されたShareを消すので、再び取り出すには改めて依頼する必要がある
+func (api *QuorumAPI) Reconstruct(ctx context.Context, form *QuorumAPIReconstructRequest) (*QuorumAPIReconstructResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	k, r, err := getQuorumRecovery(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, r.Key)
+	if r.RequestedBy != u.Email {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "Only the requester can reconstruct."}
+	}
+	if r.Status != QuorumRecoveryPending || r.Expired(time.Now()) {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("quorum recovery %s is not pending.", r.ID)}
+	}
+	if len(r.Submissions) < r.Threshold {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("%d of %d shares are submitted.", len(r.Submissions), r.Threshold)}
+	}
+
+	kms := NewCrypter()
+	shares := make([][]byte, len(r.Submissions))
+	for i, s := range r.Submissions {
+		pt, err := kms.DecryptMulti(ctx, t.CryptKeys(), s.Share)
+		if err != nil {
+			return nil, err
+		}
+		shares[i], err = base64.StdEncoding.DecodeString(pt)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed decode share. custodian=%s", s.Custodian)
+		}
+	}
+	value, err := CombineShares(shares)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed combine shares. recovery=%s", r.ID)
+	}
+
+	// 同じ依頼で2度取り出せないよう、Transactionで完了にしてから返す
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		cur := &QuorumRecovery{}
+		if err := tx.Get(k, cur); err != nil {
+			return err
+		}
+		if cur.Status != QuorumRecoveryPending {
+			return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("quorum recovery %s is %s.", r.ID, cur.Status)}
+		}
+		now := time.Now()
+		cur.Status = QuorumRecoveryCompleted
+		cur.Submissions = nil
+		cur.CompletedAt = now
+		if _, err := tx.Put(k, cur); err != nil {
+			return err
+		}
+		return putAuditLog(tx, ds, t, &AuditLog{Action: AuditQuorumRecovered, Key: r.Key, Actor: u.Email, Target: r.ID, OccurredAt: now})
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed complete quorum recovery. recovery=%s", r.ID)
+	}
+
+	return &QuorumAPIReconstructResponse{
+		Key:   r.Key,
+		Value: string(value),
+	}, nil
+}
+
+// Expire is Cronから全てのTenantの期限切れのQuorumRecoveryをExpiredにし、提出されたShareを消すhandler
+func (api *QuorumAPI) Expire(ctx context.Context, r *http.Request) error {
+	if r.Header.Get("X-Appengine-Cron") == "" {
+		// X-Appengine-CronはApp Engineの外から付けることができない
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	tenants, err := ListTenants(ctx, ds)
+	if err != nil {
+		return err
+	}
+	for _, t := range append([]*Tenant{DefaultTenant(ctx)}, tenants...) {
+		n, err := ExpireQuorumRecoveries(ctx, ds, t)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Infof(ctx, "expired %d quorum recoveries. tenant=%s", n, t.ID)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSealOpenShare(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, minCustodianKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	share := []byte("share of the secret")
+	sealed, err := SealShare(&priv.PublicKey, share)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := OpenShare(priv, sealed)
+	if err != nil {
+		t.Fatalf("OpenShare: %v", err)
+	}
+	if string(got) != string(share) {
+		t.Errorf("share: got %q, want %q", got, share)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, minCustodianKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenShare(other, sealed); err == nil {
+		t.Error("OpenShare with another key: want error")
+	}
+
+	b, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, b...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := OpenShare(priv, base64.StdEncoding.EncodeToString(tampered)); err == nil {
+		t.Error("OpenShare with tampered ciphertext: want error")
+	}
+	for n := 0; n < len(b); n++ {
+		if _, err := OpenShare(priv, base64.StdEncoding.EncodeToString(b[:n])); err == nil {
+			t.Fatalf("OpenShare with %d bytes: want error", n)
+		}
+	}
+	if _, err := OpenShare(priv, "not base64"); err == nil {
+		t.Error("OpenShare with invalid base64: want error")
+	}
+}
+
+// testCustodian is Testで利用するCustodianの秘密鍵
+type testCustodian struct {
+	email string
+	priv  *rsa.PrivateKey
+}
+
+// registerTestCustodian is 鍵を作成し、emailのuserをCustodianとして登録する
+func registerTestCustodian(t *testing.T, tenant *Tenant, email string) *testCustodian {
+	t.Helper()
+	priv, err := rsa.GenerateKey(rand.Reader, minCustodianKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	api := &QuorumAPI{}
+	if _, err := api.PutCustodian(testUserContext(t, tenant, email), &QuorumAPIPutCustodianRequest{PublicKey: string(pub)}); err != nil {
+		t.Fatal(err)
+	}
+	return &testCustodian{email: email, priv: priv}
+}
+
+// submit is 自分のShareを復号してrecoveryに提出する
+func (c *testCustodian) submit(t *testing.T, tenant *Tenant, key string, recovery string) error {
+	t.Helper()
+	api := &QuorumAPI{}
+	ctx := testUserContext(t, tenant, c.email)
+	qs, err := api.GetSecret(ctx, &QuorumAPIGetSecretRequest{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	share, err := OpenShare(c.priv, qs.share(c.email).Sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = api.SubmitShare(ctx, &QuorumAPISubmitShareRequest{ID: recovery, Share: base64.StdEncoding.EncodeToString(share)})
+	return err
+}
+
+func TestQuorumRecovery(t *testing.T) {
+	ds := newFakeDatastore()
+	defer useFakeDatastore(ds)()
+	tenant := &Tenant{ID: "quorum", Namespace: "quorum", CryptKey: testCryptKey, Admins: []string{"owner@example.com"}}
+	a := registerTestCustodian(t, tenant, "a@example.com")
+	b := registerTestCustodian(t, tenant, "b@example.com")
+	registerTestCustodian(t, tenant, "c@example.com")
+
+	const key = "root/owner"
+	api := &QuorumAPI{}
+	owner := testUserContext(t, tenant, "owner@example.com")
+	form := &QuorumAPIPostSecretRequest{Key: key, Value: "root-password", Threshold: 2, Custodians: []string{"a@example.com", "b@example.com", "c@example.com"}}
+	if _, err := api.PostSecret(owner, form); err != nil {
+		t.Fatal(err)
+	}
+	// 作り直すと以前のShareで復元できなくなるので、Replaceを指定しない限り上書きしない
+	if _, err := api.PostSecret(owner, form); httpStatus(err) != http.StatusConflict {
+		t.Errorf("PostSecret for existing key: got %v, want 409", err)
+	}
+
+	r, err := api.PostRecovery(owner, &QuorumAPIPostRecoveryRequest{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.submit(t, tenant, key, r.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.submit(t, tenant, key, r.ID); httpStatus(err) != http.StatusConflict {
+		t.Errorf("SubmitShare twice: got %v, want 409", err)
+	}
+	if _, err := api.Reconstruct(owner, &QuorumAPIReconstructRequest{ID: r.ID}); httpStatus(err) != http.StatusConflict {
+		t.Errorf("Reconstruct below threshold: got %v, want 409", err)
+	}
+	if err := b.submit(t, tenant, key, r.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := api.Reconstruct(testUserContext(t, tenant, a.email), &QuorumAPIReconstructRequest{ID: r.ID}); httpStatus(err) != http.StatusForbidden {
+		t.Errorf("Reconstruct by custodian: got %v, want 403", err)
+	}
+	resp, err := api.Reconstruct(owner, &QuorumAPIReconstructRequest{ID: r.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := resp.Value, form.Value; g != e {
+		t.Errorf("reconstructed: got %q, want %q", g, e)
+	}
+	if _, err := api.Reconstruct(owner, &QuorumAPIReconstructRequest{ID: r.ID}); httpStatus(err) != http.StatusConflict {
+		t.Errorf("Reconstruct twice: got %v, want 409", err)
+	}
+
+	// 期限を過ぎた依頼にはShareを提出できず、Expiredになる
+	r, err = api.PostRecovery(owner, &QuorumAPIPostRecoveryRequest{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.submit(t, tenant, key, r.ID); err != nil {
+		t.Fatal(err)
+	}
+	k, expiring, err := getQuorumRecovery(context.Background(), ds, tenant, r.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expiring.ExpiresAt = time.Now().Add(-time.Minute)
+	if _, err := ds.Put(context.Background(), k, expiring); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.submit(t, tenant, key, r.ID); httpStatus(err) != http.StatusConflict {
+		t.Errorf("SubmitShare after expiry: got %v, want 409", err)
+	}
+	got, err := api.GetRecovery(owner, &QuorumAPIGetRecoveryRequest{ID: r.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Status != QuorumRecoveryExpired || len(got.Submissions) != 0 {
+		t.Errorf("expired recovery: got status=%s, submissions=%d", got.Status, len(got.Submissions))
+	}
+	if _, err := api.Reconstruct(owner, &QuorumAPIReconstructRequest{ID: r.ID}); httpStatus(err) != http.StatusConflict {
+		t.Errorf("Reconstruct after expiry: got %v, want 409", err)
+	}
+
+	// Replaceを指定すれば作り直せるが、作り直す前の依頼にはShareを提出できない
+	r, err = api.PostRecovery(owner, &QuorumAPIPostRecoveryRequest{Key: key})
+	if err != nil {
+		t.Fatal(err)
+	}
+	form.Replace = true
+	qs, err := api.PostSecret(owner, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := qs.Version, int64(2); g != e {
+		t.Errorf("replaced version: got %d, want %d", g, e)
+	}
+	if err := a.submit(t, tenant, key, r.ID); httpStatus(err) != http.StatusConflict {
+		t.Errorf("SubmitShare to replaced secret: got %v, want 409", err)
+	}
+}
@@ -0,0 +1,420 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+func setupReencryptAPI(swPlugin *swagger.Plugin) {
+	api := &ReencryptAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Reencrypt", Description: "Reencrypt API list"})
+
+	handleTenantAPI(http.MethodPost, "/reencrypt", api.Post, "reencrypt values with the current crypt key of the tenant", tag)
+}
+
+// ReencryptAPI is TenantのCryptKeyを変更した後に、以前のCryptKeyでEncryptした値をEncryptし直すAPI
+// CryptKeyのProviderを変更することで、別のKey Management ServiceにSecretを移すことができる
+// RedundantCryptKeysを変更した後に、既存の値を新しいCryptKeyの組み合わせでEncryptし直す場合にも利用する
+type ReencryptAPI struct{}
+
+// ReencryptAPIPostRequest is ReencryptAPI Post Request
+// FromはTenantに以前設定していたCryptKeyで、省略した場合は現在のCryptKey. Prefixを指定した場合はPrefix配下だけを処理する
+// EnvelopeはCryptKeyを記録しているので、Fromに関わらずDecryptできる
+// DryRunの場合はDecryptできるかだけを確認し、保存しない
+type ReencryptAPIPostRequest struct {
+	From   CryptKey `json:"from"`
+	Prefix string   `json:"prefix" swagger:",keyPrefix"`
+	DryRun bool     `json:"dryRun"`
+}
+
+// ReencryptAPIPostResponse is ReencryptAPI Post Response
+// Skippedは既に現在のCryptKeyでEncryptされていた値の数
+type ReencryptAPIPostResponse struct {
+	From        string             `json:"from"`
+	To          []string           `json:"to"`
+	DryRun      bool               `json:"dryRun"`
+	Reencrypted []*ReencryptedItem `json:"reencrypted"`
+	Skipped     int                `json:"skipped"`
+}
+
+// ReencryptedItem is Encryptし直した値を持つEntity
+type ReencryptedItem struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+}
+
+// Post is Secretとその履歴, 承認待ちのSecretChangeRequest, WebhookSubscriptionのSigningSecret, QuorumSecretのShareのHashを
+// Fromから現在のCryptKeyでEncryptし直すhandler. Tenantの管理者だけが利用できる
+// Secretの内容は変わらないのでVersionは変えず、Encryptし直したSecret毎にsecret.rotatedのEventを発行する
+// 途中で失敗した場合は同じRequestをやり直せばよい
+func (api *ReencryptAPI) Post(ctx context.Context, form *ReencryptAPIPostRequest) (*ReencryptAPIPostResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+
+	from := form.From
+	if from.KeyName == "" {
+		from = t.CryptKey
+	}
+	if !KeyProviderRegistered(from.Provider) {
+		return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("key provider %s is not available.", from.Provider)}
+	}
+	prefix := NormalizeKeyPrefix(form.Prefix)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	re := &reencrypter{
+		kms:   NewCrypter(),
+		from:  from,
+		to:    t.CryptKeys(),
+		actor: u.Email,
+	}
+	resp := &ReencryptAPIPostResponse{
+		From:        from.Name(),
+		To:          cryptKeyNames(re.to),
+		DryRun:      form.DryRun,
+		Reencrypted: []*ReencryptedItem{},
+	}
+	steps := []func(ctx context.Context, ds datastore.Client, t *Tenant, prefix string, dryRun bool, resp *ReencryptAPIPostResponse) error{
+		re.secrets,
+		re.secretVersions,
+		re.changeRequests,
+		re.webhookSubscriptions,
+		re.quorumSecrets,
+	}
+	for _, step := range steps {
+		if err := step(ctx, ds, t, prefix, form.DryRun, resp); err != nil {
+			return nil, err
+		}
+	}
+	if form.DryRun || len(resp.Reencrypted) == 0 {
+		return resp, nil
+	}
+
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		return putAuditLog(tx, ds, t, &AuditLog{
+			Action:     AuditReencrypted,
+			Key:        prefix,
+			Actor:      u.Email,
+			Comment:    fmt.Sprintf("%s -> %s, %d values", resp.From, strings.Join(resp.To, ","), len(resp.Reencrypted)),
+			OccurredAt: time.Now(),
+		})
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "failed put audit log")
+	}
+	return resp, nil
+}
+
+// reencrypter is fromでEncryptした値をtoでEncryptし直す. toが複数の場合はEnvelopeにする
+// actorはEncryptし直したSecretのEventに記録する
+type reencrypter struct {
+	kms   *Crypter
+	from  CryptKey
+	to    []CryptKey
+	actor string
+}
+
+// reencrypt is ciphertextをtoでEncryptし直したCiphertextを返す. 既にtoでEncryptされている場合は空文字を返す
+func (re *reencrypter) reencrypt(ctx context.Context, ciphertext string) (string, error) {
+	name, raw := SplitCiphertext(ciphertext)
+	var pt string
+	if name == KeyProviderEnvelope {
+		env, err := parseEnvelope(raw)
+		if err != nil {
+			return "", err
+		}
+		if env.wrappedBy(re.to) {
+			return "", nil
+		}
+		pt, err = re.kms.Decrypt(ctx, re.from, ciphertext)
+		if err != nil {
+			return "", err
+		}
+	} else {
+		if len(re.to) == 1 && sameCryptKey(re.from, re.to[0]) {
+			return "", nil
+		}
+		err := fmt.Errorf("ciphertext is encrypted by %s", name)
+		if name == keyProviderName(re.from) {
+			pt, err = re.kms.Decrypt(ctx, re.from, ciphertext)
+		}
+		if err != nil {
+			// Requestをやり直した場合や、CryptKeyを変更した後に書き込まれた値は既に現在のCryptKeyでEncryptされている
+			var terr error
+			pt, terr = re.kms.Decrypt(ctx, re.to[0], ciphertext)
+			if terr != nil {
+				return "", err
+			}
+			if len(re.to) == 1 {
+				return "", nil
+			}
+		}
+	}
+	return re.kms.EncryptMulti(ctx, re.to, pt)
+}
+
+func cryptKeyNames(keys []CryptKey) []string {
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.Name()
+	}
+	return names
+}
+
+func (re *reencrypter) secrets(ctx context.Context, ds datastore.Client, t *Tenant, prefix string, dryRun bool, resp *ReencryptAPIPostResponse) error {
+	keys, err := platform.SecretStore.List(ctx, t, prefix)
+	if err != nil {
+		return err
+	}
+	list, err := platform.SecretStore.GetMulti(ctx, t, keys)
+	if err != nil {
+		return errors.Wrapf(err, "failed get secrets. prefix=%s", prefix)
+	}
+	for i, s := range list {
+		if s.AliasOf != "" {
+			continue
+		}
+		ct, err := re.reencrypt(ctx, s.Value)
+		if err != nil {
+			return errors.Wrapf(err, "failed reencrypt secret. key=%s", keys[i])
+		}
+		if ct == "" {
+			resp.Skipped++
+			continue
+		}
+		if !dryRun {
+			var rotated bool
+			err := platform.SecretStore.RunInTransaction(ctx, t, func(tx SecretTx) error {
+				rotated = false
+				cur, err := tx.Get(keys[i])
+				if err == ErrSecretNotFound {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				// 読んだ後に更新された値は、現在のCryptKeyでEncryptされている
+				if cur.Value != s.Value {
+					return nil
+				}
+				cur.Value = ct
+				rotated = true
+				return tx.Put(keys[i], cur)
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed put secret. key=%s", keys[i])
+			}
+			if rotated {
+				PublishSecretEvent(ctx, ds, t, &SecretEvent{Type: SecretEventRotated, Key: keys[i], Version: s.Version, Actor: re.actor})
+			}
+		}
+		resp.Reencrypted = append(resp.Reencrypted, &ReencryptedItem{Kind: SecretKind, Key: keys[i]})
+	}
+	return nil
+}
+
+// secretVersions is Secretの履歴をEncryptし直す. 履歴は削除されたSecretには残らないので、存在するSecretの履歴だけを対象にする
+// 値は変わらないので、Eventは発行しない
+func (re *reencrypter) secretVersions(ctx context.Context, ds datastore.Client, t *Tenant, prefix string, dryRun bool, resp *ReencryptAPIPostResponse) error {
+	keys, err := platform.SecretStore.List(ctx, t, prefix)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		list, err := listSecretVersions(ctx, ds, t, key)
+		if err != nil {
+			return err
+		}
+		for _, s := range list {
+			if s.AliasOf != "" {
+				continue
+			}
+			ct, err := re.reencrypt(ctx, s.Value)
+			if err != nil {
+				return errors.Wrapf(err, "failed reencrypt secret version. key=%s, version=%d", key, s.Version)
+			}
+			if ct == "" {
+				resp.Skipped++
+				continue
+			}
+			if !dryRun {
+				k := secretVersionKey(ds, t, key, s.Version)
+				_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+					cur := &Secret{}
+					if err := tx.Get(k, cur); err == datastore.ErrNoSuchEntity {
+						return nil
+					} else if err != nil {
+						return err
+					}
+					if cur.Value != s.Value {
+						return nil
+					}
+					cur.Value = ct
+					_, err := tx.Put(k, cur)
+					return err
+				})
+				if err != nil {
+					return errors.Wrapf(err, "failed put secret version. key=%s, version=%d", key, s.Version)
+				}
+			}
+			resp.Reencrypted = append(resp.Reencrypted, &ReencryptedItem{Kind: SecretVersionKind, Key: fmt.Sprintf("%s@%d", key, s.Version)})
+		}
+	}
+	return nil
+}
+
+func (re *reencrypter) changeRequests(ctx context.Context, ds datastore.Client, t *Tenant, prefix string, dryRun bool, resp *ReencryptAPIPostResponse) error {
+	var list []*SecretChangeRequest
+	q := t.NewQuery(ds, SecretChangeRequestKind).Filter("Status =", string(ChangeRequestPending))
+	keys, err := ds.GetAll(ctx, q, &list)
+	if err != nil {
+		return errors.Wrap(err, "failed list pending SecretChangeRequest")
+	}
+	for i, cr := range list {
+		if cr.AliasOf != "" || !HasKeyPrefix(cr.Key, prefix) {
+			continue
+		}
+		ct, err := re.reencrypt(ctx, cr.Value)
+		if err != nil {
+			return errors.Wrapf(err, "failed reencrypt change request. id=%s", keys[i].Name())
+		}
+		if ct == "" {
+			resp.Skipped++
+			continue
+		}
+		if !dryRun {
+			_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+				cur := &SecretChangeRequest{}
+				if err := tx.Get(keys[i], cur); err != nil {
+					return err
+				}
+				if cur.Status != ChangeRequestPending || cur.Value != cr.Value {
+					return nil
+				}
+				cur.Value = ct
+				_, err := tx.Put(keys[i], cur)
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed put change request. id=%s", keys[i].Name())
+			}
+		}
+		resp.Reencrypted = append(resp.Reencrypted, &ReencryptedItem{Kind: SecretChangeRequestKind, Key: keys[i].Name()})
+	}
+	return nil
+}
+
+func (re *reencrypter) webhookSubscriptions(ctx context.Context, ds datastore.Client, t *Tenant, prefix string, dryRun bool, resp *ReencryptAPIPostResponse) error {
+	list, err := ListWebhookSubscriptions(ctx, ds, t)
+	if err != nil {
+		return err
+	}
+	for _, sub := range list {
+		if sub.SigningSecret == "" || !HasKeyPrefix(sub.Prefix, prefix) {
+			continue
+		}
+		ct, err := re.reencrypt(ctx, sub.SigningSecret)
+		if err != nil {
+			return errors.Wrapf(err, "failed reencrypt webhook subscription. id=%s", sub.ID)
+		}
+		if ct == "" {
+			resp.Skipped++
+			continue
+		}
+		if !dryRun {
+			k := t.NameKey(ds, WebhookSubscriptionKind, sub.ID, nil)
+			_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+				cur := &WebhookSubscription{}
+				if err := tx.Get(k, cur); err == datastore.ErrNoSuchEntity {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				if cur.SigningSecret != sub.SigningSecret {
+					return nil
+				}
+				cur.SigningSecret = ct
+				_, err := tx.Put(k, cur)
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed put webhook subscription. id=%s", sub.ID)
+			}
+		}
+		resp.Reencrypted = append(resp.Reencrypted, &ReencryptedItem{Kind: WebhookSubscriptionKind, Key: sub.ID})
+	}
+	return nil
+}
+
+// quorumSecrets is QuorumSecretのShareのHashをEncryptし直す. 提出中のQuorumRecoveryは期限が短いので対象にしない
+func (re *reencrypter) quorumSecrets(ctx context.Context, ds datastore.Client, t *Tenant, prefix string, dryRun bool, resp *ReencryptAPIPostResponse) error {
+	keys, err := listKeysUnder(ctx, ds, t, QuorumSecretKind, prefix)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		qs := &QuorumSecret{}
+		if err := ds.Get(ctx, k, qs); err != nil {
+			return errors.Wrapf(err, "failed get quorum secret. key=%s", k.Name())
+		}
+		hashes := make([]string, len(qs.Shares))
+		var changed bool
+		for i, share := range qs.Shares {
+			ct, err := re.reencrypt(ctx, share.Hash)
+			if err != nil {
+				return errors.Wrapf(err, "failed reencrypt quorum share. key=%s, custodian=%s", k.Name(), share.Custodian)
+			}
+			if ct != "" {
+				hashes[i], changed = ct, true
+			}
+		}
+		if !changed {
+			resp.Skipped++
+			continue
+		}
+		if !dryRun {
+			_, err := ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+				cur := &QuorumSecret{}
+				if err := tx.Get(k, cur); err != nil {
+					return err
+				}
+				if cur.Version != qs.Version || len(cur.Shares) != len(hashes) {
+					return nil
+				}
+				for i, h := range hashes {
+					if h != "" {
+						cur.Shares[i].Hash = h
+					}
+				}
+				_, err := tx.Put(k, cur)
+				return err
+			})
+			if err != nil {
+				return errors.Wrapf(err, "failed put quorum secret. key=%s", k.Name())
+			}
+		}
+		resp.Reencrypted = append(resp.Reencrypted, &ReencryptedItem{Kind: QuorumSecretKind, Key: k.Name()})
+	}
+	return nil
+}
@@ -0,0 +1,600 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/user"
+)
+
+// ReplicationRuleKind is ReplicationRule EntityのKind
+const ReplicationRuleKind = "ReplicationRule"
+
+// ReplicationStateKind is ReplicationState EntityのKind
+const ReplicationStateKind = "ReplicationState"
+
+// ReplicationHeader is 複製による書き込みであることを表すHeader. 値は複製元のReplicationRuleのID
+// このHeaderが付いた書き込みは、書き込まれた側のReplicationRuleでは複製しない
+// TenantのReplicationPeersに登録したuserからのRequestでのみ受け付ける
+const ReplicationHeader = "X-Gcpsm-Replication"
+
+// ReplicationFromRequest is RequestのReplicationHeaderの値を返す
+// 複製元として登録されていないuserがHeaderを付けた場合は、複製の対象から外せないように403にする
+func ReplicationFromRequest(r *http.Request, t *Tenant, u *user.User) (string, error) {
+	rule := r.Header.Get(ReplicationHeader)
+	if rule == "" {
+		return "", nil
+	}
+	if !t.IsReplicationPeer(u) {
+		return "", &HTTPError{Code: http.StatusForbidden, Message: fmt.Sprintf("%s is only accepted from replication peers.", ReplicationHeader)}
+	}
+	return rule, nil
+}
+
+// replicationTimeout is 複製先のResponseを待つ時間
+const replicationTimeout = 10 * time.Second
+
+// ReplicationRule is Datastore Entity
+// Prefix自身、またはPrefix配下のSecretを別のgcpsmに同じKeyで複製する. 複製は一方向で、複製先での変更は取り込まない
+// 値は平文で複製先のAPIに送るので、複製先のCryptKeyでEncryptされる
+type ReplicationRule struct {
+	ID     string `json:"id" datastore:"-"`
+	Prefix string `json:"prefix"`
+	// Destination is 複製先のAPIのURL. 例: https://stg.example.com/api/1 , https://stg.example.com/api/1/t/payments
+	Destination string `json:"destination" datastore:",noindex"`
+	// AuthHeader is 複製先で認証に利用するHeader. 空の場合はAuthorization
+	AuthHeader string `json:"authHeader" datastore:",noindex"`
+	// AuthToken is AuthHeaderの値. KMSでEncryptして保存し、APIでは返さない
+	AuthToken string `json:"-" datastore:",noindex"`
+	// Deletes is 複製元で削除されたSecretを複製先でも削除する
+	Deletes   bool      `json:"deletes" datastore:",noindex"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// Matches is eventを複製する対象かを返す. 複製によって書き込まれたSecretは対象にしない
+func (rule *ReplicationRule) Matches(event *SecretEvent) bool {
+	if event.Replication != "" {
+		return false
+	}
+	// secret.rotatedは値が変わらず、複製先は複製先のCryptKeyでEncryptしているので対象にしない
+	switch event.Type {
+	case SecretEventUpdated:
+	case SecretEventDeleted:
+		if !rule.Deletes {
+			return false
+		}
+	default:
+		return false
+	}
+	return HasKeyPrefix(event.Key, rule.Prefix)
+}
+
+// ReplicationStatus is ReplicationStateの状態
+type ReplicationStatus string
+
+// ReplicationStatus List
+const (
+	ReplicationSynced ReplicationStatus = "synced"
+	// ReplicationPending is 複製先が保護されたPrefixで、SecretChangeRequestの承認待ち
+	ReplicationPending  ReplicationStatus = "pending"
+	ReplicationConflict ReplicationStatus = "conflict"
+	ReplicationFailed   ReplicationStatus = "failed"
+	ReplicationDeleted  ReplicationStatus = "deleted"
+)
+
+// ReplicationState is Datastore Entity
+// ReplicationRuleを親に持ち、Key Nameは複製したSecretのKey
+// 最後に複製した時の複製元と複製先のVersionを持ち、複製先のVersionが変わっていればConflictとする
+type ReplicationState struct {
+	Key                string            `json:"key" datastore:"-"`
+	Status             ReplicationStatus `json:"status"`
+	SourceVersion      int64             `json:"sourceVersion" datastore:",noindex"`
+	DestinationVersion int64             `json:"destinationVersion" datastore:",noindex"`
+	ChangeRequest      string            `json:"changeRequest,omitempty" datastore:",noindex"`
+	Error              string            `json:"error,omitempty" datastore:",noindex"`
+	UpdatedAt          time.Time         `json:"updatedAt" datastore:",noindex"`
+}
+
+// ReplicationAction is 複製先に対して行う操作
+type ReplicationAction string
+
+// ReplicationAction List
+const (
+	ReplicationCreate    ReplicationAction = "create"
+	ReplicationUpdate    ReplicationAction = "update"
+	ReplicationDelete    ReplicationAction = "delete"
+	ReplicationUnchanged ReplicationAction = "unchanged"
+	ReplicationConflicts ReplicationAction = "conflict"
+)
+
+// ReplicationDiff is 1つのSecretについて、複製元と複製先の差分と行う操作. 値は含めない
+type ReplicationDiff struct {
+	Key                string            `json:"key"`
+	Action             ReplicationAction `json:"action"`
+	SourceVersion      int64             `json:"sourceVersion,omitempty"`
+	DestinationVersion int64             `json:"destinationVersion,omitempty"`
+	Reason             string            `json:"reason,omitempty"`
+}
+
+// ReplicationTask is ReplicationQueueに積む内容
+type ReplicationTask struct {
+	Tenant string `json:"tenant"`
+	RuleID string `json:"ruleId"`
+	Key    string `json:"key"`
+}
+
+// ReplicationQueue is 複製を非同期に行うQueue
+// Enqueueしたtaskは、最終的にReplicateSecretで処理すること
+type ReplicationQueue interface {
+	Enqueue(ctx context.Context, task *ReplicationTask) error
+}
+
+// DefaultReplicationQueue is 複製に利用するQueue
+var DefaultReplicationQueue ReplicationQueue = &TaskQueueReplicationQueue{Queue: "replication", Path: "/api/internal/replication/push"}
+
+// ReplicationHTTPClient is 複製先のAPIの呼び出しに利用するhttp.Clientを返す
+// 同じProcessで動かす複製先に送る場合は、TransportをHandlerに差し替える
+var ReplicationHTTPClient = func(ctx context.Context) *http.Client {
+	return platform.HTTPClient(ctx)
+}
+
+// TaskQueueReplicationQueue is App Engine Task Queueで複製するReplicationQueue
+// RetryはTask Queueに任せるので、queue.yamlでRetryの間隔を設定する
+type TaskQueueReplicationQueue struct {
+	Queue string
+	Path  string
+}
+
+// Enqueue is ReplicationQueueを実装
+func (q *TaskQueueReplicationQueue) Enqueue(ctx context.Context, task *ReplicationTask) error {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return errors.Wrap(err, "failed marshal replication task")
+	}
+	t := &taskqueue.Task{
+		Path:    q.Path,
+		Payload: body,
+		Header:  http.Header{"Content-Type": []string{"application/json"}},
+		Method:  http.MethodPost,
+	}
+	if _, err := taskqueue.Add(ctx, t, q.Queue); err != nil {
+		return errors.Wrapf(err, "failed add replication task. rule=%s, key=%s", task.RuleID, task.Key)
+	}
+	return nil
+}
+
+// SyncReplicationQueue is Enqueueしたその場で複製するReplicationQueue
+// Task Queueが使えない環境で利用する. 失敗した場合はRetryせず、ReplicationStateに記録するだけとなる
+type SyncReplicationQueue struct{}
+
+// Enqueue is ReplicationQueueを実装
+func (q *SyncReplicationQueue) Enqueue(ctx context.Context, task *ReplicationTask) error {
+	_, err := ReplicateSecret(ctx, task, false)
+	if err == errReplicationRetry {
+		return nil
+	}
+	return err
+}
+
+// ValidateReplicationDestination is 複製先として利用できるURLかを確認する. localhost以外はhttpsのみ許可する
+func ValidateReplicationDestination(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+		return &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid replication destination: %q", raw)}
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if h := u.Hostname(); h == "localhost" || h == "127.0.0.1" {
+			return nil
+		}
+	}
+	return &HTTPError{Code: http.StatusBadRequest, Message: "replication destination must be https."}
+}
+
+// ListReplicationRules is TenantのReplicationRuleを全て返す
+func ListReplicationRules(ctx context.Context, ds datastore.Client, t *Tenant) ([]*ReplicationRule, error) {
+	var list []*ReplicationRule
+	keys, err := ds.GetAll(ctx, t.NewQuery(ds, ReplicationRuleKind), &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list ReplicationRule")
+	}
+	for i, k := range keys {
+		list[i].ID = k.Name()
+	}
+	return list, nil
+}
+
+// ListReplicationStates is ReplicationRuleのReplicationStateをKeyの昇順で返す
+func ListReplicationStates(ctx context.Context, ds datastore.Client, t *Tenant, ruleID string) ([]*ReplicationState, error) {
+	q := t.NewQuery(ds, ReplicationStateKind).Ancestor(t.NameKey(ds, ReplicationRuleKind, ruleID, nil))
+	var list []*ReplicationState
+	keys, err := ds.GetAll(ctx, q, &list)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed list ReplicationState. rule=%s", ruleID)
+	}
+	for i, k := range keys {
+		list[i].Key = k.Name()
+	}
+	return list, nil
+}
+
+// enqueueReplication is eventを対象とする全てのReplicationRuleに複製を予約する
+func enqueueReplication(ctx context.Context, ds datastore.Client, t *Tenant, event *SecretEvent) error {
+	if event.Replication != "" {
+		return nil
+	}
+	rules, err := ListReplicationRules(ctx, ds, t)
+	if err != nil {
+		return err
+	}
+	for _, rule := range rules {
+		if !rule.Matches(event) {
+			continue
+		}
+		if err := DefaultReplicationQueue.Enqueue(ctx, &ReplicationTask{Tenant: t.ID, RuleID: rule.ID, Key: event.Key}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// errReplicationRetry is 複製先に送れず、Retryが必要であることを表す
+var errReplicationRetry = errors.New("replication: destination is unavailable, retry later")
+
+// ReplicateSecret is ReplicationTaskのSecretを複製し、ReplicationStateに結果を記録する
+// 複製先と通信できなかった場合はerrReplicationRetryを返す. Conflictの場合はforceでなければ複製しない
+func ReplicateSecret(ctx context.Context, task *ReplicationTask, force bool) (*ReplicationDiff, error) {
+	t, err := webhookTenant(ctx, task.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rule := &ReplicationRule{}
+	if err := ds.Get(ctx, t.NameKey(ds, ReplicationRuleKind, task.RuleID, nil), rule); err == datastore.ErrNoSuchEntity {
+		// Ruleが削除された場合は複製しない
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed get ReplicationRule. rule=%s", task.RuleID)
+	}
+	rule.ID = task.RuleID
+
+	r, err := newReplicator(ctx, ds, t, rule)
+	if err != nil {
+		return nil, err
+	}
+	st, err := r.state(ctx, task.Key)
+	if err != nil {
+		return nil, err
+	}
+	return r.replicate(ctx, task.Key, st, force, false)
+}
+
+// replicator is 1つのReplicationRuleの複製を行う
+// actorはAuditLogに記録するuserで、Secretの変更による複製ではRuleの作成者とする
+type replicator struct {
+	ds    datastore.Client
+	t     *Tenant
+	rule  *ReplicationRule
+	token string
+	actor string
+	kms   *Crypter
+}
+
+func newReplicator(ctx context.Context, ds datastore.Client, t *Tenant, rule *ReplicationRule) (*replicator, error) {
+	r := &replicator{ds: ds, t: t, rule: rule, actor: rule.CreatedBy, kms: NewCrypter()}
+	if rule.AuthToken != "" {
+		token, err := r.kms.DecryptMulti(ctx, t.CryptKeys(), rule.AuthToken)
+		if err != nil {
+			return nil, err
+		}
+		r.token = token
+	}
+	return r, nil
+}
+
+func (r *replicator) stateKey(key string) datastore.Key {
+	return r.t.NameKey(r.ds, ReplicationStateKind, key, r.t.NameKey(r.ds, ReplicationRuleKind, r.rule.ID, nil))
+}
+
+// state is keyのReplicationStateを返す. まだ複製していない場合はnil
+func (r *replicator) state(ctx context.Context, key string) (*ReplicationState, error) {
+	st := &ReplicationState{}
+	if err := r.ds.Get(ctx, r.stateKey(key), st); err == datastore.ErrNoSuchEntity {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed get ReplicationState. rule=%s, key=%s", r.rule.ID, key)
+	}
+	st.Key = key
+	return st, nil
+}
+
+func (r *replicator) putState(ctx context.Context, st *ReplicationState) error {
+	st.UpdatedAt = time.Now()
+	if _, err := r.ds.Put(ctx, r.stateKey(st.Key), st); err != nil {
+		return errors.Wrapf(err, "failed put ReplicationState. rule=%s, key=%s", r.rule.ID, st.Key)
+	}
+	return nil
+}
+
+// replicate is keyの差分を求め、dryRunでなければ複製先に反映してReplicationStateを更新する
+// forceの場合はConflictでも複製元の値で上書きする
+func (r *replicator) replicate(ctx context.Context, key string, st *ReplicationState, force bool, dryRun bool) (*ReplicationDiff, error) {
+	src, err := r.source(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	dst, err := r.get(ctx, key)
+	if err != nil {
+		if dryRun {
+			return nil, err
+		}
+		return nil, r.fail(ctx, key, st, err)
+	}
+	d := planReplication(key, src, dst, st, r.rule.Deletes)
+	forced := force && d.Action == ReplicationConflicts
+	if forced {
+		d.Action, d.Reason = ReplicationUpdate, "overwritten: "+d.Reason
+		if src == nil {
+			d.Action = ReplicationDelete
+		} else if dst == nil {
+			d.Action = ReplicationCreate
+		}
+	}
+	if dryRun {
+		return d, nil
+	}
+
+	var resp *SecretAPIPostResponse
+	switch d.Action {
+	case ReplicationCreate, ReplicationUpdate:
+		resp, err = r.post(ctx, key, src, dst)
+	case ReplicationDelete:
+		err = r.delete(ctx, key, dst)
+	}
+	if he, ok := err.(*HTTPError); ok && he.Code == http.StatusPreconditionFailed {
+		d.Action, d.Reason, err = ReplicationConflicts, "updated at destination during replication.", nil
+	}
+	if err != nil {
+		return nil, r.fail(ctx, key, st, err)
+	}
+
+	next := &ReplicationState{Key: key, Status: ReplicationSynced, SourceVersion: d.SourceVersion, DestinationVersion: d.DestinationVersion}
+	switch d.Action {
+	case ReplicationUnchanged:
+		if st == nil && dst == nil {
+			// 複製したことも複製先に存在したこともないので記録しない
+			return d, nil
+		}
+		if src == nil {
+			next.Status = ReplicationDeleted
+		}
+	case ReplicationConflicts:
+		next = &ReplicationState{Key: key, Status: ReplicationConflict, Error: d.Reason}
+		if st != nil {
+			next.SourceVersion, next.DestinationVersion = st.SourceVersion, st.DestinationVersion
+		}
+		if st == nil || st.Status != ReplicationConflict {
+			// 同じConflictを何度も記録しない
+			if err := WriteAuditLog(ctx, r.ds, r.t, &AuditLog{Action: AuditReplicationConflict, Key: key, Actor: r.actor, Target: r.rule.ID, Comment: d.Reason}); err != nil {
+				return nil, err
+			}
+		}
+	case ReplicationDelete:
+		next.Status, next.DestinationVersion = ReplicationDeleted, 0
+	default:
+		next.DestinationVersion = resp.Version
+		if resp.ChangeRequest != "" {
+			next.Status, next.ChangeRequest = ReplicationPending, resp.ChangeRequest
+		}
+	}
+	if forced {
+		if err := WriteAuditLog(ctx, r.ds, r.t, &AuditLog{Action: AuditReplicationForced, Key: key, Actor: r.actor, Target: r.rule.ID, Comment: d.Reason}); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.putState(ctx, next); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// fail is 複製先と通信できなかったことを記録し、errReplicationRetryを返す
+func (r *replicator) fail(ctx context.Context, key string, st *ReplicationState, err error) error {
+	next := &ReplicationState{Key: key, Status: ReplicationFailed, Error: err.Error()}
+	if st != nil {
+		next.SourceVersion, next.DestinationVersion, next.ChangeRequest = st.SourceVersion, st.DestinationVersion, st.ChangeRequest
+	}
+	if perr := r.putState(ctx, next); perr != nil {
+		return perr
+	}
+	log.Warningf(ctx, "failed replicate secret. rule=%s, key=%s, err=%v", r.rule.ID, key, err)
+	return errReplicationRetry
+}
+
+// replicatedSecret is 複製元または複製先のSecretの値. Aliasの場合はAliasOfだけを持つ
+type replicatedSecret struct {
+	Value   string
+	AliasOf string
+	Version int64
+}
+
+// source is 複製元のSecretをDecryptして返す. 存在しない場合はnil
+func (r *replicator) source(ctx context.Context, key string) (*replicatedSecret, error) {
+	s, err := platform.SecretStore.Get(ctx, r.t, key)
+	if err == ErrSecretNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	rs := &replicatedSecret{AliasOf: s.AliasOf, Version: s.Version}
+	if s.AliasOf == "" {
+		rs.Value, err = r.kms.DecryptMulti(ctx, r.t.CryptKeys(), s.Value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rs, nil
+}
+
+// planReplication is 複製元src, 複製先dst, 前回の複製stから行う操作を決める. src, dst, stは存在しない場合nil
+// 複製先が前回の複製から変更されている場合、まだ複製していないKeyが複製先に異なる値で存在する場合はConflictとする
+// 複製先で承認待ちの場合は、承認によってVersionが変わるのでConflictとしない
+func planReplication(key string, src *replicatedSecret, dst *replicatedSecret, st *ReplicationState, deletes bool) *ReplicationDiff {
+	d := &ReplicationDiff{Key: key, Action: ReplicationUnchanged}
+	if src != nil {
+		d.SourceVersion = src.Version
+	}
+	if dst != nil {
+		d.DestinationVersion = dst.Version
+	}
+	replicated := st != nil && st.Status != ReplicationDeleted && st.Status != ReplicationConflict
+	changed := st != nil && (st.Status == ReplicationConflict || (st.Status != ReplicationPending && dst != nil && dst.Version != st.DestinationVersion))
+
+	if src == nil {
+		switch {
+		case dst == nil:
+		case !deletes:
+			d.Reason = "deletes are not replicated."
+		case st == nil || st.Status == ReplicationDeleted:
+			d.Reason = "not replicated from this source."
+		case changed:
+			d.Action, d.Reason = ReplicationConflicts, "updated at destination."
+		default:
+			d.Action = ReplicationDelete
+		}
+		return d
+	}
+
+	switch {
+	case dst == nil:
+		d.Action = ReplicationCreate
+		if replicated {
+			d.Action, d.Reason = ReplicationConflicts, "deleted at destination."
+		}
+	case dst.Value == src.Value && dst.AliasOf == src.AliasOf:
+		// 同じ値であれば複製先のVersionを引き継ぐ. 手で複製していたSecretもここで揃う
+	case st == nil || st.Status == ReplicationDeleted:
+		d.Action, d.Reason = ReplicationConflicts, "exists at destination with a different value."
+	case changed:
+		d.Action, d.Reason = ReplicationConflicts, "updated at destination."
+	default:
+		d.Action = ReplicationUpdate
+	}
+	return d
+}
+
+// secretURL is 複製先のSecret APIのURL. Keyの / は %2F にする
+func (r *replicator) secretURL(key string) string {
+	u := strings.TrimRight(r.rule.Destination, "/") + "/secret"
+	if key != "" {
+		u += "/" + url.PathEscape(key)
+	}
+	return u
+}
+
+// get is 複製先のSecretをAliasとReferenceを解決せずに返す. 存在しない場合はnil
+func (r *replicator) get(ctx context.Context, key string) (*replicatedSecret, error) {
+	resp := &SecretAPIGetResponse{}
+	if err := r.do(ctx, http.MethodGet, r.secretURL(key)+"?raw=true", nil, nil, resp); err != nil {
+		if he, ok := err.(*HTTPError); ok && he.Code == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &replicatedSecret{Value: resp.Value, AliasOf: resp.AliasOf, Version: resp.Version}, nil
+}
+
+// post is 複製先にsrcを書き込む. dstのVersionが変わっていれば複製先が412を返す
+func (r *replicator) post(ctx context.Context, key string, src *replicatedSecret, dst *replicatedSecret) (*SecretAPIPostResponse, error) {
+	h := http.Header{}
+	if dst == nil {
+		h.Set("If-None-Match", "*")
+	} else {
+		h.Set("If-Match", fmt.Sprintf(`"%d"`, dst.Version))
+	}
+	body := &SecretAPIPostRequest{Key: key, Value: src.Value, AliasOf: src.AliasOf}
+	resp := &SecretAPIPostResponse{}
+	if err := r.do(ctx, http.MethodPost, r.secretURL(""), body, h, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (r *replicator) delete(ctx context.Context, key string, dst *replicatedSecret) error {
+	h := http.Header{}
+	h.Set("If-Match", fmt.Sprintf(`"%d"`, dst.Version))
+	return r.do(ctx, http.MethodDelete, r.secretURL(key), nil, h, nil)
+}
+
+// do is 複製先のAPIを呼び出す. 2xx以外は複製先が返したHTTPErrorにする
+func (r *replicator) do(ctx context.Context, method string, u string, body interface{}, header http.Header, v interface{}) error {
+	var rb io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "failed marshal replication request")
+		}
+		rb = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, rb)
+	if err != nil {
+		return errors.Wrap(err, "failed create replication request")
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	req.Header.Set(ReplicationHeader, r.rule.ID)
+	if r.token != "" {
+		h := r.rule.AuthHeader
+		if h == "" {
+			h = "Authorization"
+		}
+		req.Header.Set(h, r.token)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, replicationTimeout)
+	defer cancel()
+	resp, err := ReplicationHTTPClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed send replication request")
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return errors.Wrap(err, "failed read replication response")
+	}
+	if resp.StatusCode/100 != 2 {
+		he := &HTTPError{}
+		if err := json.Unmarshal(b, he); err != nil || he.Code == 0 {
+			he = &HTTPError{Code: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+		}
+		return he
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return errors.Wrap(err, "failed parse replication response")
+	}
+	return nil
+}
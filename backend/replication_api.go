@@ -0,0 +1,384 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+func setupReplicationAPI(swPlugin *swagger.Plugin) {
+	api := &ReplicationAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Replication", Description: "Replication API list"})
+
+	handleTenantAPI(http.MethodPost, "/replication", api.Post, "replicate secrets of prefix to another gcpsm", tag)
+	handleTenantAPI(http.MethodGet, "/replication", api.List, "list replication rules", tag)
+	handleTenantAPI(http.MethodDelete, "/replication/{id}", api.Delete, "delete replication rule", tag)
+	handleTenantAPI(http.MethodGet, "/replication/{id}/status", api.Status, "list replication status of secrets", tag)
+	handleTenantAPI(http.MethodPost, "/replication/{id}/sync", api.Sync, "replicate all secrets of rule, or show the diff with dryRun", tag)
+
+	// Task Queueから呼ばれるHandler. app.yamlでlogin: adminにしている
+	ucon.HandleFunc(http.MethodPost, "/api/internal/replication/push", api.Push)
+}
+
+// ReplicationAPI is API to manage ReplicationRule
+// 複製先には値を平文で送るので、Tenantの管理者のみ利用できる
+type ReplicationAPI struct{}
+
+// ReplicationAPIPostRequest is ReplicationAPI Post Request
+// AuthTokenは複製先で認証に利用する値で、AuthHeaderを省略した場合は Authorization: {AuthToken} として送る
+type ReplicationAPIPostRequest struct {
+	Prefix      string `json:"prefix" swagger:",keyPrefix"`
+	Destination string `json:"destination" swagger:",req"`
+	AuthHeader  string `json:"authHeader"`
+	AuthToken   string `json:"authToken"`
+	Deletes     bool   `json:"deletes"`
+}
+
+// Post is ReplicationRule registration handler
+// 既存のSecretは複製しないので、Syncで複製すること
+func (api *ReplicationAPI) Post(ctx context.Context, form *ReplicationAPIPostRequest) (*ReplicationRule, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	if err := ValidateReplicationDestination(form.Destination); err != nil {
+		return nil, err
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &ReplicationRule{
+		ID:          newRandomID(),
+		Prefix:      NormalizeKeyPrefix(form.Prefix),
+		Destination: form.Destination,
+		AuthHeader:  form.AuthHeader,
+		Deletes:     form.Deletes,
+		CreatedBy:   u.Email,
+		CreatedAt:   time.Now(),
+	}
+	if form.AuthToken != "" {
+		rule.AuthToken, err = NewCrypter().EncryptMulti(ctx, t.CryptKeys(), form.AuthToken)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if _, err := ds.Put(ctx, t.NameKey(ds, ReplicationRuleKind, rule.ID, nil), rule); err != nil {
+		return nil, errors.Wrap(err, "failed put ReplicationRule")
+	}
+	return rule, nil
+}
+
+// ReplicationAPIListResponse is ReplicationAPI List Response
+type ReplicationAPIListResponse struct {
+	List []*ReplicationRule `json:"list"`
+}
+
+// List is ReplicationRule list handler
+func (api *ReplicationAPI) List(ctx context.Context) (*ReplicationAPIListResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := ListReplicationRules(ctx, ds, t)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		list = []*ReplicationRule{}
+	}
+	return &ReplicationAPIListResponse{
+		List: list,
+	}, nil
+}
+
+// ReplicationAPIDeleteRequest is ReplicationAPI Delete Request
+type ReplicationAPIDeleteRequest struct {
+	ID string `json:"id" swagger:",in=path"`
+}
+
+// Delete is ReplicationRule delete handler. ReplicationStateも削除する. 複製先のSecretは削除しない
+func (api *ReplicationAPI) Delete(ctx context.Context, form *ReplicationAPIDeleteRequest) error {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	k, _, err := getReplicationRule(ctx, ds, t, form.ID)
+	if err != nil {
+		return err
+	}
+	keys, err := ds.GetAll(ctx, t.NewQuery(ds, ReplicationStateKind).Ancestor(k).KeysOnly(), nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed list ReplicationState. rule=%s", form.ID)
+	}
+	keys = append(keys, k)
+	for i := 0; i < len(keys); i += datastoreBatchSize {
+		j := i + datastoreBatchSize
+		if j > len(keys) {
+			j = len(keys)
+		}
+		if err := ds.DeleteMulti(ctx, keys[i:j]); err != nil {
+			return errors.Wrapf(err, "failed delete ReplicationRule. rule=%s", form.ID)
+		}
+	}
+	return nil
+}
+
+// ReplicationAPIStatusRequest is ReplicationAPI Status Request
+type ReplicationAPIStatusRequest struct {
+	ID     string            `json:"id" swagger:",in=path"`
+	Status ReplicationStatus `json:"status" swagger:",in=query"`
+}
+
+// ReplicationAPIStatusResponse is ReplicationAPI Status Response
+// Listはstatusを指定した場合はそのStatusのものだけを返す
+type ReplicationAPIStatusResponse struct {
+	Rule   *ReplicationRule    `json:"rule"`
+	Counts *ReplicationCounts  `json:"counts"`
+	List   []*ReplicationState `json:"list"`
+}
+
+// ReplicationCounts is Status毎のSecretの数
+type ReplicationCounts struct {
+	Synced   int `json:"synced"`
+	Pending  int `json:"pending"`
+	Conflict int `json:"conflict"`
+	Failed   int `json:"failed"`
+	Deleted  int `json:"deleted"`
+}
+
+func (c *ReplicationCounts) add(status ReplicationStatus) {
+	switch status {
+	case ReplicationSynced:
+		c.Synced++
+	case ReplicationPending:
+		c.Pending++
+	case ReplicationConflict:
+		c.Conflict++
+	case ReplicationFailed:
+		c.Failed++
+	case ReplicationDeleted:
+		c.Deleted++
+	}
+}
+
+// Status is ReplicationRuleで複製したSecretの状態を返すhandler
+func (api *ReplicationAPI) Status(ctx context.Context, form *ReplicationAPIStatusRequest) (*ReplicationAPIStatusResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, rule, err := getReplicationRule(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	states, err := ListReplicationStates(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ReplicationAPIStatusResponse{
+		Rule:   rule,
+		Counts: &ReplicationCounts{},
+		List:   []*ReplicationState{},
+	}
+	for _, st := range states {
+		resp.Counts.add(st.Status)
+		if form.Status == "" || st.Status == form.Status {
+			resp.List = append(resp.List, st)
+		}
+	}
+	return resp, nil
+}
+
+// ReplicationAPISyncRequest is ReplicationAPI Sync Request
+// Prefixを指定した場合は、RuleのPrefixのうちPrefix配下だけを対象にする
+type ReplicationAPISyncRequest struct {
+	ID     string `json:"id" swagger:",in=path"`
+	Prefix string `json:"prefix" swagger:",keyPrefix"`
+	DryRun bool   `json:"dryRun"`
+	Force  bool   `json:"force"`
+}
+
+// ReplicationAPISyncResponse is ReplicationAPI Sync Response
+type ReplicationAPISyncResponse struct {
+	DryRun bool               `json:"dryRun"`
+	Diff   []*ReplicationDiff `json:"diff"`
+}
+
+// Sync is 複製元のSecretと、これまでに複製したSecretを全て複製するhandler
+// DryRunの場合は複製先に書き込まず、差分だけを返す. Forceの場合は複製先で変更されたSecretも上書きする
+func (api *ReplicationAPI) Sync(ctx context.Context, form *ReplicationAPISyncRequest) (*ReplicationAPISyncResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if !t.IsAdmin(u) {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, rule, err := getReplicationRule(ctx, ds, t, form.ID)
+	if err != nil {
+		return nil, err
+	}
+	prefix := NormalizeKeyPrefix(form.Prefix)
+	if !HasKeyPrefix(prefix, rule.Prefix) {
+		if !HasKeyPrefix(rule.Prefix, prefix) {
+			return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("prefix %s is not replicated by rule %s.", prefix, rule.ID)}
+		}
+		prefix = rule.Prefix
+	}
+
+	r, err := newReplicator(ctx, ds, t, rule)
+	if err != nil {
+		return nil, err
+	}
+	r.actor = u.Email
+	keys, states, err := replicationTargets(ctx, ds, t, rule.ID, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &ReplicationAPISyncResponse{
+		DryRun: form.DryRun,
+		Diff:   []*ReplicationDiff{},
+	}
+	for _, key := range keys {
+		d, err := r.replicate(ctx, key, states[key], form.Force, form.DryRun)
+		if err == errReplicationRetry {
+			return nil, &HTTPError{Code: http.StatusBadGateway, Message: fmt.Sprintf("failed replicate %s. see replication status.", key)}
+		} else if he, ok := err.(*HTTPError); ok && form.DryRun {
+			// 複製先が返したErrorをそのまま返すと、このAPIのErrorと区別できない
+			return nil, &HTTPError{Code: http.StatusBadGateway, Message: fmt.Sprintf("destination returned %d for %s: %v", he.Code, key, he.Message)}
+		} else if err != nil {
+			return nil, err
+		}
+		resp.Diff = append(resp.Diff, d)
+	}
+	return resp, nil
+}
+
+// Push is Task Queueから1つのSecretを複製するhandler
+// 複製先と通信できなかった場合は503を返し、Task QueueにRetryさせる
+func (api *ReplicationAPI) Push(ctx context.Context, r *http.Request, form *ReplicationTask) error {
+	if r.Header.Get("X-AppEngine-QueueName") == "" {
+		// X-AppEngine-QueueNameはApp Engineの外から付けることができない
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	retryCount, _ := strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+
+	_, err := ReplicateSecret(ctx, form, false)
+	if err == errReplicationRetry {
+		if retryCount+1 >= maxWebhookAttempts {
+			// ReplicationStateにfailedとして残っているので、Syncで複製し直す
+			return nil
+		}
+		return &HTTPError{Code: http.StatusServiceUnavailable, Reason: ReasonUnavailable, Message: "replication failed.", Retriable: true}
+	}
+	return err
+}
+
+// replicationTargets is prefix配下の複製元のSecretと、これまでに複製したSecretのKeyを昇順で返す
+func replicationTargets(ctx context.Context, ds datastore.Client, t *Tenant, ruleID string, prefix string) ([]string, map[string]*ReplicationState, error) {
+	keys, err := platform.SecretStore.List(ctx, t, prefix)
+	if err != nil {
+		return nil, nil, err
+	}
+	list, err := ListReplicationStates(ctx, ds, t, ruleID)
+	if err != nil {
+		return nil, nil, err
+	}
+	states := make(map[string]*ReplicationState, len(list))
+	for _, st := range list {
+		states[st.Key] = st
+	}
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		seen[k] = true
+	}
+	for _, st := range list {
+		if !seen[st.Key] && HasKeyPrefix(st.Key, prefix) {
+			keys = append(keys, st.Key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, states, nil
+}
+
+// getReplicationRule is TenantのReplicationRuleを返す
+func getReplicationRule(ctx context.Context, ds datastore.Client, t *Tenant, id string) (datastore.Key, *ReplicationRule, error) {
+	k := t.NameKey(ds, ReplicationRuleKind, id, nil)
+	rule := &ReplicationRule{}
+	if err := ds.Get(ctx, k, rule); err == datastore.ErrNoSuchEntity {
+		return nil, nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("replication %s is not found.", id)}
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed get ReplicationRule. id=%s", id)
+	}
+	rule.ID = id
+	return k, rule, nil
+}
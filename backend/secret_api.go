@@ -3,149 +3,350 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"time"
 
-	"github.com/favclip/ucon"
 	"github.com/favclip/ucon/swagger"
-	"google.golang.org/appengine"
-	"google.golang.org/appengine/log"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
 	"google.golang.org/appengine/user"
 )
 
 func setupSecretAPI(swPlugin *swagger.Plugin) {
 	api := &SecretAPI{}
 	tag := swPlugin.AddTag(&swagger.Tag{Name: "Secret", Description: "Secret API list"})
-	var hInfo *swagger.HandlerInfo
 
-	hInfo = swagger.NewHandlerInfo(api.Post)
-	ucon.Handle(http.MethodPost, "/api/1/secret", hInfo)
-	hInfo.Description, hInfo.Tags = "post to secret", []string{tag.Name}
-
-	hInfo = swagger.NewHandlerInfo(api.Get)
-	ucon.Handle(http.MethodGet, "/api/1/secret/{key}", hInfo)
-	hInfo.Description, hInfo.Tags = "get from secret", []string{tag.Name}
+	handleTenantAPI(http.MethodPost, "/secret", api.Post, "post to secret", tag)
+	handleTenantAPI(http.MethodGet, "/secret/{key}", api.Get, "get from secret", tag)
+	handleTenantAPI(http.MethodDelete, "/secret/{key}", api.Delete, "delete secret", tag)
+	handleTenantCustomMethod(http.MethodGet, "/secret/{key}", api.Get, "watch", api.Watch, "wait until secret is updated", tag)
+	handleTenantCustomMethod(http.MethodGet, "/secret/{key}", api.Get, "metadata", api.Metadata, "get metadata and version history of secret", tag)
+	handleTenantAPI(http.MethodPost, "/secret:rollback", api.Rollback, "put the value of a past version as the new version", tag)
 }
 
 // LogEntry is Output Request Log
 type LogEntry struct {
-	User string `json:"user"`
+	User   string `json:"user"`
+	Tenant string `json:"tenant,omitempty"`
 }
 
+// SecretKind is Secret EntityのKind
+const SecretKind = "Secret"
+
 // Secret is Datastore Entity
+// AliasOfが設定されている場合は別のSecretへのAliasで、Valueは持たない
+// Versionは更新の度に1増え、ETagとして利用する
 type Secret struct {
-	Value string `datastore:",noindex"`
+	Value     string `datastore:",noindex"`
+	AliasOf   string `datastore:",noindex"`
+	Version   int64
+	UpdatedBy string
+	UpdatedAt time.Time
 }
 
 // SecretAPI is API to register and acquire Secret
 type SecretAPI struct{}
 
 // SecretAPIPostRequest is SecretAPI Post Request
+// AliasOfを指定した場合は、Valueの代わりに別のSecretへのAliasを登録する
+// Valueには ${ref:other/key} の形で別のSecretへの参照を含めることができる
 type SecretAPIPostRequest struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key     string `json:"key" swagger:",req,secretKey"`
+	Value   string `json:"value" swagger:",secretValue"`
+	AliasOf string `json:"aliasOf" swagger:",secretKey"`
+}
+
+func (form *SecretAPIPostRequest) secretKeyValue() (string, string, string) {
+	return form.Key, form.Value, form.AliasOf
+}
+
+// SecretAPIPostResponse is SecretAPI Post Response
+// 保護されたPrefixの場合はSecretを更新せず、ChangeRequestに承認待ちのSecretChangeRequestのIDを返す
+type SecretAPIPostResponse struct {
+	Key           string `json:"key"`
+	Version       int64  `json:"version"`
+	ChangeRequest string `json:"changeRequest,omitempty"`
 }
 
 // Post is Secret registration handler
-func (api *SecretAPI) Post(ctx context.Context, form *SecretAPIPostRequest, r *http.Request) error {
+// If-Matchが指定された場合はVersionが一致する場合のみ更新し、If-None-Match: * が指定された場合は新規作成のみ行う
+// 保護されたPrefixの場合は、Tenantの管理者であってもSecretChangeRequestを作成するだけで、承認されるまで反映しない
+func (api *SecretAPI) Post(ctx context.Context, w http.ResponseWriter, r *http.Request, form *SecretAPIPostRequest) (*SecretAPIPostResponse, error) {
 	le := &LogEntry{}
 	defer outputRequestLog(ctx, le)
 
-	u := user.Current(ctx)
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
 	if u == nil {
-		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
 	}
 	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
 
-	ds, err := FromContext(ctx)
+	replication, err := ReplicationFromRequest(r, t, u)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	kms, err := NewKMSService(ctx)
+	ds, err := FromContext(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, form.Key, PermissionWrite); err != nil {
+		return nil, err
+	}
+
+	s := &Secret{}
+	if form.AliasOf != "" {
+		if form.Value != "" {
+			return nil, &HTTPError{Code: http.StatusBadRequest, Message: "value and aliasOf cannot be specified at the same time."}
+		}
+		if form.AliasOf == form.Key {
+			return nil, &HTTPError{Code: http.StatusBadRequest, Message: "secret cannot be an alias of itself."}
+		}
+		// Aliasを作れるのは参照先を読めるuserだけにする
+		if err := Authorize(ctx, ds, t, u, form.AliasOf, PermissionRead); err != nil {
+			return nil, err
+		}
+		s.AliasOf = form.AliasOf
+	} else {
+		if err := ValidateSecretRefs(form.Value); err != nil {
+			return nil, err
+		}
+
+		kms := NewCrypter()
+		ev, err := kms.EncryptMulti(ctx, t.CryptKeys(), form.Value)
+		if err != nil {
+			return nil, err
+		}
+		s.Value = ev
 	}
-	appID := appengine.AppID(ctx)
-	ev, _, err := kms.Encrypt(CryptKey{
-		ProjectID:  appID,
-		LocationID: "global",
-		KeyRingID:  "testkey",
-		KeyName:    "testCryptKey",
-	}, form.Value)
+
+	pc := PreconditionFromRequest(r)
+
+	acl, err := ProtectedSecretACL(ctx, ds, t, form.Key)
 	if err != nil {
-		log.Errorf(ctx, "%+v", err)
-		return err
+		return nil, err
+	}
+	if acl != nil {
+		return requestSecretChange(ctx, ds, t, u, pc, form.Key, s, acl)
+	}
+
+	s.UpdatedBy = u.Email
+	s.UpdatedAt = time.Now()
+	if err := platform.SecretStore.PutVersion(ctx, t, form.Key, s, pc.Check); err != nil {
+		return nil, errors.Wrapf(err, "failed put secret. key=%s", form.Key)
+	}
+	w.Header().Set("ETag", s.ETag())
+	recordSecretVersion(ctx, ds, t, form.Key, s)
+	PublishSecretEvent(ctx, ds, t, &SecretEvent{Type: SecretEventUpdated, Key: form.Key, Version: s.Version, Actor: u.Email, Replication: replication})
+
+	return &SecretAPIPostResponse{
+		Key:     form.Key,
+		Version: s.Version,
+	}, nil
+}
+
+// requestSecretChange is Secretを更新する代わりに、承認待ちのSecretChangeRequestを作成する
+// Secretは読むだけなのでTransactionの外で確認する. 反映する時にBaseVersionから更新されていないかを確認する
+func requestSecretChange(ctx context.Context, ds datastore.Client, t *Tenant, u *user.User, pc *Precondition, key string, s *Secret, acl *SecretACL) (*SecretAPIPostResponse, error) {
+	cur, err := platform.SecretStore.Get(ctx, t, key)
+	if err == ErrSecretNotFound {
+		cur = nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := pc.Check(cur); err != nil {
+		return nil, err
 	}
 
-	k := ds.NameKey("Secret", form.Key, nil)
-	s := &Secret{
-		Value: ev,
+	now := time.Now()
+	cr := &SecretChangeRequest{
+		ID:                newRandomID(),
+		Key:               key,
+		Value:             s.Value,
+		AliasOf:           s.AliasOf,
+		Status:            ChangeRequestPending,
+		RequiredApprovals: acl.RequiredApprovals,
+		Approvals:         []SecretChangeApproval{},
+		RequestedBy:       u.Email,
+		RequestedAt:       now,
+		ExpiresAt:         now.Add(changeRequestTTL),
+	}
+	if cur != nil {
+		cr.BaseVersion = cur.Version
 	}
-	_, err = ds.Put(ctx, k, s)
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		if _, err := tx.Put(t.NameKey(ds, SecretChangeRequestKind, cr.ID, nil), cr); err != nil {
+			return err
+		}
+		return putAuditLog(tx, ds, t, &AuditLog{Action: AuditChangeRequested, Key: key, Actor: u.Email, Target: cr.ID, OccurredAt: now})
+	})
 	if err != nil {
-		log.Errorf(ctx, "%+v", err)
-		return err
+		return nil, errors.Wrapf(err, "failed put change request. key=%s", key)
 	}
 
-	return nil
+	return &SecretAPIPostResponse{
+		Key:           key,
+		Version:       cr.BaseVersion,
+		ChangeRequest: cr.ID,
+	}, nil
 }
 
 // SecretAPIGetRequest is SecretAPI Get Request
+// Rawを指定した場合は、AliasとReferenceを解決せずに登録されている値をそのまま返す
+// Revealは画面で値を表示する場合に指定し、AuditLogに secret.revealed を記録する
 type SecretAPIGetRequest struct {
-	Key string `json:"key" swagger:",in=query"`
+	Key    string `json:"key" swagger:",in=query,req,secretKey"`
+	Raw    bool   `json:"raw" swagger:",in=query"`
+	Reveal bool   `json:"reveal" swagger:",in=query"`
 }
 
 // SecretAPIGetResponse is SecretAPI Get Response
 type SecretAPIGetResponse struct {
-	Key   string `json:"key"`
-	Value string `json:"value"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	AliasOf string `json:"aliasOf,omitempty"`
+	Version int64  `json:"version"`
 }
 
 // Get is Secret registration handler
-func (api *SecretAPI) Get(ctx context.Context, form *SecretAPIGetRequest, r *http.Request) (*SecretAPIGetResponse, error) {
+// ETag HeaderにSecretのVersionを返す
+func (api *SecretAPI) Get(ctx context.Context, w http.ResponseWriter, form *SecretAPIGetRequest, r *http.Request) (*SecretAPIGetResponse, error) {
 	le := &LogEntry{}
 	defer outputRequestLog(ctx, le)
+	defer FlushSecretAccess(ctx)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
 
-	u := user.Current(ctx)
+	u := CurrentUser(ctx)
 	if u == nil {
 		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
 	}
 	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
 
 	ds, err := FromContext(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	k := ds.NameKey("Secret", form.Key, nil)
-	s := &Secret{}
-	if err := ds.Get(ctx, k, s); err != nil {
-		log.Errorf(ctx, "%+v", err)
+	if err := AuthorizeSecretValue(ctx, ds, t, u, form.Key); err != nil {
 		return nil, err
 	}
 
-	kms, err := NewKMSService(ctx)
+	s, err := platform.SecretStore.Get(ctx, t, form.Key)
 	if err != nil {
 		return nil, err
 	}
-	appID := appengine.AppID(ctx)
-	pt, err := kms.Decrypt(CryptKey{
-		ProjectID:  appID,
-		LocationID: "global",
-		KeyRingID:  "testkey",
-		KeyName:    "testCryptKey",
-	}, s.Value)
+	w.Header().Set("ETag", s.ETag())
+
+	if form.Reveal {
+		// 記録できない場合は値を返さない
+		if err := WriteAuditLog(ctx, ds, t, &AuditLog{Action: AuditRevealed, Key: form.Key, Actor: u.Email, Comment: fmt.Sprintf("version %d", s.Version)}); err != nil {
+			return nil, err
+		}
+	}
+
+	kms := NewCrypter()
+
+	if form.Raw {
+		resp, err := rawSecretResponse(ctx, kms, t, form.Key, s)
+		if err != nil {
+			return nil, err
+		}
+		secretReadsTotal.Inc(t.ID)
+		RecordSecretAccess(t, form.Key, u.Email)
+		return resp, nil
+	}
+
+	pt, err := NewSecretResolver(ds, kms, t, u).ResolveSecret(ctx, form.Key, s)
 	if err != nil {
-		log.Errorf(ctx, "%+v", err)
 		return nil, err
 	}
+	secretReadsTotal.Inc(t.ID)
+	RecordSecretAccess(t, form.Key, u.Email)
+	return &SecretAPIGetResponse{
+		Key:     form.Key,
+		Value:   pt,
+		Version: s.Version,
+	}, nil
+}
 
+// rawSecretResponse is AliasとReferenceを解決せずにSecretの値を返す
+func rawSecretResponse(ctx context.Context, kms *Crypter, t *Tenant, key string, s *Secret) (*SecretAPIGetResponse, error) {
+	if s.AliasOf != "" {
+		return &SecretAPIGetResponse{
+			Key:     key,
+			AliasOf: s.AliasOf,
+			Version: s.Version,
+		}, nil
+	}
+
+	pt, err := kms.DecryptMulti(ctx, t.CryptKeys(), s.Value)
+	if err != nil {
+		return nil, err
+	}
 	return &SecretAPIGetResponse{
-		Key:   form.Key,
-		Value: pt,
+		Key:     key,
+		Value:   pt,
+		Version: s.Version,
 	}, nil
 }
 
+// SecretAPIDeleteRequest is SecretAPI Delete Request
+type SecretAPIDeleteRequest struct {
+	Key string `json:"key" swagger:",in=query,req,secretKey"`
+}
+
+// Delete is Secret delete handler
+// If-Matchが指定された場合はVersionが一致する場合のみ削除する. 保護されたPrefixのSecretは削除できない
+func (api *SecretAPI) Delete(ctx context.Context, r *http.Request, form *SecretAPIDeleteRequest) error {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
+
+	replication, err := ReplicationFromRequest(r, t, u)
+	if err != nil {
+		return err
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := Authorize(ctx, ds, t, u, form.Key, PermissionWrite); err != nil {
+		return err
+	}
+	if err := requireUnprotected(ctx, ds, t, form.Key); err != nil {
+		return err
+	}
+
+	cur, err := platform.SecretStore.Delete(ctx, t, form.Key, PreconditionFromRequest(r).Check)
+	if err != nil {
+		return errors.Wrapf(err, "failed delete secret. key=%s", form.Key)
+	}
+	deleteSecretVersions(ctx, ds, t, form.Key)
+	PublishSecretEvent(ctx, ds, t, &SecretEvent{Type: SecretEventDeleted, Key: form.Key, Version: cur.Version, Actor: u.Email, Replication: replication})
+
+	return nil
+}
+
 func outputRequestLog(ctx context.Context, e *LogEntry) {
 	j, err := json.Marshal(e)
 	if err != nil {
@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// SecretVersionKind is SecretVersion EntityのKind
+// 過去のVersionのSecretを、同じKeyのSecret Kindを親にしてVersionをNameとして保存する
+// SecretStoreがDatastore以外の場合も、履歴はDatastoreに保存する. 値はSecretと同じく暗号化したまま保存する
+const SecretVersionKind = "SecretVersion"
+
+// maxSecretVersions is Keyごとに残す履歴の数. 古いものから削除する
+const maxSecretVersions = 20
+
+// SecretVersionInfo is 履歴の1 Version分. 値は含まない
+type SecretVersionInfo struct {
+	Version   int64     `json:"version"`
+	AliasOf   string    `json:"aliasOf,omitempty"`
+	UpdatedBy string    `json:"updatedBy"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+func secretVersionKey(ds datastore.Client, t *Tenant, key string, version int64) datastore.Key {
+	return t.NameKey(ds, SecretVersionKind, strconv.FormatInt(version, 10), t.NameKey(ds, SecretKind, key, nil))
+}
+
+// recordSecretVersion is 新しいVersionのSecretを履歴に追加し、maxSecretVersionsを越えた古い履歴を削除する
+// Secretの更新は完了しているので、履歴を保存できなくても操作は失敗させずLogに残す
+func recordSecretVersion(ctx context.Context, ds datastore.Client, t *Tenant, key string, s *Secret) {
+	if _, err := ds.Put(ctx, secretVersionKey(ds, t, key, s.Version), s); err != nil {
+		log.Warningf(ctx, "failed put SecretVersion. key=%s, version=%d, err=%+v", key, s.Version, err)
+		return
+	}
+	keys, err := listSecretVersionKeys(ctx, ds, t, key)
+	if err != nil {
+		log.Warningf(ctx, "failed list SecretVersion. key=%s, err=%+v", key, err)
+		return
+	}
+	if len(keys) <= maxSecretVersions {
+		return
+	}
+	if err := ds.DeleteMulti(ctx, keys[maxSecretVersions:]); err != nil {
+		log.Warningf(ctx, "failed delete old SecretVersion. key=%s, err=%+v", key, err)
+	}
+}
+
+// listSecretVersionKeys is keyの履歴のKeyを新しい順に返す
+func listSecretVersionKeys(ctx context.Context, ds datastore.Client, t *Tenant, key string) ([]datastore.Key, error) {
+	q := t.NewQuery(ds, SecretVersionKind).Ancestor(t.NameKey(ds, SecretKind, key, nil)).KeysOnly()
+	keys, err := ds.GetAll(ctx, q, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed list SecretVersion. key=%s", key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return secretVersionOf(keys[i]) > secretVersionOf(keys[j]) })
+	return keys, nil
+}
+
+func secretVersionOf(k datastore.Key) int64 {
+	v, _ := strconv.ParseInt(k.Name(), 10, 64)
+	return v
+}
+
+// listSecretVersions is keyの履歴を、値を含めて新しい順に返す
+func listSecretVersions(ctx context.Context, ds datastore.Client, t *Tenant, key string) ([]*Secret, error) {
+	q := t.NewQuery(ds, SecretVersionKind).Ancestor(t.NameKey(ds, SecretKind, key, nil))
+	var list []*Secret
+	if _, err := ds.GetAll(ctx, q, &list); err != nil {
+		return nil, errors.Wrapf(err, "failed list SecretVersion. key=%s", key)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Version > list[j].Version })
+	return list, nil
+}
+
+// ListSecretVersions is keyの履歴を新しい順に返す
+func ListSecretVersions(ctx context.Context, ds datastore.Client, t *Tenant, key string) ([]*SecretVersionInfo, error) {
+	list, err := listSecretVersions(ctx, ds, t, key)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*SecretVersionInfo, 0, len(list))
+	for _, s := range list {
+		infos = append(infos, &SecretVersionInfo{
+			Version:   s.Version,
+			AliasOf:   s.AliasOf,
+			UpdatedBy: s.UpdatedBy,
+			UpdatedAt: s.UpdatedAt,
+		})
+	}
+	return infos, nil
+}
+
+// GetSecretVersion is keyの履歴からversionのSecretを返す. 残っていない場合はErrSecretNotFound
+func GetSecretVersion(ctx context.Context, ds datastore.Client, t *Tenant, key string, version int64) (*Secret, error) {
+	s := &Secret{}
+	if err := ds.Get(ctx, secretVersionKey(ds, t, key, version), s); err == datastore.ErrNoSuchEntity {
+		return nil, ErrSecretNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed get SecretVersion. key=%s, version=%d", key, version)
+	}
+	return s, nil
+}
+
+// deleteSecretVersions is keyの履歴を全て削除する. Secretを削除した後に呼ぶ
+// 同じKeyで作り直したSecretのVersionは1から始まるので、古い履歴を残すと混ざってしまう
+func deleteSecretVersions(ctx context.Context, ds datastore.Client, t *Tenant, key string) {
+	keys, err := listSecretVersionKeys(ctx, ds, t, key)
+	if err == nil && len(keys) > 0 {
+		err = ds.DeleteMulti(ctx, keys)
+	}
+	if err != nil {
+		log.Warningf(ctx, "failed delete SecretVersion. key=%s, err=%+v", key, err)
+	}
+}
+
+// moveSecretVersions is fromの履歴をtoの履歴に移す. Secretを移動した後に呼ぶ
+// Secretの移動は完了しているので、失敗しても操作は失敗させずLogに残す. 移せなかった履歴はfromに残す
+func moveSecretVersions(ctx context.Context, ds datastore.Client, t *Tenant, from string, to string) {
+	list, err := listSecretVersions(ctx, ds, t, from)
+	if err != nil {
+		log.Warningf(ctx, "failed list SecretVersion. key=%s, err=%+v", from, err)
+		return
+	}
+	if len(list) == 0 {
+		return
+	}
+	keys := make([]datastore.Key, len(list))
+	oldKeys := make([]datastore.Key, len(list))
+	for i, s := range list {
+		keys[i] = secretVersionKey(ds, t, to, s.Version)
+		oldKeys[i] = secretVersionKey(ds, t, from, s.Version)
+	}
+	if _, err := ds.PutMulti(ctx, keys, list); err != nil {
+		log.Warningf(ctx, "failed put SecretVersion. key=%s, err=%+v", to, err)
+		return
+	}
+	if err := ds.DeleteMulti(ctx, oldKeys); err != nil {
+		log.Warningf(ctx, "failed delete moved SecretVersion. key=%s, err=%+v", from, err)
+	}
+}
@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SecretAPIMetadataRequest is SecretAPI Metadata Request
+type SecretAPIMetadataRequest struct {
+	Key string `json:"key" swagger:",in=query,req,secretKey"`
+}
+
+// SecretAPIMetadataResponse is SecretAPI Metadata Response
+// Protectedは更新に承認が必要な場合にtrueになり、ProtectedByはその時に適用されるSecretACLのPrefix
+type SecretAPIMetadataResponse struct {
+	Key         string               `json:"key"`
+	AliasOf     string               `json:"aliasOf,omitempty"`
+	Version     int64                `json:"version"`
+	UpdatedBy   string               `json:"updatedBy"`
+	UpdatedAt   time.Time            `json:"updatedAt"`
+	Protected   bool                 `json:"protected"`
+	ProtectedBy string               `json:"protectedBy,omitempty"`
+	Versions    []*SecretVersionInfo `json:"versions"`
+}
+
+// Metadata is Secretの値以外の情報と、残っている履歴を新しい順に返すhandler
+// GET /secret/{key}:metadata で呼び出す. 値を返さないのでSecretAccessには記録しない
+func (api *SecretAPI) Metadata(ctx context.Context, w http.ResponseWriter, form *SecretAPIMetadataRequest) (*SecretAPIMetadataResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, form.Key, PermissionRead); err != nil {
+		return nil, err
+	}
+
+	s, err := platform.SecretStore.Get(ctx, t, form.Key)
+	if err != nil {
+		return nil, err
+	}
+	w.Header().Set("ETag", s.ETag())
+
+	versions, err := ListSecretVersions(ctx, ds, t, form.Key)
+	if err != nil {
+		return nil, err
+	}
+	acl, err := ProtectedSecretACL(ctx, ds, t, form.Key)
+	if err != nil {
+		return nil, err
+	}
+	resp := &SecretAPIMetadataResponse{
+		Key:       form.Key,
+		AliasOf:   s.AliasOf,
+		Version:   s.Version,
+		UpdatedBy: s.UpdatedBy,
+		UpdatedAt: s.UpdatedAt,
+		Versions:  versions,
+	}
+	if acl != nil {
+		resp.Protected = true
+		resp.ProtectedBy = acl.Prefix
+	}
+	return resp, nil
+}
+
+// SecretAPIRollbackRequest is SecretAPI Rollback Request
+type SecretAPIRollbackRequest struct {
+	Key     string `json:"key" swagger:",req,secretKey"`
+	Version int64  `json:"version" swagger:",req"`
+}
+
+// Rollback is 履歴に残っている過去のVersionの値で、Secretの新しいVersionを作るhandler
+// 値はTenantの現在のCryptKeyで暗号化し直す. If-MatchとSecretACLによる承認はPostと同じように扱う
+func (api *SecretAPI) Rollback(ctx context.Context, w http.ResponseWriter, r *http.Request, form *SecretAPIRollbackRequest) (*SecretAPIPostResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, form.Key, PermissionWrite); err != nil {
+		return nil, err
+	}
+
+	old, err := GetSecretVersion(ctx, ds, t, form.Key, form.Version)
+	if err == ErrSecretNotFound {
+		return nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("version %d of %s is not in the history.", form.Version, form.Key)}
+	} else if err != nil {
+		return nil, err
+	}
+
+	s := &Secret{AliasOf: old.AliasOf}
+	if old.AliasOf != "" {
+		if err := Authorize(ctx, ds, t, u, old.AliasOf, PermissionRead); err != nil {
+			return nil, err
+		}
+	} else {
+		kms := NewCrypter()
+		pt, err := kms.DecryptMulti(ctx, t.CryptKeys(), old.Value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed decrypt version %d. key=%s", form.Version, form.Key)
+		}
+		s.Value, err = kms.EncryptMulti(ctx, t.CryptKeys(), pt)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	pc := PreconditionFromRequest(r)
+
+	acl, err := ProtectedSecretACL(ctx, ds, t, form.Key)
+	if err != nil {
+		return nil, err
+	}
+	if acl != nil {
+		return requestSecretChange(ctx, ds, t, u, pc, form.Key, s, acl)
+	}
+
+	s.UpdatedBy = u.Email
+	s.UpdatedAt = time.Now()
+	if err := platform.SecretStore.PutVersion(ctx, t, form.Key, s, pc.Check); err != nil {
+		return nil, errors.Wrapf(err, "failed put secret. key=%s", form.Key)
+	}
+	w.Header().Set("ETag", s.ETag())
+	recordSecretVersion(ctx, ds, t, form.Key, s)
+	err = WriteAuditLog(ctx, ds, t, &AuditLog{
+		Action:     AuditRolledBack,
+		Key:        form.Key,
+		Actor:      u.Email,
+		Comment:    fmt.Sprintf("version %d has the value of version %d", s.Version, form.Version),
+		OccurredAt: s.UpdatedAt,
+	})
+	if err != nil {
+		// Secretは更新済みなので、Errorを返すとClientが再実行してしまう
+		log.Errorf(ctx, "failed write rollback audit log. key=%s, version=%d, err=%+v", form.Key, s.Version, err)
+	}
+	PublishSecretEvent(ctx, ds, t, &SecretEvent{Type: SecretEventUpdated, Key: form.Key, Version: s.Version, Actor: u.Email})
+
+	return &SecretAPIPostResponse{
+		Key:     form.Key,
+		Version: s.Version,
+	}, nil
+}
@@ -0,0 +1,151 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// historyTenant is 他のTestとMemorySecretStoreのNamespaceが重ならないTenant
+func historyTenant(id string) *Tenant {
+	return &Tenant{ID: id, Namespace: id, CryptKey: testCryptKey}
+}
+
+// putTestSecretVersions is keyにvaluesを順に書き込み、履歴を記録する
+func putTestSecretVersions(t *testing.T, ctx context.Context, ds *fakeDatastore, tenant *Tenant, key string, values ...string) {
+	t.Helper()
+	for _, v := range values {
+		ct, err := NewCrypter().EncryptMulti(ctx, tenant.CryptKeys(), v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := &Secret{Value: ct, UpdatedBy: "test@example.com", UpdatedAt: time.Now()}
+		if err := platform.SecretStore.PutVersion(ctx, tenant, key, s, func(cur *Secret) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+		recordSecretVersion(ctx, ds, tenant, key, s)
+	}
+}
+
+// secretVersionValues is keyの履歴をDecryptした値を古い順に返す
+func secretVersionValues(t *testing.T, ctx context.Context, ds *fakeDatastore, tenant *Tenant, key string) []string {
+	t.Helper()
+	list, err := listSecretVersions(ctx, ds, tenant, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make([]string, len(list))
+	for i, s := range list {
+		v, err := NewCrypter().DecryptMulti(ctx, tenant.CryptKeys(), s.Value)
+		if err != nil {
+			t.Fatalf("failed decrypt %s version %d: %v", key, s.Version, err)
+		}
+		values[len(list)-1-i] = v
+	}
+	return values
+}
+
+func TestMoveSecretVersions(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	tenant := historyTenant("history-move")
+	putTestSecretVersions(t, ctx, ds, tenant, "app/db", "v1", "v2")
+
+	moveSecretVersions(ctx, ds, tenant, "app/db", "svc/db")
+
+	if g, e := fmt.Sprint(secretVersionValues(t, ctx, ds, tenant, "svc/db")), "[v1 v2]"; g != e {
+		t.Errorf("moved history: got %s, want %s", g, e)
+	}
+	if g := secretVersionValues(t, ctx, ds, tenant, "app/db"); len(g) != 0 {
+		t.Errorf("history is left at the source: %v", g)
+	}
+	s, err := GetSecretVersion(ctx, ds, tenant, "svc/db", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Version != 1 {
+		t.Errorf("unexpected version: %d", s.Version)
+	}
+}
+
+func TestReencryptSecretVersions(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	tenant := historyTenant("history-reencrypt")
+	putTestSecretVersions(t, ctx, ds, tenant, "app/db", "v1", "v2")
+
+	next := CryptKey{Provider: KeyProviderLocal, KeyRingID: "test", KeyName: "history-next"}
+	if err := testKeyRing.CreateKey(LocalKeyID(next)); err != nil {
+		t.Fatal(err)
+	}
+	re := &reencrypter{kms: NewCrypter(), from: testCryptKey, to: []CryptKey{next}, actor: "test@example.com"}
+	resp := &ReencryptAPIPostResponse{}
+	if err := re.secretVersions(ctx, ds, tenant, "app", true, resp); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := len(resp.Reencrypted), 2; g != e {
+		t.Fatalf("dry run: got %d, want %d", g, e)
+	}
+	if g := secretVersionValues(t, ctx, ds, tenant, "app/db"); len(g) != 2 {
+		t.Fatalf("history is lost in dry run: %v", g)
+	}
+
+	before, err := listSecretVersions(ctx, ds, tenant, "app/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = &ReencryptAPIPostResponse{}
+	if err := re.secretVersions(ctx, ds, tenant, "app", false, resp); err != nil {
+		t.Fatal(err)
+	}
+	if g, e := resp.Reencrypted[0].Key, "app/db@2"; g != e {
+		t.Errorf("reencrypted: got %s, want %s", g, e)
+	}
+	after, err := listSecretVersions(ctx, ds, tenant, "app/db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range after {
+		if after[i].Value == before[i].Value {
+			t.Errorf("version %d is not reencrypted", after[i].Version)
+		}
+	}
+	// 以前のCryptKeyを使わずにDecryptできる
+	reencrypted := &Tenant{ID: tenant.ID, Namespace: tenant.Namespace, CryptKey: next}
+	if g, e := fmt.Sprint(secretVersionValues(t, ctx, ds, reencrypted, "app/db")), "[v1 v2]"; g != e {
+		t.Errorf("reencrypted history: got %s, want %s", g, e)
+	}
+}
+
+func TestBackupSecretVersions(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	tenant := historyTenant("history-backup")
+	putTestSecretVersions(t, ctx, ds, tenant, "app/db", "v1", "v2", "v3")
+
+	b, err := CreateBackup(ctx, ds, []*Tenant{tenant}, "test@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := len(b.Tenants[0].SecretVersions), 3; g != e {
+		t.Fatalf("secret versions in backup: got %d, want %d", g, e)
+	}
+
+	restored := newFakeDatastore()
+	summary, err := RestoreBackup(ctx, restored, b, &RestoreOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g, e := summary.Tenants[0].SecretVersions, 3; g != e {
+		t.Errorf("restored secret versions: got %d, want %d", g, e)
+	}
+	if g, e := fmt.Sprint(secretVersionValues(t, ctx, restored, tenant, "app/db")), "[v1 v2 v3]"; g != e {
+		t.Errorf("restored history: got %s, want %s", g, e)
+	}
+
+	b.Tenants[0].SecretVersions[1].Value = "tampered"
+	if _, err := b.Verify(); err == nil {
+		t.Error("tampered secret version is not detected")
+	}
+}
@@ -0,0 +1,119 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// maxSecretRefDepth is Alias, Referenceを辿る深さの上限
+const maxSecretRefDepth = 16
+
+// secretRefPattern is Value内の ${ref:other/key} にMatchする
+var secretRefPattern = regexp.MustCompile(`\$\{ref:([^}]*)\}`)
+
+// SecretRefs is Valueに含まれる ${ref:...} のKey一覧を返す
+func SecretRefs(value string) []string {
+	var refs []string
+	for _, m := range secretRefPattern.FindAllStringSubmatch(value, -1) {
+		refs = append(refs, m[1])
+	}
+	return refs
+}
+
+// ValidateSecretRefs is Valueに含まれる ${ref:...} のKeyが正しい形式かを確認する
+func ValidateSecretRefs(value string) error {
+	for _, ref := range SecretRefs(value) {
+		if err := ValidateKeyPath(ref); err != nil {
+			return &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid reference ${ref:%s}.", ref)}
+		}
+	}
+	return nil
+}
+
+// SecretResolver is AliasとValue内の ${ref:...} を解決してPlaintextを返す
+// 辿った全てのKeyに対してuserのRead権限を確認する
+type SecretResolver struct {
+	ds       datastore.Client
+	kms      *Crypter
+	t        *Tenant
+	u        *user.User
+	visiting map[string]bool
+}
+
+// NewSecretResolver is SecretResolverを作成
+func NewSecretResolver(ds datastore.Client, kms *Crypter, t *Tenant, u *user.User) *SecretResolver {
+	return &SecretResolver{
+		ds:       ds,
+		kms:      kms,
+		t:        t,
+		u:        u,
+		visiting: map[string]bool{},
+	}
+}
+
+// Resolve is keyのSecretを解決したPlaintextを返す
+func (r *SecretResolver) Resolve(ctx context.Context, key string) (string, error) {
+	if err := AuthorizeSecretValue(ctx, r.ds, r.t, r.u, key); err != nil {
+		return "", err
+	}
+
+	s, err := platform.SecretStore.Get(ctx, r.t, key)
+	if err != nil {
+		return "", err
+	}
+	pt, err := r.ResolveSecret(ctx, key, s)
+	if err != nil {
+		return "", err
+	}
+	// Referenceから読まれたSecretも利用されているものとして記録する
+	RecordSecretAccess(r.t, key, r.u.Email)
+	return pt, nil
+}
+
+// ResolveSecret is 取得済みのkeyのSecretを解決したPlaintextを返す. keyのRead権限は確認済みであること
+func (r *SecretResolver) ResolveSecret(ctx context.Context, key string, s *Secret) (string, error) {
+	if r.visiting[key] {
+		return "", &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("reference cycle detected at %s.", key)}
+	}
+	if len(r.visiting) >= maxSecretRefDepth {
+		return "", &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("reference is too deep at %s.", key)}
+	}
+	r.visiting[key] = true
+	defer delete(r.visiting, key)
+
+	if s.AliasOf != "" {
+		return r.Resolve(ctx, s.AliasOf)
+	}
+
+	pt, err := r.kms.DecryptMulti(ctx, r.t.CryptKeys(), s.Value)
+	if err != nil {
+		return "", err
+	}
+	return r.Interpolate(ctx, pt)
+}
+
+// Interpolate is Value内の ${ref:...} を参照先のPlaintextに置き換える
+func (r *SecretResolver) Interpolate(ctx context.Context, value string) (string, error) {
+	var rerr error
+	v := secretRefPattern.ReplaceAllStringFunc(value, func(m string) string {
+		if rerr != nil {
+			return m
+		}
+		ref := secretRefPattern.FindStringSubmatch(m)[1]
+		pt, err := r.Resolve(ctx, ref)
+		if err != nil {
+			rerr = err
+			return m
+		}
+		return pt
+	})
+	if rerr != nil {
+		return "", rerr
+	}
+	return v, nil
+}
@@ -0,0 +1,207 @@
+package backend
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// ErrSecretNotFound is SecretStoreにSecretが存在しない場合のError
+var ErrSecretNotFound = errors.New("secret not found")
+
+// SecretStore is Secretの保存先
+// KeyはTenantごとに独立しており、ListはKeyの昇順で返す
+type SecretStore interface {
+	// Get is keyのSecretを返す. 存在しない場合はErrSecretNotFound
+	Get(ctx context.Context, t *Tenant, key string) (*Secret, error)
+	// GetMulti is keysのSecretをkeysと同じ順で返す. 1つでも存在しない場合はErrSecretNotFound
+	GetMulti(ctx context.Context, t *Tenant, keys []string) ([]*Secret, error)
+	// List is prefix自身とprefix配下のKeyを返す. prefixが空の場合は全てのKey
+	List(ctx context.Context, t *Tenant, prefix string) ([]string, error)
+	// PutVersion is checkが通った場合に、現在のVersionに1を足してsを保存する. checkには存在しない場合nilを渡す
+	PutVersion(ctx context.Context, t *Tenant, key string, s *Secret, check func(cur *Secret) error) error
+	// Delete is checkが通った場合にkeyのSecretを削除し、削除したSecretを返す
+	Delete(ctx context.Context, t *Tenant, key string, check func(cur *Secret) error) (*Secret, error)
+	// RunInTransaction is fをTransactionで実行する. fがErrorを返した場合は何も保存しない
+	RunInTransaction(ctx context.Context, t *Tenant, f func(tx SecretTx) error) error
+}
+
+// SecretTx is SecretStoreのTransaction
+type SecretTx interface {
+	Get(key string) (*Secret, error)
+	Put(key string, s *Secret) error
+	Delete(key string) error
+}
+
+// putSecretVersion is SecretStore.PutVersionの実装
+func putSecretVersion(tx SecretTx, key string, s *Secret, check func(cur *Secret) error) error {
+	cur, err := tx.Get(key)
+	if err == ErrSecretNotFound {
+		cur = nil
+	} else if err != nil {
+		return err
+	}
+	if err := check(cur); err != nil {
+		return err
+	}
+	s.Version = 1
+	if cur != nil {
+		s.Version = cur.Version + 1
+	}
+	return tx.Put(key, s)
+}
+
+// deleteSecret is SecretStore.Deleteの実装
+func deleteSecret(tx SecretTx, key string, check func(cur *Secret) error) (*Secret, error) {
+	cur, err := tx.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := check(cur); err != nil {
+		return nil, err
+	}
+	return cur, tx.Delete(key)
+}
+
+type datastoreTransactionContextKey struct{}
+
+// withDatastoreTransaction is 実行中のDatastore Transactionをctxに持たせる
+// DatastoreSecretStoreはこのTransactionに参加するので、Secretと他のKindを同じTransactionで更新できる
+// 他のSecretStoreではSecretだけ別のTransactionになる
+func withDatastoreTransaction(ctx context.Context, tx datastore.Transaction) context.Context {
+	return context.WithValue(ctx, datastoreTransactionContextKey{}, tx)
+}
+
+// DatastoreSecretStore is DatastoreのSecret Kindに保存するSecretStore
+type DatastoreSecretStore struct{}
+
+// Get is SecretStoreを実装
+func (st *DatastoreSecretStore) Get(ctx context.Context, t *Tenant, key string) (*Secret, error) {
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	s := &Secret{}
+	if err := ds.Get(ctx, t.NameKey(ds, SecretKind, key, nil), s); err == datastore.ErrNoSuchEntity {
+		return nil, ErrSecretNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed get secret. key=%s", key)
+	}
+	return s, nil
+}
+
+// maxDatastoreGetMulti is DatastoreのGetMultiで1度に取得できるKeyの数
+const maxDatastoreGetMulti = 1000
+
+// GetMulti is SecretStoreを実装
+func (st *DatastoreSecretStore) GetMulti(ctx context.Context, t *Tenant, keys []string) ([]*Secret, error) {
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]*Secret, len(keys))
+	for i := 0; i < len(keys); i += maxDatastoreGetMulti {
+		end := i + maxDatastoreGetMulti
+		if end > len(keys) {
+			end = len(keys)
+		}
+		dsKeys := make([]datastore.Key, 0, end-i)
+		for j := i; j < end; j++ {
+			list[j] = &Secret{}
+			dsKeys = append(dsKeys, t.NameKey(ds, SecretKind, keys[j], nil))
+		}
+		err := ds.GetMulti(ctx, dsKeys, list[i:end])
+		if merr, ok := err.(datastore.MultiError); ok {
+			for _, e := range merr {
+				if e == datastore.ErrNoSuchEntity {
+					return nil, ErrSecretNotFound
+				}
+			}
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "failed get secrets")
+		}
+	}
+	return list, nil
+}
+
+// List is SecretStoreを実装
+func (st *DatastoreSecretStore) List(ctx context.Context, t *Tenant, prefix string) ([]string, error) {
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := listKeysUnder(ctx, ds, t, SecretKind, prefix)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, len(keys))
+	for i, k := range keys {
+		names[i] = k.Name()
+	}
+	return names, nil
+}
+
+// PutVersion is SecretStoreを実装
+func (st *DatastoreSecretStore) PutVersion(ctx context.Context, t *Tenant, key string, s *Secret, check func(cur *Secret) error) error {
+	return st.RunInTransaction(ctx, t, func(tx SecretTx) error {
+		return putSecretVersion(tx, key, s, check)
+	})
+}
+
+// Delete is SecretStoreを実装
+func (st *DatastoreSecretStore) Delete(ctx context.Context, t *Tenant, key string, check func(cur *Secret) error) (*Secret, error) {
+	var cur *Secret
+	err := st.RunInTransaction(ctx, t, func(tx SecretTx) error {
+		var err error
+		cur, err = deleteSecret(tx, key, check)
+		return err
+	})
+	return cur, err
+}
+
+// RunInTransaction is SecretStoreを実装. ctxにDatastore Transactionがある場合はそれに参加する
+func (st *DatastoreSecretStore) RunInTransaction(ctx context.Context, t *Tenant, f func(tx SecretTx) error) error {
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	if tx, ok := ctx.Value(datastoreTransactionContextKey{}).(datastore.Transaction); ok {
+		return f(&datastoreSecretTx{ds: ds, tx: tx, t: t})
+	}
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		return f(&datastoreSecretTx{ds: ds, tx: tx, t: t})
+	})
+	return err
+}
+
+type datastoreSecretTx struct {
+	ds datastore.Client
+	tx datastore.Transaction
+	t  *Tenant
+}
+
+func (tx *datastoreSecretTx) Get(key string) (*Secret, error) {
+	s := &Secret{}
+	if err := tx.tx.Get(tx.t.NameKey(tx.ds, SecretKind, key, nil), s); err == datastore.ErrNoSuchEntity {
+		return nil, ErrSecretNotFound
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed get secret. key=%s", key)
+	}
+	return s, nil
+}
+
+func (tx *datastoreSecretTx) Put(key string, s *Secret) error {
+	if _, err := tx.tx.Put(tx.t.NameKey(tx.ds, SecretKind, key, nil), s); err != nil {
+		return errors.Wrapf(err, "failed put secret. key=%s", key)
+	}
+	return nil
+}
+
+func (tx *datastoreSecretTx) Delete(key string) error {
+	if err := tx.tx.Delete(tx.t.NameKey(tx.ds, SecretKind, key, nil)); err != nil {
+		return errors.Wrapf(err, "failed delete secret. key=%s", key)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/pkg/errors"
+)
+
+// boltSecretBucket is BoltSecretStoreでSecretを保存するBucket
+// KeyはNamespaceとSecretのKeyを\x00でつないだもので、ValueはSecretのJSON
+var boltSecretBucket = []byte(SecretKind)
+
+// BoltSecretStore is 1つのFileに保存するSecretStore. 小規模なSelf-HostingやLocalでの開発用
+// Fileは1つのProcessからしか開けない
+type BoltSecretStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltSecretStore is pathのFileを開く. 存在しない場合は作成する
+func OpenBoltSecretStore(path string) (*BoltSecretStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed open bolt db. path=%s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(boltSecretBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "failed create bucket. path=%s", path)
+	}
+	return &BoltSecretStore{db: db}, nil
+}
+
+// Close is Fileを閉じる
+func (st *BoltSecretStore) Close() error {
+	return st.db.Close()
+}
+
+// Get is SecretStoreを実装
+func (st *BoltSecretStore) Get(ctx context.Context, t *Tenant, key string) (*Secret, error) {
+	var s *Secret
+	err := st.db.View(func(btx *bolt.Tx) error {
+		var err error
+		s, err = st.tx(btx, t).Get(key)
+		return err
+	})
+	return s, err
+}
+
+// GetMulti is SecretStoreを実装
+func (st *BoltSecretStore) GetMulti(ctx context.Context, t *Tenant, keys []string) ([]*Secret, error) {
+	list := make([]*Secret, len(keys))
+	err := st.db.View(func(btx *bolt.Tx) error {
+		tx := st.tx(btx, t)
+		for i, key := range keys {
+			s, err := tx.Get(key)
+			if err != nil {
+				return err
+			}
+			list[i] = s
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// List is SecretStoreを実装
+func (st *BoltSecretStore) List(ctx context.Context, t *Tenant, prefix string) ([]string, error) {
+	keys := []string{}
+	err := st.db.View(func(btx *bolt.Tx) error {
+		ns := boltNamespacePrefix(t)
+		start := append(ns, prefix...)
+		c := btx.Bucket(boltSecretBucket).Cursor()
+		// prefixで始まるKeyの中から、prefix自身とprefix配下のものを集める
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, start); k, _ = c.Next() {
+			key := string(k[len(ns):])
+			if HasKeyPrefix(key, prefix) {
+				keys = append(keys, key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed list secrets. prefix=%s", prefix)
+	}
+	return keys, nil
+}
+
+// PutVersion is SecretStoreを実装
+func (st *BoltSecretStore) PutVersion(ctx context.Context, t *Tenant, key string, s *Secret, check func(cur *Secret) error) error {
+	return st.RunInTransaction(ctx, t, func(tx SecretTx) error {
+		return putSecretVersion(tx, key, s, check)
+	})
+}
+
+// Delete is SecretStoreを実装
+func (st *BoltSecretStore) Delete(ctx context.Context, t *Tenant, key string, check func(cur *Secret) error) (*Secret, error) {
+	var cur *Secret
+	err := st.RunInTransaction(ctx, t, func(tx SecretTx) error {
+		var err error
+		cur, err = deleteSecret(tx, key, check)
+		return err
+	})
+	return cur, err
+}
+
+// RunInTransaction is SecretStoreを実装. BoltのWrite Transactionは同時に1つしか実行されない
+func (st *BoltSecretStore) RunInTransaction(ctx context.Context, t *Tenant, f func(tx SecretTx) error) error {
+	return st.db.Update(func(btx *bolt.Tx) error {
+		return f(st.tx(btx, t))
+	})
+}
+
+func (st *BoltSecretStore) tx(btx *bolt.Tx, t *Tenant) *boltSecretTx {
+	return &boltSecretTx{
+		b:  btx.Bucket(boltSecretBucket),
+		ns: boltNamespacePrefix(t),
+	}
+}
+
+// boltNamespacePrefix is TenantのSecretのKeyに付けるPrefix
+func boltNamespacePrefix(t *Tenant) []byte {
+	return append([]byte(t.Namespace), 0)
+}
+
+type boltSecretTx struct {
+	b  *bolt.Bucket
+	ns []byte
+}
+
+func (tx *boltSecretTx) key(key string) []byte {
+	return append(append([]byte{}, tx.ns...), key...)
+}
+
+func (tx *boltSecretTx) Get(key string) (*Secret, error) {
+	v := tx.b.Get(tx.key(key))
+	if v == nil {
+		return nil, ErrSecretNotFound
+	}
+	s := &Secret{}
+	if err := json.Unmarshal(v, s); err != nil {
+		return nil, errors.Wrapf(err, "failed unmarshal secret. key=%s", key)
+	}
+	return s, nil
+}
+
+func (tx *boltSecretTx) Put(key string, s *Secret) error {
+	v, err := json.Marshal(s)
+	if err != nil {
+		return errors.Wrapf(err, "failed marshal secret. key=%s", key)
+	}
+	if err := tx.b.Put(tx.key(key), v); err != nil {
+		return errors.Wrapf(err, "failed put secret. key=%s", key)
+	}
+	return nil
+}
+
+func (tx *boltSecretTx) Delete(key string) error {
+	if err := tx.b.Delete(tx.key(key)); err != nil {
+		return errors.Wrapf(err, "failed delete secret. key=%s", key)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package backend
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemorySecretStore is Memory上に保持するSecretStore. Processを終了すると消える
+// Transactionは全体のLockで直列に実行する
+type MemorySecretStore struct {
+	mu   sync.Mutex
+	data map[string]map[string]Secret
+}
+
+// NewMemorySecretStore is MemorySecretStoreを作成
+func NewMemorySecretStore() *MemorySecretStore {
+	return &MemorySecretStore{
+		data: map[string]map[string]Secret{},
+	}
+}
+
+// Get is SecretStoreを実装
+func (st *MemorySecretStore) Get(ctx context.Context, t *Tenant, key string) (*Secret, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.data[t.Namespace][key]
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+	return &s, nil
+}
+
+// GetMulti is SecretStoreを実装
+func (st *MemorySecretStore) GetMulti(ctx context.Context, t *Tenant, keys []string) ([]*Secret, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	list := make([]*Secret, len(keys))
+	for i, key := range keys {
+		s, ok := st.data[t.Namespace][key]
+		if !ok {
+			return nil, ErrSecretNotFound
+		}
+		list[i] = &s
+	}
+	return list, nil
+}
+
+// List is SecretStoreを実装
+func (st *MemorySecretStore) List(ctx context.Context, t *Tenant, prefix string) ([]string, error) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	keys := []string{}
+	for key := range st.data[t.Namespace] {
+		if HasKeyPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// PutVersion is SecretStoreを実装
+func (st *MemorySecretStore) PutVersion(ctx context.Context, t *Tenant, key string, s *Secret, check func(cur *Secret) error) error {
+	return st.RunInTransaction(ctx, t, func(tx SecretTx) error {
+		return putSecretVersion(tx, key, s, check)
+	})
+}
+
+// Delete is SecretStoreを実装
+func (st *MemorySecretStore) Delete(ctx context.Context, t *Tenant, key string, check func(cur *Secret) error) (*Secret, error) {
+	var cur *Secret
+	err := st.RunInTransaction(ctx, t, func(tx SecretTx) error {
+		var err error
+		cur, err = deleteSecret(tx, key, check)
+		return err
+	})
+	return cur, err
+}
+
+// RunInTransaction is SecretStoreを実装. 変更はfが成功した後にまとめて反映する
+func (st *MemorySecretStore) RunInTransaction(ctx context.Context, t *Tenant, f func(tx SecretTx) error) error {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	tx := &memorySecretTx{
+		data:    st.data[t.Namespace],
+		changes: map[string]*Secret{},
+	}
+	if err := f(tx); err != nil {
+		return err
+	}
+	if len(tx.changes) == 0 {
+		return nil
+	}
+	if st.data[t.Namespace] == nil {
+		st.data[t.Namespace] = map[string]Secret{}
+	}
+	for key, s := range tx.changes {
+		if s == nil {
+			delete(st.data[t.Namespace], key)
+			continue
+		}
+		st.data[t.Namespace][key] = *s
+	}
+	return nil
+}
+
+// memorySecretTx is MemorySecretStoreのTransaction. changesのnilは削除を表す
+type memorySecretTx struct {
+	data    map[string]Secret
+	changes map[string]*Secret
+}
+
+func (tx *memorySecretTx) Get(key string) (*Secret, error) {
+	if s, ok := tx.changes[key]; ok {
+		if s == nil {
+			return nil, ErrSecretNotFound
+		}
+		c := *s
+		return &c, nil
+	}
+	s, ok := tx.data[key]
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+	return &s, nil
+}
+
+func (tx *memorySecretTx) Put(key string, s *Secret) error {
+	c := *s
+	tx.changes[key] = &c
+	return nil
+}
+
+func (tx *memorySecretTx) Delete(key string) error {
+	tx.changes[key] = nil
+	return nil
+}
@@ -0,0 +1,237 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestMemorySecretStore(t *testing.T) {
+	checkSecretStore(t, NewMemorySecretStore())
+}
+
+func TestBoltSecretStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gcpsm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	st, err := OpenBoltSecretStore(filepath.Join(dir, "gcpsm.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer st.Close()
+	checkSecretStore(t, st)
+}
+
+func TestDatastoreSecretStore(t *testing.T) {
+	defer useFakeDatastore(newFakeDatastore())()
+	checkSecretStore(t, &DatastoreSecretStore{})
+}
+
+// checkSecretStore is SecretStoreの実装が期待する振る舞いをするかを確認する. 全ての実装で同じ確認を行う
+// 空のSecretStoreに対して実行すること
+func checkSecretStore(t *testing.T, st SecretStore) {
+	ctx := context.Background()
+	tenant := &Tenant{ID: "conformance", Namespace: "gcpsm-conformance"}
+	other := &Tenant{ID: "conformance-other", Namespace: "gcpsm-conformance-other"}
+	keys := []string{"a", "a/b", "a/b/c", "ab", "b"}
+	checks := []struct {
+		name string
+		f    func() error
+	}{
+		{"get missing", func() error {
+			_, err := st.Get(ctx, tenant, "a")
+			return expectErr(err, ErrSecretNotFound)
+		}},
+		{"put version", func() error {
+			for i, want := range []int64{1, 2} {
+				s := &Secret{Value: fmt.Sprintf("v%d", i+1), UpdatedBy: "conformance@example.com"}
+				var got *Secret
+				err := st.PutVersion(ctx, tenant, "a", s, func(cur *Secret) error {
+					got = cur
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+				if s.Version != want {
+					return fmt.Errorf("version is %d, want %d", s.Version, want)
+				}
+				if want == 1 && got != nil {
+					return fmt.Errorf("check got %+v for new secret, want nil", got)
+				}
+				if want == 2 && (got == nil || got.Version != 1) {
+					return fmt.Errorf("check got %+v, want version 1", got)
+				}
+			}
+			s, err := st.Get(ctx, tenant, "a")
+			if err != nil {
+				return err
+			}
+			if s.Value != "v2" || s.Version != 2 || s.UpdatedBy != "conformance@example.com" {
+				return fmt.Errorf("got %+v, want value v2 at version 2", s)
+			}
+			return nil
+		}},
+		{"put version check error", func() error {
+			errCheck := errors.New("check failed")
+			err := st.PutVersion(ctx, tenant, "a", &Secret{Value: "v3"}, func(cur *Secret) error { return errCheck })
+			if err := expectErr(err, errCheck); err != nil {
+				return err
+			}
+			s, err := st.Get(ctx, tenant, "a")
+			if err != nil {
+				return err
+			}
+			if s.Version != 2 {
+				return fmt.Errorf("version is %d after failed check, want 2", s.Version)
+			}
+			return nil
+		}},
+		{"tenant isolation", func() error {
+			_, err := st.Get(ctx, other, "a")
+			if err := expectErr(err, ErrSecretNotFound); err != nil {
+				return err
+			}
+			list, err := st.List(ctx, other, "")
+			if err != nil {
+				return err
+			}
+			return expectKeys(list, []string{})
+		}},
+		{"list", func() error {
+			for _, key := range keys[1:] {
+				if err := st.PutVersion(ctx, tenant, key, &Secret{Value: key}, func(cur *Secret) error { return nil }); err != nil {
+					return err
+				}
+			}
+			if err := st.PutVersion(ctx, other, "z", &Secret{Value: "z"}, func(cur *Secret) error { return nil }); err != nil {
+				return err
+			}
+			defer st.Delete(ctx, other, "z", func(cur *Secret) error { return nil })
+
+			for prefix, want := range map[string][]string{
+				"":    keys,
+				"a":   {"a", "a/b", "a/b/c"},
+				"a/b": {"a/b", "a/b/c"},
+				"c":   {},
+			} {
+				list, err := st.List(ctx, tenant, prefix)
+				if err != nil {
+					return err
+				}
+				if err := expectKeys(list, want); err != nil {
+					return errors.Wrapf(err, "prefix=%q", prefix)
+				}
+			}
+			return nil
+		}},
+		{"get multi", func() error {
+			list, err := st.GetMulti(ctx, tenant, []string{"b", "a/b", "ab"})
+			if err != nil {
+				return err
+			}
+			for i, want := range []string{"b", "a/b", "ab"} {
+				if list[i].Value != want {
+					return fmt.Errorf("list[%d] is %q, want %q", i, list[i].Value, want)
+				}
+			}
+			_, err = st.GetMulti(ctx, tenant, []string{"b", "missing"})
+			return expectErr(err, ErrSecretNotFound)
+		}},
+		{"transaction rollback", func() error {
+			errAbort := errors.New("abort")
+			err := st.RunInTransaction(ctx, tenant, func(tx SecretTx) error {
+				if err := tx.Put("b", &Secret{Value: "changed"}); err != nil {
+					return err
+				}
+				if err := tx.Delete("ab"); err != nil {
+					return err
+				}
+				return errAbort
+			})
+			if err := expectErr(err, errAbort); err != nil {
+				return err
+			}
+			list, err := st.GetMulti(ctx, tenant, []string{"b", "ab"})
+			if err != nil {
+				return err
+			}
+			if list[0].Value != "b" || list[1].Value != "ab" {
+				return fmt.Errorf("changes in aborted transaction are saved")
+			}
+			return nil
+		}},
+		{"transaction commit", func() error {
+			err := st.RunInTransaction(ctx, tenant, func(tx SecretTx) error {
+				s, err := tx.Get("b")
+				if err != nil {
+					return err
+				}
+				if err := tx.Put("ab", s); err != nil {
+					return err
+				}
+				return tx.Delete("b")
+			})
+			if err != nil {
+				return err
+			}
+			s, err := st.Get(ctx, tenant, "ab")
+			if err != nil {
+				return err
+			}
+			if s.Value != "b" {
+				return fmt.Errorf("ab is %q, want b", s.Value)
+			}
+			_, err = st.Get(ctx, tenant, "b")
+			return expectErr(err, ErrSecretNotFound)
+		}},
+		{"delete", func() error {
+			errCheck := errors.New("check failed")
+			_, err := st.Delete(ctx, tenant, "a", func(cur *Secret) error { return errCheck })
+			if err := expectErr(err, errCheck); err != nil {
+				return err
+			}
+			s, err := st.Delete(ctx, tenant, "a", func(cur *Secret) error { return nil })
+			if err != nil {
+				return err
+			}
+			if s.Version != 2 {
+				return fmt.Errorf("deleted secret is version %d, want 2", s.Version)
+			}
+			_, err = st.Get(ctx, tenant, "a")
+			if err := expectErr(err, ErrSecretNotFound); err != nil {
+				return err
+			}
+			_, err = st.Delete(ctx, tenant, "a", func(cur *Secret) error { return nil })
+			return expectErr(err, ErrSecretNotFound)
+		}},
+	}
+	for _, c := range checks {
+		if err := c.f(); err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+	}
+}
+
+func expectErr(err error, want error) error {
+	if errors.Cause(err) != want {
+		return fmt.Errorf("error is %v, want %v", err, want)
+	}
+	return nil
+}
+
+func expectKeys(got []string, want []string) error {
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("keys are %q, want %q", got, want)
+	}
+	return nil
+}
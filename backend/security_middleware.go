@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/favclip/ucon"
+)
+
+// CSRF Tokenを受け渡すCookieとHeader
+// Tokenは画面のmeta要素で渡すので、CookieはJavaScriptから読めなくてよい
+const (
+	CSRFCookieName = "XSRF-TOKEN"
+	CSRFHeader     = "X-XSRF-TOKEN"
+)
+
+// contentSecurityPolicy is 画面とAPIの全てのResponseに付けるCSP
+// ScriptとStyleは /ui/static/ から読むものだけを許可し、inlineのScriptは実行させない
+const contentSecurityPolicy = "default-src 'none'; script-src 'self'; style-src 'self'; img-src 'self'; connect-src 'self'; " +
+	"form-action 'self'; frame-ancestors 'none'; base-uri 'none'"
+
+// setSecurityHeaders is ResponseにSecurity Headerを設定する
+// HSTSはHTTPSで受け取った場合だけBrowserが従うので、HTTPの場合も設定してよい
+func setSecurityHeaders(w http.ResponseWriter) {
+	h := w.Header()
+	h.Set("Content-Security-Policy", contentSecurityPolicy)
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Referrer-Policy", "no-referrer")
+	h.Set("Strict-Transport-Security", "max-age=31536000; includeSubDomains")
+}
+
+// UseSecurityHeaders is Middleware, ResponseにCSP, X-Frame-Options, HSTS等を設定する
+func UseSecurityHeaders(b *ucon.Bubble) error {
+	setSecurityHeaders(b.W)
+	return b.Next()
+}
+
+// SecurityHeaders is ucon以外のHandler (画面) にUseSecurityHeadersと同じHeaderを設定する
+func SecurityHeaders(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setSecurityHeaders(w)
+		h.ServeHTTP(w, r)
+	})
+}
+
+var csrfProtect = mustCSRFProtect()
+
+func mustCSRFProtect() ucon.MiddlewareFunc {
+	f, err := ucon.CSRFProtect(&ucon.CSRFOption{
+		CookieName:        CSRFCookieName,
+		RequestHeaderName: CSRFHeader,
+		GenerateCookie: func(r *http.Request) (*http.Cookie, error) {
+			token, err := newCSRFToken()
+			if err != nil {
+				return nil, err
+			}
+			return csrfCookie(r, token), nil
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	return f
+}
+
+func newCSRFToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func csrfCookie(r *http.Request, token string) *http.Cookie {
+	return &http.Cookie{
+		Name:     CSRFCookieName,
+		Value:    token,
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+	}
+}
+
+// issueCSRFToken is 画面に埋め込むCSRF Tokenを返す. Cookieが無ければ作成してResponseに設定する
+func issueCSRFToken(w http.ResponseWriter, r *http.Request) (string, error) {
+	if c, err := r.Cookie(CSRFCookieName); err == nil && len(c.Value) == 64 {
+		return c.Value, nil
+	}
+	token, err := newCSRFToken()
+	if err != nil {
+		return "", err
+	}
+	http.SetCookie(w, csrfCookie(r, token))
+	return token, nil
+}
+
+// csrfExempt is CSRFの対象にならないRequestかを返す
+// BrowserはCookieを自動で送るが、Authorization: Bearerは送らないので、Cookieを持たないRequestとBearer TokenのRequestは確認しない
+// CLI, Task Queue, 複製のように、Browser以外から呼ばれるAPIはこちらに該当する
+func csrfExempt(r *http.Request) bool {
+	if strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ") {
+		return true
+	}
+	return len(r.Cookies()) == 0
+}
+
+// UseCSRFProtect is Middleware, Cookieで認証されるBrowserからのRequestに、ucon.CSRFProtectでCSRF Tokenを要求する
+// GET等ではCookieを発行し、POST等ではCSRFHeaderの値がCookieと一致しなければ403を返す
+// Errorを返すのでUseErrorTranslationより後に置くこと
+func UseCSRFProtect(b *ucon.Bubble) error {
+	if csrfExempt(b.R) {
+		return b.Next()
+	}
+	err := csrfProtect(b)
+	if err == ucon.ErrCSRFBadToken {
+		return &HTTPError{Code: http.StatusForbidden, Reason: ReasonPermissionDenied, Message: "invalid CSRF token. reload the page and retry."}
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// serveTestRequest is http.DefaultServeMuxでRequestを処理したResponseを返す
+func serveTestRequest(t *testing.T, method string, path string, header http.Header, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := httptest.NewRequest(method, path, bytes.NewReader(b))
+	r.Header.Set("Content-Type", "application/json")
+	for k, vs := range header {
+		for _, v := range vs {
+			r.Header.Add(k, v)
+		}
+	}
+	w := httptest.NewRecorder()
+	http.DefaultServeMux.ServeHTTP(w, r)
+	return w
+}
+
+func checkSecurityHeaders(t *testing.T, name string, w *httptest.ResponseRecorder) {
+	t.Helper()
+	for k, v := range map[string]string{
+		"Content-Security-Policy":   contentSecurityPolicy,
+		"X-Frame-Options":           "DENY",
+		"X-Content-Type-Options":    "nosniff",
+		"Strict-Transport-Security": "max-age=31536000; includeSubDomains",
+	} {
+		if g := w.Header().Get(k); g != v {
+			t.Errorf("%s: %s: got %q, want %q", name, k, g, v)
+		}
+	}
+}
+
+func TestUseCSRFProtect(t *testing.T) {
+	defer useFakeDatastore(newFakeDatastore())()
+
+	// 画面を表示するとCookieが発行され、同じTokenが画面に埋め込まれる
+	page := serveTestRequest(t, http.MethodGet, "/ui/", nil, nil)
+	if page.Code != http.StatusOK {
+		t.Fatalf("GET /ui/: got %d, want %d", page.Code, http.StatusOK)
+	}
+	checkSecurityHeaders(t, "GET /ui/", page)
+	var token string
+	for _, c := range page.Result().Cookies() {
+		if c.Name == CSRFCookieName {
+			token = c.Value
+		}
+	}
+	if token == "" {
+		t.Fatalf("GET /ui/: %s cookie is not issued", CSRFCookieName)
+	}
+	if !strings.Contains(page.Body.String(), token) {
+		t.Errorf("GET /ui/: CSRF token is not in the page")
+	}
+
+	cookie := CSRFCookieName + "=" + token
+	cases := []struct {
+		name   string
+		header http.Header
+		code   int
+	}{
+		{"cookie without token", http.Header{"Cookie": {cookie}}, http.StatusForbidden},
+		{"cookie with other token", http.Header{"Cookie": {cookie}, CSRFHeader: {"other"}}, http.StatusForbidden},
+		{"other cookie without token", http.Header{"Cookie": {"session=x"}}, http.StatusForbidden},
+		{"cookie with token", http.Header{"Cookie": {cookie}, CSRFHeader: {token}}, http.StatusOK},
+		{"bearer with cookie", http.Header{"Cookie": {cookie}, "Authorization": {"Bearer token"}}, http.StatusOK},
+		{"no cookie", nil, http.StatusOK},
+	}
+	for _, c := range cases {
+		w := serveTestRequest(t, http.MethodPost, "/api/1/secret", c.header, &SecretAPIPostRequest{Key: "csrf/" + strings.Replace(c.name, " ", "-", -1), Value: "v"})
+		if w.Code != c.code {
+			t.Errorf("%s: got %d, want %d. body=%s", c.name, w.Code, c.code, w.Body.String())
+		}
+		checkSecurityHeaders(t, c.name, w)
+	}
+}
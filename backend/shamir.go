@@ -0,0 +1,117 @@
+package backend
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+// Shamir's Secret Sharing over GF(2^8)
+// ShareはX座標の1byteの後に、secretと同じ長さのY座標が続く. App EngineのAPIを使わないので、Offlineでも利用できる
+
+// gfExp, gfLog is GF(2^8)の乗算に使うTable. 生成元は3, 既約多項式は x^8 + x^4 + x^3 + x + 1 (AESと同じ)
+var gfExp, gfLog = gfTables()
+
+func gfTables() (exp [510]byte, log [256]byte) {
+	x := byte(1)
+	for i := 0; i < 255; i++ {
+		exp[i] = x
+		log[x] = byte(i)
+		// x * 3 = x * 2 + x
+		x2 := x << 1
+		if x&0x80 != 0 {
+			x2 ^= 0x1b
+		}
+		x = x2 ^ x
+	}
+	for i := 255; i < len(exp); i++ {
+		exp[i] = exp[i-255]
+	}
+	return exp, log
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+int(gfLog[b])]
+}
+
+func gfDiv(a, b byte) byte {
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])+255-int(gfLog[b])]
+}
+
+// SplitSecret is secretをn個のShareに分割する. 任意のk個のShareから元に戻せ、k-1個以下では何も分からない
+func SplitSecret(secret []byte, n int, k int) ([][]byte, error) {
+	if k < 2 || n < k || n > 255 {
+		return nil, fmt.Errorf("invalid threshold. n=%d, k=%d", n, k)
+	}
+	if len(secret) == 0 {
+		return nil, errors.New("secret is empty")
+	}
+
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret)+1)
+		shares[i][0] = byte(i + 1)
+	}
+	coef := make([]byte, k)
+	for j, b := range secret {
+		coef[0] = b
+		if _, err := rand.Read(coef[1:]); err != nil {
+			return nil, errors.Wrap(err, "failed generate coefficients")
+		}
+		for _, share := range shares {
+			// Horner法で多項式を評価する
+			x := share[0]
+			var y byte
+			for c := k - 1; c >= 0; c-- {
+				y = gfMul(y, x) ^ coef[c]
+			}
+			share[j+1] = y
+		}
+	}
+	return shares, nil
+}
+
+// CombineShares is SplitSecretで分割したShareからsecretを元に戻す
+// Shareがk個に足りない場合はErrorにならず、別の値を返すことに注意
+func CombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) < 2 {
+		return nil, errors.New("at least 2 shares are required")
+	}
+	size := len(shares[0])
+	if size < 2 {
+		return nil, errors.New("invalid share")
+	}
+	seen := map[byte]bool{}
+	for _, s := range shares {
+		if len(s) != size {
+			return nil, errors.New("shares have different length")
+		}
+		if s[0] == 0 || seen[s[0]] {
+			return nil, fmt.Errorf("invalid or duplicated share. x=%d", s[0])
+		}
+		seen[s[0]] = true
+	}
+
+	secret := make([]byte, size-1)
+	for i, si := range shares {
+		// x=0でのLagrange基底多項式の値
+		basis := byte(1)
+		for j, sj := range shares {
+			if i == j {
+				continue
+			}
+			basis = gfMul(basis, gfDiv(sj[0], sj[0]^si[0]))
+		}
+		for b := range secret {
+			secret[b] ^= gfMul(si[b+1], basis)
+		}
+	}
+	return secret, nil
+}
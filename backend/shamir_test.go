@@ -0,0 +1,123 @@
+package backend
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSplitSecretCombineShares(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	cases := []struct {
+		n, k int
+		use  []int
+	}{
+		{2, 2, []int{0, 1}},
+		{3, 2, []int{2, 0}},
+		{5, 3, []int{0, 1, 2}},
+		{5, 3, []int{4, 2, 0}},
+		{5, 3, []int{0, 1, 2, 3, 4}},
+		{10, 7, []int{9, 8, 7, 6, 5, 4, 3}},
+		{255, 2, []int{0, 254}},
+	}
+	for _, c := range cases {
+		shares, err := SplitSecret(secret, c.n, c.k)
+		if err != nil {
+			t.Fatalf("n=%d, k=%d: %v", c.n, c.k, err)
+		}
+		if len(shares) != c.n {
+			t.Fatalf("n=%d, k=%d: got %d shares", c.n, c.k, len(shares))
+		}
+		var use [][]byte
+		for _, i := range c.use {
+			use = append(use, shares[i])
+		}
+		got, err := CombineShares(use)
+		if err != nil {
+			t.Fatalf("n=%d, k=%d, use=%v: %v", c.n, c.k, c.use, err)
+		}
+		if !bytes.Equal(got, secret) {
+			t.Errorf("n=%d, k=%d, use=%v: got %q, want %q", c.n, c.k, c.use, got, secret)
+		}
+	}
+}
+
+func TestCombineSharesBelowThreshold(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	shares, err := SplitSecret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// k個に足りない場合はErrorにならず、別の値になる
+	got, err := CombineShares(shares[:2])
+	if err != nil {
+		t.Fatalf("CombineShares: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Errorf("combined below threshold: got the secret")
+	}
+}
+
+func TestCombineSharesTampered(t *testing.T) {
+	secret := []byte("correct horse battery staple")
+	shares, err := SplitSecret(secret, 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tampered := append([]byte{}, shares[1]...)
+	tampered[5] ^= 0x01
+
+	got, err := CombineShares([][]byte{shares[0], tampered})
+	if err != nil {
+		t.Fatalf("CombineShares: %v", err)
+	}
+	if bytes.Equal(got, secret) {
+		t.Errorf("combined tampered share: got the secret")
+	}
+	// 改竄したShareはshareHashで検出する
+	if shareHash("prod/db", tampered) == shareHash("prod/db", shares[1]) {
+		t.Errorf("shareHash: tampered share has the same hash")
+	}
+}
+
+func TestSplitSecretInvalid(t *testing.T) {
+	cases := []struct {
+		name   string
+		secret []byte
+		n, k   int
+	}{
+		{"k=1", []byte("s"), 3, 1},
+		{"n<k", []byte("s"), 2, 3},
+		{"n>255", []byte("s"), 256, 2},
+		{"empty secret", nil, 3, 2},
+	}
+	for _, c := range cases {
+		if _, err := SplitSecret(c.secret, c.n, c.k); err == nil {
+			t.Errorf("%s: want error", c.name)
+		}
+	}
+}
+
+func TestCombineSharesInvalid(t *testing.T) {
+	shares, err := SplitSecret([]byte("secret"), 3, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zero := append([]byte{}, shares[0]...)
+	zero[0] = 0
+
+	cases := []struct {
+		name   string
+		shares [][]byte
+	}{
+		{"one share", shares[:1]},
+		{"duplicated", [][]byte{shares[0], shares[0]}},
+		{"different length", [][]byte{shares[0], shares[1][:3]}},
+		{"x=0", [][]byte{zero, shares[1]}},
+		{"too short", [][]byte{{1}, {2}}},
+	}
+	for _, c := range cases {
+		if _, err := CombineShares(c.shares); err == nil {
+			t.Errorf("%s: want error", c.name)
+		}
+	}
+}
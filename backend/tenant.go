@@ -0,0 +1,262 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/user"
+)
+
+// TenantKind is Tenant EntityのKind
+const TenantKind = "Tenant"
+
+// validTenantID is Tenant IDとして利用できる文字列. Datastore Namespaceの制約に合わせている
+var validTenantID = regexp.MustCompile(`^[0-9A-Za-z._-]{1,100}$`)
+
+// Tenant is Datastore Entity
+// Secretを分離する単位で、1つのDatastore Namespaceに対応する
+// Tenant Entity自体はDefault Namespaceに保存する
+// RedundantCryptKeysを設定した場合は、値毎のData KeyをCryptKeyとRedundantCryptKeysの全てでEncryptする
+type Tenant struct {
+	ID                 string     `json:"id" datastore:"-"`
+	Namespace          string     `json:"namespace"`
+	CryptKey           CryptKey   `json:"cryptKey"`
+	RedundantCryptKeys []CryptKey `json:"redundantCryptKeys,omitempty"`
+	Admins             []string   `json:"admins"`
+	// ReplicationPeers is 複製元のgcpsmが複製先で認証されるuser. このuserからの書き込みだけをReplicationHeaderで複製によるものとする
+	ReplicationPeers []string  `json:"replicationPeers,omitempty"`
+	CreatedAt        time.Time `json:"createdAt"`
+	UpdatedAt        time.Time `json:"updatedAt"`
+}
+
+// CryptKeys is 値のEncryptに利用するCryptKeyを返す. 先頭はCryptKeyで、Decryptはこの順に試す
+func (t *Tenant) CryptKeys() []CryptKey {
+	return append([]CryptKey{t.CryptKey}, t.RedundantCryptKeys...)
+}
+
+type tenantContextKey struct{}
+
+// NameKey is TenantのNamespaceに属するKeyを作成する
+func (t *Tenant) NameKey(ds datastore.Client, kind string, name string, parent datastore.Key) datastore.Key {
+	k := ds.NameKey(kind, name, parent)
+	k.SetNamespace(t.Namespace)
+	return k
+}
+
+// NewQuery is TenantのNamespaceを対象にしたQueryを作成する
+func (t *Tenant) NewQuery(ds datastore.Client, kind string) datastore.Query {
+	return ds.NewQuery(kind).Namespace(t.Namespace)
+}
+
+// IsAdmin is userがTenantの管理者かどうかを返す
+// App Engineの管理者は全てのTenantの管理者として扱う
+func (t *Tenant) IsAdmin(u *user.User) bool {
+	if u == nil {
+		return false
+	}
+	if u.Admin {
+		return true
+	}
+	for _, admin := range t.Admins {
+		if admin == u.Email {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccess is userがTenantのSecretにアクセスできるかを返す
+// Default Tenantはこれまで通りログインしているuser全員がアクセスできる
+func (t *Tenant) CanAccess(u *user.User) bool {
+	if u == nil {
+		return false
+	}
+	if t.ID == "" {
+		return true
+	}
+	return t.IsAdmin(u)
+}
+
+// IsReplicationPeer is userが複製元のgcpsmとして登録されているかを返す
+func (t *Tenant) IsReplicationPeer(u *user.User) bool {
+	if u == nil {
+		return false
+	}
+	for _, peer := range t.ReplicationPeers {
+		if peer == u.Email {
+			return true
+		}
+	}
+	return false
+}
+
+// DefaultCryptKey is Tenantを指定しない場合に利用するCryptKey
+func DefaultCryptKey(ctx context.Context) CryptKey {
+	ck := CryptKey{
+		Provider:   platform.KeyProvider,
+		ProjectID:  platform.ProjectID(ctx),
+		LocationID: "global",
+		KeyRingID:  "testkey",
+		KeyName:    "testCryptKey",
+	}
+	if platform.CryptKey.LocationID != "" {
+		ck.LocationID = platform.CryptKey.LocationID
+	}
+	if platform.CryptKey.KeyRingID != "" {
+		ck.KeyRingID = platform.CryptKey.KeyRingID
+	}
+	if platform.CryptKey.KeyName != "" {
+		ck.KeyName = platform.CryptKey.KeyName
+	}
+	return ck
+}
+
+// DefaultTenant is Tenantを指定しない場合に利用するDefault NamespaceのTenant
+func DefaultTenant(ctx context.Context) *Tenant {
+	t := &Tenant{
+		CryptKey:         DefaultCryptKey(ctx),
+		ReplicationPeers: platform.ReplicationPeers,
+	}
+	for _, ck := range platform.RedundantCryptKeys {
+		t.RedundantCryptKeys = append(t.RedundantCryptKeys, tenantCryptKey(ctx, ck))
+	}
+	return t
+}
+
+// TenantFromContext is Requestの対象となっているTenantを返す
+func TenantFromContext(ctx context.Context) *Tenant {
+	t, ok := ctx.Value(tenantContextKey{}).(*Tenant)
+	if !ok || t == nil {
+		return DefaultTenant(ctx)
+	}
+	return t
+}
+
+// WithTenant is Tenantを設定したContextを返す
+func WithTenant(ctx context.Context, t *Tenant) (context.Context, error) {
+	ctx, err := appengine.Namespace(ctx, t.Namespace)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed appengine.Namespace. tenant=%s", t.ID)
+	}
+	return context.WithValue(ctx, tenantContextKey{}, t), nil
+}
+
+// ValidateTenantID is Tenant IDとして利用できる文字列かを確認する
+func ValidateTenantID(id string) error {
+	if !validTenantID.MatchString(id) {
+		return &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid tenant id: %q", id)}
+	}
+	return nil
+}
+
+// tenantCacheTTL is Instance内でTenantをCacheする時間
+// 他のInstanceで更新されたTenantは、最大でこの時間だけ古いまま利用される
+const tenantCacheTTL = time.Minute
+
+type tenantCacheEntry struct {
+	tenant    Tenant
+	expiresAt time.Time
+}
+
+// tenantCache is 全てのRequestでTenantをDatastoreから読まないためのCache
+var tenantCache = struct {
+	sync.Mutex
+	m map[string]*tenantCacheEntry
+}{m: map[string]*tenantCacheEntry{}}
+
+// GetTenant is Tenantを取得する. tenantCacheTTLの間はInstance内のCacheを返す
+func GetTenant(ctx context.Context, id string) (*Tenant, error) {
+	tenantCache.Lock()
+	e, ok := tenantCache.m[id]
+	tenantCache.Unlock()
+	if ok && time.Now().Before(e.expiresAt) {
+		cacheRequestsTotal.Inc("tenant", "hit")
+		t := e.tenant
+		return &t, nil
+	}
+	cacheRequestsTotal.Inc("tenant", "miss")
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tenant{}
+	if err := ds.Get(ctx, ds.NameKey(TenantKind, id, nil), t); err != nil {
+		return nil, errors.Wrapf(err, "failed get tenant. tenant=%s", id)
+	}
+	t.ID = id
+
+	tenantCache.Lock()
+	tenantCache.m[id] = &tenantCacheEntry{tenant: *t, expiresAt: time.Now().Add(tenantCacheTTL)}
+	tenantCache.Unlock()
+	return t, nil
+}
+
+// ListTenants is 登録されている全てのTenantを返す. Default Tenantは含まない
+func ListTenants(ctx context.Context, ds datastore.Client) ([]*Tenant, error) {
+	var list []*Tenant
+	keys, err := ds.GetAll(ctx, ds.NewQuery(TenantKind), &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list tenant")
+	}
+	for i, k := range keys {
+		list[i].ID = k.Name()
+	}
+	return list, nil
+}
+
+// invalidateTenantCache is 更新したTenantをCacheから取り除く
+func invalidateTenantCache(id string) {
+	tenantCache.Lock()
+	defer tenantCache.Unlock()
+
+	delete(tenantCache.m, id)
+}
+
+// UseTenant is Path Parameterの{tenant}を解決し、ContextにTenantとNamespaceを設定する
+// {tenant}はHandlerのRequest Structに渡らないように取り除く
+func UseTenant(b *ucon.Bubble) error {
+	params, ok := b.Context.Value(ucon.PathParameterKey).(map[string]string)
+	if !ok {
+		return b.Next()
+	}
+	id, ok := params["tenant"]
+	if !ok {
+		return b.Next()
+	}
+	if err := ValidateTenantID(id); err != nil {
+		return err
+	}
+
+	t, err := GetTenant(b.Context, id)
+	if errors.Cause(err) == datastore.ErrNoSuchEntity {
+		return &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("tenant %s is not found.", id)}
+	} else if err != nil {
+		return err
+	}
+
+	ctx, err := WithTenant(b.Context, t)
+	if err != nil {
+		return err
+	}
+
+	np := make(map[string]string, len(params)-1)
+	for k, v := range params {
+		if k == "tenant" {
+			continue
+		}
+		np[k] = v
+	}
+	b.Context = context.WithValue(ctx, ucon.PathParameterKey, np)
+
+	return b.Next()
+}
@@ -0,0 +1,238 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+	"go.mercari.io/datastore"
+)
+
+func setupTenantAPI(swPlugin *swagger.Plugin) {
+	api := &TenantAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Tenant", Description: "Tenant admin API list"})
+	var hInfo *swagger.HandlerInfo
+
+	hInfo = swagger.NewHandlerInfo(api.Post)
+	ucon.Handle(http.MethodPost, "/api/admin/tenant", hInfo)
+	hInfo.Description, hInfo.Tags = "create tenant", []string{tag.Name}
+
+	hInfo = swagger.NewHandlerInfo(api.Put)
+	ucon.Handle(http.MethodPut, "/api/admin/tenant/{id}", hInfo)
+	hInfo.Description, hInfo.Tags = "update tenant", []string{tag.Name}
+
+	hInfo = swagger.NewHandlerInfo(api.List)
+	ucon.Handle(http.MethodGet, "/api/admin/tenant", hInfo)
+	hInfo.Description, hInfo.Tags = "list tenant", []string{tag.Name}
+}
+
+// TenantAPI is API to manage Tenant
+type TenantAPI struct{}
+
+// TenantAPIPostRequest is TenantAPI Post Request
+type TenantAPIPostRequest struct {
+	ID                 string     `json:"id"`
+	CryptKey           CryptKey   `json:"cryptKey"`
+	RedundantCryptKeys []CryptKey `json:"redundantCryptKeys"`
+	Admins             []string   `json:"admins"`
+	ReplicationPeers   []string   `json:"replicationPeers"`
+}
+
+// Post is Tenant registration handler
+func (api *TenantAPI) Post(ctx context.Context, form *TenantAPIPostRequest) (*Tenant, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	u := CurrentUser(ctx)
+	if u == nil || !u.Admin {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	if err := ValidateTenantID(form.ID); err != nil {
+		return nil, err
+	}
+	cryptKey, redundant, err := tenantCryptKeys(ctx, form.CryptKey, form.RedundantCryptKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	t := &Tenant{
+		ID:                 form.ID,
+		Namespace:          form.ID,
+		CryptKey:           cryptKey,
+		RedundantCryptKeys: redundant,
+		Admins:             form.Admins,
+		ReplicationPeers:   form.ReplicationPeers,
+		CreatedAt:          now,
+		UpdatedAt:          now,
+	}
+	k := ds.NameKey(TenantKind, form.ID, nil)
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		err := tx.Get(k, &Tenant{})
+		if err == nil {
+			return &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("tenant %s already exists.", form.ID)}
+		} else if err != datastore.ErrNoSuchEntity {
+			return err
+		}
+
+		_, err = tx.Put(k, t)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// TenantAPIPutRequest is TenantAPI Put Request
+type TenantAPIPutRequest struct {
+	ID                 string     `json:"id" swagger:",in=path"`
+	CryptKey           CryptKey   `json:"cryptKey"`
+	RedundantCryptKeys []CryptKey `json:"redundantCryptKeys"`
+	Admins             []string   `json:"admins"`
+	ReplicationPeers   []string   `json:"replicationPeers"`
+}
+
+// Put is Tenant update handler
+// CryptKeyを変更した場合、以前のCryptKeyはRedundantCryptKeysに残す. 既存の値は以前のCryptKeyでEncryptされているため
+// ReencryptAPIでEncryptし直した後に、RedundantCryptKeysから外す
+func (api *TenantAPI) Put(ctx context.Context, form *TenantAPIPutRequest) (*Tenant, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	u := CurrentUser(ctx)
+	if u == nil || !u.Admin {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	cryptKey, redundant, err := tenantCryptKeys(ctx, form.CryptKey, form.RedundantCryptKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Tenant{}
+	k := ds.NameKey(TenantKind, form.ID, nil)
+	_, err = ds.RunInTransaction(ctx, func(tx datastore.Transaction) error {
+		if err := tx.Get(k, t); err == datastore.ErrNoSuchEntity {
+			return &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("tenant %s is not found.", form.ID)}
+		} else if err != nil {
+			return err
+		}
+
+		t.RedundantCryptKeys = redundant
+		if !sameCryptKey(t.CryptKey, cryptKey) && !containsCryptKey(redundant, t.CryptKey) {
+			t.RedundantCryptKeys = append(t.RedundantCryptKeys, t.CryptKey)
+		}
+		t.CryptKey = cryptKey
+		t.Admins = form.Admins
+		t.ReplicationPeers = form.ReplicationPeers
+		t.UpdatedAt = time.Now()
+		_, err := tx.Put(k, t)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	invalidateTenantCache(form.ID)
+	t.ID = form.ID
+
+	return t, nil
+}
+
+// TenantAPIListResponse is TenantAPI List Response
+type TenantAPIListResponse struct {
+	List []*Tenant `json:"list"`
+}
+
+// List is Tenant list handler
+func (api *TenantAPI) List(ctx context.Context) (*TenantAPIListResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	u := CurrentUser(ctx)
+	if u == nil || !u.Admin {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	list, err := ListTenants(ctx, ds)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TenantAPIListResponse{
+		List: list,
+	}, nil
+}
+
+// tenantCryptKey is 省略されたCryptKeyの項目をDefaultの値で補完する
+func tenantCryptKey(ctx context.Context, ck CryptKey) CryptKey {
+	d := DefaultCryptKey(ctx)
+	if ck.Provider == "" {
+		ck.Provider = d.Provider
+	}
+	if ck.ProjectID == "" {
+		ck.ProjectID = d.ProjectID
+	}
+	if ck.LocationID == "" {
+		ck.LocationID = d.LocationID
+	}
+	if ck.KeyRingID == "" {
+		ck.KeyRingID = d.KeyRingID
+	}
+	if ck.KeyName == "" {
+		ck.KeyName = d.KeyName
+	}
+	return ck
+}
+
+// tenantCryptKeys is CryptKeyとRedundantCryptKeysを補完し、Providerが利用できるか、同じKeyが重複していないかを確認する
+func tenantCryptKeys(ctx context.Context, cryptKey CryptKey, redundant []CryptKey) (CryptKey, []CryptKey, error) {
+	keys := append([]CryptKey{cryptKey}, redundant...)
+	for i, ck := range keys {
+		if !KeyProviderRegistered(ck.Provider) {
+			return CryptKey{}, nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("key provider %s is not available.", ck.Provider)}
+		}
+		keys[i] = tenantCryptKey(ctx, ck)
+		for _, prev := range keys[:i] {
+			if sameCryptKey(prev, keys[i]) {
+				return CryptKey{}, nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("crypt key %s is specified more than once.", keys[i].Name())}
+			}
+		}
+	}
+	if len(keys) == 1 {
+		return keys[0], nil, nil
+	}
+	return keys[0], keys[1:], nil
+}
+
+func containsCryptKey(keys []CryptKey, key CryptKey) bool {
+	for _, k := range keys {
+		if sameCryptKey(k, key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// SpanExporter is 終わったSpanの出力先
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+}
+
+// InMemoryExporter is SpanをMemoryに保持するSpanExporter. 動作確認に利用する
+type InMemoryExporter struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+// NewInMemoryExporter is InMemoryExporterを作成
+func NewInMemoryExporter() *InMemoryExporter {
+	return &InMemoryExporter{}
+}
+
+// ExportSpans is SpanExporterを実装
+func (e *InMemoryExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = append(e.spans, spans...)
+	return nil
+}
+
+// Spans is ExportされたSpanを返す
+func (e *InMemoryExporter) Spans() []*Span {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return append([]*Span{}, e.spans...)
+}
+
+// Reset is 保持しているSpanを捨てる
+func (e *InMemoryExporter) Reset() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.spans = nil
+}
+
+// StdoutExporter is Spanを1行1つのJSONで書き出すSpanExporter
+type StdoutExporter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewStdoutExporter is StdoutExporterを作成
+func NewStdoutExporter(w io.Writer) *StdoutExporter {
+	return &StdoutExporter{w: w}
+}
+
+// ExportSpans is SpanExporterを実装
+func (e *StdoutExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	enc := json.NewEncoder(e.w)
+	for _, s := range spans {
+		if err := enc.Encode(newOTLPSpan(s)); err != nil {
+			return errors.Wrap(err, "failed write span")
+		}
+	}
+	return nil
+}
+
+// OTLPExporter is OTLP/HTTP(JSON)でCollectorにSpanを送るSpanExporter
+type OTLPExporter struct {
+	// Endpoint is Collectorの URL. /v1/traces に送信する
+	Endpoint string
+	// ServiceName is Resourceのservice.name
+	ServiceName string
+	// Client is 送信に利用するhttp.Clientを返す. nilの場合はPlatform.HTTPClientを利用する
+	Client func(ctx context.Context) *http.Client
+}
+
+// NewOTLPExporter is OTLPExporterを作成
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		Endpoint:    strings.TrimRight(endpoint, "/"),
+		ServiceName: "gcpsm",
+	}
+}
+
+// ExportSpans is SpanExporterを実装
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	list := make([]*otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		list = append(list, newOTLPSpan(s))
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": []*otlpAttribute{newOTLPAttribute("service.name", e.ServiceName)},
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "github.com/sinmetal/gcpsm/backend"},
+						"spans": list,
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return errors.Wrap(err, "failed marshal spans")
+	}
+
+	client := platform.HTTPClient(ctx)
+	if e.Client != nil {
+		client = e.Client(ctx)
+	}
+	req, err := http.NewRequest(http.MethodPost, e.Endpoint+"/v1/traces", bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "failed create otlp request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return errors.Wrap(err, "failed send spans")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("otlp collector returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// otlpSpan is OTLP JSONのSpan
+type otlpSpan struct {
+	TraceID           string           `json:"traceId"`
+	SpanID            string           `json:"spanId"`
+	ParentSpanID      string           `json:"parentSpanId,omitempty"`
+	Name              string           `json:"name"`
+	Kind              SpanKind         `json:"kind"`
+	StartTimeUnixNano string           `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+	Attributes        []*otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus      `json:"status,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+func newOTLPAttribute(key string, value string) *otlpAttribute {
+	return &otlpAttribute{Key: key, Value: map[string]string{"stringValue": value}}
+}
+
+func newOTLPSpan(s *Span) *otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ospan := &otlpSpan{
+		TraceID:           s.SpanContext.TraceID.String(),
+		SpanID:            s.SpanContext.SpanID.String(),
+		Name:              s.Name,
+		Kind:              s.Kind,
+		StartTimeUnixNano: strconv.FormatInt(s.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.EndTime.UnixNano(), 10),
+	}
+	if s.ParentSpanID != (SpanID{}) {
+		ospan.ParentSpanID = s.ParentSpanID.String()
+	}
+	keys := make([]string, 0, len(s.Attributes))
+	for k := range s.Attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		ospan.Attributes = append(ospan.Attributes, newOTLPAttribute(k, s.Attributes[k]))
+	}
+	if s.Error != "" {
+		// 2 is STATUS_CODE_ERROR
+		ospan.Status = &otlpStatus{Code: 2, Message: s.Error}
+	}
+	return ospan
+}
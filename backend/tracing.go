@@ -0,0 +1,423 @@
+package backend
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/favclip/ucon"
+	"golang.org/x/oauth2"
+)
+
+// Span Attribute List
+// AttrSecretKey, AttrHTTPTarget, AttrDatastoreKeysはSecret Keyを含むので、TraceConfig.RedactSecretKeysで伏せられる
+const (
+	AttrSecretKey     = "gcpsm.secret.key"
+	AttrSecretValue   = "gcpsm.secret.value"
+	AttrTenant        = "gcpsm.tenant"
+	AttrCryptKey      = "gcpsm.kms.crypt_key"
+	AttrHTTPMethod    = "http.method"
+	AttrHTTPTarget    = "http.target"
+	AttrHTTPStatus    = "http.status_code"
+	AttrDatastoreKind = "db.datastore.kind"
+	AttrDatastoreKeys = "db.datastore.keys"
+)
+
+// redactedValue is 伏せたAttributeの値
+const redactedValue = "[REDACTED]"
+
+// TraceConfig is Tracingの設定
+type TraceConfig struct {
+	// Exporter is 終わったSpanの出力先. nilの場合はTracingを行わない
+	Exporter SpanExporter
+	// RedactSecretKeys is trueの場合、Secret Keyを含むAttributeを伏せる
+	RedactSecretKeys bool
+	// RedactSecretValues is trueの場合、Secretの値を含むAttributeを伏せる
+	RedactSecretValues bool
+	// RedactAttributes is 追加で伏せるAttributeの名前
+	RedactAttributes []string
+}
+
+// redacted is Attributeを伏せるかを返す
+func (c *TraceConfig) redacted(key string) bool {
+	switch key {
+	case AttrSecretKey, AttrHTTPTarget, AttrDatastoreKeys:
+		if c.RedactSecretKeys {
+			return true
+		}
+	case AttrSecretValue:
+		if c.RedactSecretValues {
+			return true
+		}
+	}
+	for _, a := range c.RedactAttributes {
+		if a == key {
+			return true
+		}
+	}
+	return false
+}
+
+var traceConfig = struct {
+	sync.RWMutex
+	c *TraceConfig
+}{c: traceConfigFromEnv()}
+
+// SetTraceConfig is Tracingの設定を変更する
+func SetTraceConfig(c *TraceConfig) {
+	traceConfig.Lock()
+	defer traceConfig.Unlock()
+
+	traceConfig.c = c
+}
+
+func currentTraceConfig() *TraceConfig {
+	traceConfig.RLock()
+	defer traceConfig.RUnlock()
+
+	return traceConfig.c
+}
+
+// traceConfigFromEnv is 環境変数からTraceConfigを作成する
+// GCPSM_TRACE_EXPORTER: none(default) | stdout | otlp
+// GCPSM_TRACE_OTLP_ENDPOINT: otlpの送信先. ex) https://collector.example.com
+// GCPSM_TRACE_REDACT_KEYS: trueの場合Secret Keyを伏せる
+// GCPSM_TRACE_REDACT_VALUES: falseにしない限りSecretの値を伏せる
+// GCPSM_TRACE_REDACT_ATTRIBUTES: 追加で伏せるAttributeの名前をカンマ区切りで指定する
+func traceConfigFromEnv() *TraceConfig {
+	c := &TraceConfig{
+		RedactSecretValues: true,
+	}
+	switch os.Getenv("GCPSM_TRACE_EXPORTER") {
+	case "stdout":
+		c.Exporter = NewStdoutExporter(os.Stdout)
+	case "otlp":
+		c.Exporter = NewOTLPExporter(os.Getenv("GCPSM_TRACE_OTLP_ENDPOINT"))
+	}
+	if v, err := strconv.ParseBool(os.Getenv("GCPSM_TRACE_REDACT_KEYS")); err == nil {
+		c.RedactSecretKeys = v
+	}
+	if v, err := strconv.ParseBool(os.Getenv("GCPSM_TRACE_REDACT_VALUES")); err == nil {
+		c.RedactSecretValues = v
+	}
+	if v := os.Getenv("GCPSM_TRACE_REDACT_ATTRIBUTES"); v != "" {
+		c.RedactAttributes = strings.Split(v, ",")
+	}
+	return c
+}
+
+// TraceID is W3C Trace ContextのTrace ID
+type TraceID [16]byte
+
+// SpanID is W3C Trace ContextのSpan ID
+type SpanID [8]byte
+
+// String is 16進数の文字列を返す
+func (id TraceID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// String is 16進数の文字列を返す
+func (id SpanID) String() string {
+	return hex.EncodeToString(id[:])
+}
+
+// SpanContext is Process間で伝播するSpanの識別子
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// IsValid is TraceIDとSpanIDが両方とも0でないかを返す
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// Traceparent is W3C traceparent Headerの値を返す
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceID, sc.SpanID, flags)
+}
+
+// ParseTraceparent is W3C traceparent Headerの値を読む
+// version-traceid-parentid-flags の形式でない場合はfalseを返す
+func ParseTraceparent(v string) (SpanContext, bool) {
+	var sc SpanContext
+	parts := strings.Split(strings.TrimSpace(v), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	flags, err := hex.DecodeString(parts[3])
+	if err != nil {
+		return sc, false
+	}
+	sc.Sampled = flags[0]&0x01 == 0x01
+	if !sc.IsValid() {
+		return sc, false
+	}
+	return sc, true
+}
+
+// SpanKind is OpenTelemetryのSpan Kind
+type SpanKind int
+
+// SpanKind List
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is 1つの処理の区間
+type Span struct {
+	Name         string
+	Kind         SpanKind
+	SpanContext  SpanContext
+	ParentSpanID SpanID
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]string
+	Error        string
+
+	mu       sync.Mutex
+	config   *TraceConfig
+	recorder *spanRecorder
+	ended    bool
+}
+
+// SetAttribute is Attributeを設定する. TraceConfigで伏せる設定になっている場合は値を伏せる
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	if s.config.redacted(key) {
+		value = redactedValue
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Attributes[key] = value
+}
+
+// SetError is Spanの処理が失敗したことを記録する
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Error MessageにはSecret Keyが含まれることがあるので、Keyを伏せる場合は型だけにする
+	if s.config.RedactSecretKeys {
+		s.Error = fmt.Sprintf("%T", err)
+		return
+	}
+	s.Error = err.Error()
+}
+
+// End is Spanを終了し、Exportの対象にする
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.EndTime = time.Now()
+	s.mu.Unlock()
+
+	if s.recorder != nil {
+		s.recorder.add(s)
+		return
+	}
+	// Requestの外で作られたSpanはその場でExportする
+	if err := s.config.Exporter.ExportSpans(context.Background(), []*Span{s}); err != nil {
+		fmt.Fprintf(os.Stderr, "failed export span: %v\n", err)
+	}
+}
+
+// spanRecorder is 1 Requestの間に終わったSpanを集める
+type spanRecorder struct {
+	mu    sync.Mutex
+	spans []*Span
+}
+
+func (r *spanRecorder) add(s *Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = append(r.spans, s)
+}
+
+func (r *spanRecorder) flush() []*Span {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spans := r.spans
+	r.spans = nil
+	return spans
+}
+
+type spanContextKey struct{}
+
+type spanRecorderContextKey struct{}
+
+// SpanFromContext is Contextの現在のSpanを返す. Tracingしていない場合はnilを返す
+// nilのSpanのMethodは何もしないので、そのまま呼び出してよい
+func SpanFromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanContextKey{}).(*Span)
+	return s
+}
+
+// StartSpan is Contextの現在のSpanを親として新しいSpanを開始する
+// Exporterが設定されていない場合や、親がSampleされていない場合はnilのSpanを返す
+func StartSpan(ctx context.Context, name string, kind SpanKind) (context.Context, *Span) {
+	c := currentTraceConfig()
+	if c == nil || c.Exporter == nil {
+		return ctx, nil
+	}
+
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		StartTime:  time.Now(),
+		Attributes: map[string]string{},
+		config:     c,
+	}
+	s.recorder, _ = ctx.Value(spanRecorderContextKey{}).(*spanRecorder)
+
+	parent := SpanFromContext(ctx)
+	if parent != nil {
+		s.SpanContext.TraceID = parent.SpanContext.TraceID
+		s.ParentSpanID = parent.SpanContext.SpanID
+	} else if sc, ok := ctx.Value(remoteSpanContextKey{}).(SpanContext); ok {
+		if !sc.Sampled {
+			return ctx, nil
+		}
+		s.SpanContext.TraceID = sc.TraceID
+		s.ParentSpanID = sc.SpanID
+	} else {
+		rand.Read(s.SpanContext.TraceID[:])
+	}
+	rand.Read(s.SpanContext.SpanID[:])
+	s.SpanContext.Sampled = true
+
+	return context.WithValue(ctx, spanContextKey{}, s), s
+}
+
+type remoteSpanContextKey struct{}
+
+// UseTracing is Middleware, HandlerのSpanを作成し、Request終了時にRequest中の全てのSpanをExportする
+// Requestのtraceparent Headerがあれば、そのTraceの子として記録する
+func UseTracing(b *ucon.Bubble) error {
+	c := currentTraceConfig()
+	if c == nil || c.Exporter == nil {
+		return b.Next()
+	}
+
+	ctx := b.Context
+	if sc, ok := ParseTraceparent(b.R.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, remoteSpanContextKey{}, sc)
+	}
+	recorder := &spanRecorder{}
+	ctx = context.WithValue(ctx, spanRecorderContextKey{}, recorder)
+
+	ctx, span := StartSpan(ctx, handlerName(b.RequestHandler), SpanKindServer)
+	if span == nil {
+		return b.Next()
+	}
+	span.SetAttribute(AttrHTTPMethod, b.R.Method)
+	span.SetAttribute(AttrHTTPTarget, b.R.URL.RequestURI())
+
+	rec := &statusRecorder{ResponseWriter: b.W}
+	b.W = rec
+	b.Context = ctx
+
+	err := b.Next()
+
+	status := rec.status
+	if err != nil {
+		span.SetError(err)
+		status = http.StatusInternalServerError
+	} else if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttribute(AttrHTTPStatus, strconv.Itoa(status))
+	if t, ok := b.Context.Value(tenantContextKey{}).(*Tenant); ok {
+		span.SetAttribute(AttrTenant, t.ID)
+	}
+	span.End()
+
+	if eerr := c.Exporter.ExportSpans(ctx, recorder.flush()); eerr != nil {
+		log.Warningf(ctx, "failed export spans: %v", eerr)
+	}
+	return err
+}
+
+// traceTransport is Requestのtraceparent Headerに現在のSpanを設定するhttp.RoundTripper
+type traceTransport struct {
+	Base http.RoundTripper
+}
+
+// RoundTrip is http.RoundTripperを実装
+func (t *traceTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	s := SpanFromContext(req.Context())
+	if s == nil {
+		return t.Base.RoundTrip(req)
+	}
+
+	r := new(http.Request)
+	*r = *req
+	r.Header = make(http.Header, len(req.Header)+1)
+	for k, v := range req.Header {
+		r.Header[k] = v
+	}
+	r.Header.Set("traceparent", s.SpanContext.Traceparent())
+	return t.Base.RoundTrip(r)
+}
+
+// traceTokenSource is OAuth2 Tokenの取得をSpanとして記録するTokenSource
+// TokenSourceはContextを受け取らないので、作成時のContextを利用する
+type traceTokenSource struct {
+	ctx context.Context
+	ts  oauth2.TokenSource
+}
+
+// Token is oauth2.TokenSourceを実装
+func (t *traceTokenSource) Token() (*oauth2.Token, error) {
+	_, span := StartSpan(t.ctx, "oauth2.Token", SpanKindClient)
+	defer span.End()
+
+	token, err := t.ts.Token()
+	span.SetError(err)
+	return token, err
+}
@@ -0,0 +1,198 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const (
+	testTraceID      = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testParentSpanID = "00f067aa0ba902b7"
+)
+
+// useTraceConfig is TraceConfigをcに差し替え、元に戻す関数を返す
+func useTraceConfig(c *TraceConfig) func() {
+	org := currentTraceConfig()
+	SetTraceConfig(c)
+	return func() {
+		SetTraceConfig(org)
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	cases := []struct {
+		name    string
+		v       string
+		ok      bool
+		sampled bool
+	}{
+		{"sampled", "00-" + testTraceID + "-" + testParentSpanID + "-01", true, true},
+		{"not sampled", "00-" + testTraceID + "-" + testParentSpanID + "-00", true, false},
+		{"future version with extra field", "01-" + testTraceID + "-" + testParentSpanID + "-01-extra", true, true},
+		{"surrounding spaces", " 00-" + testTraceID + "-" + testParentSpanID + "-01 ", true, true},
+		{"empty", "", false, false},
+		{"version 00 with extra field", "00-" + testTraceID + "-" + testParentSpanID + "-01-extra", false, false},
+		{"version ff", "ff-" + testTraceID + "-" + testParentSpanID + "-01", false, false},
+		{"short trace id", "00-" + testTraceID[1:] + "-" + testParentSpanID + "-01", false, false},
+		{"short span id", "00-" + testTraceID + "-" + testParentSpanID[1:] + "-01", false, false},
+		{"non hex trace id", "00-" + strings.Repeat("z", 32) + "-" + testParentSpanID + "-01", false, false},
+		{"non hex flags", "00-" + testTraceID + "-" + testParentSpanID + "-zz", false, false},
+		{"zero trace id", "00-" + strings.Repeat("0", 32) + "-" + testParentSpanID + "-01", false, false},
+		{"zero span id", "00-" + testTraceID + "-" + strings.Repeat("0", 16) + "-01", false, false},
+	}
+	for _, c := range cases {
+		sc, ok := ParseTraceparent(c.v)
+		if ok != c.ok {
+			t.Errorf("%s: got ok=%v, want %v", c.name, ok, c.ok)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if sc.TraceID.String() != testTraceID || sc.SpanID.String() != testParentSpanID {
+			t.Errorf("%s: got %s-%s", c.name, sc.TraceID, sc.SpanID)
+		}
+		if sc.Sampled != c.sampled {
+			t.Errorf("%s: sampled: got %v, want %v", c.name, sc.Sampled, c.sampled)
+		}
+		if c.v == cases[0].v && sc.Traceparent() != c.v {
+			t.Errorf("%s: Traceparent: got %s, want %s", c.name, sc.Traceparent(), c.v)
+		}
+	}
+}
+
+func TestUseTracing(t *testing.T) {
+	defer useFakeDatastore(newFakeDatastore())()
+	exp := NewInMemoryExporter()
+	defer useTraceConfig(&TraceConfig{Exporter: exp, RedactSecretKeys: true, RedactSecretValues: true})()
+
+	const key = "hidden-key"
+	w := serveTestRequest(t, http.MethodGet, "/api/1/secret/"+key, http.Header{"Traceparent": {"00-" + testTraceID + "-" + testParentSpanID + "-01"}}, nil)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("status: got %d, want %d", w.Code, http.StatusNotFound)
+	}
+
+	spans := exp.Spans()
+	var server *Span
+	for _, s := range spans {
+		if s.SpanContext.TraceID.String() != testTraceID {
+			t.Errorf("%s: trace id: got %s, want %s", s.Name, s.SpanContext.TraceID, testTraceID)
+		}
+		if s.Kind == SpanKindServer {
+			server = s
+		}
+		for k, v := range s.Attributes {
+			if strings.Contains(v, key) {
+				t.Errorf("%s: attribute %s contains the secret key: %s", s.Name, k, v)
+			}
+		}
+		if strings.Contains(s.Error, key) {
+			t.Errorf("%s: error contains the secret key: %s", s.Name, s.Error)
+		}
+	}
+	if server == nil {
+		t.Fatalf("server span is not exported. spans=%d", len(spans))
+	}
+	if g, e := server.ParentSpanID.String(), testParentSpanID; g != e {
+		t.Errorf("parent span id: got %s, want %s", g, e)
+	}
+	for k, e := range map[string]string{
+		AttrHTTPMethod: http.MethodGet,
+		AttrHTTPTarget: redactedValue,
+		AttrSecretKey:  redactedValue,
+		AttrHTTPStatus: "404",
+	} {
+		if g := server.Attributes[k]; g != e {
+			t.Errorf("attribute %s: got %q, want %q", k, g, e)
+		}
+	}
+	for _, s := range spans {
+		if s != server && s.ParentSpanID == (SpanID{}) {
+			t.Errorf("%s: child span has no parent", s.Name)
+		}
+	}
+
+	// Sampleされていない親からのRequestはExportしない
+	exp.Reset()
+	serveTestRequest(t, http.MethodGet, "/api/1/secret/"+key, http.Header{"Traceparent": {"00-" + testTraceID + "-" + testParentSpanID + "-00"}}, nil)
+	if g := len(exp.Spans()); g != 0 {
+		t.Errorf("spans of not sampled request: got %d, want 0", g)
+	}
+
+	// traceparentがなければ新しいTraceを始める
+	exp.Reset()
+	serveTestRequest(t, http.MethodGet, "/api/1/secret/"+key, nil, nil)
+	for _, s := range exp.Spans() {
+		if s.Kind == SpanKindServer && (s.ParentSpanID != SpanID{} || s.SpanContext.TraceID.String() == testTraceID) {
+			t.Errorf("server span without traceparent: got trace=%s, parent=%s", s.SpanContext.TraceID, s.ParentSpanID)
+		}
+	}
+}
+
+func TestTraceConfigRedaction(t *testing.T) {
+	exp := NewInMemoryExporter()
+	cases := []struct {
+		config   *TraceConfig
+		redacted []string
+		kept     []string
+	}{
+		{&TraceConfig{Exporter: exp}, nil, []string{AttrSecretKey, AttrHTTPTarget, AttrDatastoreKeys, AttrSecretValue, AttrTenant}},
+		{&TraceConfig{Exporter: exp, RedactSecretKeys: true}, []string{AttrSecretKey, AttrHTTPTarget, AttrDatastoreKeys}, []string{AttrSecretValue, AttrTenant}},
+		{&TraceConfig{Exporter: exp, RedactSecretValues: true, RedactAttributes: []string{AttrTenant}}, []string{AttrSecretValue, AttrTenant}, []string{AttrSecretKey, AttrHTTPTarget}},
+	}
+	for i, c := range cases {
+		restore := useTraceConfig(c.config)
+		exp.Reset()
+		_, span := StartSpan(context.Background(), "test", SpanKindInternal)
+		for _, k := range append(append([]string{}, c.redacted...), c.kept...) {
+			span.SetAttribute(k, "value")
+		}
+		span.End()
+		restore()
+
+		spans := exp.Spans()
+		if len(spans) != 1 {
+			t.Fatalf("%d: spans: got %d, want 1", i, len(spans))
+		}
+		for _, k := range c.redacted {
+			if g := spans[0].Attributes[k]; g != redactedValue {
+				t.Errorf("%d: %s: got %q, want redacted", i, k, g)
+			}
+		}
+		for _, k := range c.kept {
+			if g := spans[0].Attributes[k]; g != "value" {
+				t.Errorf("%d: %s: got %q, want kept", i, k, g)
+			}
+		}
+	}
+}
+
+func TestTraceTransport(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("traceparent")
+	}))
+	defer srv.Close()
+
+	defer useTraceConfig(&TraceConfig{Exporter: NewInMemoryExporter()})()
+	ctx, span := StartSpan(context.Background(), "client", SpanKindClient)
+	req, err := http.NewRequest(http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: &traceTransport{Base: http.DefaultTransport}}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if e := span.SpanContext.Traceparent(); got != e {
+		t.Errorf("traceparent: got %q, want %q", got, e)
+	}
+	if req.Header.Get("traceparent") != "" {
+		t.Error("traceTransport modified the original request")
+	}
+}
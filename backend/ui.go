@@ -0,0 +1,149 @@
+package backend
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// 画面のTemplateとScript, Stylesheetはui_assets.goに埋め込み、Binaryだけで配信する
+// 画面は既存のAPIを呼び出すだけで、権限の確認はAPIで行う
+// /secret.html と /ui/ はapp.yaml (gcpsm-serverではadminPaths) で管理者だけに制限する
+
+// uiPage is 画面のTemplateに渡す値
+type uiPage struct {
+	// Page is Templateの名前. bodyのdata-pageに入れ、Scriptが画面毎の処理を選ぶ
+	Page  string
+	Title string
+	// Tenant is ?tenant= で指定したTenant. 画面間のLinkに引き継ぐ
+	Tenant string
+	// CSRFToken is APIへのPOST等でCSRFHeaderに付けるToken
+	CSRFToken string
+	// APIBase is 画面から呼ぶAPIのPath. ?tenant= を指定した場合は /api/1/t/{tenant}
+	APIBase string
+	// Error is 画面を表示できなかった場合のError
+	Error *HTTPError
+}
+
+// uiTemplates is 画面の名前毎のTemplate. 全てuiLayoutTemplateの中に表示する
+var uiTemplates = parseUITemplates(map[string]string{
+	"secret":  uiSecretTemplate,
+	"secrets": uiSecretsTemplate,
+	"acl":     uiACLTemplate,
+	"audit":   uiAuditTemplate,
+	"error":   uiErrorTemplate,
+})
+
+// uiPages is /ui/ 配下のPathと、表示する画面のTemplateとTitle
+var uiPages = map[string]*uiPage{
+	"/ui/":      {Page: "secrets", Title: "Secrets"},
+	"/ui/acl":   {Page: "acl", Title: "ACL"},
+	"/ui/audit": {Page: "audit", Title: "Audit Log"},
+}
+
+func parseUITemplates(pages map[string]string) map[string]*template.Template {
+	layout := template.Must(template.New("layout").Parse(uiLayoutTemplate))
+	m := map[string]*template.Template{}
+	for name, src := range pages {
+		m[name] = template.Must(template.Must(layout.Clone()).Parse(src))
+	}
+	return m
+}
+
+// uiAsset is /ui/static/ で配信するFile
+type uiAsset struct {
+	ContentType string
+	Body        string
+}
+
+var uiAssets = map[string]*uiAsset{
+	"app.js":  {ContentType: "application/javascript; charset=utf-8", Body: uiScript},
+	"app.css": {ContentType: "text/css; charset=utf-8", Body: uiStylesheet},
+}
+
+// uiStartedAt is AssetのLast-Modified. AssetはBinaryに含まれるので、起動時刻から変わらない
+var uiStartedAt = time.Now()
+
+func setupUI(mux *http.ServeMux) {
+	mux.Handle("/secret.html", SecurityHeaders(http.HandlerFunc(uiSecretHandler)))
+	mux.Handle("/ui/static/", SecurityHeaders(http.HandlerFunc(uiAssetHandler)))
+	mux.Handle("/ui/", SecurityHeaders(http.HandlerFunc(uiPageHandler)))
+}
+
+func uiSecretHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		renderUIError(w, r, &HTTPError{Code: http.StatusMethodNotAllowed, Message: "method not allowed."})
+		return
+	}
+	renderUI(w, r, &uiPage{Page: "secret", Title: "Secret Registration"})
+}
+
+func uiPageHandler(w http.ResponseWriter, r *http.Request) {
+	p, ok := uiPages[r.URL.Path]
+	if !ok {
+		renderUIError(w, r, &HTTPError{Code: http.StatusNotFound, Message: "not found."})
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		renderUIError(w, r, &HTTPError{Code: http.StatusMethodNotAllowed, Message: "method not allowed."})
+		return
+	}
+	page := *p
+	renderUI(w, r, &page)
+}
+
+func uiAssetHandler(w http.ResponseWriter, r *http.Request) {
+	a, ok := uiAssets[strings.TrimPrefix(r.URL.Path, "/ui/static/")]
+	if !ok {
+		renderUIError(w, r, &HTTPError{Code: http.StatusNotFound, Message: "not found."})
+		return
+	}
+	w.Header().Set("Content-Type", a.ContentType)
+	http.ServeContent(w, r, "", uiStartedAt, strings.NewReader(a.Body))
+}
+
+// uiAPIBase is 画面から呼ぶAPIのPathを返す
+func uiAPIBase(r *http.Request) string {
+	if t := r.URL.Query().Get("tenant"); t != "" {
+		return "/api/1/t/" + url.PathEscape(t)
+	}
+	return "/api/1"
+}
+
+// renderUI is CSRF Tokenを発行し、page.Pageのtemplateで画面を返す
+func renderUI(w http.ResponseWriter, r *http.Request, page *uiPage) {
+	token, err := issueCSRFToken(w, r)
+	if err != nil {
+		http.Error(w, "internal server error.", http.StatusInternalServerError)
+		return
+	}
+	page.CSRFToken = token
+	page.APIBase = uiAPIBase(r)
+	page.Tenant = r.URL.Query().Get("tenant")
+	code := http.StatusOK
+	if page.Error != nil {
+		code = page.Error.Code
+	}
+
+	var buf bytes.Buffer
+	if err := uiTemplates[page.Page].ExecuteTemplate(&buf, "layout", page); err != nil {
+		http.Error(w, "internal server error.", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// CSRF Tokenを含むのでCacheさせない
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+// renderUIError is HTTPErrorのMessageを画面に表示する
+func renderUIError(w http.ResponseWriter, r *http.Request, he *HTTPError) {
+	if he.Reason == "" {
+		he.Reason = reasonFromStatus(he.Code)
+	}
+	renderUI(w, r, &uiPage{Page: "error", Title: http.StatusText(he.Code), Error: he})
+}
@@ -0,0 +1,628 @@
+package backend
+
+// uiLayoutTemplate is 全ての画面に共通のLayout. 各画面は "content" を定義する
+// ScriptはCSPでinlineを禁止しているので /ui/static/app.js から読み、CSRF TokenとAPIのPathはmeta要素で渡す
+const uiLayoutTemplate = `<!DOCTYPE html>
+<html lang="en">
+<head>
+    <meta charset="UTF-8">
+    <meta name="csrf-token" content="{{.CSRFToken}}">
+    <meta name="api-base" content="{{.APIBase}}">
+    <link rel="stylesheet" href="/ui/static/app.css">
+    <title>{{.Title}} - gcpsm</title>
+</head>
+<body data-page="{{.Page}}">
+    <nav class="navbar">
+        <div class="container">
+            <span class="brand">gcpsm{{if .Tenant}} / {{.Tenant}}{{end}}</span>
+            <a href="/ui/{{if .Tenant}}?tenant={{.Tenant}}{{end}}">Secrets</a>
+            <a href="/ui/acl{{if .Tenant}}?tenant={{.Tenant}}{{end}}">ACL</a>
+            <a href="/ui/audit{{if .Tenant}}?tenant={{.Tenant}}{{end}}">Audit Log</a>
+            <a href="/secret.html{{if .Tenant}}?tenant={{.Tenant}}{{end}}">Register</a>
+        </div>
+    </nav>
+    <div class="container">
+        <h1>{{.Title}}</h1>
+        <div id="message" class="message" role="alert" hidden></div>
+        {{template "content" .}}
+    </div>
+    <script src="/ui/static/app.js"></script>
+</body>
+</html>
+`
+
+// uiSecretTemplate is Secretを読み込み、登録する画面
+const uiSecretTemplate = `{{define "content"}}
+        <form id="secret-form" autocomplete="off">
+            <div class="form-group">
+                <label for="key">key</label>
+                <input id="key" class="form-control" type="text" required>
+            </div>
+            <div class="form-group">
+                <label for="value">value</label>
+                <textarea id="value" class="form-control" cols="100" rows="25"></textarea>
+            </div>
+            <button id="load" class="btn btn-secondary" type="button">Load</button>
+            <button id="submit" class="btn btn-primary" type="submit">Submit</button>
+        </form>
+{{end}}`
+
+// uiSecretsTemplate is Key Prefixの階層を辿り、Secretの情報と履歴を表示する画面
+// 値は伏せて表示し、Revealを押した時だけ ?reveal=true で読む
+const uiSecretsTemplate = `{{define "content"}}
+        <div class="row">
+            <div class="col-tree">
+                <h2>Folders</h2>
+                <ul id="tree" class="tree"></ul>
+            </div>
+            <div class="col-detail">
+                <p id="empty" class="muted">Select a secret.</p>
+                <div id="detail" hidden>
+                    <h2 id="detail-key" class="key"></h2>
+                    <table class="table">
+                        <tbody>
+                            <tr><th>version</th><td id="detail-version"></td></tr>
+                            <tr><th>updated by</th><td id="detail-updated-by"></td></tr>
+                            <tr><th>updated at</th><td id="detail-updated-at"></td></tr>
+                            <tr id="detail-alias-row"><th>alias of</th><td id="detail-alias"></td></tr>
+                            <tr id="detail-protected-row"><th>protected by</th><td id="detail-protected"></td></tr>
+                            <tr>
+                                <th>value</th>
+                                <td>
+                                    <pre id="detail-value" class="value masked">&bull;&bull;&bull;&bull;&bull;&bull;&bull;&bull;</pre>
+                                    <button id="reveal" class="btn btn-secondary btn-sm" type="button">Reveal</button>
+                                    <button id="hide" class="btn btn-secondary btn-sm" type="button" hidden>Hide</button>
+                                    <span class="muted">revealing is recorded in the audit log.</span>
+                                </td>
+                            </tr>
+                        </tbody>
+                    </table>
+                    <p>
+                        <a id="edit" class="btn btn-primary btn-sm" href="/secret.html">Edit</a>
+                        <a id="acl-link" class="btn btn-secondary btn-sm" href="/ui/acl">ACL</a>
+                        <a id="audit-link" class="btn btn-secondary btn-sm" href="/ui/audit">Audit Log</a>
+                    </p>
+                    <h3>History</h3>
+                    <table class="table">
+                        <thead><tr><th>version</th><th>updated by</th><th>updated at</th><th></th></tr></thead>
+                        <tbody id="history"></tbody>
+                    </table>
+                </div>
+            </div>
+        </div>
+{{end}}`
+
+// uiACLTemplate is Prefixに適用されるSecretACLを表示、編集する画面
+const uiACLTemplate = `{{define "content"}}
+        <form id="acl-search" class="form-inline" autocomplete="off">
+            <label for="acl-key">key or prefix</label>
+            <input id="acl-key" class="form-control" type="text">
+            <button class="btn btn-secondary" type="submit">Show</button>
+        </form>
+        <p id="acl-effective" class="muted"></p>
+        <form id="acl-form" autocomplete="off">
+            <div class="form-group">
+                <label for="acl-prefix">prefix</label>
+                <input id="acl-prefix" class="form-control" type="text">
+            </div>
+            <div class="form-group">
+                <label for="acl-readers">readers (one per line. * for everyone)</label>
+                <textarea id="acl-readers" class="form-control" rows="4"></textarea>
+            </div>
+            <div class="form-group">
+                <label for="acl-writers">writers</label>
+                <textarea id="acl-writers" class="form-control" rows="4"></textarea>
+            </div>
+            <div class="form-group">
+                <label for="acl-approvers">approvers</label>
+                <textarea id="acl-approvers" class="form-control" rows="4"></textarea>
+            </div>
+            <div class="form-group">
+                <label for="acl-breakglass">break-glass (may request temporary read access)</label>
+                <textarea id="acl-breakglass" class="form-control" rows="4"></textarea>
+            </div>
+            <div class="form-group">
+                <label for="acl-required">required approvals</label>
+                <input id="acl-required" class="form-control" type="number" min="0" value="0">
+            </div>
+            <button class="btn btn-primary" type="submit">Save</button>
+        </form>
+{{end}}`
+
+// uiAuditTemplate is Prefix配下のAuditLogを新しい順に表示する画面
+const uiAuditTemplate = `{{define "content"}}
+        <form id="audit-search" class="form-inline" autocomplete="off">
+            <label for="audit-prefix">prefix</label>
+            <input id="audit-prefix" class="form-control" type="text">
+            <button class="btn btn-secondary" type="submit">Show</button>
+        </form>
+        <table class="table">
+            <thead><tr><th>occurred at</th><th>action</th><th>key</th><th>actor</th><th>target</th><th>comment</th></tr></thead>
+            <tbody id="audit"></tbody>
+        </table>
+{{end}}`
+
+// uiErrorTemplate is HTTPErrorを表示する画面
+const uiErrorTemplate = `{{define "content"}}
+        <div class="message message-error" role="alert">
+            <strong>{{.Error.Code}} {{.Error.Reason}}</strong>
+            <span>{{.Error.Message}}</span>
+        </div>
+{{end}}`
+
+// uiScript is 画面から呼ぶAPIのClientと、各画面の処理
+// APIのErrorはHTTPErrorのJSONなので、reasonとmessageをそのまま表示する
+const uiScript = `(function() {
+    "use strict";
+
+    function meta(name) {
+        var m = document.querySelector('meta[name="' + name + '"]');
+        return m ? m.getAttribute("content") : "";
+    }
+
+    var apiBase = meta("api-base");
+
+    function query(name) {
+        var params = window.location.search.replace(/^\?/, "").split("&");
+        for (var i = 0; i < params.length; i++) {
+            var kv = params[i].split("=");
+            if (decodeURIComponent(kv[0]) === name) {
+                return decodeURIComponent((kv[1] || "").replace(/\+/g, " "));
+            }
+        }
+        return "";
+    }
+
+    // pageURL is 画面のURL. ?tenant= を引き継ぐ
+    function pageURL(path, params) {
+        var q = [];
+        var tenant = query("tenant");
+        if (tenant) {
+            q.push("tenant=" + encodeURIComponent(tenant));
+        }
+        Object.keys(params || {}).forEach(function(k) {
+            q.push(k + "=" + encodeURIComponent(params[k]));
+        });
+        return path + (q.length ? "?" + q.join("&") : "");
+    }
+
+    // el is Elementを作る. 値はtextContentで入れるので、Keyや値にHTMLが含まれていても解釈されない
+    function el(tag, text, attrs) {
+        var e = document.createElement(tag);
+        if (text !== undefined && text !== null) {
+            e.textContent = text;
+        }
+        Object.keys(attrs || {}).forEach(function(k) {
+            e.setAttribute(k, attrs[k]);
+        });
+        return e;
+    }
+
+    function formatTime(v) {
+        if (!v || v.indexOf("0001-01-01") === 0) {
+            return "";
+        }
+        return new Date(v).toLocaleString();
+    }
+
+    function lines(v) {
+        return v.split("\n").map(function(s) { return s.trim(); }).filter(function(s) { return s !== ""; });
+    }
+
+    function showMessage(text, isError) {
+        var m = document.getElementById("message");
+        m.textContent = text;
+        m.className = "message " + (isError ? "message-error" : "message-success");
+        m.hidden = false;
+    }
+
+    function clearMessage() {
+        document.getElementById("message").hidden = true;
+    }
+
+    // errorMessage is ResponseのHTTPErrorから表示するMessageを作る
+    function errorMessage(xhr) {
+        var he;
+        try {
+            he = JSON.parse(xhr.responseText);
+        } catch (e) {
+            he = null;
+        }
+        if (!he || typeof he !== "object" || he.message === undefined) {
+            return xhr.status + " " + (xhr.statusText || "request failed");
+        }
+        var msg = typeof he.message === "string" ? he.message : JSON.stringify(he.message);
+        return (he.reason || he.code || xhr.status) + ": " + msg;
+    }
+
+    // api is APIを呼び出す. GET以外はCSRF Tokenを付ける
+    function api(method, path, body, headers, done) {
+        var xhr = new XMLHttpRequest();
+        xhr.open(method, apiBase + path, true);
+        xhr.setRequestHeader("Accept", "application/json");
+        if (method !== "GET") {
+            xhr.setRequestHeader("X-XSRF-TOKEN", meta("csrf-token"));
+        }
+        if (body !== null) {
+            xhr.setRequestHeader("Content-Type", "application/json;charset=UTF-8");
+        }
+        Object.keys(headers || {}).forEach(function(k) {
+            xhr.setRequestHeader(k, headers[k]);
+        });
+        xhr.onreadystatechange = function() {
+            if (xhr.readyState !== XMLHttpRequest.DONE) {
+                return;
+            }
+            if (xhr.status >= 200 && xhr.status < 300) {
+                done(null, xhr.responseText ? JSON.parse(xhr.responseText) : null, xhr);
+            } else {
+                done(errorMessage(xhr), null, xhr);
+            }
+        };
+        xhr.send(body === null ? null : JSON.stringify(body));
+    }
+
+    function secretPath(key) {
+        return "/secret/" + encodeURIComponent(key);
+    }
+
+    window.gcpsm = {api: api, showMessage: showMessage, clearMessage: clearMessage};
+
+    // secret is Secretを読み込み、登録する画面. ?key= で開いた場合は読み込んでおく
+    function setupSecret() {
+        // Loadした時のETag. 空の場合は新規作成として扱う
+        var etag = "";
+        var form = document.getElementById("secret-form");
+        var key = document.getElementById("key");
+        var value = document.getElementById("value");
+
+        function load() {
+            clearMessage();
+            api("GET", secretPath(key.value) + "?raw=true&reveal=true", null, {}, function(err, resp, xhr) {
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                etag = xhr.getResponseHeader("ETag") || "";
+                value.value = resp.aliasOf ? "" : resp.value;
+                showMessage("loaded version " + resp.version + (resp.aliasOf ? ". alias of " + resp.aliasOf + "." : "."), false);
+            });
+        }
+
+        document.getElementById("load").addEventListener("click", load);
+
+        form.addEventListener("submit", function(e) {
+            e.preventDefault();
+            clearMessage();
+            var headers = etag ? {"If-Match": etag} : {"If-None-Match": "*"};
+            api("POST", "/secret", {key: key.value, value: value.value}, headers, function(err, resp, xhr) {
+                if (err && xhr.status === 412) {
+                    showMessage(err + " Load again and retry.", true);
+                    return;
+                }
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                etag = "";
+                key.value = "";
+                value.value = "";
+                showMessage(resp && resp.changeRequest ? "waiting for approval. change request " + resp.changeRequest + "." : "done.", false);
+            });
+        });
+
+        if (query("key")) {
+            key.value = query("key");
+            load();
+        }
+    }
+
+    // secrets is Key Prefixの階層を辿り、Secretの情報と履歴を表示する画面
+    function setupSecrets() {
+        var current = null;
+        var etag = "";
+        var valueEl = document.getElementById("detail-value");
+        var masked = valueEl.textContent;
+
+        function mask() {
+            valueEl.textContent = masked;
+            valueEl.className = "value masked";
+            document.getElementById("reveal").hidden = false;
+            document.getElementById("hide").hidden = true;
+        }
+
+        // loadFolder is prefix直下のFolderとSecretをulに表示する. Folderを押すと1階層ずつ読み込む
+        function loadFolder(prefix, ul) {
+            api("GET", "/folder?prefix=" + encodeURIComponent(prefix), null, {}, function(err, folder) {
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                ul.textContent = "";
+                folder.folders.forEach(function(f) {
+                    var li = el("li", null, {"class": "folder"});
+                    var a = el("a", f.substring(prefix ? prefix.length + 1 : 0) + "/", {href: "#"});
+                    var children = el("ul", null, {"class": "tree"});
+                    children.hidden = true;
+                    a.addEventListener("click", function(e) {
+                        e.preventDefault();
+                        children.hidden = !children.hidden;
+                        if (!children.hidden && !children.hasChildNodes()) {
+                            loadFolder(f, children);
+                        }
+                    });
+                    li.appendChild(a);
+                    li.appendChild(children);
+                    ul.appendChild(li);
+                });
+                folder.secrets.forEach(function(key) {
+                    var li = el("li", null, {"class": "secret"});
+                    var a = el("a", key.substring(prefix ? prefix.length + 1 : 0), {href: pageURL("/ui/", {key: key})});
+                    a.addEventListener("click", function(e) {
+                        e.preventDefault();
+                        window.history.replaceState(null, "", a.getAttribute("href"));
+                        showSecret(key);
+                    });
+                    li.appendChild(a);
+                    ul.appendChild(li);
+                });
+                if (!folder.folders.length && !folder.secrets.length) {
+                    ul.appendChild(el("li", "(empty)", {"class": "muted"}));
+                }
+            });
+        }
+
+        function showSecret(key) {
+            clearMessage();
+            api("GET", secretPath(key) + ":metadata", null, {}, function(err, md, xhr) {
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                current = md;
+                etag = xhr.getResponseHeader("ETag") || "";
+                mask();
+                document.getElementById("empty").hidden = true;
+                document.getElementById("detail").hidden = false;
+                document.getElementById("detail-key").textContent = md.key;
+                document.getElementById("detail-version").textContent = md.version;
+                document.getElementById("detail-updated-by").textContent = md.updatedBy;
+                document.getElementById("detail-updated-at").textContent = formatTime(md.updatedAt);
+                document.getElementById("detail-alias-row").hidden = !md.aliasOf;
+                document.getElementById("detail-alias").textContent = md.aliasOf || "";
+                document.getElementById("detail-protected-row").hidden = !md.protected;
+                document.getElementById("detail-protected").textContent = md.protected ? "acl of " + (md.protectedBy || "(root)") + " requires approval" : "";
+                document.getElementById("edit").setAttribute("href", pageURL("/secret.html", {key: md.key}));
+                document.getElementById("acl-link").setAttribute("href", pageURL("/ui/acl", {key: md.key}));
+                document.getElementById("audit-link").setAttribute("href", pageURL("/ui/audit", {prefix: md.key}));
+                showHistory(md);
+            });
+        }
+
+        function showHistory(md) {
+            var tbody = document.getElementById("history");
+            tbody.textContent = "";
+            md.versions.forEach(function(v) {
+                var tr = el("tr");
+                tr.appendChild(el("td", v.version + (v.aliasOf ? " (alias of " + v.aliasOf + ")" : "")));
+                tr.appendChild(el("td", v.updatedBy));
+                tr.appendChild(el("td", formatTime(v.updatedAt)));
+                var td = el("td");
+                if (v.version === md.version) {
+                    td.appendChild(el("span", "current", {"class": "muted"}));
+                } else {
+                    var b = el("button", "Rollback", {"class": "btn btn-secondary btn-sm", type: "button"});
+                    b.addEventListener("click", function() {
+                        rollback(md.key, v.version);
+                    });
+                    td.appendChild(b);
+                }
+                tr.appendChild(td);
+                tbody.appendChild(tr);
+            });
+            if (!md.versions.length) {
+                var tr = el("tr");
+                tr.appendChild(el("td", "no history.", {colspan: "4", "class": "muted"}));
+                tbody.appendChild(tr);
+            }
+        }
+
+        function rollback(key, version) {
+            if (!window.confirm("Put the value of version " + version + " of " + key + " as a new version?")) {
+                return;
+            }
+            clearMessage();
+            api("POST", "/secret:rollback", {key: key, version: version}, {"If-Match": etag}, function(err, resp) {
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                showSecret(key);
+                if (resp.changeRequest) {
+                    showMessage("waiting for approval. change request " + resp.changeRequest + ".", false);
+                } else {
+                    showMessage("rolled back to version " + version + " as version " + resp.version + ".", false);
+                }
+            });
+        }
+
+        document.getElementById("reveal").addEventListener("click", function() {
+            if (!current) {
+                return;
+            }
+            clearMessage();
+            api("GET", secretPath(current.key) + "?raw=true&reveal=true", null, {}, function(err, resp) {
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                valueEl.textContent = resp.aliasOf ? "(alias of " + resp.aliasOf + ")" : resp.value;
+                valueEl.className = "value";
+                document.getElementById("reveal").hidden = true;
+                document.getElementById("hide").hidden = false;
+            });
+        });
+        document.getElementById("hide").addEventListener("click", mask);
+
+        loadFolder("", document.getElementById("tree"));
+        if (query("key")) {
+            showSecret(query("key"));
+        }
+    }
+
+    // acl is Prefixに適用されるSecretACLを表示、編集する画面
+    function setupACL() {
+        var key = document.getElementById("acl-key");
+
+        function fill(acl, prefix) {
+            document.getElementById("acl-prefix").value = prefix;
+            document.getElementById("acl-readers").value = (acl.readers || []).join("\n");
+            document.getElementById("acl-writers").value = (acl.writers || []).join("\n");
+            document.getElementById("acl-approvers").value = (acl.approvers || []).join("\n");
+            document.getElementById("acl-breakglass").value = (acl.breakGlass || []).join("\n");
+            document.getElementById("acl-required").value = acl.requiredApprovals || 0;
+        }
+
+        function show() {
+            clearMessage();
+            var effective = document.getElementById("acl-effective");
+            api("GET", "/acl?key=" + encodeURIComponent(key.value), null, {}, function(err, acl, xhr) {
+                if (err && xhr.status === 404) {
+                    effective.textContent = "no acl applies to " + (key.value || "(root)") + ". only tenant admins can access it.";
+                    fill({}, key.value);
+                    return;
+                }
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                effective.textContent = "acl of " + (acl.prefix || "(root)") + " applies. updated by " + acl.updatedBy + " at " + formatTime(acl.updatedAt) + ".";
+                fill(acl, acl.prefix);
+            });
+        }
+
+        document.getElementById("acl-search").addEventListener("submit", function(e) {
+            e.preventDefault();
+            show();
+        });
+
+        document.getElementById("acl-form").addEventListener("submit", function(e) {
+            e.preventDefault();
+            clearMessage();
+            var prefix = document.getElementById("acl-prefix").value;
+            var body = {
+                prefix: prefix,
+                readers: lines(document.getElementById("acl-readers").value),
+                writers: lines(document.getElementById("acl-writers").value),
+                approvers: lines(document.getElementById("acl-approvers").value),
+                breakGlass: lines(document.getElementById("acl-breakglass").value),
+                requiredApprovals: parseInt(document.getElementById("acl-required").value, 10) || 0
+            };
+            api("PUT", "/acl", body, {}, function(err) {
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                key.value = prefix;
+                show();
+                showMessage("saved acl of " + (prefix || "(root)") + ".", false);
+            });
+        });
+
+        key.value = query("key");
+        show();
+    }
+
+    // audit is Prefix配下のAuditLogを新しい順に表示する画面
+    function setupAudit() {
+        var prefix = document.getElementById("audit-prefix");
+
+        function show() {
+            clearMessage();
+            api("GET", "/audit?prefix=" + encodeURIComponent(prefix.value), null, {}, function(err, resp) {
+                if (err) {
+                    showMessage(err, true);
+                    return;
+                }
+                var tbody = document.getElementById("audit");
+                tbody.textContent = "";
+                resp.list.forEach(function(a) {
+                    var tr = el("tr", null, a.breakGlass ? {"class": "breakglass"} : {});
+                    tr.appendChild(el("td", formatTime(a.occurredAt)));
+                    tr.appendChild(el("td", a.action));
+                    tr.appendChild(el("td", a.key));
+                    tr.appendChild(el("td", a.actor));
+                    tr.appendChild(el("td", a.target || ""));
+                    tr.appendChild(el("td", a.comment || ""));
+                    tbody.appendChild(tr);
+                });
+                if (!resp.list.length) {
+                    var tr = el("tr");
+                    tr.appendChild(el("td", "no audit logs.", {colspan: "6", "class": "muted"}));
+                    tbody.appendChild(tr);
+                }
+            });
+        }
+
+        document.getElementById("audit-search").addEventListener("submit", function(e) {
+            e.preventDefault();
+            show();
+        });
+
+        prefix.value = query("prefix");
+        show();
+    }
+
+    var pages = {secret: setupSecret, secrets: setupSecrets, acl: setupACL, audit: setupAudit};
+    var setup = pages[document.body.getAttribute("data-page")];
+    if (setup) {
+        setup();
+    }
+})();
+`
+
+// uiStylesheet is 画面のStylesheet. 外部のCDNには依存しない
+const uiStylesheet = `*, *::before, *::after { box-sizing: border-box; }
+body { margin: 0; font-family: -apple-system, "Segoe UI", Roboto, "Helvetica Neue", Arial, sans-serif; font-size: 1rem; line-height: 1.5; color: #212529; background: #fff; }
+h1 { font-size: 2rem; font-weight: 500; margin: 1rem 0; }
+.container { max-width: 960px; margin: 0 auto; padding: 0 15px; }
+.form-group { margin-bottom: 1rem; }
+label { display: inline-block; margin-bottom: .5rem; }
+.form-control { display: block; width: 100%; padding: .375rem .75rem; font-size: 1rem; line-height: 1.5; color: #495057; border: 1px solid #ced4da; border-radius: .25rem; font-family: inherit; }
+textarea.form-control { font-family: SFMono-Regular, Menlo, Monaco, Consolas, monospace; }
+.btn { display: inline-block; padding: .375rem .75rem; font-size: 1rem; line-height: 1.5; border: 1px solid transparent; border-radius: .25rem; color: #fff; cursor: pointer; }
+.btn-primary { background: #007bff; border-color: #007bff; }
+.btn-secondary { background: #6c757d; border-color: #6c757d; }
+.message { padding: .75rem 1.25rem; margin-bottom: 1rem; border: 1px solid transparent; border-radius: .25rem; white-space: pre-wrap; }
+.message-error { color: #721c24; background: #f8d7da; border-color: #f5c6cb; }
+.message-success { color: #155724; background: #d4edda; border-color: #c3e6cb; }
+[hidden] { display: none !important; }
+h2 { font-size: 1.5rem; font-weight: 500; margin: 0 0 .75rem; }
+h3 { font-size: 1.25rem; font-weight: 500; margin: 1.5rem 0 .75rem; }
+a { color: #007bff; text-decoration: none; }
+a:hover { text-decoration: underline; }
+.navbar { background: #343a40; padding: .5rem 0; }
+.navbar a, .navbar .brand { color: rgba(255, 255, 255, .75); margin-right: 1rem; }
+.navbar .brand { color: #fff; font-weight: 500; }
+.row { display: flex; flex-wrap: wrap; margin: 0 -15px; }
+.col-tree { flex: 0 0 33%; max-width: 33%; padding: 0 15px; overflow-x: auto; }
+.col-detail { flex: 1 1 0; min-width: 0; padding: 0 15px; }
+.tree { list-style: none; margin: 0; padding-left: 1rem; }
+#tree { padding-left: 0; }
+.tree .folder > a { font-weight: 500; }
+.tree li { white-space: nowrap; }
+.table { width: 100%; margin-bottom: 1rem; border-collapse: collapse; }
+.table th, .table td { padding: .5rem; vertical-align: top; border-top: 1px solid #dee2e6; text-align: left; word-break: break-all; }
+.table thead th { border-bottom: 2px solid #dee2e6; }
+.table tr.breakglass { background: #fff3cd; }
+.btn-sm { padding: .25rem .5rem; font-size: .875rem; }
+a.btn { color: #fff; text-decoration: none; }
+.btn:disabled { opacity: .65; cursor: default; }
+.muted { color: #6c757d; }
+.key { word-break: break-all; }
+.value { margin: 0 0 .5rem; padding: .5rem; background: #f8f9fa; border: 1px solid #dee2e6; border-radius: .25rem; white-space: pre-wrap; word-break: break-all; font-family: SFMono-Regular, Menlo, Monaco, Consolas, monospace; }
+.value.masked { color: #6c757d; }
+.form-inline { display: flex; align-items: center; margin-bottom: 1rem; }
+.form-inline label { margin: 0 .5rem 0 0; white-space: nowrap; }
+.form-inline .form-control { flex: 1 1 auto; width: auto; margin-right: .5rem; }
+`
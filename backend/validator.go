@@ -0,0 +1,223 @@
+package backend
+
+import (
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/favclip/golidator"
+	"github.com/favclip/ucon"
+)
+
+// maxSecretValueSize is Secret Valueの最大Byte数. Cloud KMSのPlaintextの上限(64KiB)に合わせている
+const maxSecretValueSize = 64 * 1024
+
+// validKeyChars is Secret Keyに利用できる文字
+var validKeyChars = regexp.MustCompile(`^[0-9A-Za-z._\-/]*$`)
+
+// ReservedKeyPrefixes is Systemで利用するため、userが登録できないKeyのPrefix
+var ReservedKeyPrefixes = []string{"_gcpsm"}
+
+var _ ucon.Validator = &RequestValidator{}
+
+// RequestValidator is Request Structをgolidatorで検証するucon.Validator
+// 全てのField Errorを集めて、400のHTTPErrorとして返す
+type RequestValidator struct {
+	V *golidator.Validator
+}
+
+// ValidationError is Validation Errorの時にHTTPError.Messageとして返す内容
+type ValidationError struct {
+	Type   string        `json:"type"`
+	Fields []*FieldError `json:"fields"`
+}
+
+// FieldError is 1 FieldのValidation Error
+type FieldError struct {
+	Field   string   `json:"field"`
+	Reasons []string `json:"reasons"`
+}
+
+// SecretValueValidator is Key Prefix毎に登録するSecret ValueのValidator
+type SecretValueValidator func(key string, value string) error
+
+type namedSecretValueValidator struct {
+	Name string
+	F    SecretValueValidator
+}
+
+var secretValueValidators = struct {
+	sync.RWMutex
+	m map[string][]*namedSecretValueValidator
+}{m: map[string][]*namedSecretValueValidator{}}
+
+// secretValueHolder is Key Prefix毎のValidatorを適用するRequest
+type secretValueHolder interface {
+	secretKeyValue() (key string, value string, aliasOf string)
+}
+
+// NewRequestValidator is swaggerのDefaultValidatorと同じRuleに、Secret用のRuleを加えたRequestValidatorを作成する
+//
+// secretKey : Secret Keyとして正しい形式か
+// keyPrefix : Folderを表すPrefixとして正しい形式か. 空文字を許可する
+// secretValue : Secret Valueの大きさが上限以下か
+func NewRequestValidator() *RequestValidator {
+	v := &golidator.Validator{}
+	v.SetTag("swagger")
+
+	v.SetValidationFunc("req", golidator.ReqValidator)
+	v.SetValidationFunc("d", golidator.DefaultValidator)
+	v.SetValidationFunc("enum", golidator.EnumValidator)
+	v.SetValidationFunc("min", golidator.MinValidator)
+	v.SetValidationFunc("max", golidator.MaxValidator)
+	v.SetValidationFunc("minLen", golidator.MinLenValidator)
+	v.SetValidationFunc("maxLen", golidator.MaxLenValidator)
+	v.SetValidationFunc("in", func(param string, v reflect.Value) (golidator.ValidationResult, error) {
+		return golidator.ValidationOK, nil
+	})
+
+	v.SetValidationFunc("secretKey", SecretKeyValidator)
+	v.SetValidationFunc("keyPrefix", KeyPrefixValidator)
+	v.SetValidationFunc("secretValue", SecretValueSizeValidator)
+
+	return &RequestValidator{V: v}
+}
+
+// Validate is ucon.Validatorを実装
+func (rv *RequestValidator) Validate(v interface{}) error {
+	ve := &ValidationError{
+		Type: "validation",
+	}
+
+	err := rv.V.Validate(v)
+	if report, ok := err.(*golidator.ErrorReport); ok {
+		for _, d := range report.Details {
+			fe := &FieldError{Field: d.FieldName}
+			for _, r := range d.ReasonList {
+				reason := r.Type
+				if r.Config != "" {
+					reason += "=" + r.Config
+				}
+				fe.Reasons = append(fe.Reasons, reason)
+			}
+			sort.Strings(fe.Reasons)
+			ve.Fields = append(ve.Fields, fe)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if h, ok := v.(secretValueHolder); ok {
+		key, value, aliasOf := h.secretKeyValue()
+		var reasons []string
+		if value == "" && aliasOf == "" {
+			reasons = append(reasons, "req")
+		} else if value != "" {
+			reasons = append(reasons, ValidateSecretValue(key, value)...)
+		}
+		if len(reasons) > 0 {
+			ve.Fields = append(ve.Fields, &FieldError{Field: "value", Reasons: reasons})
+		}
+	}
+
+	if len(ve.Fields) == 0 {
+		return nil
+	}
+	return &HTTPError{Code: http.StatusBadRequest, Message: ve}
+}
+
+// SecretKeyValidator is Secret Keyとして正しい形式かを確認するgolidator.ValidationFunc
+func SecretKeyValidator(param string, v reflect.Value) (golidator.ValidationResult, error) {
+	if v.Kind() != reflect.String {
+		return golidator.ValidationNG, golidator.ErrValidateUnsupportedType
+	}
+	// 必須かどうかはreqで確認する
+	if v.String() != "" && !isValidSecretKey(v.String()) {
+		return golidator.ValidationNG, nil
+	}
+	return golidator.ValidationOK, nil
+}
+
+// KeyPrefixValidator is Folderを表すPrefixとして正しい形式かを確認するgolidator.ValidationFunc
+func KeyPrefixValidator(param string, v reflect.Value) (golidator.ValidationResult, error) {
+	if v.Kind() != reflect.String {
+		return golidator.ValidationNG, golidator.ErrValidateUnsupportedType
+	}
+	prefix := NormalizeKeyPrefix(v.String())
+	if prefix != "" && !isValidSecretKey(prefix) {
+		return golidator.ValidationNG, nil
+	}
+	return golidator.ValidationOK, nil
+}
+
+// SecretValueSizeValidator is Secret Valueの大きさを確認するgolidator.ValidationFunc
+// paramで上限のByte数を指定できる. 省略した場合はmaxSecretValueSize
+func SecretValueSizeValidator(param string, v reflect.Value) (golidator.ValidationResult, error) {
+	if v.Kind() != reflect.String {
+		return golidator.ValidationNG, golidator.ErrValidateUnsupportedType
+	}
+	max := maxSecretValueSize
+	if param != "" {
+		var err error
+		max, err = strconv.Atoi(param)
+		if err != nil {
+			return golidator.ValidationNG, golidator.ErrInvalidConfigValue
+		}
+	}
+	if len(v.String()) > max {
+		return golidator.ValidationNG, nil
+	}
+	return golidator.ValidationOK, nil
+}
+
+// isValidSecretKey is 文字種、Pathとしての形式、予約済みPrefixを確認する
+// __ で始まる名前はDatastoreの予約語と衝突する可能性があるので許可しない
+func isValidSecretKey(key string) bool {
+	if !validKeyChars.MatchString(key) {
+		return false
+	}
+	if ValidateKeyPath(key) != nil {
+		return false
+	}
+	if strings.HasPrefix(key, "__") {
+		return false
+	}
+	for _, p := range ReservedKeyPrefixes {
+		if HasKeyPrefix(key, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterSecretValueValidator is prefix配下のSecret Valueに適用するValidatorを登録する
+func RegisterSecretValueValidator(prefix string, name string, f SecretValueValidator) {
+	secretValueValidators.Lock()
+	defer secretValueValidators.Unlock()
+
+	prefix = NormalizeKeyPrefix(prefix)
+	secretValueValidators.m[prefix] = append(secretValueValidators.m[prefix], &namedSecretValueValidator{
+		Name: name,
+		F:    f,
+	})
+}
+
+// ValidateSecretValue is keyの祖先に登録されている全てのValidatorを適用し、Errorの理由を返す
+func ValidateSecretValue(key string, value string) []string {
+	secretValueValidators.RLock()
+	defer secretValueValidators.RUnlock()
+
+	var reasons []string
+	for _, prefix := range KeyPathAncestors(key) {
+		for _, v := range secretValueValidators.m[prefix] {
+			if err := v.F(key, value); err != nil {
+				reasons = append(reasons, v.Name+": "+err.Error())
+			}
+		}
+	}
+	return reasons
+}
@@ -0,0 +1,228 @@
+package backend
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+)
+
+// SecretEventKind is SecretEvent EntityのKind. Secretの変更履歴としてPrefixのWatchに利用する
+const SecretEventKind = "SecretEvent"
+
+// Watch List
+const (
+	// defaultWatchTimeout is Timeoutを指定しない場合に待つ時間
+	defaultWatchTimeout = 30 * time.Second
+	// maxWatchTimeout is 待つ時間の上限. App Engineの60秒のRequest Deadlineより短くする
+	maxWatchTimeout = 50 * time.Second
+	// watchPollInterval is 別のInstanceで行われた変更に気付くために、Datastoreを確認する間隔
+	watchPollInterval = 2 * time.Second
+	// maxWatchEvents is PrefixのWatchで1度に返すEventの最大数
+	maxWatchEvents = 100
+	// watchLookback is PrefixのWatchで、Cursorより前に起きたEventが後から見えるようになるのを待つ時間
+	// Instance間の時計のずれと、Queryに反映されるまでの遅れを吸収する
+	watchLookback = 10 * time.Second
+)
+
+// secretWatchHub is 同じInstanceでSecretが変更された時に、Watchしている全てのRequestを起こす
+// 別のInstanceでの変更はwatchPollInterval毎のDatastoreの確認で検出する
+var secretWatchHub = struct {
+	sync.Mutex
+	waiters map[string]map[chan struct{}]bool
+}{waiters: map[string]map[chan struct{}]bool{}}
+
+// subscribeSecretChange is Namespaceの変更を待つchanを返す. 使い終わったらcancelを呼ぶこと
+func subscribeSecretChange(namespace string) (ch chan struct{}, cancel func()) {
+	ch = make(chan struct{}, 1)
+
+	secretWatchHub.Lock()
+	defer secretWatchHub.Unlock()
+
+	if secretWatchHub.waiters[namespace] == nil {
+		secretWatchHub.waiters[namespace] = map[chan struct{}]bool{}
+	}
+	secretWatchHub.waiters[namespace][ch] = true
+
+	return ch, func() {
+		secretWatchHub.Lock()
+		defer secretWatchHub.Unlock()
+
+		delete(secretWatchHub.waiters[namespace], ch)
+		if len(secretWatchHub.waiters[namespace]) == 0 {
+			delete(secretWatchHub.waiters, namespace)
+		}
+	}
+}
+
+// notifySecretChange is Namespaceの変更を待っている全てのRequestを起こす
+func notifySecretChange(namespace string) {
+	secretWatchHub.Lock()
+	defer secretWatchHub.Unlock()
+
+	for ch := range secretWatchHub.waiters[namespace] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// WatchTimeout is Clientが指定したTimeout(秒)を、利用できる範囲に収める
+func WatchTimeout(seconds int) time.Duration {
+	if seconds <= 0 {
+		return defaultWatchTimeout
+	}
+	d := time.Duration(seconds) * time.Second
+	if d > maxWatchTimeout {
+		return maxWatchTimeout
+	}
+	return d
+}
+
+// waitSecretChange is checkがtrueを返すか、timeoutになるまで待つ
+// checkは最初に1回、その後は同じInstanceでの変更とwatchPollInterval毎に呼ぶ
+func waitSecretChange(ctx context.Context, t *Tenant, timeout time.Duration, check func() (bool, error)) (bool, error) {
+	ch, cancel := subscribeSecretChange(t.Namespace)
+	defer cancel()
+
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	poll := time.NewTicker(watchPollInterval)
+	defer poll.Stop()
+
+	for {
+		changed, err := check()
+		if err != nil || changed {
+			return changed, err
+		}
+
+		select {
+		case <-ch:
+		case <-poll.C:
+		case <-deadline.C:
+			return false, nil
+		case <-ctx.Done():
+			return false, nil
+		}
+	}
+}
+
+// putSecretEvent is SecretEventを保存し、同じInstanceでWatchしているRequestに知らせる
+func putSecretEvent(ctx context.Context, ds datastore.Client, t *Tenant, event *SecretEvent) error {
+	if _, err := ds.Put(ctx, t.NameKey(ds, SecretEventKind, event.ID, nil), event); err != nil {
+		return errors.Wrapf(err, "failed put SecretEvent. key=%s", event.Key)
+	}
+	notifySecretChange(t.Namespace)
+	return nil
+}
+
+// WatchCursor is PrefixのWatchで読んだところ
+// OccurredAtはWriterの時計で付けられ、QueryもEventually Consistentなので、後から見えるようになったEventがCursorより前のOccurredAtを持つことがある
+// そのため、読んだ最後のEventよりwatchLookbackだけ前のFromから読み直し、既に返したEventのIDをSeenで除く
+// 文字列では {From(RFC3339Nano)}/{ID},{ID}... になる. IDを省略した場合はFrom以降の全てのEventを読む
+type WatchCursor struct {
+	From time.Time
+	Seen []string
+}
+
+// ParseWatchCursor is WatchCursor.Stringで作成した文字列を読み込む
+func ParseWatchCursor(s string) (WatchCursor, error) {
+	var c WatchCursor
+	if i := strings.Index(s, "/"); i >= 0 {
+		var seen string
+		s, seen = s[:i], s[i+1:]
+		if seen != "" {
+			c.Seen = strings.Split(seen, ",")
+		}
+	}
+	var err error
+	c.From, err = time.Parse(time.RFC3339Nano, s)
+	return c, err
+}
+
+// String is Clientに返すCursorの文字列
+func (c WatchCursor) String() string {
+	s := c.From.Format(time.RFC3339Nano)
+	if len(c.Seen) == 0 {
+		return s
+	}
+	return s + "/" + strings.Join(c.Seen, ",")
+}
+
+// NewWatchCursor is atより後に起きたEventを読むCursorを返す
+// at以前に起きたEventが後から見えるようになっても返さないように、watchLookbackの間に起きたEventを既に返したものとする
+func NewWatchCursor(ctx context.Context, ds datastore.Client, t *Tenant, at time.Time) (WatchCursor, error) {
+	c := WatchCursor{From: at.Add(-watchLookback)}
+	var list []*SecretEvent
+	q := t.NewQuery(ds, SecretEventKind).
+		Filter("OccurredAt >=", c.From).
+		Order("OccurredAt").
+		Order("__key__")
+	if _, err := ds.GetAll(ctx, q, &list); err != nil {
+		return c, errors.Wrap(err, "failed list SecretEvent")
+	}
+	for _, e := range list {
+		c.Seen = append(c.Seen, e.ID)
+	}
+	return c, nil
+}
+
+// ListSecretEvents is sinceの後に見えるようになった、prefix配下のSecretEventを古い順に返す
+// nextは次に指定するsinceで、prefix配下以外のEventも含めて読んだところまで進める
+func ListSecretEvents(ctx context.Context, ds datastore.Client, t *Tenant, prefix string, since WatchCursor) (events []*SecretEvent, next WatchCursor, err error) {
+	now := time.Now()
+	limit := len(since.Seen) + maxWatchEvents
+	q := t.NewQuery(ds, SecretEventKind).
+		Filter("OccurredAt >=", since.From).
+		Order("OccurredAt").
+		Order("__key__").
+		Limit(limit)
+	var list []*SecretEvent
+	if _, err := ds.GetAll(ctx, q, &list); err != nil {
+		return nil, since, errors.Wrapf(err, "failed list SecretEvent. prefix=%s", prefix)
+	}
+	truncated := len(list) == limit
+
+	seen := map[string]bool{}
+	for _, id := range since.Seen {
+		seen[id] = true
+	}
+	for _, e := range list {
+		if seen[e.ID] {
+			continue
+		}
+		if HasKeyPrefix(e.Key, prefix) {
+			events = append(events, e)
+		}
+	}
+
+	// 読み残しがある場合は、読んだ最後のEventを基準にFromを進める
+	latest := now
+	if truncated {
+		latest = list[len(list)-1].OccurredAt
+	}
+	next = WatchCursor{From: latest.Add(-watchLookback)}
+	if next.From.Before(since.From) {
+		next.From = since.From
+	}
+	read := map[string]bool{}
+	for _, e := range list {
+		read[e.ID] = true
+		if !e.OccurredAt.Before(next.From) {
+			next.Seen = append(next.Seen, e.ID)
+		}
+	}
+	if truncated {
+		// 読まなかったSeenのEventは、Fromより後に起きたものなので残す
+		for _, id := range since.Seen {
+			if !read[id] {
+				next.Seen = append(next.Seen, id)
+			}
+		}
+	}
+	return events, next, nil
+}
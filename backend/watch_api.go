@@ -0,0 +1,163 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// SecretAPIWatchRequest is SecretAPI Watch Request
+type SecretAPIWatchRequest struct {
+	Key          string `json:"key" swagger:",in=path,req,secretKey"`
+	SinceVersion int64  `json:"sinceVersion" swagger:",in=query"`
+	Timeout      int    `json:"timeout" swagger:",in=query"`
+}
+
+// SecretAPIWatchResponse is SecretAPI Watch Response. Secretの値は返さないので、必要な場合は改めてGetする
+// Changedがfalseの場合はTimeoutまでに変更がなかったことを表す
+type SecretAPIWatchResponse struct {
+	Key       string    `json:"key"`
+	Changed   bool      `json:"changed"`
+	Deleted   bool      `json:"deleted,omitempty"`
+	Version   int64     `json:"version"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt,omitempty"`
+}
+
+// Watch is SecretのVersionがsinceVersionより新しくなるか、Timeoutになるまで待つhandler
+// GET /secret/{key}:watch で呼び出す. sinceVersionより前に削除された場合はDeletedを返す
+func (api *SecretAPI) Watch(ctx context.Context, form *SecretAPIWatchRequest) (*SecretAPIWatchResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+	SpanFromContext(ctx).SetAttribute(AttrSecretKey, form.Key)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, form.Key, PermissionRead); err != nil {
+		return nil, err
+	}
+
+	resp := &SecretAPIWatchResponse{
+		Key:     form.Key,
+		Version: form.SinceVersion,
+	}
+	_, err = waitSecretChange(ctx, t, WatchTimeout(form.Timeout), func() (bool, error) {
+		s, err := platform.SecretStore.Get(ctx, t, form.Key)
+		if err == ErrSecretNotFound {
+			// 存在していたSecretが削除された場合だけ変更とする
+			resp.Changed, resp.Deleted = form.SinceVersion > 0, form.SinceVersion > 0
+			resp.Version = 0
+			return resp.Changed, nil
+		} else if err != nil {
+			return false, err
+		}
+		if s.Version <= form.SinceVersion {
+			return false, nil
+		}
+		resp.Changed = true
+		resp.Version = s.Version
+		resp.UpdatedBy = s.UpdatedBy
+		resp.UpdatedAt = s.UpdatedAt
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// FolderAPIWatchRequest is FolderAPI Watch Request
+// Sinceには前回のResponseのCursorを指定する. 省略した場合は今から後の変更を待つ
+type FolderAPIWatchRequest struct {
+	Prefix  string `json:"prefix" swagger:",in=query,keyPrefix"`
+	Since   string `json:"since" swagger:",in=query"`
+	Timeout int    `json:"timeout" swagger:",in=query"`
+}
+
+// FolderAPIWatchResponse is FolderAPI Watch Response
+type FolderAPIWatchResponse struct {
+	Prefix string         `json:"prefix"`
+	Events []*SecretEvent `json:"events"`
+	Cursor string         `json:"cursor"`
+}
+
+// Watch is Prefix配下のSecretが変更されるか、Timeoutになるまで待つhandler
+// GET /folder:watch?prefix=... で呼び出す. 読む権限のないSecretのEventは返さない
+func (api *FolderAPI) Watch(ctx context.Context, form *FolderAPIWatchRequest) (*FolderAPIWatchResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	prefix := NormalizeKeyPrefix(form.Prefix)
+	var since WatchCursor
+	if form.Since != "" {
+		var err error
+		since, err = ParseWatchCursor(form.Since)
+		if err != nil {
+			return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid since: %q", form.Since)}
+		}
+	}
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, prefix, PermissionRead); err != nil {
+		return nil, err
+	}
+
+	if form.Since == "" {
+		since, err = NewWatchCursor(ctx, ds, t, time.Now())
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &FolderAPIWatchResponse{
+		Prefix: prefix,
+		Events: []*SecretEvent{},
+	}
+	_, err = waitSecretChange(ctx, t, WatchTimeout(form.Timeout), func() (bool, error) {
+		events, next, err := ListSecretEvents(ctx, ds, t, prefix, since)
+		if err != nil {
+			return false, err
+		}
+		since = next
+		for _, e := range events {
+			if err := Authorize(ctx, ds, t, u, e.Key, PermissionRead); err != nil {
+				continue
+			}
+			resp.Events = append(resp.Events, e)
+		}
+		return len(resp.Events) > 0, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Cursor = since.String()
+
+	return resp, nil
+}
@@ -0,0 +1,228 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWatchCursor(t *testing.T) {
+	at := time.Date(2018, 4, 1, 12, 0, 0, 123456000, time.UTC)
+	cases := []struct {
+		s    string
+		want WatchCursor
+	}{
+		{"2018-04-01T12:00:00.123456Z", WatchCursor{From: at}},
+		{"2018-04-01T12:00:00.123456Z/0a1b", WatchCursor{From: at, Seen: []string{"0a1b"}}},
+		{"2018-04-01T12:00:00.123456Z/0a1b,2c3d", WatchCursor{From: at, Seen: []string{"0a1b", "2c3d"}}},
+	}
+	for _, c := range cases {
+		got, err := ParseWatchCursor(c.s)
+		if err != nil {
+			t.Fatalf("%s: %v", c.s, err)
+		}
+		if !got.From.Equal(c.want.From) || fmt.Sprint(got.Seen) != fmt.Sprint(c.want.Seen) {
+			t.Errorf("%s: got %+v, want %+v", c.s, got, c.want)
+		}
+		if g := got.String(); g != c.s {
+			t.Errorf("String: got %q, want %q", g, c.s)
+		}
+	}
+	if _, err := ParseWatchCursor("0a1b"); err == nil {
+		t.Errorf("invalid cursor: want error")
+	}
+}
+
+func TestListSecretEventsLateEvent(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	tenant := &Tenant{ID: "watch-late", Namespace: "watch-late"}
+	now := time.Now()
+	put := func(id string, key string, at time.Time) {
+		t.Helper()
+		if err := putSecretEvent(ctx, ds, tenant, &SecretEvent{ID: id, Type: SecretEventUpdated, Tenant: tenant.ID, Key: key, OccurredAt: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(since WatchCursor) ([]string, WatchCursor) {
+		t.Helper()
+		events, next, err := ListSecretEvents(ctx, ds, tenant, "prod", since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, e := range events {
+			ids = append(ids, e.ID)
+		}
+		// Clientとは文字列でやり取りする
+		next, err = ParseWatchCursor(next.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ids, next
+	}
+
+	put("old", "prod/db", now.Add(-time.Minute))
+	since, err := NewWatchCursor(ctx, ds, tenant, now.Add(-30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	put("a", "prod/db", now.Add(-2*time.Second))
+	put("other", "dev/db", now.Add(-2*time.Second))
+	ids, next := list(since)
+	if g, e := fmt.Sprint(ids), "[a]"; g != e {
+		t.Errorf("first: got %s, want %s", g, e)
+	}
+
+	// 別のInstanceで、aより前のOccurredAtで書かれたEventが後から見えるようになる
+	put("late", "prod/api", now.Add(-5*time.Second))
+	ids, next = list(next)
+	if g, e := fmt.Sprint(ids), "[late]"; g != e {
+		t.Errorf("late event: got %s, want %s", g, e)
+	}
+	ids, _ = list(next)
+	if len(ids) != 0 {
+		t.Errorf("after all events are read: got %v", ids)
+	}
+
+	// watchLookbackより前に起きたEventは、それ以降のCursorからは読まない
+	put("too-late", "prod/api", now.Add(-time.Minute))
+	if ids, _ = list(next); len(ids) != 0 {
+		t.Errorf("event older than lookback: got %v", ids)
+	}
+}
+
+func TestListSecretEventsPaging(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	tenant := &Tenant{ID: "watch-paging", Namespace: "watch-paging"}
+	at := time.Now().Add(-time.Second)
+	const n = maxWatchEvents + 5
+	for i := 0; i < n; i++ {
+		// 同じOccurredAtのEventがLimitより多くても取りこぼさない
+		if err := putSecretEvent(ctx, ds, tenant, &SecretEvent{ID: fmt.Sprintf("%03d", i), Type: SecretEventUpdated, Tenant: tenant.ID, Key: "prod/db", OccurredAt: at}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	since := WatchCursor{From: at.Add(-time.Minute)}
+	got := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		events, next, err := ListSecretEvents(ctx, ds, tenant, "", since)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, e := range events {
+			if got[e.ID] {
+				t.Errorf("%s is returned twice", e.ID)
+			}
+			got[e.ID] = true
+		}
+		since = next
+	}
+	if len(got) != n {
+		t.Errorf("events: got %d, want %d", len(got), n)
+	}
+}
+
+func TestSecretAPIWatch(t *testing.T) {
+	defer useFakeDatastore(newFakeDatastore())()
+	tenant := &Tenant{ID: "watch-secret", Namespace: "watch-secret", CryptKey: testCryptKey, Admins: []string{"admin@example.com"}}
+	ctx := testUserContext(t, tenant, "admin@example.com")
+	const key = "prod/db"
+	postTestSecret(t, tenant, "admin@example.com", key, "v1")
+
+	api := &SecretAPI{}
+	errc := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		r := httptest.NewRequest(http.MethodPost, "/api/1/secret", nil)
+		_, err := api.Post(ctx, httptest.NewRecorder(), r, &SecretAPIPostRequest{Key: key, Value: "v2"})
+		errc <- err
+	}()
+	start := time.Now()
+	resp, err := api.Watch(ctx, &SecretAPIWatchRequest{Key: key, SinceVersion: 1, Timeout: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	// 同じInstanceでの変更は、Pollを待たずに返す
+	if d := time.Since(start); d >= watchPollInterval {
+		t.Errorf("watch returned after %v, want before %v", d, watchPollInterval)
+	}
+	if !resp.Changed || resp.Version != 2 || resp.UpdatedBy != "admin@example.com" {
+		t.Errorf("changed: got %+v", resp)
+	}
+
+	start = time.Now()
+	resp, err = api.Watch(ctx, &SecretAPIWatchRequest{Key: key, SinceVersion: 2, Timeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Changed {
+		t.Errorf("not changed: got %+v", resp)
+	}
+	if d := time.Since(start); d < time.Second || d >= 5*time.Second {
+		t.Errorf("watch returned after %v, want after the 1s timeout", d)
+	}
+}
+
+func TestFolderAPIWatch(t *testing.T) {
+	defer useFakeDatastore(newFakeDatastore())()
+	tenant := &Tenant{ID: "watch-folder", Namespace: "watch-folder", CryptKey: testCryptKey, Admins: []string{"admin@example.com"}}
+	ctx := testUserContext(t, tenant, "admin@example.com")
+	postTestSecret(t, tenant, "admin@example.com", "prod/db", "before watch")
+
+	secrets := &SecretAPI{}
+	errc := make(chan error, 1)
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		for _, key := range []string{"dev/db", "prod/api"} {
+			r := httptest.NewRequest(http.MethodPost, "/api/1/secret", nil)
+			if _, err := secrets.Post(ctx, httptest.NewRecorder(), r, &SecretAPIPostRequest{Key: key, Value: "v"}); err != nil {
+				errc <- err
+				return
+			}
+		}
+		errc <- nil
+	}()
+	api := &FolderAPI{}
+	start := time.Now()
+	resp, err := api.Watch(ctx, &FolderAPIWatchRequest{Prefix: "prod", Timeout: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d >= watchPollInterval {
+		t.Errorf("watch returned after %v, want before %v", d, watchPollInterval)
+	}
+	if len(resp.Events) != 1 || resp.Events[0].Key != "prod/api" {
+		t.Fatalf("events: got %+v, want only prod/api", resp.Events)
+	}
+	if resp.Cursor == "" {
+		t.Fatal("cursor is empty")
+	}
+
+	start = time.Now()
+	resp, err = api.Watch(ctx, &FolderAPIWatchRequest{Prefix: "prod", Since: resp.Cursor, Timeout: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Events) != 0 {
+		t.Errorf("events after cursor: got %+v", resp.Events)
+	}
+	if d := time.Since(start); d < time.Second || d >= 5*time.Second {
+		t.Errorf("watch returned after %v, want after the 1s timeout", d)
+	}
+
+	if _, err := api.Watch(ctx, &FolderAPIWatchRequest{Prefix: "prod", Since: "invalid"}); httpStatus(err) != http.StatusBadRequest {
+		t.Errorf("invalid since: got %v, want 400", err)
+	}
+}
@@ -0,0 +1,422 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/taskqueue"
+	"google.golang.org/appengine/user"
+)
+
+// WebhookSubscriptionKind is WebhookSubscription EntityのKind
+const WebhookSubscriptionKind = "WebhookSubscription"
+
+// WebhookDeliveryKind is WebhookDelivery EntityのKind
+const WebhookDeliveryKind = "WebhookDelivery"
+
+// maxWebhookAttempts is Webhookの送信を試みる最大回数. 超えた場合はDead Letterとして扱う
+const maxWebhookAttempts = 10
+
+// webhookTimeout is Webhook送信先のResponseを待つ時間
+const webhookTimeout = 10 * time.Second
+
+// Webhook Header List
+const (
+	WebhookHeaderEvent     = "X-Gcpsm-Event"
+	WebhookHeaderDelivery  = "X-Gcpsm-Delivery"
+	WebhookHeaderTimestamp = "X-Gcpsm-Timestamp"
+	WebhookHeaderSignature = "X-Gcpsm-Signature"
+	WebhookHeaderPriority  = "X-Gcpsm-Priority"
+)
+
+// SecretEventType is Webhookで通知するEventの種類
+type SecretEventType string
+
+// SecretEventType List
+const (
+	SecretEventUpdated SecretEventType = "secret.updated"
+	SecretEventDeleted SecretEventType = "secret.deleted"
+	SecretEventRotated SecretEventType = "secret.rotated"
+	// SecretEventBreakGlass is Break-glassで一時的な読み込み権限が与えられた
+	SecretEventBreakGlass SecretEventType = "secret.breakglass"
+)
+
+// Priority is Webhookの受信側で通知の重要度を判断するための値. X-Gcpsm-Priority Headerで送る
+func (e SecretEventType) Priority() string {
+	if e == SecretEventBreakGlass {
+		return "high"
+	}
+	return "normal"
+}
+
+// SecretEvent is Webhookで通知する内容. Secretの値は含めない
+// JustificationとExpiresAtはBreak-glassの場合のみ設定する
+// Replicationは別のgcpsmから複製された変更の場合に、複製元のReplicationRuleのIDを設定する
+type SecretEvent struct {
+	ID            string          `json:"id"`
+	Type          SecretEventType `json:"type"`
+	Tenant        string          `json:"tenant"`
+	Key           string          `json:"key"`
+	Version       int64           `json:"version"`
+	Actor         string          `json:"actor"`
+	Justification string          `json:"justification,omitempty" datastore:",noindex"`
+	ExpiresAt     time.Time       `json:"expiresAt,omitempty" datastore:",noindex"`
+	Replication   string          `json:"replication,omitempty" datastore:",noindex"`
+	OccurredAt    time.Time       `json:"occurredAt"`
+}
+
+// WebhookSubscription is Datastore Entity
+// Prefix自身、またはPrefix配下のSecretが変更された時にURLに通知する
+type WebhookSubscription struct {
+	ID     string            `json:"id" datastore:"-"`
+	Prefix string            `json:"prefix"`
+	URL    string            `json:"url" datastore:",noindex"`
+	Events []SecretEventType `json:"events" datastore:",noindex"`
+	// SigningSecret is 署名に利用するSecret. KMSでEncryptして保存する
+	SigningSecret string    `json:"-" datastore:",noindex"`
+	CreatedBy     string    `json:"createdBy"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+// Matches is eventを通知する対象かを返す. PrefixとEventの種類だけを見て、登録者がKeyを読めるかはpublishSecretEventで確認する
+func (s *WebhookSubscription) Matches(event *SecretEvent) bool {
+	if !HasKeyPrefix(event.Key, s.Prefix) {
+		return false
+	}
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, e := range s.Events {
+		if e == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookDeliveryStatus is WebhookDeliveryの状態
+type WebhookDeliveryStatus string
+
+// WebhookDeliveryStatus List
+const (
+	WebhookDeliveryPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryRetrying  WebhookDeliveryStatus = "retrying"
+	WebhookDeliveryDead      WebhookDeliveryStatus = "dead"
+)
+
+// WebhookDelivery is Datastore Entity
+// 1 Subscriptionへの1 Eventの送信記録. StatusがdeadのものがDead Letterとなる
+type WebhookDelivery struct {
+	ID             string                `json:"id" datastore:"-"`
+	SubscriptionID string                `json:"subscriptionId"`
+	Event          SecretEvent           `json:"event" datastore:",noindex"`
+	Status         WebhookDeliveryStatus `json:"status"`
+	Attempts       int                   `json:"attempts" datastore:",noindex"`
+	LastStatusCode int                   `json:"lastStatusCode,omitempty" datastore:",noindex"`
+	LastError      string                `json:"lastError,omitempty" datastore:",noindex"`
+	CreatedAt      time.Time             `json:"createdAt"`
+	UpdatedAt      time.Time             `json:"updatedAt" datastore:",noindex"`
+}
+
+// WebhookTask is WebhookQueueに積む内容
+type WebhookTask struct {
+	Tenant     string `json:"tenant"`
+	DeliveryID string `json:"deliveryId"`
+}
+
+// WebhookQueue is Webhookの送信を非同期に行うQueue
+// Enqueueしたtaskは、最終的にDeliverWebhookで処理すること
+type WebhookQueue interface {
+	Enqueue(ctx context.Context, task *WebhookTask) error
+}
+
+// DefaultWebhookQueue is Webhookの送信に利用するQueue
+var DefaultWebhookQueue WebhookQueue = &TaskQueueWebhookQueue{Queue: "webhook", Path: "/api/internal/webhook/deliver"}
+
+// WebhookHTTPClient is Webhookの送信に利用するhttp.Clientを返す
+var WebhookHTTPClient = func(ctx context.Context) *http.Client {
+	return platform.HTTPClient(ctx)
+}
+
+// TaskQueueWebhookQueue is App Engine Task QueueでWebhookを送信するWebhookQueue
+// RetryはTask Queueに任せるので、queue.yamlでRetryの間隔を設定する
+type TaskQueueWebhookQueue struct {
+	Queue string
+	Path  string
+}
+
+// Enqueue is WebhookQueueを実装
+func (q *TaskQueueWebhookQueue) Enqueue(ctx context.Context, task *WebhookTask) error {
+	body, err := json.Marshal(task)
+	if err != nil {
+		return errors.Wrap(err, "failed marshal webhook task")
+	}
+	t := &taskqueue.Task{
+		Path:    q.Path,
+		Payload: body,
+		Header:  http.Header{"Content-Type": []string{"application/json"}},
+		Method:  http.MethodPost,
+	}
+	if _, err := taskqueue.Add(ctx, t, q.Queue); err != nil {
+		return errors.Wrapf(err, "failed add webhook task. delivery=%s", task.DeliveryID)
+	}
+	return nil
+}
+
+// SyncWebhookQueue is Enqueueしたその場でWebhookを送信するWebhookQueue
+// Task Queueが使えない環境で利用する. 失敗した場合はRetryせず、WebhookDeliveryに記録するだけとなる
+type SyncWebhookQueue struct{}
+
+// Enqueue is WebhookQueueを実装
+func (q *SyncWebhookQueue) Enqueue(ctx context.Context, task *WebhookTask) error {
+	_, err := DeliverWebhook(ctx, task, maxWebhookAttempts-1)
+	return err
+}
+
+// newRandomID is Webhook, AuditLogなど、Key NameにするランダムなIDを作成する
+func newRandomID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewWebhookSigningSecret is 署名に利用するSecretを作成する
+func NewWebhookSigningSecret() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// SignWebhook is timestampとbodyのHMAC-SHA256署名を返す. Replayを防ぐためtimestampも署名に含める
+func SignWebhook(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature is Webhookを受け取った側で署名を確認する
+// timestampがtoleranceより古い場合は、署名が正しくても失敗とする
+func VerifyWebhookSignature(secret string, timestamp string, body []byte, signature string, tolerance time.Duration) error {
+	ts, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid timestamp")
+	}
+	if d := time.Since(time.Unix(ts, 0)); d > tolerance || d < -tolerance {
+		return fmt.Errorf("timestamp is out of tolerance. timestamp=%s", timestamp)
+	}
+	if !hmac.Equal([]byte(SignWebhook(secret, timestamp, body)), []byte(signature)) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// ValidateWebhookURL is Webhookの送信先として利用できるURLかを確認する. localhost以外はhttpsのみ許可する
+func ValidateWebhookURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("invalid webhook url: %q", raw)}
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		if h := u.Hostname(); h == "localhost" || h == "127.0.0.1" {
+			return nil
+		}
+	}
+	return &HTTPError{Code: http.StatusBadRequest, Message: "webhook url must be https."}
+}
+
+// PublishSecretEvent is eventをSecretEventとして保存してWatchしているRequestに知らせ、該当する全てのWebhookSubscriptionにWebhookの送信を予約する
+// また、該当する全てのReplicationRuleに複製を予約する
+// Secretの変更自体は成功しているので、失敗はLogに出力するだけで呼び出し元には返さない
+func PublishSecretEvent(ctx context.Context, ds datastore.Client, t *Tenant, event *SecretEvent) {
+	event.ID = newRandomID()
+	event.Tenant = t.ID
+	event.OccurredAt = time.Now()
+
+	if err := publishSecretEvent(ctx, ds, t, event); err != nil {
+		log.Errorf(ctx, "failed publish secret event. event=%s, key=%s, err=%+v", event.Type, event.Key, err)
+	}
+}
+
+func publishSecretEvent(ctx context.Context, ds datastore.Client, t *Tenant, event *SecretEvent) error {
+	if err := putSecretEvent(ctx, ds, t, event); err != nil {
+		return err
+	}
+
+	subs, err := ListWebhookSubscriptions(ctx, ds, t)
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if !sub.Matches(event) {
+			continue
+		}
+		// Prefixは登録時にしか認可していないので、配下にSecretACLで制限されたKeyがある場合に備えてEvent毎に登録者を認可する
+		ok, err := authorizeByACL(ctx, ds, t, &user.User{Email: sub.CreatedBy}, event.Key, PermissionRead)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			log.Infof(ctx, "skip webhook delivery. subscription=%s createdBy=%s can not read key=%s", sub.ID, sub.CreatedBy, event.Key)
+			continue
+		}
+		now := time.Now()
+		d := &WebhookDelivery{
+			ID:             newRandomID(),
+			SubscriptionID: sub.ID,
+			Event:          *event,
+			Status:         WebhookDeliveryPending,
+			CreatedAt:      now,
+			UpdatedAt:      now,
+		}
+		if _, err := ds.Put(ctx, t.NameKey(ds, WebhookDeliveryKind, d.ID, nil), d); err != nil {
+			return errors.Wrapf(err, "failed put WebhookDelivery. subscription=%s", sub.ID)
+		}
+		if err := DefaultWebhookQueue.Enqueue(ctx, &WebhookTask{Tenant: t.ID, DeliveryID: d.ID}); err != nil {
+			return err
+		}
+	}
+	return enqueueReplication(ctx, ds, t, event)
+}
+
+// ListWebhookSubscriptions is TenantのWebhookSubscriptionを全て返す
+func ListWebhookSubscriptions(ctx context.Context, ds datastore.Client, t *Tenant) ([]*WebhookSubscription, error) {
+	var list []*WebhookSubscription
+	keys, err := ds.GetAll(ctx, t.NewQuery(ds, WebhookSubscriptionKind), &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed list WebhookSubscription")
+	}
+	for i, k := range keys {
+		list[i].ID = k.Name()
+	}
+	return list, nil
+}
+
+// errWebhookRetry is Webhookの送信に失敗し、Retryが必要であることを表す
+var errWebhookRetry = errors.New("webhook: delivery failed, retry later")
+
+// DeliverWebhook is WebhookDeliveryを送信し、結果を記録する
+// retryCountはこれまでに失敗した回数で、maxWebhookAttemptsに達した場合はDead Letterとする
+// Retryが必要な場合はerrWebhookRetryを返す
+func DeliverWebhook(ctx context.Context, task *WebhookTask, retryCount int) (*WebhookDelivery, error) {
+	t, err := webhookTenant(ctx, task.Tenant)
+	if err != nil {
+		return nil, err
+	}
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dk := t.NameKey(ds, WebhookDeliveryKind, task.DeliveryID, nil)
+	d := &WebhookDelivery{}
+	if err := ds.Get(ctx, dk, d); err != nil {
+		return nil, errors.Wrapf(err, "failed get WebhookDelivery. delivery=%s", task.DeliveryID)
+	}
+	d.ID = task.DeliveryID
+	if d.Status == WebhookDeliveryDelivered {
+		// Task Queueは同じTaskを複数回実行することがある
+		return d, nil
+	}
+
+	sub := &WebhookSubscription{}
+	if err := ds.Get(ctx, t.NameKey(ds, WebhookSubscriptionKind, d.SubscriptionID, nil), sub); err == datastore.ErrNoSuchEntity {
+		// Subscriptionが削除された場合は送らない
+		d.Status = WebhookDeliveryDead
+		d.LastError = "subscription is deleted."
+		return d, putWebhookDelivery(ctx, ds, dk, d)
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "failed get WebhookSubscription. subscription=%s", d.SubscriptionID)
+	}
+
+	d.Attempts++
+	d.LastStatusCode, err = sendWebhook(ctx, t, sub, d)
+	if err == nil {
+		d.Status = WebhookDeliveryDelivered
+		d.LastError = ""
+		return d, putWebhookDelivery(ctx, ds, dk, d)
+	}
+
+	d.LastError = err.Error()
+	if retryCount+1 >= maxWebhookAttempts {
+		d.Status = WebhookDeliveryDead
+		log.Warningf(ctx, "webhook is dead lettered. delivery=%s, subscription=%s, err=%v", d.ID, d.SubscriptionID, err)
+		return d, putWebhookDelivery(ctx, ds, dk, d)
+	}
+	d.Status = WebhookDeliveryRetrying
+	if err := putWebhookDelivery(ctx, ds, dk, d); err != nil {
+		return nil, err
+	}
+	return d, errWebhookRetry
+}
+
+func putWebhookDelivery(ctx context.Context, ds datastore.Client, k datastore.Key, d *WebhookDelivery) error {
+	d.UpdatedAt = time.Now()
+	if _, err := ds.Put(ctx, k, d); err != nil {
+		return errors.Wrapf(err, "failed put WebhookDelivery. delivery=%s", d.ID)
+	}
+	return nil
+}
+
+// sendWebhook is 署名したEventをSubscriptionのURLにPOSTする. 2xx以外は失敗とする
+func sendWebhook(ctx context.Context, t *Tenant, sub *WebhookSubscription, d *WebhookDelivery) (int, error) {
+	kms := NewCrypter()
+	secret, err := kms.DecryptMulti(ctx, t.CryptKeys(), sub.SigningSecret)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := json.Marshal(&d.Event)
+	if err != nil {
+		return 0, errors.Wrap(err, "failed marshal secret event")
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest(http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed create webhook request")
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookHeaderEvent, string(d.Event.Type))
+	req.Header.Set(WebhookHeaderDelivery, d.ID)
+	req.Header.Set(WebhookHeaderTimestamp, timestamp)
+	req.Header.Set(WebhookHeaderSignature, SignWebhook(secret, timestamp, body))
+	req.Header.Set(WebhookHeaderPriority, d.Event.Type.Priority())
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+	resp, err := WebhookHTTPClient(ctx).Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, errors.Wrap(err, "failed send webhook")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return resp.StatusCode, fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// webhookTenant is WebhookTaskのTenantを返す. Default TenantはEntityがないのでDefaultTenantを使う
+func webhookTenant(ctx context.Context, id string) (*Tenant, error) {
+	if id == "" {
+		return DefaultTenant(ctx), nil
+	}
+	return GetTenant(ctx, id)
+}
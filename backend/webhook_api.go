@@ -0,0 +1,319 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/favclip/ucon"
+	"github.com/favclip/ucon/swagger"
+	"github.com/pkg/errors"
+	"go.mercari.io/datastore"
+	"google.golang.org/appengine/user"
+)
+
+// maxWebhookDeliveryLog is Delivery Logで返す最大件数
+const maxWebhookDeliveryLog = 100
+
+func setupWebhookAPI(swPlugin *swagger.Plugin) {
+	api := &WebhookAPI{}
+	tag := swPlugin.AddTag(&swagger.Tag{Name: "Webhook", Description: "Webhook API list"})
+
+	handleTenantAPI(http.MethodPost, "/webhook", api.Post, "subscribe secret events of key or prefix", tag)
+	handleTenantAPI(http.MethodGet, "/webhook", api.List, "list webhook subscriptions", tag)
+	handleTenantAPI(http.MethodDelete, "/webhook/{id}", api.Delete, "unsubscribe", tag)
+	handleTenantAPI(http.MethodGet, "/webhook/{id}/delivery", api.ListDelivery, "list webhook delivery log", tag)
+	handleTenantAPI(http.MethodPost, "/webhook/delivery/{id}/redeliver", api.Redeliver, "redeliver webhook", tag)
+
+	// Task Queueから呼ばれるHandler. app.yamlでlogin: adminにしている
+	ucon.HandleFunc(http.MethodPost, "/api/internal/webhook/deliver", api.Deliver)
+}
+
+// WebhookAPI is API to manage WebhookSubscription
+type WebhookAPI struct{}
+
+// WebhookAPIPostRequest is WebhookAPI Post Request
+type WebhookAPIPostRequest struct {
+	Prefix string            `json:"prefix" swagger:",keyPrefix"`
+	URL    string            `json:"url" swagger:",req"`
+	Events []SecretEventType `json:"events"`
+}
+
+// WebhookAPIPostResponse is WebhookAPI Post Response
+// SigningSecretは作成時にしか返さないので、Clientで保存すること
+type WebhookAPIPostResponse struct {
+	Subscription  *WebhookSubscription `json:"subscription"`
+	SigningSecret string               `json:"signingSecret"`
+}
+
+// Post is WebhookSubscription registration handler
+// Prefixを読めるuserのみ登録できる
+func (api *WebhookAPI) Post(ctx context.Context, form *WebhookAPIPostRequest) (*WebhookAPIPostResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	if err := ValidateWebhookURL(form.URL); err != nil {
+		return nil, err
+	}
+	for _, e := range form.Events {
+		switch e {
+		case SecretEventUpdated, SecretEventDeleted, SecretEventRotated, SecretEventBreakGlass:
+		default:
+			return nil, &HTTPError{Code: http.StatusBadRequest, Message: fmt.Sprintf("unknown event: %q", e)}
+		}
+	}
+	prefix := NormalizeKeyPrefix(form.Prefix)
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := Authorize(ctx, ds, t, u, prefix, PermissionRead); err != nil {
+		return nil, err
+	}
+
+	kms := NewCrypter()
+	secret := NewWebhookSigningSecret()
+	es, err := kms.EncryptMulti(ctx, t.CryptKeys(), secret)
+	if err != nil {
+		return nil, err
+	}
+
+	sub := &WebhookSubscription{
+		ID:            newRandomID(),
+		Prefix:        prefix,
+		URL:           form.URL,
+		Events:        form.Events,
+		SigningSecret: es,
+		CreatedBy:     u.Email,
+		CreatedAt:     time.Now(),
+	}
+	if _, err := ds.Put(ctx, t.NameKey(ds, WebhookSubscriptionKind, sub.ID, nil), sub); err != nil {
+		return nil, errors.Wrap(err, "failed put WebhookSubscription")
+	}
+
+	return &WebhookAPIPostResponse{
+		Subscription:  sub,
+		SigningSecret: secret,
+	}, nil
+}
+
+// WebhookAPIListResponse is WebhookAPI List Response
+type WebhookAPIListResponse struct {
+	List []*WebhookSubscription `json:"list"`
+}
+
+// List is WebhookSubscription list handler. Tenantの管理者以外は自分が登録したものだけを返す
+func (api *WebhookAPI) List(ctx context.Context) (*WebhookAPIListResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	subs, err := ListWebhookSubscriptions(ctx, ds, t)
+	if err != nil {
+		return nil, err
+	}
+	list := []*WebhookSubscription{}
+	for _, sub := range subs {
+		if t.IsAdmin(u) || sub.CreatedBy == u.Email {
+			list = append(list, sub)
+		}
+	}
+
+	return &WebhookAPIListResponse{
+		List: list,
+	}, nil
+}
+
+// WebhookAPIDeleteRequest is WebhookAPI Delete Request
+type WebhookAPIDeleteRequest struct {
+	ID string `json:"id" swagger:",in=path"`
+}
+
+// Delete is WebhookSubscription delete handler
+func (api *WebhookAPI) Delete(ctx context.Context, form *WebhookAPIDeleteRequest) error {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	k, _, err := getOwnWebhookSubscription(ctx, ds, t, u, form.ID)
+	if err != nil {
+		return err
+	}
+	if err := ds.Delete(ctx, k); err != nil {
+		return errors.Wrapf(err, "failed delete WebhookSubscription. id=%s", form.ID)
+	}
+	return nil
+}
+
+// WebhookAPIListDeliveryRequest is WebhookAPI ListDelivery Request
+type WebhookAPIListDeliveryRequest struct {
+	ID     string                `json:"id" swagger:",in=path"`
+	Status WebhookDeliveryStatus `json:"status" swagger:",in=query"`
+}
+
+// WebhookAPIListDeliveryResponse is WebhookAPI ListDelivery Response
+type WebhookAPIListDeliveryResponse struct {
+	List []*WebhookDelivery `json:"list"`
+}
+
+// ListDelivery is Subscriptionの送信記録を新しい順に返すhandler. status=deadを指定するとDead Letterだけを返す
+func (api *WebhookAPI) ListDelivery(ctx context.Context, form *WebhookAPIListDeliveryRequest) (*WebhookAPIListDeliveryResponse, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, _, err := getOwnWebhookSubscription(ctx, ds, t, u, form.ID); err != nil {
+		return nil, err
+	}
+
+	q := t.NewQuery(ds, WebhookDeliveryKind).
+		Filter("SubscriptionID =", form.ID).
+		Order("-CreatedAt").
+		Limit(maxWebhookDeliveryLog)
+	var list []*WebhookDelivery
+	keys, err := ds.GetAll(ctx, q, &list)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed list WebhookDelivery. subscription=%s", form.ID)
+	}
+	resp := &WebhookAPIListDeliveryResponse{
+		List: []*WebhookDelivery{},
+	}
+	for i, k := range keys {
+		list[i].ID = k.Name()
+		if form.Status == "" || list[i].Status == form.Status {
+			resp.List = append(resp.List, list[i])
+		}
+	}
+	return resp, nil
+}
+
+// WebhookAPIRedeliverRequest is WebhookAPI Redeliver Request
+type WebhookAPIRedeliverRequest struct {
+	ID string `json:"id" swagger:",in=path"`
+}
+
+// Redeliver is Dead LetterになったWebhookDeliveryを再送するhandler
+func (api *WebhookAPI) Redeliver(ctx context.Context, form *WebhookAPIRedeliverRequest) (*WebhookDelivery, error) {
+	le := &LogEntry{}
+	defer outputRequestLog(ctx, le)
+
+	t := TenantFromContext(ctx)
+	le.Tenant = t.ID
+
+	u := CurrentUser(ctx)
+	if u == nil {
+		return nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	le.User = u.Email
+
+	ds, err := FromContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	dk := t.NameKey(ds, WebhookDeliveryKind, form.ID, nil)
+	d := &WebhookDelivery{}
+	if err := ds.Get(ctx, dk, d); err != nil {
+		return nil, errors.Wrapf(err, "failed get WebhookDelivery. delivery=%s", form.ID)
+	}
+	d.ID = form.ID
+	if _, _, err := getOwnWebhookSubscription(ctx, ds, t, u, d.SubscriptionID); err != nil {
+		return nil, err
+	}
+	if d.Status != WebhookDeliveryDead {
+		return nil, &HTTPError{Code: http.StatusConflict, Message: fmt.Sprintf("delivery %s is %s.", d.ID, d.Status)}
+	}
+
+	d.Status = WebhookDeliveryPending
+	if err := putWebhookDelivery(ctx, ds, dk, d); err != nil {
+		return nil, err
+	}
+	if err := DefaultWebhookQueue.Enqueue(ctx, &WebhookTask{Tenant: t.ID, DeliveryID: d.ID}); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Deliver is Task QueueからWebhookを送信するhandler
+// Retryが必要な場合は503を返し、Task QueueにRetryさせる
+func (api *WebhookAPI) Deliver(ctx context.Context, r *http.Request, form *WebhookTask) error {
+	if r.Header.Get("X-AppEngine-QueueName") == "" {
+		// X-AppEngine-QueueNameはApp Engineの外から付けることができない
+		return &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	retryCount, _ := strconv.Atoi(r.Header.Get("X-AppEngine-TaskRetryCount"))
+
+	_, err := DeliverWebhook(ctx, form, retryCount)
+	if err == errWebhookRetry {
+		return &HTTPError{Code: http.StatusServiceUnavailable, Reason: ReasonUnavailable, Message: "webhook delivery failed.", Retriable: true}
+	}
+	return err
+}
+
+// getOwnWebhookSubscription is userが管理できるWebhookSubscriptionを返す. 作成者とTenantの管理者のみ管理できる
+func getOwnWebhookSubscription(ctx context.Context, ds datastore.Client, t *Tenant, u *user.User, id string) (datastore.Key, *WebhookSubscription, error) {
+	k := t.NameKey(ds, WebhookSubscriptionKind, id, nil)
+	sub := &WebhookSubscription{}
+	if err := ds.Get(ctx, k, sub); err == datastore.ErrNoSuchEntity {
+		return nil, nil, &HTTPError{Code: http.StatusNotFound, Message: fmt.Sprintf("webhook %s is not found.", id)}
+	} else if err != nil {
+		return nil, nil, errors.Wrapf(err, "failed get WebhookSubscription. id=%s", id)
+	}
+	sub.ID = id
+	if sub.CreatedBy != u.Email && !t.IsAdmin(u) {
+		return nil, nil, &HTTPError{Code: http.StatusForbidden, Message: "You do not have permission."}
+	}
+	return k, sub, nil
+}
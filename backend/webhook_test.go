@@ -0,0 +1,204 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver is 受け取ったWebhookを記録し、指定したStatus Codeを順に返すReceiver
+type webhookReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	code := http.StatusOK
+	if len(rc.statuses) > 0 {
+		code, rc.statuses = rc.statuses[0], rc.statuses[1:]
+	}
+	w.WriteHeader(code)
+}
+
+func newTestWebhookSubscription(t *testing.T, tenant *Tenant, url string, secret string) *WebhookSubscription {
+	ct, _, err := NewCrypter().Encrypt(context.Background(), tenant.CryptKey, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &WebhookSubscription{ID: "sub", Prefix: "prod", URL: url, SigningSecret: ct}
+}
+
+func TestSendWebhook(t *testing.T) {
+	rc := &webhookReceiver{}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	tenant := testTenant()
+	sub := newTestWebhookSubscription(t, tenant, srv.URL, "signing-secret")
+	d := &WebhookDelivery{
+		ID:             "delivery",
+		SubscriptionID: sub.ID,
+		Event:          SecretEvent{Type: SecretEventUpdated, Key: "prod/db", Version: 3, Actor: "test@example.com"},
+	}
+	code, err := sendWebhook(context.Background(), tenant, sub, d)
+	if err != nil {
+		t.Fatalf("sendWebhook: %v", err)
+	}
+	if code != http.StatusOK {
+		t.Errorf("status: got %d, want %d", code, http.StatusOK)
+	}
+
+	if len(rc.requests) != 1 {
+		t.Fatalf("requests: got %d, want 1", len(rc.requests))
+	}
+	r, body := rc.requests[0], rc.bodies[0]
+	if g, e := r.Header.Get(WebhookHeaderEvent), string(SecretEventUpdated); g != e {
+		t.Errorf("%s: got %q, want %q", WebhookHeaderEvent, g, e)
+	}
+	if g, e := r.Header.Get(WebhookHeaderDelivery), d.ID; g != e {
+		t.Errorf("%s: got %q, want %q", WebhookHeaderDelivery, g, e)
+	}
+	err = VerifyWebhookSignature("signing-secret", r.Header.Get(WebhookHeaderTimestamp), body, r.Header.Get(WebhookHeaderSignature), time.Minute)
+	if err != nil {
+		t.Errorf("VerifyWebhookSignature: %v", err)
+	}
+	err = VerifyWebhookSignature("other-secret", r.Header.Get(WebhookHeaderTimestamp), body, r.Header.Get(WebhookHeaderSignature), time.Minute)
+	if err == nil {
+		t.Errorf("VerifyWebhookSignature with other secret: want error")
+	}
+	var event SecretEvent
+	if err := json.Unmarshal(body, &event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Key != d.Event.Key || event.Version != d.Event.Version || event.Actor != d.Event.Actor {
+		t.Errorf("event: got %+v, want %+v", event, d.Event)
+	}
+}
+
+func TestSendWebhookRetry(t *testing.T) {
+	rc := &webhookReceiver{statuses: []int{http.StatusServiceUnavailable, http.StatusInternalServerError}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	tenant := testTenant()
+	sub := newTestWebhookSubscription(t, tenant, srv.URL, "signing-secret")
+	d := &WebhookDelivery{ID: "delivery", Event: SecretEvent{Type: SecretEventDeleted, Key: "prod/db"}}
+
+	// 2xx以外はErrorになり、Task QueueがRetryする
+	for _, want := range []int{http.StatusServiceUnavailable, http.StatusInternalServerError} {
+		code, err := sendWebhook(context.Background(), tenant, sub, d)
+		if err == nil {
+			t.Fatalf("status %d: want error", want)
+		}
+		if code != want {
+			t.Errorf("status: got %d, want %d", code, want)
+		}
+	}
+	code, err := sendWebhook(context.Background(), tenant, sub, d)
+	if err != nil || code != http.StatusOK {
+		t.Fatalf("retry: got %d %v, want %d", code, err, http.StatusOK)
+	}
+	if g, e := len(rc.requests), 3; g != e {
+		t.Errorf("requests: got %d, want %d", g, e)
+	}
+	for i, r := range rc.requests {
+		if g, e := r.Header.Get(WebhookHeaderDelivery), d.ID; g != e {
+			t.Errorf("request %d %s: got %q, want %q", i, WebhookHeaderDelivery, g, e)
+		}
+	}
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"secret.updated"}`)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-10*time.Minute).Unix(), 10)
+
+	cases := []struct {
+		name      string
+		timestamp string
+		body      []byte
+		signature string
+		ok        bool
+	}{
+		{"valid", now, body, SignWebhook("s", now, body), true},
+		{"other secret", now, body, SignWebhook("x", now, body), false},
+		{"tampered body", now, []byte(`{"type":"secret.deleted"}`), SignWebhook("s", now, body), false},
+		{"stale timestamp", stale, body, SignWebhook("s", stale, body), false},
+		{"missing signature", now, body, "", false},
+		{"invalid timestamp", "now", body, SignWebhook("s", "now", body), false},
+	}
+	for _, c := range cases {
+		err := VerifyWebhookSignature("s", c.timestamp, c.body, c.signature, 5*time.Minute)
+		if g := err == nil; g != c.ok {
+			t.Errorf("%s: got err=%v, want ok=%v", c.name, err, c.ok)
+		}
+	}
+}
+
+// recordingWebhookQueue is Enqueueされた WebhookTask を記録するだけのQueue
+type recordingWebhookQueue struct {
+	tasks []*WebhookTask
+}
+
+func (q *recordingWebhookQueue) Enqueue(ctx context.Context, task *WebhookTask) error {
+	q.tasks = append(q.tasks, task)
+	return nil
+}
+
+func TestPublishSecretEventAuthorizesSubscriber(t *testing.T) {
+	ctx := context.Background()
+	ds := newFakeDatastore()
+	tenant := testTenant()
+
+	orgQueue := DefaultWebhookQueue
+	queue := &recordingWebhookQueue{}
+	DefaultWebhookQueue = queue
+	defer func() {
+		DefaultWebhookQueue = orgQueue
+	}()
+
+	acls := map[string]*SecretACL{
+		"prod":            {Readers: []string{"reader@example.com"}},
+		"prod/restricted": {Readers: []string{"other@example.com"}},
+	}
+	for prefix, acl := range acls {
+		if _, err := ds.Put(ctx, SecretACLKey(ds, tenant, prefix), acl); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sub := &WebhookSubscription{Prefix: "prod", URL: "https://example.com/hook", CreatedBy: "reader@example.com"}
+	if _, err := ds.Put(ctx, tenant.NameKey(ds, WebhookSubscriptionKind, "sub", nil), sub); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, key := range []string{"prod/db", "prod/restricted/db"} {
+		event := &SecretEvent{ID: strconv.Itoa(i), Type: SecretEventUpdated, Tenant: tenant.ID, Key: key, Version: 1, Actor: "writer@example.com", OccurredAt: time.Now()}
+		if err := publishSecretEvent(ctx, ds, tenant, event); err != nil {
+			t.Fatalf("publishSecretEvent %s: %v", key, err)
+		}
+	}
+
+	var deliveries []*WebhookDelivery
+	if _, err := ds.GetAll(ctx, tenant.NewQuery(ds, WebhookDeliveryKind), &deliveries); err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 1 || deliveries[0].Event.Key != "prod/db" {
+		t.Fatalf("deliveries: got %+v, want only prod/db", deliveries)
+	}
+	if len(queue.tasks) != 1 {
+		t.Errorf("enqueued: got %d, want 1", len(queue.tasks))
+	}
+}
@@ -0,0 +1,345 @@
+package clouddatastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"cloud.google.com/go/datastore"
+	w "go.mercari.io/datastore"
+)
+
+var _ w.Middleware = (*bridge)(nil)
+
+var typeOfPropertyLoadSaver = reflect.TypeOf((*w.PropertyLoadSaver)(nil)).Elem()
+var typeOfPropertyList = reflect.TypeOf(w.PropertyList(nil))
+
+// bridge is 登録されたMiddlewareを順に呼び出し、最後にCloud Datastoreを呼び出すMiddleware
+// go.mercari.io/datastore/internal/shared.MiddlewareBridge と同じ順序でMiddlewareを呼ぶ
+type bridge struct {
+	d    *datastoreImpl
+	tx   *transactionImpl
+	iter *iteratorImpl
+	mws  []w.Middleware
+	info *w.MiddlewareInfo
+}
+
+func newBridge(info *w.MiddlewareInfo, d *datastoreImpl, tx *transactionImpl, iter *iteratorImpl) *bridge {
+	b := &bridge{d: d, tx: tx, iter: iter, mws: d.middlewares, info: info}
+	info.Next = b
+	return b
+}
+
+// next is 次に呼ぶMiddlewareと、そのMiddlewareに渡すInfoを返す. 残りのMiddlewareがなければnilを返す
+func (b *bridge) next() (w.Middleware, *w.MiddlewareInfo) {
+	if len(b.mws) == 0 {
+		return nil, nil
+	}
+	left := &bridge{d: b.d, tx: b.tx, iter: b.iter, mws: b.mws[1:], info: b.info}
+	left.info.Next = left
+	return b.mws[0], left.info
+}
+
+func (b *bridge) AllocateIDs(info *w.MiddlewareInfo, keys []w.Key) ([]w.Key, error) {
+	if mw, info := b.next(); mw != nil {
+		return mw.AllocateIDs(info, keys)
+	}
+	origKeys, err := b.d.client.AllocateIDs(info.Context, toOriginalKeys(keys))
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	return toWrapperKeys(origKeys), nil
+}
+
+func (b *bridge) PutMultiWithoutTx(info *w.MiddlewareInfo, keys []w.Key, psList []w.PropertyList) ([]w.Key, error) {
+	if mw, info := b.next(); mw != nil {
+		return mw.PutMultiWithoutTx(info, keys, psList)
+	}
+	origPss, err := toOriginalPropertyListList(psList)
+	if err != nil {
+		return nil, err
+	}
+	origKeys, err := b.d.client.PutMulti(info.Context, toOriginalKeys(keys), origPss)
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	return toWrapperKeys(origKeys), nil
+}
+
+func (b *bridge) PutMultiWithTx(info *w.MiddlewareInfo, keys []w.Key, psList []w.PropertyList) ([]w.PendingKey, error) {
+	if mw, info := b.next(); mw != nil {
+		return mw.PutMultiWithTx(info, keys, psList)
+	}
+	origPss, err := toOriginalPropertyListList(psList)
+	if err != nil {
+		return nil, err
+	}
+	pKeys, err := b.tx.tx.PutMulti(toOriginalKeys(keys), origPss)
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	return toWrapperPendingKeys(b.tx.client.ctx, pKeys), nil
+}
+
+func (b *bridge) GetMultiWithoutTx(info *w.MiddlewareInfo, keys []w.Key, psList []w.PropertyList) error {
+	if mw, info := b.next(); mw != nil {
+		return mw.GetMultiWithoutTx(info, keys, psList)
+	}
+	origPss := make([]datastore.PropertyList, len(keys))
+	err := b.d.client.GetMulti(info.Context, toOriginalKeys(keys), origPss)
+	copy(psList, toWrapperPropertyListList(origPss))
+	return toWrapperError(err)
+}
+
+func (b *bridge) GetMultiWithTx(info *w.MiddlewareInfo, keys []w.Key, psList []w.PropertyList) error {
+	if mw, info := b.next(); mw != nil {
+		return mw.GetMultiWithTx(info, keys, psList)
+	}
+	origPss := make([]datastore.PropertyList, len(keys))
+	err := b.tx.tx.GetMulti(toOriginalKeys(keys), origPss)
+	copy(psList, toWrapperPropertyListList(origPss))
+	return toWrapperError(err)
+}
+
+func (b *bridge) DeleteMultiWithoutTx(info *w.MiddlewareInfo, keys []w.Key) error {
+	if mw, info := b.next(); mw != nil {
+		return mw.DeleteMultiWithoutTx(info, keys)
+	}
+	return toWrapperError(b.d.client.DeleteMulti(info.Context, toOriginalKeys(keys)))
+}
+
+func (b *bridge) DeleteMultiWithTx(info *w.MiddlewareInfo, keys []w.Key) error {
+	if mw, info := b.next(); mw != nil {
+		return mw.DeleteMultiWithTx(info, keys)
+	}
+	return toWrapperError(b.tx.tx.DeleteMulti(toOriginalKeys(keys)))
+}
+
+func (b *bridge) PostCommit(info *w.MiddlewareInfo, tx w.Transaction, commit w.Commit) error {
+	if mw, info := b.next(); mw != nil {
+		return mw.PostCommit(info, tx, commit)
+	}
+	return nil
+}
+
+func (b *bridge) PostRollback(info *w.MiddlewareInfo, tx w.Transaction) error {
+	if mw, info := b.next(); mw != nil {
+		return mw.PostRollback(info, tx)
+	}
+	return nil
+}
+
+func (b *bridge) Run(info *w.MiddlewareInfo, q w.Query, qDump *w.QueryDump) w.Iterator {
+	if mw, info := b.next(); mw != nil {
+		return mw.Run(info, q, qDump)
+	}
+	qImpl := q.(*queryImpl)
+	return &iteratorImpl{
+		client: b.d,
+		q:      qImpl,
+		qDump:  qDump,
+		t:      b.d.client.Run(info.Context, qImpl.q),
+		info: &w.MiddlewareInfo{
+			Context:     info.Context,
+			Client:      b.d,
+			Transaction: qDump.Transaction,
+		},
+		firstError: qImpl.firstError,
+	}
+}
+
+func (b *bridge) GetAll(info *w.MiddlewareInfo, q w.Query, qDump *w.QueryDump, psList *[]w.PropertyList) ([]w.Key, error) {
+	if mw, info := b.next(); mw != nil {
+		return mw.GetAll(info, q, qDump, psList)
+	}
+	qImpl, ok := q.(*queryImpl)
+	if !ok {
+		return nil, errors.New("invalid query type")
+	}
+	if qImpl.firstError != nil {
+		return nil, qImpl.firstError
+	}
+	var origPss []datastore.PropertyList
+	var dst interface{}
+	if !qDump.KeysOnly {
+		dst = &origPss
+	}
+	origKeys, err := b.d.client.GetAll(info.Context, qImpl.q, dst)
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	if !qDump.KeysOnly {
+		*psList = toWrapperPropertyListList(origPss)
+	}
+	return toWrapperKeys(origKeys), nil
+}
+
+func (b *bridge) Next(info *w.MiddlewareInfo, q w.Query, qDump *w.QueryDump, iter w.Iterator, ps *w.PropertyList) (w.Key, error) {
+	if mw, info := b.next(); mw != nil {
+		return mw.Next(info, q, qDump, iter, ps)
+	}
+	iterImpl := iter.(*iteratorImpl)
+	var origPs datastore.PropertyList
+	var dst interface{}
+	if !qDump.KeysOnly {
+		dst = &origPs
+	}
+	origKey, err := iterImpl.t.Next(dst)
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	if !qDump.KeysOnly {
+		*ps = toWrapperPropertyList(origPs)
+	}
+	return toWrapperKey(origKey), nil
+}
+
+func (b *bridge) Count(info *w.MiddlewareInfo, q w.Query, qDump *w.QueryDump) (int, error) {
+	if mw, info := b.next(); mw != nil {
+		return mw.Count(info, q, qDump)
+	}
+	qImpl, ok := q.(*queryImpl)
+	if !ok {
+		return 0, errors.New("invalid query type")
+	}
+	if qImpl.firstError != nil {
+		return 0, qImpl.firstError
+	}
+	count, err := b.d.client.Count(info.Context, qImpl.q)
+	return count, toWrapperError(err)
+}
+
+// getMultiOps is opsで読み込んだPropertyListをdstにLoadする
+func getMultiOps(ctx context.Context, keys []w.Key, dst interface{}, ops func(keys []w.Key, psList []w.PropertyList) error) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Slice {
+		return errors.New("datastore: dst has invalid type")
+	}
+	if len(keys) != v.Len() {
+		return errors.New("datastore: keys and dst slices have different length")
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	psList := make([]w.PropertyList, len(keys))
+	err := ops(keys, psList)
+	merr, catchMerr := err.(w.MultiError)
+	if catchMerr {
+		if len(merr) != len(keys) {
+			panic(fmt.Sprintf("unexpected merr length: %d, expected: %d", len(merr), len(keys)))
+		}
+	} else if err != nil {
+		return err
+	} else {
+		merr = make(w.MultiError, len(keys))
+	}
+
+	foundError := false
+	elemType := v.Type().Elem()
+	for i := range keys {
+		if merr[i] != nil {
+			foundError = true
+			continue
+		}
+		elem := v.Index(i)
+		if reflect.PtrTo(elemType).Implements(typeOfPropertyLoadSaver) || elemType.Kind() == reflect.Struct {
+			elem = elem.Addr()
+		} else if elemType.Kind() == reflect.Ptr && elemType.Elem().Kind() == reflect.Struct && elem.IsNil() {
+			elem.Set(reflect.New(elemType.Elem()))
+		}
+		if err := w.LoadEntity(ctx, elem.Interface(), &w.Entity{Key: keys[i], Properties: psList[i]}); err != nil {
+			merr[i] = err
+			foundError = true
+		}
+	}
+	if foundError {
+		return merr
+	}
+	return nil
+}
+
+// putMultiOps is srcの各要素をPropertyListにSaveする
+func putMultiOps(ctx context.Context, keys []w.Key, src interface{}) ([]w.PropertyList, error) {
+	v := reflect.ValueOf(src)
+	if v.Kind() != reflect.Slice {
+		return nil, errors.New("datastore: src has invalid type")
+	}
+	if len(keys) != v.Len() {
+		return nil, errors.New("datastore: key and src slices have different length")
+	}
+
+	var psList []w.PropertyList
+	for i, key := range keys {
+		elem := v.Index(i)
+		if reflect.PtrTo(elem.Type()).Implements(typeOfPropertyLoadSaver) || elem.Type().Kind() == reflect.Struct {
+			elem = elem.Addr()
+		}
+		e, err := w.SaveEntity(ctx, key, elem.Interface())
+		if err != nil {
+			return nil, err
+		}
+		psList = append(psList, e.Properties)
+	}
+	return psList, nil
+}
+
+// nextOps is opsで読み込んだPropertyListをdstにLoadする. KeysOnlyのQueryではLoadしない
+func nextOps(ctx context.Context, qDump *w.QueryDump, dst interface{}, ops func(ps *w.PropertyList) (w.Key, error)) (w.Key, error) {
+	var ps w.PropertyList
+	key, err := ops(&ps)
+	if err != nil {
+		return nil, err
+	}
+	if !qDump.KeysOnly {
+		if err := w.LoadEntity(ctx, dst, &w.Entity{Key: key, Properties: ps}); err != nil {
+			return key, err
+		}
+	}
+	return key, nil
+}
+
+// getAllOps is opsで読み込んだPropertyListをdstのSliceに追加する. KeysOnlyのQueryではdstを使わない
+func getAllOps(ctx context.Context, qDump *w.QueryDump, dst interface{}, ops func(psList *[]w.PropertyList) ([]w.Key, error)) ([]w.Key, error) {
+	var dv reflect.Value
+	var elemType reflect.Type
+	var isPtrStruct bool
+	if !qDump.KeysOnly {
+		dv = reflect.ValueOf(dst)
+		if dv.Kind() != reflect.Ptr || dv.IsNil() {
+			return nil, w.ErrInvalidEntityType
+		}
+		dv = dv.Elem()
+		if dv.Kind() != reflect.Slice || dv.Type() == typeOfPropertyList {
+			return nil, w.ErrInvalidEntityType
+		}
+		elemType = dv.Type().Elem()
+		if !reflect.PtrTo(elemType).Implements(typeOfPropertyLoadSaver) && elemType.Kind() == reflect.Ptr {
+			isPtrStruct = true
+			elemType = elemType.Elem()
+			if elemType.Kind() != reflect.Struct {
+				return nil, w.ErrInvalidEntityType
+			}
+		}
+	}
+
+	var psList []w.PropertyList
+	keys, err := ops(&psList)
+	if err != nil {
+		return nil, err
+	}
+	if !qDump.KeysOnly {
+		for i, ps := range psList {
+			elem := reflect.New(elemType)
+			if err := w.LoadEntity(ctx, elem.Interface(), &w.Entity{Key: keys[i], Properties: ps}); err != nil {
+				return nil, err
+			}
+			if !isPtrStruct {
+				elem = elem.Elem()
+			}
+			dv.Set(reflect.Append(dv, elem))
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,218 @@
+// Package clouddatastore is cloud.google.com/go/datastoreを go.mercari.io/datastore のClientとして使うAdapter
+// App Engine以外で動かすgcpsm-serverが利用する. aedatastoreと同じくMiddlewareをサポートする
+package clouddatastore
+
+import (
+	"context"
+	"encoding/gob"
+
+	"cloud.google.com/go/datastore"
+	w "go.mercari.io/datastore"
+	"google.golang.org/api/option"
+)
+
+func init() {
+	gob.Register(&keyImpl{})
+}
+
+var _ w.Client = (*datastoreImpl)(nil)
+
+type datastoreImpl struct {
+	ctx         context.Context
+	client      *datastore.Client
+	middlewares []w.Middleware
+}
+
+// NewClient is Cloud Datastore Clientを作成する
+// DATASTORE_EMULATOR_HOSTが設定されていればEmulatorに接続する. projectIDが空の場合はDATASTORE_PROJECT_IDを使う
+func NewClient(ctx context.Context, projectID string, opts ...option.ClientOption) (w.Client, error) {
+	if ctx == nil {
+		panic("ctx can't be nil")
+	}
+	client, err := datastore.NewClient(ctx, projectID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &datastoreImpl{ctx: ctx, client: client}, nil
+}
+
+// IsCloudDatastoreClient is clientがNewClientで作成したClientかどうかを返す
+func IsCloudDatastoreClient(client w.Client) bool {
+	_, ok := client.(*datastoreImpl)
+	return ok
+}
+
+func (d *datastoreImpl) Get(ctx context.Context, key w.Key, dst interface{}) error {
+	err := d.GetMulti(ctx, []w.Key{key}, []interface{}{dst})
+	if merr, ok := err.(w.MultiError); ok {
+		return merr[0]
+	}
+	return err
+}
+
+func (d *datastoreImpl) GetMulti(ctx context.Context, keys []w.Key, dst interface{}) error {
+	info := &w.MiddlewareInfo{Context: ctx, Client: d}
+	b := newBridge(info, d, nil, nil)
+	return getMultiOps(ctx, keys, dst, func(keys []w.Key, psList []w.PropertyList) error {
+		return b.GetMultiWithoutTx(info, keys, psList)
+	})
+}
+
+func (d *datastoreImpl) Put(ctx context.Context, key w.Key, src interface{}) (w.Key, error) {
+	keys, err := d.PutMulti(ctx, []w.Key{key}, []interface{}{src})
+	if merr, ok := err.(w.MultiError); ok {
+		return nil, merr[0]
+	} else if err != nil {
+		return nil, err
+	}
+	return keys[0], nil
+}
+
+func (d *datastoreImpl) PutMulti(ctx context.Context, keys []w.Key, src interface{}) ([]w.Key, error) {
+	info := &w.MiddlewareInfo{Context: ctx, Client: d}
+	b := newBridge(info, d, nil, nil)
+	psList, err := putMultiOps(ctx, keys, src)
+	if err != nil || len(psList) == 0 {
+		return nil, err
+	}
+	return b.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (d *datastoreImpl) Delete(ctx context.Context, key w.Key) error {
+	err := d.DeleteMulti(ctx, []w.Key{key})
+	if merr, ok := err.(w.MultiError); ok {
+		return merr[0]
+	}
+	return err
+}
+
+func (d *datastoreImpl) DeleteMulti(ctx context.Context, keys []w.Key) error {
+	info := &w.MiddlewareInfo{Context: ctx, Client: d}
+	b := newBridge(info, d, nil, nil)
+	return b.DeleteMultiWithoutTx(info, keys)
+}
+
+func (d *datastoreImpl) NewTransaction(ctx context.Context) (w.Transaction, error) {
+	tx, err := d.client.NewTransaction(ctx)
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	txImpl := &transactionImpl{
+		client: &datastoreImpl{ctx: ctx, client: d.client, middlewares: d.middlewares},
+		tx:     tx,
+	}
+	txImpl.info = &w.MiddlewareInfo{Context: ctx, Client: d, Transaction: txImpl}
+	return txImpl, nil
+}
+
+// RunInTransaction is fをTransactionの中で実行する
+// aedatastoreと同じく自動ではRetryしない. ErrConcurrentTransactionを受け取ったら呼び出し側でRetryする
+func (d *datastoreImpl) RunInTransaction(ctx context.Context, f func(tx w.Transaction) error) (w.Commit, error) {
+	tx, err := d.NewTransaction(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := f(tx); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return nil, rerr
+		}
+		return nil, err
+	}
+	return tx.Commit()
+}
+
+func (d *datastoreImpl) Run(ctx context.Context, q w.Query) w.Iterator {
+	info := &w.MiddlewareInfo{Context: ctx, Client: d}
+	b := newBridge(info, d, nil, nil)
+	return b.Run(info, q, q.Dump())
+}
+
+func (d *datastoreImpl) AllocateIDs(ctx context.Context, keys []w.Key) ([]w.Key, error) {
+	info := &w.MiddlewareInfo{Context: ctx, Client: d}
+	b := newBridge(info, d, nil, nil)
+	return b.AllocateIDs(info, keys)
+}
+
+func (d *datastoreImpl) Count(ctx context.Context, q w.Query) (int, error) {
+	info := &w.MiddlewareInfo{Context: ctx, Client: d}
+	b := newBridge(info, d, nil, nil)
+	return b.Count(info, q, q.Dump())
+}
+
+func (d *datastoreImpl) GetAll(ctx context.Context, q w.Query, dst interface{}) ([]w.Key, error) {
+	qDump := q.Dump()
+	info := &w.MiddlewareInfo{Context: ctx, Client: d, Transaction: qDump.Transaction}
+	b := newBridge(info, d, nil, nil)
+	return getAllOps(ctx, qDump, dst, func(psList *[]w.PropertyList) ([]w.Key, error) {
+		return b.GetAll(info, q, qDump, psList)
+	})
+}
+
+func (d *datastoreImpl) IncompleteKey(kind string, parent w.Key) w.Key {
+	return newKey(kind, "", 0, parent)
+}
+
+func (d *datastoreImpl) NameKey(kind, name string, parent w.Key) w.Key {
+	return newKey(kind, name, 0, parent)
+}
+
+func (d *datastoreImpl) IDKey(kind string, id int64, parent w.Key) w.Key {
+	return newKey(kind, "", id, parent)
+}
+
+func (d *datastoreImpl) NewQuery(kind string) w.Query {
+	return &queryImpl{ctx: d.ctx, q: datastore.NewQuery(kind), dump: &w.QueryDump{Kind: kind}}
+}
+
+func (d *datastoreImpl) Close() error {
+	return d.client.Close()
+}
+
+func (d *datastoreImpl) DecodeKey(encoded string) (w.Key, error) {
+	key, err := datastore.DecodeKey(encoded)
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	return toWrapperKey(key), nil
+}
+
+func (d *datastoreImpl) DecodeCursor(s string) (w.Cursor, error) {
+	cur, err := datastore.DecodeCursor(s)
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	return &cursorImpl{cursor: cur}, nil
+}
+
+func (d *datastoreImpl) Batch() *w.Batch {
+	return &w.Batch{Client: d}
+}
+
+func (d *datastoreImpl) AppendMiddleware(mw w.Middleware) {
+	d.middlewares = append(d.middlewares, mw)
+}
+
+func (d *datastoreImpl) RemoveMiddleware(mw w.Middleware) bool {
+	list := make([]w.Middleware, 0, len(d.middlewares))
+	found := false
+	for _, old := range d.middlewares {
+		if old == mw {
+			found = true
+			continue
+		}
+		list = append(list, old)
+	}
+	d.middlewares = list
+	return found
+}
+
+func (d *datastoreImpl) Context() context.Context {
+	return d.ctx
+}
+
+func (d *datastoreImpl) SetContext(ctx context.Context) {
+	if ctx == nil {
+		panic("ctx can't be nil")
+	}
+	d.ctx = ctx
+}
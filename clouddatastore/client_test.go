@@ -0,0 +1,432 @@
+package clouddatastore
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	w "go.mercari.io/datastore"
+	pb "google.golang.org/genproto/googleapis/datastore/v1"
+	"google.golang.org/grpc"
+)
+
+// fakeDatastoreServer is Datastore EmulatorのかわりにTestで使うgRPC Server
+// QueryはKindとNamespaceだけで絞り込み、Filterは無視する
+type fakeDatastoreServer struct {
+	mu       sync.Mutex
+	entities map[string]*pb.Entity
+	lastID   int64
+	commits  int
+}
+
+func (s *fakeDatastoreServer) keyString(k *pb.Key) string {
+	return proto.CompactTextString(k)
+}
+
+func (s *fakeDatastoreServer) completeKey(k *pb.Key) *pb.Key {
+	k = proto.Clone(k).(*pb.Key)
+	last := k.Path[len(k.Path)-1]
+	if last.IdType == nil {
+		s.lastID++
+		last.IdType = &pb.Key_PathElement_Id{Id: s.lastID}
+	}
+	return k
+}
+
+func (s *fakeDatastoreServer) Lookup(ctx context.Context, req *pb.LookupRequest) (*pb.LookupResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &pb.LookupResponse{}
+	for _, k := range req.Keys {
+		if e, ok := s.entities[s.keyString(k)]; ok {
+			resp.Found = append(resp.Found, &pb.EntityResult{Entity: e, Version: 1})
+		} else {
+			resp.Missing = append(resp.Missing, &pb.EntityResult{Entity: &pb.Entity{Key: k}, Version: 1})
+		}
+	}
+	return resp, nil
+}
+
+func (s *fakeDatastoreServer) RunQuery(ctx context.Context, req *pb.RunQueryRequest) (*pb.RunQueryResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := req.GetQuery()
+	keysOnly := len(q.Projection) == 1 && q.Projection[0].Property.Name == "__key__"
+	var names []string
+	for name, e := range s.entities {
+		path := e.Key.Path
+		if path[len(path)-1].Kind != q.Kind[0].Name || e.Key.PartitionId.GetNamespaceId() != req.PartitionId.GetNamespaceId() {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	batch := &pb.QueryResultBatch{EntityResultType: pb.EntityResult_FULL, MoreResults: pb.QueryResultBatch_NO_MORE_RESULTS}
+	if keysOnly {
+		batch.EntityResultType = pb.EntityResult_KEY_ONLY
+	}
+	for _, name := range names {
+		e := s.entities[name]
+		if keysOnly {
+			e = &pb.Entity{Key: e.Key}
+		}
+		batch.EntityResults = append(batch.EntityResults, &pb.EntityResult{Entity: e, Version: 1, Cursor: []byte(name)})
+	}
+	return &pb.RunQueryResponse{Batch: batch, Query: q}, nil
+}
+
+func (s *fakeDatastoreServer) BeginTransaction(ctx context.Context, req *pb.BeginTransactionRequest) (*pb.BeginTransactionResponse, error) {
+	return &pb.BeginTransactionResponse{Transaction: []byte("tx")}, nil
+}
+
+func (s *fakeDatastoreServer) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commits++
+	resp := &pb.CommitResponse{}
+	for _, m := range req.Mutations {
+		var e *pb.Entity
+		switch op := m.Operation.(type) {
+		case *pb.Mutation_Insert:
+			e = op.Insert
+		case *pb.Mutation_Update:
+			e = op.Update
+		case *pb.Mutation_Upsert:
+			e = op.Upsert
+		case *pb.Mutation_Delete:
+			delete(s.entities, s.keyString(op.Delete))
+			resp.MutationResults = append(resp.MutationResults, &pb.MutationResult{})
+			continue
+		}
+		e = proto.Clone(e).(*pb.Entity)
+		incomplete := e.Key.Path[len(e.Key.Path)-1].IdType == nil
+		e.Key = s.completeKey(e.Key)
+		s.entities[s.keyString(e.Key)] = e
+		r := &pb.MutationResult{Version: 1}
+		if incomplete {
+			r.Key = e.Key
+		}
+		resp.MutationResults = append(resp.MutationResults, r)
+	}
+	return resp, nil
+}
+
+func (s *fakeDatastoreServer) Rollback(ctx context.Context, req *pb.RollbackRequest) (*pb.RollbackResponse, error) {
+	return &pb.RollbackResponse{}, nil
+}
+
+func (s *fakeDatastoreServer) AllocateIds(ctx context.Context, req *pb.AllocateIdsRequest) (*pb.AllocateIdsResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp := &pb.AllocateIdsResponse{}
+	for _, k := range req.Keys {
+		resp.Keys = append(resp.Keys, s.completeKey(k))
+	}
+	return resp, nil
+}
+
+func (s *fakeDatastoreServer) ReserveIds(ctx context.Context, req *pb.ReserveIdsRequest) (*pb.ReserveIdsResponse, error) {
+	return &pb.ReserveIdsResponse{}, nil
+}
+
+// newTestClient is fakeDatastoreServerを起動し、DATASTORE_EMULATOR_HOSTで接続したClientを返す
+func newTestClient(t *testing.T) (w.Client, *fakeDatastoreServer) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := &fakeDatastoreServer{entities: map[string]*pb.Entity{}}
+	srv := grpc.NewServer()
+	pb.RegisterDatastoreServer(srv, fake)
+	go srv.Serve(lis)
+	t.Cleanup(srv.Stop)
+
+	org, ok := os.LookupEnv("DATASTORE_EMULATOR_HOST")
+	os.Setenv("DATASTORE_EMULATOR_HOST", lis.Addr().String())
+	defer func() {
+		if ok {
+			os.Setenv("DATASTORE_EMULATOR_HOST", org)
+		} else {
+			os.Unsetenv("DATASTORE_EMULATOR_HOST")
+		}
+	}()
+	client, err := NewClient(context.Background(), "test-project")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, fake
+}
+
+type testSecret struct {
+	Value     string    `datastore:",noindex"`
+	Tags      []string
+	Version   int
+	Owner     w.Key
+	UpdatedAt time.Time
+	Location  w.GeoPoint
+}
+
+// countingMiddleware is 呼び出されたMiddlewareの操作を記録する
+type countingMiddleware struct {
+	ops []string
+}
+
+func (m *countingMiddleware) AllocateIDs(info *w.MiddlewareInfo, keys []w.Key) ([]w.Key, error) {
+	m.ops = append(m.ops, "AllocateIDs")
+	return info.Next.AllocateIDs(info, keys)
+}
+
+func (m *countingMiddleware) PutMultiWithoutTx(info *w.MiddlewareInfo, keys []w.Key, psList []w.PropertyList) ([]w.Key, error) {
+	m.ops = append(m.ops, "Put")
+	return info.Next.PutMultiWithoutTx(info, keys, psList)
+}
+
+func (m *countingMiddleware) PutMultiWithTx(info *w.MiddlewareInfo, keys []w.Key, psList []w.PropertyList) ([]w.PendingKey, error) {
+	m.ops = append(m.ops, "TxPut")
+	return info.Next.PutMultiWithTx(info, keys, psList)
+}
+
+func (m *countingMiddleware) GetMultiWithoutTx(info *w.MiddlewareInfo, keys []w.Key, psList []w.PropertyList) error {
+	m.ops = append(m.ops, "Get")
+	return info.Next.GetMultiWithoutTx(info, keys, psList)
+}
+
+func (m *countingMiddleware) GetMultiWithTx(info *w.MiddlewareInfo, keys []w.Key, psList []w.PropertyList) error {
+	m.ops = append(m.ops, "TxGet")
+	return info.Next.GetMultiWithTx(info, keys, psList)
+}
+
+func (m *countingMiddleware) DeleteMultiWithoutTx(info *w.MiddlewareInfo, keys []w.Key) error {
+	m.ops = append(m.ops, "Delete")
+	return info.Next.DeleteMultiWithoutTx(info, keys)
+}
+
+func (m *countingMiddleware) DeleteMultiWithTx(info *w.MiddlewareInfo, keys []w.Key) error {
+	m.ops = append(m.ops, "TxDelete")
+	return info.Next.DeleteMultiWithTx(info, keys)
+}
+
+func (m *countingMiddleware) PostCommit(info *w.MiddlewareInfo, tx w.Transaction, commit w.Commit) error {
+	m.ops = append(m.ops, "PostCommit")
+	return info.Next.PostCommit(info, tx, commit)
+}
+
+func (m *countingMiddleware) PostRollback(info *w.MiddlewareInfo, tx w.Transaction) error {
+	m.ops = append(m.ops, "PostRollback")
+	return info.Next.PostRollback(info, tx)
+}
+
+func (m *countingMiddleware) Run(info *w.MiddlewareInfo, q w.Query, qDump *w.QueryDump) w.Iterator {
+	m.ops = append(m.ops, "Run")
+	return info.Next.Run(info, q, qDump)
+}
+
+func (m *countingMiddleware) GetAll(info *w.MiddlewareInfo, q w.Query, qDump *w.QueryDump, psList *[]w.PropertyList) ([]w.Key, error) {
+	m.ops = append(m.ops, "GetAll")
+	return info.Next.GetAll(info, q, qDump, psList)
+}
+
+func (m *countingMiddleware) Next(info *w.MiddlewareInfo, q w.Query, qDump *w.QueryDump, iter w.Iterator, ps *w.PropertyList) (w.Key, error) {
+	m.ops = append(m.ops, "Next")
+	return info.Next.Next(info, q, qDump, iter, ps)
+}
+
+func (m *countingMiddleware) Count(info *w.MiddlewareInfo, q w.Query, qDump *w.QueryDump) (int, error) {
+	m.ops = append(m.ops, "Count")
+	return info.Next.Count(info, q, qDump)
+}
+
+func TestPutGetDelete(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+
+	owner := client.NameKey("User", "alice", nil)
+	owner.SetNamespace("tenant-a")
+	key := client.NameKey("Secret", "app/db", owner)
+	key.SetNamespace("tenant-a")
+	src := &testSecret{
+		Value:     "ciphertext",
+		Tags:      []string{"db", "prod"},
+		Version:   3,
+		Owner:     owner,
+		UpdatedAt: time.Date(2018, 4, 1, 12, 0, 0, 0, time.UTC),
+		Location:  w.GeoPoint{Lat: 35.6, Lng: 139.7},
+	}
+	if _, err := client.Put(ctx, key, src); err != nil {
+		t.Fatal(err)
+	}
+
+	got := &testSecret{}
+	if err := client.Get(ctx, key, got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.UpdatedAt.Equal(src.UpdatedAt) {
+		t.Errorf("UpdatedAt: got %v, want %v", got.UpdatedAt, src.UpdatedAt)
+	}
+	got.UpdatedAt = src.UpdatedAt
+	if !got.Owner.Equal(owner) {
+		t.Errorf("Owner: got %v, want %v", got.Owner, owner)
+	}
+	got.Owner = owner
+	if !reflect.DeepEqual(got, src) {
+		t.Errorf("got %+v, want %+v", got, src)
+	}
+
+	// 別のNamespaceの同じKeyは別のEntity
+	other := client.NameKey("Secret", "app/db", nil)
+	if err := client.Get(ctx, other, &testSecret{}); err != w.ErrNoSuchEntity {
+		t.Errorf("unexpected error of another namespace: %v", err)
+	}
+
+	list := make([]*testSecret, 2)
+	err := client.GetMulti(ctx, []w.Key{key, other}, list)
+	merr, ok := err.(w.MultiError)
+	if !ok || merr[0] != nil || merr[1] != w.ErrNoSuchEntity {
+		t.Fatalf("unexpected error of GetMulti: %v", err)
+	}
+	if list[0].Value != "ciphertext" {
+		t.Errorf("unexpected value of GetMulti: %+v", list[0])
+	}
+
+	if err := client.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Get(ctx, key, &testSecret{}); err != w.ErrNoSuchEntity {
+		t.Errorf("entity is not deleted: %v", err)
+	}
+}
+
+func TestTransaction(t *testing.T) {
+	ctx := context.Background()
+	client, fake := newTestClient(t)
+	mw := &countingMiddleware{}
+	client.AppendMiddleware(mw)
+
+	key := client.NameKey("Secret", "app/db", nil)
+	if _, err := client.Put(ctx, key, &testSecret{Value: "v1", Version: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	var pKey w.PendingKey
+	commit, err := client.RunInTransaction(ctx, func(tx w.Transaction) error {
+		cur := &testSecret{}
+		if err := tx.Get(key, cur); err != nil {
+			return err
+		}
+		cur.Value = "v2"
+		cur.Version++
+		if _, err := tx.Put(key, cur); err != nil {
+			return err
+		}
+		var err error
+		pKey, err = tx.Put(client.IncompleteKey("SecretHistory", key), &testSecret{Value: "v1", Version: 1})
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := commit.Key(pKey)
+	if history == nil || history.Incomplete() || !history.ParentKey().Equal(key) {
+		t.Errorf("unexpected key of the pending key: %v", history)
+	}
+
+	got := &testSecret{}
+	if err := client.Get(ctx, key, got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Value != "v2" || got.Version != 2 {
+		t.Errorf("transaction is not committed: %+v", got)
+	}
+
+	commits := fake.commits
+	_, err = client.RunInTransaction(ctx, func(tx w.Transaction) error {
+		if err := tx.Delete(key); err != nil {
+			return err
+		}
+		return fmt.Errorf("abort")
+	})
+	if err == nil || err.Error() != "abort" {
+		t.Errorf("unexpected error of rolled back transaction: %v", err)
+	}
+	if fake.commits != commits {
+		t.Error("rolled back transaction is committed")
+	}
+
+	want := []string{"Put", "TxGet", "TxPut", "TxPut", "PostCommit", "Get", "TxDelete", "PostRollback"}
+	if !reflect.DeepEqual(mw.ops, want) {
+		t.Errorf("middleware: got %v, want %v", mw.ops, want)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	ctx := context.Background()
+	client, _ := newTestClient(t)
+
+	var keys []w.Key
+	var src []*testSecret
+	for i := 1; i <= 3; i++ {
+		k := client.NameKey("Secret", fmt.Sprintf("app/%d", i), nil)
+		k.SetNamespace("tenant-a")
+		keys = append(keys, k)
+		src = append(src, &testSecret{Value: fmt.Sprintf("v%d", i), Version: i})
+	}
+	if _, err := client.PutMulti(ctx, keys, src); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Put(ctx, client.NameKey("Secret", "app/other", nil), &testSecret{}); err != nil {
+		t.Fatal(err)
+	}
+
+	q := client.NewQuery("Secret").Namespace("tenant-a")
+	var list []*testSecret
+	got, err := client.GetAll(ctx, q, &list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || len(list) != 3 {
+		t.Fatalf("unexpected result: keys=%v, list=%v", got, list)
+	}
+	for i := range got {
+		if !got[i].Equal(keys[i]) || list[i].Value != src[i].Value {
+			t.Errorf("unexpected entity %d: %v %+v", i, got[i], list[i])
+		}
+	}
+
+	got, err = client.GetAll(ctx, q.KeysOnly(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 3 || got[0].Namespace() != "tenant-a" {
+		t.Errorf("unexpected keys: %v", got)
+	}
+
+	n, err := client.Count(ctx, q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("count: got %d, want 3", n)
+	}
+
+	iter := client.Run(ctx, q)
+	var values []string
+	for {
+		s := &testSecret{}
+		if _, err := iter.Next(s); err != nil {
+			break
+		}
+		values = append(values, s.Value)
+	}
+	if g, e := fmt.Sprint(values), "[v1 v2 v3]"; g != e {
+		t.Errorf("run: got %s, want %s", g, e)
+	}
+}
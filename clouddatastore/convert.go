@@ -0,0 +1,268 @@
+package clouddatastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	w "go.mercari.io/datastore"
+)
+
+func toOriginalKey(key w.Key) *datastore.Key {
+	if key == nil {
+		return nil
+	}
+	k := key.(*keyImpl)
+	if k == nil {
+		return nil
+	}
+	return &datastore.Key{
+		Kind:      k.kind,
+		ID:        k.id,
+		Name:      k.name,
+		Parent:    toOriginalKey(k.ParentKey()),
+		Namespace: k.namespace,
+	}
+}
+
+func toOriginalKeys(keys []w.Key) []*datastore.Key {
+	if keys == nil {
+		return nil
+	}
+	origKeys := make([]*datastore.Key, len(keys))
+	for i, key := range keys {
+		origKeys[i] = toOriginalKey(key)
+	}
+	return origKeys
+}
+
+func toWrapperKey(key *datastore.Key) *keyImpl {
+	if key == nil {
+		return nil
+	}
+	return &keyImpl{
+		kind:      key.Kind,
+		id:        key.ID,
+		name:      key.Name,
+		parent:    toWrapperKey(key.Parent),
+		namespace: key.Namespace,
+	}
+}
+
+func toWrapperKeys(keys []*datastore.Key) []w.Key {
+	if keys == nil {
+		return nil
+	}
+	wKeys := make([]w.Key, len(keys))
+	for i, key := range keys {
+		// nilの*keyImplをw.Keyに入れるとnilと比較できなくなる
+		if key != nil {
+			wKeys[i] = toWrapperKey(key)
+		}
+	}
+	return wKeys
+}
+
+func toOriginalPendingKey(pKey w.PendingKey) *datastore.PendingKey {
+	if pKey == nil {
+		return nil
+	}
+	pk, ok := pKey.StoredContext().Value(contextPendingKey{}).(*pendingKeyImpl)
+	if !ok || pk == nil {
+		return nil
+	}
+	return pk.key
+}
+
+func toWrapperPendingKeys(ctx context.Context, keys []*datastore.PendingKey) []w.PendingKey {
+	if keys == nil {
+		return nil
+	}
+	wKeys := make([]w.PendingKey, len(keys))
+	for i, key := range keys {
+		wKeys[i] = &pendingKeyImpl{ctx: ctx, key: key}
+	}
+	return wKeys
+}
+
+func toWrapperError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	switch err {
+	case datastore.ErrNoSuchEntity:
+		return w.ErrNoSuchEntity
+	case datastore.ErrConcurrentTransaction:
+		return w.ErrConcurrentTransaction
+	case datastore.ErrInvalidEntityType:
+		return w.ErrInvalidEntityType
+	case datastore.ErrInvalidKey:
+		return w.ErrInvalidKey
+	}
+
+	switch err := err.(type) {
+	case *datastore.ErrFieldMismatch:
+		return &w.ErrFieldMismatch{
+			StructType: err.StructType,
+			FieldName:  err.FieldName,
+			Reason:     err.Reason,
+		}
+	case datastore.MultiError:
+		merr := make(w.MultiError, len(err))
+		for i, e := range err {
+			merr[i] = toWrapperError(e)
+		}
+		return merr
+	}
+	return err
+}
+
+// toOriginalValue is go.mercari.io/datastoreのPropertyの値をcloud.google.com/go/datastoreの値にする
+func toOriginalValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case []interface{}:
+		origVs := make([]interface{}, 0, len(v))
+		for _, v := range v {
+			origV, err := toOriginalValue(v)
+			if err != nil {
+				return nil, err
+			}
+			origVs = append(origVs, origV)
+		}
+		return origVs, nil
+
+	case w.Key:
+		if k := toOriginalKey(v); k != nil {
+			return k, nil
+		}
+		return nil, nil
+	case []w.Key:
+		origVs := make([]interface{}, 0, len(v))
+		for _, k := range v {
+			origVs = append(origVs, toOriginalKey(k))
+		}
+		return origVs, nil
+
+	case w.GeoPoint:
+		return datastore.GeoPoint{Lat: v.Lat, Lng: v.Lng}, nil
+	case []w.GeoPoint:
+		origVs := make([]interface{}, 0, len(v))
+		for _, g := range v {
+			origVs = append(origVs, datastore.GeoPoint{Lat: g.Lat, Lng: g.Lng})
+		}
+		return origVs, nil
+
+	case *w.Entity:
+		return toOriginalEntity(v)
+	case []*w.Entity:
+		origVs := make([]interface{}, 0, len(v))
+		for _, e := range v {
+			origE, err := toOriginalEntity(e)
+			if err != nil {
+				return nil, err
+			}
+			origVs = append(origVs, origE)
+		}
+		return origVs, nil
+
+	default:
+		return v, nil
+	}
+}
+
+func toOriginalEntity(e *w.Entity) (*datastore.Entity, error) {
+	if e == nil {
+		return nil, nil
+	}
+	ps, err := toOriginalPropertyList(e.Properties)
+	if err != nil {
+		return nil, err
+	}
+	return &datastore.Entity{Key: toOriginalKey(e.Key), Properties: ps}, nil
+}
+
+// toWrapperValue is cloud.google.com/go/datastoreの値をgo.mercari.io/datastoreのPropertyの値にする
+func toWrapperValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		wVs := make([]interface{}, 0, len(v))
+		for _, v := range v {
+			wVs = append(wVs, toWrapperValue(v))
+		}
+		return wVs
+
+	case *datastore.Key:
+		if v == nil {
+			return nil
+		}
+		return toWrapperKey(v)
+
+	case datastore.GeoPoint:
+		return w.GeoPoint{Lat: v.Lat, Lng: v.Lng}
+
+	case *datastore.Entity:
+		if v == nil {
+			return nil
+		}
+		e := &w.Entity{Properties: toWrapperPropertyList(v.Properties)}
+		if v.Key != nil {
+			e.Key = toWrapperKey(v.Key)
+		}
+		return e
+
+	default:
+		return v
+	}
+}
+
+func toOriginalPropertyList(ps []w.Property) (datastore.PropertyList, error) {
+	if ps == nil {
+		return nil, nil
+	}
+	origPs := make(datastore.PropertyList, 0, len(ps))
+	for _, p := range ps {
+		v, err := toOriginalValue(p.Value)
+		if err != nil {
+			return nil, err
+		}
+		origPs = append(origPs, datastore.Property{Name: p.Name, Value: v, NoIndex: p.NoIndex})
+	}
+	return origPs, nil
+}
+
+func toOriginalPropertyListList(pss []w.PropertyList) ([]datastore.PropertyList, error) {
+	if pss == nil {
+		return nil, nil
+	}
+	origPss := make([]datastore.PropertyList, 0, len(pss))
+	for _, ps := range pss {
+		origPs, err := toOriginalPropertyList(ps)
+		if err != nil {
+			return nil, err
+		}
+		origPss = append(origPss, origPs)
+	}
+	return origPss, nil
+}
+
+func toWrapperPropertyList(ps []datastore.Property) w.PropertyList {
+	if ps == nil {
+		return nil
+	}
+	wPs := make(w.PropertyList, 0, len(ps))
+	for _, p := range ps {
+		wPs = append(wPs, w.Property{Name: p.Name, Value: toWrapperValue(p.Value), NoIndex: p.NoIndex})
+	}
+	return wPs
+}
+
+func toWrapperPropertyListList(pss []datastore.PropertyList) []w.PropertyList {
+	if pss == nil {
+		return nil
+	}
+	wPss := make([]w.PropertyList, 0, len(pss))
+	for _, ps := range pss {
+		wPss = append(wPss, toWrapperPropertyList(ps))
+	}
+	return wPss
+}
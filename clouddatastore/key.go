@@ -0,0 +1,121 @@
+package clouddatastore
+
+import (
+	"context"
+
+	"cloud.google.com/go/datastore"
+	w "go.mercari.io/datastore"
+)
+
+var _ w.Key = (*keyImpl)(nil)
+var _ w.PendingKey = (*pendingKeyImpl)(nil)
+
+type keyImpl struct {
+	kind      string
+	id        int64
+	name      string
+	parent    *keyImpl
+	namespace string
+}
+
+type pendingKeyImpl struct {
+	ctx context.Context
+	key *datastore.PendingKey
+}
+
+type contextPendingKey struct{}
+
+func newKey(kind, name string, id int64, parent w.Key) *keyImpl {
+	k := &keyImpl{kind: kind, id: id, name: name}
+	if parent != nil {
+		k.parent = parent.(*keyImpl)
+	}
+	return k
+}
+
+func (k *keyImpl) Kind() string {
+	if k == nil {
+		panic("k is nil")
+	}
+	return k.kind
+}
+
+func (k *keyImpl) ID() int64 {
+	return k.id
+}
+
+func (k *keyImpl) Name() string {
+	return k.name
+}
+
+func (k *keyImpl) ParentKey() w.Key {
+	if k.parent == nil {
+		return nil
+	}
+	return k.parent
+}
+
+func (k *keyImpl) Namespace() string {
+	return k.namespace
+}
+
+func (k *keyImpl) SetNamespace(namespace string) {
+	k.namespace = namespace
+}
+
+func (k *keyImpl) String() string {
+	return toOriginalKey(k).String()
+}
+
+func (k *keyImpl) GobEncode() ([]byte, error) {
+	return toOriginalKey(k).GobEncode()
+}
+
+func (k *keyImpl) GobDecode(buf []byte) error {
+	origKey := &datastore.Key{}
+	if err := origKey.GobDecode(buf); err != nil {
+		return err
+	}
+	*k = *toWrapperKey(origKey)
+	return nil
+}
+
+func (k *keyImpl) MarshalJSON() ([]byte, error) {
+	return toOriginalKey(k).MarshalJSON()
+}
+
+func (k *keyImpl) UnmarshalJSON(buf []byte) error {
+	origKey := &datastore.Key{}
+	if err := origKey.UnmarshalJSON(buf); err != nil {
+		return err
+	}
+	*k = *toWrapperKey(origKey)
+	return nil
+}
+
+func (k *keyImpl) Encode() string {
+	return toOriginalKey(k).Encode()
+}
+
+func (k *keyImpl) Equal(o w.Key) bool {
+	var a w.Key = k
+	var b = o
+	for {
+		if a == nil || b == nil {
+			return a == nil && b == nil
+		}
+		if a.Kind() != b.Kind() || a.Name() != b.Name() || a.ID() != b.ID() || a.Namespace() != b.Namespace() {
+			return false
+		}
+		a = a.ParentKey()
+		b = b.ParentKey()
+	}
+}
+
+func (k *keyImpl) Incomplete() bool {
+	return k.Name() == "" && k.ID() == 0
+}
+
+func (p *pendingKeyImpl) StoredContext() context.Context {
+	return context.WithValue(p.ctx, contextPendingKey{}, p)
+}
@@ -0,0 +1,99 @@
+package clouddatastore
+
+import (
+	"cloud.google.com/go/datastore"
+	w "go.mercari.io/datastore"
+)
+
+var _ w.Transaction = (*transactionImpl)(nil)
+var _ w.Commit = (*commitImpl)(nil)
+
+type transactionImpl struct {
+	client *datastoreImpl
+	tx     *datastore.Transaction
+	info   *w.MiddlewareInfo
+}
+
+type commitImpl struct {
+	commit *datastore.Commit
+}
+
+func (tx *transactionImpl) Get(key w.Key, dst interface{}) error {
+	err := tx.GetMulti([]w.Key{key}, []interface{}{dst})
+	if merr, ok := err.(w.MultiError); ok {
+		return merr[0]
+	}
+	return err
+}
+
+func (tx *transactionImpl) GetMulti(keys []w.Key, dst interface{}) error {
+	b := newBridge(tx.info, tx.client, tx, nil)
+	return getMultiOps(tx.client.ctx, keys, dst, func(keys []w.Key, psList []w.PropertyList) error {
+		return b.GetMultiWithTx(tx.info, keys, psList)
+	})
+}
+
+func (tx *transactionImpl) Put(key w.Key, src interface{}) (w.PendingKey, error) {
+	pKeys, err := tx.PutMulti([]w.Key{key}, []interface{}{src})
+	if merr, ok := err.(w.MultiError); ok {
+		return nil, merr[0]
+	} else if err != nil {
+		return nil, err
+	}
+	return pKeys[0], nil
+}
+
+func (tx *transactionImpl) PutMulti(keys []w.Key, src interface{}) ([]w.PendingKey, error) {
+	b := newBridge(tx.info, tx.client, tx, nil)
+	psList, err := putMultiOps(tx.client.ctx, keys, src)
+	if err != nil || len(psList) == 0 {
+		return nil, err
+	}
+	return b.PutMultiWithTx(tx.info, keys, psList)
+}
+
+func (tx *transactionImpl) Delete(key w.Key) error {
+	err := tx.DeleteMulti([]w.Key{key})
+	if merr, ok := err.(w.MultiError); ok {
+		return merr[0]
+	}
+	return err
+}
+
+func (tx *transactionImpl) DeleteMulti(keys []w.Key) error {
+	b := newBridge(tx.info, tx.client, tx, nil)
+	return b.DeleteMultiWithTx(tx.info, keys)
+}
+
+func (tx *transactionImpl) Commit() (w.Commit, error) {
+	commit, err := tx.tx.Commit()
+	if err != nil {
+		return nil, toWrapperError(err)
+	}
+	c := &commitImpl{commit: commit}
+	b := newBridge(tx.info, tx.client, tx, nil)
+	if err := b.PostCommit(tx.info, tx, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (tx *transactionImpl) Rollback() error {
+	if err := tx.tx.Rollback(); err != nil {
+		return toWrapperError(err)
+	}
+	b := newBridge(tx.info, tx.client, tx, nil)
+	return b.PostRollback(tx.info, tx)
+}
+
+func (tx *transactionImpl) Batch() *w.TransactionBatch {
+	return &w.TransactionBatch{Transaction: tx}
+}
+
+func (c *commitImpl) Key(p w.PendingKey) w.Key {
+	pk := toOriginalPendingKey(p)
+	if pk == nil {
+		return nil
+	}
+	return toWrapperKey(c.commit.Key(pk))
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+// gcpsmClient is gcpsmのAPIからSecretを読むClient
+type gcpsmClient struct {
+	// Base is APIのURL. 例: https://gcpsm.example.com/api/1 , https://gcpsm.example.com/api/1/t/payments
+	Base       string
+	AuthHeader string
+	AuthToken  string
+	Client     *http.Client
+}
+
+// source is gcpsmのSecretのうち、Kubernetesに書き込む値. AliasとReferenceは解決したもの
+type source struct {
+	Key     string
+	Value   string
+	Version int64
+}
+
+// export is prefix配下の全てのSecretを返す. AliasとReferenceを含むものは解決した値を読み直す
+func (c *gcpsmClient) export(ctx context.Context, prefix string) ([]*source, error) {
+	resp := &backend.FolderAPIExportResponse{}
+	if err := c.get(ctx, "/export?prefix="+url.QueryEscape(prefix), 0, resp); err != nil {
+		return nil, err
+	}
+	list := make([]*source, 0, len(resp.Secrets))
+	for _, s := range resp.Secrets {
+		src := &source{Key: s.Key, Value: s.Value, Version: s.Version}
+		if s.AliasOf != "" || strings.Contains(s.Value, "${ref:") {
+			r := &backend.SecretAPIGetResponse{}
+			if err := c.get(ctx, "/secret/"+url.PathEscape(s.Key), 0, r); err != nil {
+				return nil, err
+			}
+			src.Value = r.Value
+		}
+		list = append(list, src)
+	}
+	return list, nil
+}
+
+// watch is prefix配下のSecretが変更されるか、timeoutになるまで待つ. 次に渡すCursorを返す
+func (c *gcpsmClient) watch(ctx context.Context, prefix string, since string, timeout time.Duration) (*backend.FolderAPIWatchResponse, error) {
+	q := url.Values{}
+	q.Set("prefix", prefix)
+	if since != "" {
+		q.Set("since", since)
+	}
+	q.Set("timeout", strconv.Itoa(int(timeout.Seconds())))
+	resp := &backend.FolderAPIWatchResponse{}
+	if err := c.get(ctx, "/folder:watch?"+q.Encode(), timeout+30*time.Second, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (c *gcpsmClient) get(ctx context.Context, path string, timeout time.Duration, v interface{}) error {
+	if timeout == 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(c.Base, "/")+path, nil)
+	if err != nil {
+		return err
+	}
+	if c.AuthToken != "" {
+		req.Header.Set(c.AuthHeader, c.AuthToken)
+	}
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		he := &backend.HTTPError{}
+		if err := json.Unmarshal(b, he); err != nil || he.Code == 0 {
+			he = &backend.HTTPError{Code: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+		}
+		return he
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// kubeSecret is v1.Secretのうち、同期に利用する項目だけを持つもの
+type kubeSecret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   kubeObjectMeta    `json:"metadata"`
+	Type       string            `json:"type,omitempty"`
+	Data       map[string][]byte `json:"data"`
+}
+
+// kubeObjectMeta is v1.ObjectMeta
+type kubeObjectMeta struct {
+	Name            string            `json:"name"`
+	Namespace       string            `json:"namespace,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty"`
+	ResourceVersion string            `json:"resourceVersion,omitempty"`
+}
+
+// kubeSecretList is v1.SecretList
+type kubeSecretList struct {
+	Items []*kubeSecret `json:"items"`
+}
+
+// kubeError is Kubernetes API Serverが返すv1.Status
+type kubeError struct {
+	Code    int    `json:"code"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
+
+func (e *kubeError) Error() string {
+	return fmt.Sprintf("kubernetes returned %d %s: %s", e.Code, e.Reason, e.Message)
+}
+
+// isKubeNotFound is errが404かを返す
+func isKubeNotFound(err error) bool {
+	ke, ok := err.(*kubeError)
+	return ok && ke.Code == http.StatusNotFound
+}
+
+// kubeClient is Kubernetes API ServerのSecretを操作するClient
+type kubeClient struct {
+	// Base is API ServerのURL. 例: https://10.0.0.1:443
+	Base   string
+	Token  string
+	Client *http.Client
+}
+
+// Service Accountの認証情報がMountされるPath
+const (
+	inClusterTokenFile = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	inClusterCAFile    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+)
+
+// newKubeClient is apiが空の場合はPodのService Accountを使ってClusterのAPI Serverに接続する
+func newKubeClient(api string, tokenFile string, caFile string) (*kubeClient, error) {
+	if api == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, fmt.Errorf("-kube-api is required outside of kubernetes")
+		}
+		api = "https://" + host + ":" + port
+	}
+	c := &kubeClient{
+		Base:   strings.TrimRight(api, "/"),
+		Client: &http.Client{Timeout: 30 * time.Second},
+	}
+	if tokenFile != "" {
+		b, err := ioutil.ReadFile(tokenFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		c.Token = strings.TrimSpace(string(b))
+	}
+	if caFile != "" && strings.HasPrefix(c.Base, "https://") {
+		b, err := ioutil.ReadFile(caFile)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		if err == nil {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(b) {
+				return nil, fmt.Errorf("no certificate in %s", caFile)
+			}
+			c.Client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		}
+	}
+	return c, nil
+}
+
+func (c *kubeClient) secretsURL(namespace string) string {
+	return c.Base + "/api/v1/namespaces/" + url.PathEscape(namespace) + "/secrets"
+}
+
+// listSecrets is namespaceのSecretのうち、labelsを全て持つものを返す
+func (c *kubeClient) listSecrets(ctx context.Context, namespace string, labels map[string]string) ([]*kubeSecret, error) {
+	var selector []string
+	for k, v := range labels {
+		selector = append(selector, k+"="+v)
+	}
+	list := &kubeSecretList{}
+	u := c.secretsURL(namespace) + "?labelSelector=" + url.QueryEscape(strings.Join(selector, ","))
+	if err := c.do(ctx, http.MethodGet, u, nil, list); err != nil {
+		return nil, err
+	}
+	return list.Items, nil
+}
+
+// getSecret is Secretを返す. 存在しない場合はnil
+func (c *kubeClient) getSecret(ctx context.Context, namespace string, name string) (*kubeSecret, error) {
+	s := &kubeSecret{}
+	if err := c.do(ctx, http.MethodGet, c.secretsURL(namespace)+"/"+url.PathEscape(name), nil, s); err != nil {
+		if isKubeNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return s, nil
+}
+
+func (c *kubeClient) createSecret(ctx context.Context, s *kubeSecret) error {
+	return c.do(ctx, http.MethodPost, c.secretsURL(s.Metadata.Namespace), s, s)
+}
+
+// updateSecret is Secretを置き換える. ResourceVersionが変わっていれば409になる
+func (c *kubeClient) updateSecret(ctx context.Context, s *kubeSecret) error {
+	return c.do(ctx, http.MethodPut, c.secretsURL(s.Metadata.Namespace)+"/"+url.PathEscape(s.Metadata.Name), s, s)
+}
+
+// deleteSecret is Secretを削除する. ResourceVersionが変わっていれば409になる
+func (c *kubeClient) deleteSecret(ctx context.Context, s *kubeSecret) error {
+	opts := map[string]interface{}{
+		"apiVersion":    "v1",
+		"kind":          "DeleteOptions",
+		"preconditions": map[string]string{"resourceVersion": s.Metadata.ResourceVersion},
+	}
+	return c.do(ctx, http.MethodDelete, c.secretsURL(s.Metadata.Namespace)+"/"+url.PathEscape(s.Metadata.Name), opts, nil)
+}
+
+func (c *kubeClient) do(ctx context.Context, method string, u string, body interface{}, v interface{}) error {
+	var rb io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		rb = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, u, rb)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		ke := &kubeError{}
+		if err := json.Unmarshal(b, ke); err != nil || ke.Code == 0 {
+			ke = &kubeError{Code: resp.StatusCode, Message: strings.TrimSpace(string(b))}
+		}
+		return ke
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(b, v)
+}
@@ -0,0 +1,135 @@
+// gcpsm-k8s-sync is gcpsmのPrefix配下のSecretを、KubernetesのNamespaceのv1.Secretに同期し続けるController
+//
+//	GCPSM_TOKEN=... go run ./cmd/gcpsm-k8s-sync -gcpsm https://gcpsm.example.com/api/1 -config sync.json
+//	go run ./cmd/k8s-standin -addr localhost:8001 -token dev
+//	echo dev > /tmp/kube-token
+//	go run ./cmd/gcpsm-k8s-sync -gcpsm http://localhost:8080/api/1 -kube-api http://localhost:8001 -kube-token-file /tmp/kube-token -config sync.json -once
+//
+// -configには同期するPrefixとNamespaceの組を書く
+//
+//	{"mappings": [{"name": "payments", "prefix": "prod/payments", "namespace": "payments", "namePrefix": "gcpsm-", "dataKey": "value"}]}
+//
+// Secret 1つにつき v1.Secret を1つ作り、Source KeyとVersionをLabelに記録する
+// Kubernetes側で変更されたもの (Drift) は報告して上書きし、gcpsmから無くなったものは削除する
+// -watchの場合はgcpsmの /folder:watch で変更を待ち、それ以外は -interval ごとに読み直す. どちらも -resync ごとに全体を同期する
+// -addrの /status で、Mapping毎の最後の同期結果を返す
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+func main() {
+	gcpsmURL := flag.String("gcpsm", os.Getenv("GCPSM_URL"), "gcpsm api url. e.g. https://gcpsm.example.com/api/1 or https://gcpsm.example.com/api/1/t/{tenant}")
+	gcpsmAuthHeader := flag.String("gcpsm-auth-header", "Authorization", "header to send GCPSM_TOKEN. the token is sent as is, so include Bearer if needed")
+	configFile := flag.String("config", "gcpsm-k8s-sync.json", "mapping config file")
+	kubeAPI := flag.String("kube-api", "", "kubernetes api server url. the in-cluster service account is used if empty")
+	kubeTokenFile := flag.String("kube-token-file", inClusterTokenFile, "bearer token file for the kubernetes api server")
+	kubeCAFile := flag.String("kube-ca-file", inClusterCAFile, "ca certificate of the kubernetes api server")
+	watch := flag.Bool("watch", true, "wait changes with /folder:watch. poll every -interval if false")
+	interval := flag.Duration("interval", time.Minute, "polling interval, or watch timeout if -watch")
+	resync := flag.Duration("resync", 10*time.Minute, "interval to sync everything to fix drift")
+	prune := flag.Bool("prune", true, "delete managed secrets whose key no longer exists in gcpsm")
+	fixDrift := flag.Bool("fix-drift", true, "overwrite secrets modified outside of gcpsm. drift is only reported if false")
+	dryRun := flag.Bool("dry-run", false, "report changes without writing to kubernetes")
+	once := flag.Bool("once", false, "sync every mapping once, print the report and exit")
+	addr := flag.String("addr", ":8080", "listen address of /healthz and /status. disabled if empty")
+	flag.Parse()
+
+	if *gcpsmURL == "" {
+		log.Fatal("-gcpsm is required")
+	}
+	b, err := ioutil.ReadFile(*configFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	cfg := &config{}
+	if err := json.Unmarshal(b, cfg); err != nil {
+		log.Fatalf("invalid config %s. %v", *configFile, err)
+	}
+	if err := cfg.validate(); err != nil {
+		log.Fatalf("invalid config %s. %v", *configFile, err)
+	}
+	if len(cfg.Mappings) == 0 {
+		log.Fatalf("no mappings in %s", *configFile)
+	}
+
+	kube, err := newKubeClient(*kubeAPI, *kubeTokenFile, *kubeCAFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	s := &syncer{
+		gcpsm: &gcpsmClient{
+			Base:       *gcpsmURL,
+			AuthHeader: *gcpsmAuthHeader,
+			AuthToken:  os.Getenv("GCPSM_TOKEN"),
+			Client:     &http.Client{},
+		},
+		kube:     kube,
+		prune:    *prune,
+		fixDrift: *fixDrift,
+		dryRun:   *dryRun,
+		reports:  map[string]*mappingReport{},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *once {
+		failed := false
+		for _, m := range cfg.Mappings {
+			if _, err := s.sync(ctx, m); err != nil {
+				log.Printf("failed sync mapping %s. %v", m.Name, err)
+				failed = true
+			}
+		}
+		reports := s.snapshot()
+		for _, r := range reports {
+			failed = failed || len(r.Errors) > 0
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			log.Fatal(err)
+		}
+		if failed {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *addr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		})
+		mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			json.NewEncoder(w).Encode(s.snapshot())
+		})
+		go func() {
+			log.Printf("listening on %s", *addr)
+			if err := http.ListenAndServe(*addr, mux); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
+	for _, m := range cfg.Mappings {
+		go s.run(ctx, m, *watch, *interval, *resync)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+	<-sig
+	log.Print("shutting down")
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+// Secretに付けるLabelとAnnotation
+const (
+	labelManagedBy  = "app.kubernetes.io/managed-by"
+	managedBy       = "gcpsm-k8s-sync"
+	labelMapping    = "gcpsm.sinmetal.github.com/mapping"
+	labelKey        = "gcpsm.sinmetal.github.com/key"
+	labelVersion    = "gcpsm.sinmetal.github.com/version"
+	annotationKey   = "gcpsm.sinmetal.github.com/key"
+	annotationSum   = "gcpsm.sinmetal.github.com/checksum"
+	defaultDataKey  = "value"
+	maxLabelValue   = 63
+	maxResourceName = 253
+)
+
+var (
+	// invalidNameChars is Secretの名前に使えない文字
+	invalidNameChars = regexp.MustCompile(`[^a-z0-9.-]`)
+	// invalidLabelChars is Labelの値に使えない文字
+	invalidLabelChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+)
+
+// mapping is gcpsmのPrefixをKubernetesのNamespaceに同期する設定
+// Prefix配下のSecret 1つにつき、NamePrefixとPrefixからの相対的なKeyを名前にしたv1.Secretを1つ作る
+type mapping struct {
+	// Name is Mappingの名前. Labelに記録し、Pruneする範囲を決める
+	Name       string `json:"name"`
+	Prefix     string `json:"prefix"`
+	Namespace  string `json:"namespace"`
+	NamePrefix string `json:"namePrefix"`
+	// DataKey is v1.Secretのdataで値を入れるKey. 空の場合はvalue
+	DataKey string `json:"dataKey"`
+}
+
+// config is -configで指定するFile
+type config struct {
+	Mappings []*mapping `json:"mappings"`
+}
+
+func (c *config) validate() error {
+	names := map[string]bool{}
+	for _, m := range c.Mappings {
+		if m.Name == "" || m.Namespace == "" {
+			return fmt.Errorf("name and namespace are required. mapping=%+v", m)
+		}
+		if len(m.Name) > maxLabelValue || invalidNameChars.MatchString(m.Name) {
+			return fmt.Errorf("mapping name %q must be a lowercase label value", m.Name)
+		}
+		if names[m.Name] {
+			return fmt.Errorf("mapping name %q is duplicated", m.Name)
+		}
+		names[m.Name] = true
+		m.Prefix = backend.NormalizeKeyPrefix(m.Prefix)
+		if m.DataKey == "" {
+			m.DataKey = defaultDataKey
+		}
+	}
+	return nil
+}
+
+// secretName is keyを同期するv1.Secretの名前. / は . にし、大文字と _ は使えないので置き換える
+func (m *mapping) secretName(key string) string {
+	rel := strings.TrimPrefix(strings.TrimPrefix(key, m.Prefix), "/")
+	if rel == "" {
+		rel = key[strings.LastIndex(key, "/")+1:]
+	}
+	name := m.NamePrefix + strings.Replace(strings.Replace(strings.ToLower(rel), "/", ".", -1), "_", "-", -1)
+	return strings.Trim(invalidNameChars.ReplaceAllString(name, "-"), ".-")
+}
+
+// labelValue is Labelの値に使えない文字を置き換え、63文字を越える場合はHashで短くする
+func labelValue(v string) string {
+	v = strings.Trim(invalidLabelChars.ReplaceAllString(strings.Replace(v, "/", ".", -1), "-"), "_.-")
+	if len(v) <= maxLabelValue {
+		return v
+	}
+	sum := sha256.Sum256([]byte(v))
+	return strings.Trim(v[:maxLabelValue-9], "_.-") + "-" + hex.EncodeToString(sum[:])[:8]
+}
+
+// dataChecksum is dataのSHA-256. 最後に書き込んだ値から変更されたか (Drift) の確認に利用する
+func dataChecksum(data map[string][]byte) string {
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	h := sha256.New()
+	for _, k := range keys {
+		fmt.Fprintf(h, "%d:%s%d:", len(k), k, len(data[k]))
+		h.Write(data[k])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// desiredSecret is srcを同期したv1.Secret
+func (m *mapping) desiredSecret(src *source) *kubeSecret {
+	data := map[string][]byte{m.DataKey: []byte(src.Value)}
+	return &kubeSecret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata: kubeObjectMeta{
+			Name:      m.secretName(src.Key),
+			Namespace: m.Namespace,
+			Labels: map[string]string{
+				labelManagedBy: managedBy,
+				labelMapping:   m.Name,
+				labelKey:       labelValue(src.Key),
+				labelVersion:   strconv.FormatInt(src.Version, 10),
+			},
+			Annotations: map[string]string{
+				annotationKey: src.Key,
+				annotationSum: dataChecksum(data),
+			},
+		},
+		Type: "Opaque",
+		Data: data,
+	}
+}
+
+// mappingReport is 1つのMappingを同期した結果
+type mappingReport struct {
+	Mapping   string    `json:"mapping"`
+	Prefix    string    `json:"prefix"`
+	Namespace string    `json:"namespace"`
+	SyncedAt  time.Time `json:"syncedAt"`
+	Created   []string  `json:"created"`
+	Updated   []string  `json:"updated"`
+	Unchanged int       `json:"unchanged"`
+	Pruned    []string  `json:"pruned"`
+	// Drifted is gcpsm-k8s-syncが最後に書き込んだ後に、Kubernetes側で変更されていたSecret
+	Drifted []string `json:"drifted"`
+	Errors  []string `json:"errors"`
+}
+
+// syncer is 全てのMappingを同期し、最後の結果を保持する
+type syncer struct {
+	gcpsm    *gcpsmClient
+	kube     *kubeClient
+	prune    bool
+	fixDrift bool
+	dryRun   bool
+
+	mu      sync.Mutex
+	reports map[string]*mappingReport
+}
+
+func (s *syncer) setReport(r *mappingReport) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.reports[r.Mapping] = r
+}
+
+// snapshot is Mapping名の順に最後の結果を返す
+func (s *syncer) snapshot() []*mappingReport {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]*mappingReport, 0, len(s.reports))
+	for _, r := range s.reports {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Mapping < list[j].Mapping })
+	return list
+}
+
+// sync is mのPrefix配下のSecretをKubernetesに書き込み、無くなったSecretを削除する
+// gcpsmかKubernetesの一覧を読めない場合はerrorを返し、Secret毎の失敗はReportに記録する
+func (s *syncer) sync(ctx context.Context, m *mapping) (*mappingReport, error) {
+	r := &mappingReport{
+		Mapping:   m.Name,
+		Prefix:    m.Prefix,
+		Namespace: m.Namespace,
+		SyncedAt:  time.Now(),
+		Created:   []string{},
+		Updated:   []string{},
+		Pruned:    []string{},
+		Drifted:   []string{},
+		Errors:    []string{},
+	}
+	sources, err := s.gcpsm.export(ctx, m.Prefix)
+	if err != nil {
+		return nil, fmt.Errorf("failed export %s from gcpsm: %v", m.Prefix, err)
+	}
+	existing, err := s.kube.listSecrets(ctx, m.Namespace, map[string]string{labelManagedBy: managedBy, labelMapping: m.Name})
+	if err != nil {
+		return nil, fmt.Errorf("failed list secrets in %s: %v", m.Namespace, err)
+	}
+	managed := map[string]*kubeSecret{}
+	for _, ks := range existing {
+		managed[ks.Metadata.Name] = ks
+	}
+
+	desired := map[string]string{}
+	for _, src := range sources {
+		want := m.desiredSecret(src)
+		name := want.Metadata.Name
+		if name == "" || len(name) > maxResourceName {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s: cannot be a secret name", src.Key))
+			continue
+		}
+		if other, ok := desired[name]; ok {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s: secret %s is also used by %s", src.Key, name, other))
+			continue
+		}
+		desired[name] = src.Key
+
+		if err := s.apply(ctx, r, want, managed[name]); err != nil {
+			r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", src.Key, err))
+		}
+	}
+
+	for name, ks := range managed {
+		if _, ok := desired[name]; ok || !s.prune {
+			continue
+		}
+		log.Printf("prune secret %s/%s. key=%s", m.Namespace, name, ks.Metadata.Annotations[annotationKey])
+		if !s.dryRun {
+			if err := s.kube.deleteSecret(ctx, ks); err != nil && !isKubeNotFound(err) {
+				r.Errors = append(r.Errors, fmt.Sprintf("%s: %v", name, err))
+				continue
+			}
+		}
+		r.Pruned = append(r.Pruned, name)
+	}
+	sort.Strings(r.Pruned)
+	s.setReport(r)
+	return r, nil
+}
+
+// apply is wantを作成または更新する. curはこのMappingが管理している同じ名前のSecret
+func (s *syncer) apply(ctx context.Context, r *mappingReport, want *kubeSecret, cur *kubeSecret) error {
+	name := want.Metadata.Name
+	if cur == nil {
+		other, err := s.kube.getSecret(ctx, want.Metadata.Namespace, name)
+		if err != nil {
+			return err
+		}
+		if other != nil {
+			// 手で作られたSecretや、別のMappingのSecretは上書きしない
+			return fmt.Errorf("secret %s already exists and is not managed by mapping %s", name, r.Mapping)
+		}
+		log.Printf("create secret %s/%s. key=%s, version=%s", want.Metadata.Namespace, name, want.Metadata.Annotations[annotationKey], want.Metadata.Labels[labelVersion])
+		if !s.dryRun {
+			if err := s.kube.createSecret(ctx, want); err != nil {
+				return err
+			}
+		}
+		r.Created = append(r.Created, name)
+		return nil
+	}
+
+	written := cur.Metadata.Annotations[annotationSum]
+	drifted := dataChecksum(cur.Data) != written
+	changed := written != want.Metadata.Annotations[annotationSum] || cur.Metadata.Labels[labelVersion] != want.Metadata.Labels[labelVersion]
+	if drifted {
+		log.Printf("drift detected. secret %s/%s was modified outside of gcpsm. key=%s", want.Metadata.Namespace, name, want.Metadata.Annotations[annotationKey])
+		r.Drifted = append(r.Drifted, name)
+	}
+	if !changed && (!drifted || !s.fixDrift) {
+		r.Unchanged++
+		return nil
+	}
+
+	// Kubernetes側で追加されたLabelとAnnotationは残す
+	want.Metadata.ResourceVersion = cur.Metadata.ResourceVersion
+	for k, v := range cur.Metadata.Labels {
+		if _, ok := want.Metadata.Labels[k]; !ok {
+			want.Metadata.Labels[k] = v
+		}
+	}
+	for k, v := range cur.Metadata.Annotations {
+		if _, ok := want.Metadata.Annotations[k]; !ok {
+			want.Metadata.Annotations[k] = v
+		}
+	}
+	log.Printf("update secret %s/%s. key=%s, version=%s", want.Metadata.Namespace, name, want.Metadata.Annotations[annotationKey], want.Metadata.Labels[labelVersion])
+	if !s.dryRun {
+		if err := s.kube.updateSecret(ctx, want); err != nil {
+			return err
+		}
+	}
+	r.Updated = append(r.Updated, name)
+	return nil
+}
+
+// watchSkew is 最初のWatchで、同期を始める少し前からの変更を受け取るための余裕. gcpsmとの時計のずれを吸収する
+const watchSkew = time.Minute
+
+// run is mを同期し続ける. watchの場合はgcpsmのfolder:watchで変更を待ち、それ以外はintervalごとに同期する
+// watchの場合も、Kubernetes側のDriftを直すためにresyncごとに同期する
+func (s *syncer) run(ctx context.Context, m *mapping, watch bool, interval time.Duration, resync time.Duration) {
+	var cursor string
+	var last time.Time
+	dirty := true
+	for ctx.Err() == nil {
+		if dirty || time.Since(last) >= resync {
+			start := time.Now()
+			if _, err := s.sync(ctx, m); err != nil {
+				log.Printf("failed sync mapping %s. %v", m.Name, err)
+				sleep(ctx, 10*time.Second)
+				continue
+			}
+			if cursor == "" {
+				cursor = start.Add(-watchSkew).Format(time.RFC3339Nano)
+			}
+			last, dirty = time.Now(), false
+		}
+		if !watch {
+			sleep(ctx, interval)
+			dirty = true
+			continue
+		}
+
+		timeout := interval
+		if d := resync - time.Since(last); d < timeout {
+			timeout = d
+		}
+		if timeout < time.Second {
+			continue
+		}
+		resp, err := s.gcpsm.watch(ctx, m.Prefix, cursor, timeout)
+		if err != nil {
+			log.Printf("failed watch %s. %v", m.Prefix, err)
+			sleep(ctx, 10*time.Second)
+			continue
+		}
+		cursor = resp.Cursor
+		if len(resp.Events) > 0 {
+			log.Printf("%d changes under %s", len(resp.Events), m.Prefix)
+			dirty = true
+		}
+	}
+}
+
+func sleep(ctx context.Context, d time.Duration) {
+	select {
+	case <-ctx.Done():
+	case <-time.After(d):
+	}
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeGcpsm is /export だけを返すgcpsm
+type fakeGcpsm struct {
+	mu      sync.Mutex
+	secrets map[string]*backend.SecretAPIGetResponse
+}
+
+func (g *fakeGcpsm) set(key string, value string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s, ok := g.secrets[key]
+	if !ok {
+		s = &backend.SecretAPIGetResponse{Key: key}
+		g.secrets[key] = s
+	}
+	s.Value = value
+	s.Version++
+}
+
+func (g *fakeGcpsm) delete(key string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.secrets, key)
+}
+
+func (g *fakeGcpsm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/1/export" {
+		http.NotFound(w, r)
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	prefix := r.URL.Query().Get("prefix")
+	resp := &backend.FolderAPIExportResponse{Prefix: prefix, Secrets: []*backend.SecretAPIGetResponse{}}
+	for k, s := range g.secrets {
+		if backend.HasKeyPrefix(k, prefix) {
+			c := *s
+			resp.Secrets = append(resp.Secrets, &c)
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// fakeKube is Kubernetes API ServerのSecretだけを実装したもの. ResourceVersionが一致しないupdateとdeleteは409を返す
+type fakeKube struct {
+	mu      sync.Mutex
+	secrets map[string]*kubeSecret
+	version int
+}
+
+func (k *fakeKube) get(namespace string, name string) *kubeSecret {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	s, ok := k.secrets[namespace+"/"+name]
+	if !ok {
+		return nil
+	}
+	c := *s
+	return &c
+}
+
+func (k *fakeKube) put(s *kubeSecret) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.version++
+	s.Metadata.ResourceVersion = strconv.Itoa(k.version)
+	k.secrets[s.Metadata.Namespace+"/"+s.Metadata.Name] = s
+}
+
+func (k *fakeKube) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	if len(parts) < 2 || parts[1] != "secrets" {
+		writeKubeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	namespace := parts[0]
+	if len(parts) == 2 {
+		switch r.Method {
+		case http.MethodGet:
+			k.list(w, r, namespace)
+		case http.MethodPost:
+			s := &kubeSecret{}
+			if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+				writeKubeError(w, http.StatusBadRequest, "BadRequest")
+				return
+			}
+			if k.get(namespace, s.Metadata.Name) != nil {
+				writeKubeError(w, http.StatusConflict, "AlreadyExists")
+				return
+			}
+			s.Metadata.Namespace = namespace
+			k.put(s)
+			json.NewEncoder(w).Encode(s)
+		}
+		return
+	}
+
+	cur := k.get(namespace, parts[2])
+	if cur == nil {
+		writeKubeError(w, http.StatusNotFound, "NotFound")
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(cur)
+	case http.MethodPut:
+		s := &kubeSecret{}
+		if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+			writeKubeError(w, http.StatusBadRequest, "BadRequest")
+			return
+		}
+		if s.Metadata.ResourceVersion != cur.Metadata.ResourceVersion {
+			writeKubeError(w, http.StatusConflict, "Conflict")
+			return
+		}
+		s.Metadata.Namespace = namespace
+		k.put(s)
+		json.NewEncoder(w).Encode(s)
+	case http.MethodDelete:
+		opts := &struct {
+			Preconditions struct {
+				ResourceVersion string `json:"resourceVersion"`
+			} `json:"preconditions"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(opts); err != nil {
+			writeKubeError(w, http.StatusBadRequest, "BadRequest")
+			return
+		}
+		if opts.Preconditions.ResourceVersion != cur.Metadata.ResourceVersion {
+			writeKubeError(w, http.StatusConflict, "Conflict")
+			return
+		}
+		k.mu.Lock()
+		delete(k.secrets, namespace+"/"+cur.Metadata.Name)
+		k.mu.Unlock()
+		w.Write([]byte(`{"kind":"Status","status":"Success"}`))
+	}
+}
+
+func (k *fakeKube) list(w http.ResponseWriter, r *http.Request, namespace string) {
+	selector := map[string]string{}
+	for _, s := range strings.Split(r.URL.Query().Get("labelSelector"), ",") {
+		if kv := strings.SplitN(s, "=", 2); len(kv) == 2 {
+			selector[kv[0]] = kv[1]
+		}
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	list := &kubeSecretList{Items: []*kubeSecret{}}
+	for _, s := range k.secrets {
+		if s.Metadata.Namespace != namespace {
+			continue
+		}
+		matched := true
+		for l, v := range selector {
+			if s.Metadata.Labels[l] != v {
+				matched = false
+			}
+		}
+		if matched {
+			list.Items = append(list.Items, s)
+		}
+	}
+	json.NewEncoder(w).Encode(list)
+}
+
+func writeKubeError(w http.ResponseWriter, code int, reason string) {
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(&kubeError{Code: code, Reason: reason, Message: reason})
+}
+
+// newTestSyncer is fakeGcpsmとfakeKubeに接続したsyncerを返す
+func newTestSyncer(t *testing.T) (*syncer, *fakeGcpsm, *fakeKube, func()) {
+	g := &fakeGcpsm{secrets: map[string]*backend.SecretAPIGetResponse{}}
+	k := &fakeKube{secrets: map[string]*kubeSecret{}}
+	gs := httptest.NewServer(g)
+	ks := httptest.NewServer(k)
+	kube, err := newKubeClient(ks.URL, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &syncer{
+		gcpsm:    &gcpsmClient{Base: gs.URL + "/api/1", Client: http.DefaultClient},
+		kube:     kube,
+		prune:    true,
+		fixDrift: true,
+		reports:  map[string]*mappingReport{},
+	}
+	return s, g, k, func() {
+		gs.Close()
+		ks.Close()
+	}
+}
+
+func testMapping(t *testing.T) *mapping {
+	cfg := &config{Mappings: []*mapping{{Name: "payments", Prefix: "prod/payments", Namespace: "payments", NamePrefix: "gcpsm-"}}}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg.Mappings[0]
+}
+
+func TestSync(t *testing.T) {
+	s, g, k, closer := newTestSyncer(t)
+	defer closer()
+	m := testMapping(t)
+	ctx := context.Background()
+
+	g.set("prod/payments/db_password", "v1")
+	g.set("prod/other", "ignored")
+	r, err := s.sync(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Created) != 1 || r.Created[0] != "gcpsm-db-password" {
+		t.Errorf("unexpected created: %v", r.Created)
+	}
+	ks := k.get("payments", "gcpsm-db-password")
+	if ks == nil {
+		t.Fatal("secret is not created")
+	}
+	if v := string(ks.Data["value"]); v != "v1" {
+		t.Errorf("unexpected value: %q", v)
+	}
+	if v := ks.Metadata.Labels[labelVersion]; v != "1" {
+		t.Errorf("unexpected version label: %q", v)
+	}
+
+	g.set("prod/payments/db_password", "v2")
+	r, err = s.sync(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Updated) != 1 {
+		t.Errorf("unexpected updated: %v", r.Updated)
+	}
+	if v := string(k.get("payments", "gcpsm-db-password").Data["value"]); v != "v2" {
+		t.Errorf("secret is not updated: %q", v)
+	}
+
+	// Kubernetes側で書き換えられた値はgcpsmの値に戻す
+	drifted := k.get("payments", "gcpsm-db-password")
+	drifted.Data = map[string][]byte{"value": []byte("edited")}
+	k.put(drifted)
+	r, err = s.sync(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Drifted) != 1 || len(r.Updated) != 1 {
+		t.Errorf("drift is not fixed: %+v", r)
+	}
+	if v := string(k.get("payments", "gcpsm-db-password").Data["value"]); v != "v2" {
+		t.Errorf("drift is not fixed: %q", v)
+	}
+
+	r, err = s.sync(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Unchanged != 1 || len(r.Updated) != 0 {
+		t.Errorf("unchanged secret is written: %+v", r)
+	}
+
+	// 管理していない同じ名前のSecretは上書きしない
+	k.put(&kubeSecret{Metadata: kubeObjectMeta{Name: "gcpsm-api-key", Namespace: "payments"}, Data: map[string][]byte{"value": []byte("manual")}})
+	g.set("prod/payments/api_key", "v1")
+	r, err = s.sync(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Errors) != 1 {
+		t.Errorf("unexpected errors: %v", r.Errors)
+	}
+	if v := string(k.get("payments", "gcpsm-api-key").Data["value"]); v != "manual" {
+		t.Errorf("unmanaged secret is overwritten: %q", v)
+	}
+
+	g.delete("prod/payments/db_password")
+	r, err = s.sync(ctx, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Pruned) != 1 || r.Pruned[0] != "gcpsm-db-password" {
+		t.Errorf("unexpected pruned: %v", r.Pruned)
+	}
+	if k.get("payments", "gcpsm-db-password") != nil {
+		t.Error("secret is not deleted")
+	}
+	if k.get("payments", "gcpsm-api-key") == nil {
+		t.Error("unmanaged secret is deleted")
+	}
+}
+
+func TestSyncDryRun(t *testing.T) {
+	s, g, k, closer := newTestSyncer(t)
+	defer closer()
+	s.dryRun = true
+	m := testMapping(t)
+
+	g.set("prod/payments/db_password", "v1")
+	r, err := s.sync(context.Background(), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Created) != 1 {
+		t.Errorf("unexpected created: %v", r.Created)
+	}
+	if k.get("payments", "gcpsm-db-password") != nil {
+		t.Error("secret is created in dry run")
+	}
+}
+
+// waitFor is condが満たされるまで待つ
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRun(t *testing.T) {
+	s, g, k, closer := newTestSyncer(t)
+	defer closer()
+	m := testMapping(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	g.set("prod/payments/db_password", "v1")
+	go func() {
+		defer close(done)
+		s.run(ctx, m, false, 10*time.Millisecond, time.Minute)
+	}()
+
+	value := func(v string) func() bool {
+		return func() bool {
+			ks := k.get("payments", "gcpsm-db-password")
+			return ks != nil && string(ks.Data["value"]) == v
+		}
+	}
+	waitFor(t, "create", value("v1"))
+	g.set("prod/payments/db_password", "v2")
+	waitFor(t, "update", value("v2"))
+	g.delete("prod/payments/db_password")
+	waitFor(t, "delete", func() bool {
+		return k.get("payments", "gcpsm-db-password") == nil
+	})
+
+	reports := s.snapshot()
+	if len(reports) != 1 || reports[0].Mapping != "payments" {
+		t.Errorf("unexpected reports: %+v", reports)
+	}
+}
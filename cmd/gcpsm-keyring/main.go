@@ -0,0 +1,100 @@
+// gcpsm-keyring is gcpsm-server -key-provider local で利用するLocalKeyRingのFileを管理するTool
+//
+//	export GCPSM_KEYRING_PASSPHRASE=...
+//	go run ./cmd/gcpsm-keyring init -keyring gcpsm.keyring
+//	go run ./cmd/gcpsm-keyring rotate -keyring gcpsm.keyring -key testkey/testCryptKey
+//	go run ./cmd/gcpsm-keyring disable -keyring gcpsm.keyring -key testkey/testCryptKey -version 1
+//	go run ./cmd/gcpsm-keyring list -keyring gcpsm.keyring
+//
+// KeyのIDはTenantのCryptKeyの {keyRingId}/{keyName}
+// Passphraseを変更する場合は GCPSM_KEYRING_NEW_PASSPHRASE を設定して passwd を実行する
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	cmd := os.Args[1]
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	path := fs.String("keyring", "gcpsm.keyring", "keyring file")
+	key := fs.String("key", backend.LocalKeyID(backend.CryptKey{KeyRingID: "testkey", KeyName: "testCryptKey"}), "key id. {keyRingId}/{keyName}")
+	version := fs.Int("version", 0, "key version for enable and disable")
+	fs.Parse(os.Args[2:])
+
+	passphrase := os.Getenv("GCPSM_KEYRING_PASSPHRASE")
+	if passphrase == "" {
+		log.Fatal("GCPSM_KEYRING_PASSPHRASE is required")
+	}
+
+	if cmd == "init" {
+		if _, err := os.Stat(*path); err == nil {
+			log.Fatalf("%s already exists", *path)
+		}
+		kr := backend.NewLocalKeyRing()
+		if err := kr.CreateKey(*key); err != nil {
+			log.Fatal(err)
+		}
+		if err := kr.Save(*path, passphrase); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("created %s with key %s\n", *path, *key)
+		return
+	}
+
+	kr, err := backend.OpenLocalKeyRing(*path, passphrase)
+	if err != nil {
+		log.Fatal(err)
+	}
+	switch cmd {
+	case "list":
+		for _, id := range kr.IDs() {
+			k := kr.Keys[id]
+			fmt.Printf("%s primary=%d\n", id, k.Primary)
+			for _, v := range k.Versions {
+				state := "enabled"
+				if v.Disabled {
+					state = "disabled"
+				}
+				fmt.Printf("  version=%d state=%s createdAt=%s\n", v.Version, state, v.CreatedAt.Format("2006-01-02T15:04:05Z07:00"))
+			}
+		}
+		return
+	case "create":
+		err = kr.CreateKey(*key)
+	case "rotate":
+		var v int
+		v, err = kr.Rotate(*key)
+		if err == nil {
+			fmt.Printf("%s primary version is %d\n", *key, v)
+		}
+	case "enable", "disable":
+		err = kr.SetVersionDisabled(*key, *version, cmd == "disable")
+	case "passwd":
+		passphrase = os.Getenv("GCPSM_KEYRING_NEW_PASSPHRASE")
+		if passphrase == "" {
+			log.Fatal("GCPSM_KEYRING_NEW_PASSPHRASE is required")
+		}
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := kr.Save(*path, passphrase); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gcpsm-keyring init|list|create|rotate|enable|disable|passwd [flags]")
+	os.Exit(2)
+}
@@ -0,0 +1,132 @@
+// gcpsm-quorum is QuorumSecretのCustodianがOfflineで利用するTool
+//
+//	go run ./cmd/gcpsm-quorum keygen -out custodian.pem > custodian.pub.pem
+//	go run ./cmd/gcpsm-quorum open -key custodian.pem -sealed <sealed share>
+//	go run ./cmd/gcpsm-quorum combine <share> <share> ...
+//
+// keygenで作成した公開鍵を PUT /api/1/quorum/custodian で登録し、
+// openで復号したShareを POST /api/1/quorum/recovery/{id}/share で提出する
+// combineはServiceを使わずにShareからSecretを復元する
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "keygen":
+		err = keygen(os.Args[2:])
+	case "open":
+		err = open(os.Args[2:])
+	case "combine":
+		err = combine(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: gcpsm-quorum keygen|open|combine [flags]")
+	os.Exit(2)
+}
+
+// keygen is RSAの鍵を作成し、秘密鍵をFileに、公開鍵を標準出力に書き出す
+func keygen(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	out := fs.String("out", "custodian.pem", "file to write the private key")
+	bits := fs.Int("bits", 4096, "RSA key size")
+	fs.Parse(args)
+
+	priv, err := rsa.GenerateKey(rand.Reader, *bits)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := pem.Encode(f, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)}); err != nil {
+		return err
+	}
+	return pem.Encode(os.Stdout, &pem.Block{Type: "PUBLIC KEY", Bytes: der})
+}
+
+// open is Sealed Shareを秘密鍵で復号し、提出するShareをBase64で標準出力に書き出す
+func open(args []string) error {
+	fs := flag.NewFlagSet("open", flag.ExitOnError)
+	keyFile := fs.String("key", "custodian.pem", "private key file created by keygen")
+	sealed := fs.String("sealed", "", "sealed share. read from stdin if empty")
+	fs.Parse(args)
+
+	b, err := ioutil.ReadFile(*keyFile)
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return fmt.Errorf("%s is not a RSA PRIVATE KEY", *keyFile)
+	}
+	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return err
+	}
+
+	s := *sealed
+	if s == "" {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return err
+		}
+		s = string(b)
+	}
+	share, err := backend.OpenShare(priv, strings.TrimSpace(s))
+	if err != nil {
+		return err
+	}
+	fmt.Println(base64.StdEncoding.EncodeToString(share))
+	return nil
+}
+
+// combine is Base64のShareからSecretを復元して標準出力に書き出す
+func combine(args []string) error {
+	shares := make([][]byte, len(args))
+	for i, a := range args {
+		s, err := base64.StdEncoding.DecodeString(a)
+		if err != nil {
+			return fmt.Errorf("share %d is not base64: %v", i+1, err)
+		}
+		shares[i] = s
+	}
+	secret, err := backend.CombineShares(shares)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(secret)
+	return err
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+// backupFlags is backupとrestoreのFlag
+type backupFlags struct {
+	key       string
+	file      string
+	tenant    string
+	cryptKey  string
+	actor     string
+	overwrite bool
+	dryRun    bool
+}
+
+func parseBackupFlags(cmd string, args []string) *backupFlags {
+	f := &backupFlags{}
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.StringVar(&f.key, "key", "", "backup: PEM encoded RSA PUBLIC KEY. restore: RSA PRIVATE KEY (gcpsm-quorum keygen creates both)")
+	fs.StringVar(&f.file, "file", "gcpsm.backup", "backup file to write or read")
+	fs.StringVar(&f.tenant, "tenant", "", "tenant to backup or restore. "+backend.DefaultTenantID+" for the default tenant. all tenants if empty")
+	fs.StringVar(&f.cryptKey, "crypt-key", "", "restore: crypt key to encrypt restored values. [{provider}:]projects/{p}/locations/{l}/keyRings/{r}/cryptoKeys/{k}. keys of the backup are used if empty")
+	fs.StringVar(&f.actor, "actor", os.Getenv("USER"), "recorded in audit logs as the actor")
+	fs.BoolVar(&f.overwrite, "overwrite", false, "restore: overwrite tenants which already have secrets")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "restore: decrypt the backup and verify checksums without writing. kms and datastore are not used")
+	fs.Parse(args)
+	if f.key == "" {
+		fmt.Fprintf(os.Stderr, "-key is required for %s\n", cmd)
+		os.Exit(2)
+	}
+	return f
+}
+
+// runBackup is 現在のPlatformからBackupを作成し、公開鍵で暗号化してFileに書き出す
+func runBackup(ctx context.Context, f *backupFlags) error {
+	b, err := ioutil.ReadFile(f.key)
+	if err != nil {
+		return err
+	}
+	pub, err := backend.ParseCustodianPublicKey(string(b))
+	if err != nil {
+		return err
+	}
+	ds, err := backend.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	tenants, err := backend.BackupTenants(ctx, ds, f.tenant)
+	if err != nil {
+		return err
+	}
+	backup, err := backend.CreateBackup(ctx, ds, tenants, f.actor)
+	if err != nil {
+		return err
+	}
+	data, err := backend.SealBackup(pub, backup)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(f.file, data, 0600); err != nil {
+		return err
+	}
+	if err := backend.RecordBackup(ctx, ds, backup, backend.AuditBackupCreated, f.actor); err != nil {
+		return err
+	}
+	summary, err := backup.Verify()
+	if err != nil {
+		return err
+	}
+	summary.DryRun = false
+	return printJSON(summary)
+}
+
+// runRestore is BackupをDecryptして確認し、DryRunでなければ現在のPlatformに復元する
+func runRestore(ctx context.Context, f *backupFlags) error {
+	backup, err := openBackupFile(f)
+	if err != nil {
+		return err
+	}
+	opts := &backend.RestoreOptions{
+		Tenant:    f.tenant,
+		Overwrite: f.overwrite,
+		DryRun:    f.dryRun,
+	}
+	if f.cryptKey != "" {
+		ck, err := backend.ParseCryptKey(f.cryptKey)
+		if err != nil {
+			return err
+		}
+		if !backend.KeyProviderRegistered(ck.Provider) {
+			return fmt.Errorf("key provider %q is not available", ck.Provider)
+		}
+		opts.CryptKey = &ck
+	}
+	if f.dryRun {
+		summary, err := backend.RestoreBackup(ctx, nil, backup, opts)
+		if err != nil {
+			return err
+		}
+		return printJSON(summary)
+	}
+
+	ds, err := backend.FromContext(ctx)
+	if err != nil {
+		return err
+	}
+	summary, err := backend.RestoreBackup(ctx, ds, backup, opts)
+	if err != nil {
+		return err
+	}
+	for _, tb := range backup.Tenants {
+		for _, c := range summary.Tenants {
+			if c.Tenant != tb.Tenant.ID {
+				continue
+			}
+			one := &backend.Backup{Checksum: backup.Checksum, Tenants: []*backend.TenantBackup{tb}}
+			if err := backend.RecordBackup(ctx, ds, one, backend.AuditBackupRestored, f.actor); err != nil {
+				return err
+			}
+		}
+	}
+	return printJSON(summary)
+}
+
+func openBackupFile(f *backupFlags) (*backend.Backup, error) {
+	b, err := ioutil.ReadFile(f.key)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, fmt.Errorf("%s is not PEM encoded", f.key)
+	}
+	var priv *rsa.PrivateKey
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		priv, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		var k interface{}
+		k, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err == nil {
+			var ok bool
+			if priv, ok = k.(*rsa.PrivateKey); !ok {
+				err = fmt.Errorf("%s is not a RSA private key", f.key)
+			}
+		}
+	default:
+		err = fmt.Errorf("%s is not a private key", f.key)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(f.file)
+	if err != nil {
+		return nil, err
+	}
+	return backend.OpenBackup(priv, data)
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
@@ -0,0 +1,286 @@
+// gcpsm-server is App Engine Standardの外 (Cloud Run, GKE, Local) でgcpsmを動かすServer
+//
+//	go run ./cmd/gcpsm-server -project my-project -identity header -admins admin@example.com
+//	DATASTORE_EMULATOR_HOST=localhost:8432 go run ./cmd/gcpsm-server -project dev -identity static -user dev@example.com -key-provider local -keyring gcpsm.keyring
+//	VAULT_TOKEN=... go run ./cmd/gcpsm-server -project my-project -key-provider vault -vault-addr https://vault.example.com:8200 -key-ring transit -key-name gcpsm
+//	AWS_ACCESS_KEY_ID=... AWS_SECRET_ACCESS_KEY=... go run ./cmd/gcpsm-server -project my-project -key-provider awskms -aws-region us-east-1 -key-name alias/gcpsm
+//
+// backupとrestoreは同じFlagで接続したDatastoreとKeyProviderを使い、Serverを起動せずに実行する
+//
+//	go run ./cmd/gcpsm-server -project my-project backup -key backup.pub.pem -file gcpsm.backup
+//	go run ./cmd/gcpsm-server restore -dry-run -key backup.pem -file gcpsm.backup
+//	go run ./cmd/gcpsm-server -project dr-project restore -key backup.pem -file gcpsm.backup -crypt-key projects/dr-project/locations/global/keyRings/gcpsm/cryptoKeys/restored
+//
+// DatastoreはCloud Datastore Clientを利用し、DATASTORE_EMULATOR_HOSTが設定されていればEmulatorに接続する
+// Task QueueとCronは使えないので、Webhookと複製はRequestの中で行い、期限切れの処理はServerの中で定期的に実行する
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sinmetal/gcpsm/backend"
+	"github.com/sinmetal/gcpsm/clouddatastore"
+	"google.golang.org/api/option"
+)
+
+// adminPaths is app.yamlで login: admin としているPath
+var adminPaths = []string{"/api/admin/", "/api/internal/", "/swagger-ui", "/secret.html", "/ui/"}
+
+func main() {
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8080"
+	}
+	addr := flag.String("addr", ":"+port, "listen address")
+	project := flag.String("project", os.Getenv("GOOGLE_CLOUD_PROJECT"), "GCP project ID of Datastore and Cloud KMS")
+	store := flag.String("store", "datastore", "where secrets are stored. datastore, bolt or memory. other entities are always stored in Datastore")
+	boltPath := flag.String("bolt-path", "gcpsm.db", "file used when -store bolt")
+	keyProvider := flag.String("key-provider", backend.KeyProviderCloudKMS, "key provider of the default crypt key. gcpkms, local, vault or awskms")
+	keyLocation := flag.String("key-location", "", "location of the default crypt key. region for awskms")
+	keyRing := flag.String("key-ring", "", "key ring of the default crypt key. mount path for vault")
+	keyName := flag.String("key-name", "", "name of the default crypt key. key id, alias or arn for awskms")
+	redundantKeys := flag.String("redundant-keys", os.Getenv("GCPSM_REDUNDANT_CRYPT_KEYS"), "comma separated crypt keys also wrapping data keys of the default tenant. [{provider}:]projects/{p}/locations/{l}/keyRings/{r}/cryptoKeys/{k}")
+	keyring := flag.String("keyring", "", "keyring file created by gcpsm-keyring. passphrase is read from GCPSM_KEYRING_PASSPHRASE")
+	vaultAddr := flag.String("vault-addr", os.Getenv("VAULT_ADDR"), "vault address for the vault key provider. token is read from VAULT_TOKEN")
+	vaultNamespace := flag.String("vault-namespace", os.Getenv("VAULT_NAMESPACE"), "vault enterprise namespace")
+	awsRegion := flag.String("aws-region", os.Getenv("AWS_REGION"), "region for the awskms key provider. credentials are read from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN")
+	awsEndpoint := flag.String("aws-kms-endpoint", "", "endpoint of an aws kms compatible service. https://kms.{region}.amazonaws.com if empty")
+	credentials := flag.String("credentials", "", "service account key file. Application Default Credentials are used if empty")
+	identity := flag.String("identity", "header", "how to identify users. header or static")
+	header := flag.String("identity-header", "X-Goog-Authenticated-User-Email", "header set by the authenticating proxy")
+	prefix := flag.String("identity-prefix", "accounts.google.com:", "prefix trimmed from the identity header")
+	admins := flag.String("admins", "", "comma separated emails treated as administrators of all tenants")
+	staticUser := flag.String("user", "", "email used for every request when -identity static")
+	replicationPeers := flag.String("replication-peers", os.Getenv("GCPSM_REPLICATION_PEERS"), "comma separated users of other gcpsm allowed to write with X-Gcpsm-Replication to the default tenant, e.g. emails in -token-file")
+	tokenFile := flag.String("token-file", "", "file of \"{email} {sha256 of token}\" lines. requests with Authorization: Bearer {token} are identified as the email, e.g. replication from another gcpsm")
+	logFormat := flag.String("log", "json", "log format. json or text")
+	static := flag.String("static", "backend", "directory containing swagger-ui")
+	expireInterval := flag.Duration("expire-interval", 10*time.Minute, "interval to expire change requests and quorum recoveries")
+	flag.Parse()
+
+	cmd := flag.Arg(0)
+	var bf *backupFlags
+	switch cmd {
+	case "":
+	case "backup", "restore":
+		bf = parseBackupFlags(cmd, flag.Args()[1:])
+	default:
+		log.Fatalf("unknown command %q. backup or restore", cmd)
+	}
+	if cmd == "restore" && bf.dryRun && bf.cryptKey == "" {
+		// DryRunはBackupのFileと秘密鍵だけで確認できる
+		if err := runRestore(context.Background(), bf); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if *project == "" {
+		log.Fatal("-project is required")
+	}
+
+	ctx := context.Background()
+	var opts []option.ClientOption
+	if *credentials != "" {
+		opts = append(opts, option.WithCredentialsFile(*credentials))
+	}
+	client, err := clouddatastore.NewClient(ctx, *project, opts...)
+	if err != nil {
+		log.Fatalf("failed create datastore client. %v", err)
+	}
+	defer client.Close()
+
+	var secrets backend.SecretStore
+	switch *store {
+	case "datastore":
+		secrets = &backend.DatastoreSecretStore{}
+	case "bolt":
+		bolt, err := backend.OpenBoltSecretStore(*boltPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer bolt.Close()
+		secrets = bolt
+	case "memory":
+		secrets = backend.NewMemorySecretStore()
+	default:
+		log.Fatalf("unknown store %q", *store)
+	}
+
+	if *keyring != "" {
+		kr, err := backend.OpenLocalKeyRing(*keyring, os.Getenv("GCPSM_KEYRING_PASSPHRASE"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		backend.RegisterKeyProvider(backend.KeyProviderLocal, func(ctx context.Context) (backend.KeyProvider, error) {
+			return kr, nil
+		})
+	}
+	if *vaultAddr != "" {
+		vault := backend.NewVaultTransitProvider(*vaultAddr, os.Getenv("VAULT_TOKEN"))
+		vault.Namespace = *vaultNamespace
+		backend.RegisterKeyProvider(backend.KeyProviderVault, func(ctx context.Context) (backend.KeyProvider, error) {
+			return vault, nil
+		})
+	}
+	if *awsRegion != "" || *awsEndpoint != "" {
+		aws := backend.NewAWSKMSProvider(*awsRegion, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"))
+		aws.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+		aws.Endpoint = *awsEndpoint
+		backend.RegisterKeyProvider(backend.KeyProviderAWSKMS, func(ctx context.Context) (backend.KeyProvider, error) {
+			return aws, nil
+		})
+	}
+	if !backend.KeyProviderRegistered(*keyProvider) {
+		log.Fatalf("key provider %q is not available. -keyring, -vault-addr or -aws-region is required", *keyProvider)
+	}
+	redundant, err := backend.ParseCryptKeys(*redundantKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, ck := range redundant {
+		if !backend.KeyProviderRegistered(ck.Provider) {
+			log.Fatalf("key provider %q of redundant key is not available", ck.Provider)
+		}
+	}
+
+	var id backend.Identity
+	switch *identity {
+	case "header":
+		id = &backend.HeaderIdentity{Header: *header, Prefix: *prefix, Admins: backend.SplitList(*admins)}
+	case "static":
+		if *staticUser == "" {
+			log.Fatal("-user is required when -identity static")
+		}
+		id = &backend.StaticIdentity{Email: *staticUser, Admin: true}
+	default:
+		log.Fatalf("unknown identity %q", *identity)
+	}
+	if *tokenFile != "" {
+		f, err := os.Open(*tokenFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tokens, err := backend.ReadTokens(f)
+		f.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		id = &backend.TokenIdentity{Tokens: tokens, Next: id}
+	}
+
+	backend.SetPlatform(&backend.Platform{
+		NewContext: func(parent context.Context, r *http.Request) context.Context {
+			if parent == nil {
+				return r.Context()
+			}
+			return parent
+		},
+		Datastore:   backend.SharedDatastore(client),
+		SecretStore: secrets,
+		Identity:    id,
+		Logger:      &backend.StreamLogger{W: os.Stdout, JSON: *logFormat == "json"},
+		HTTPClient:  func(ctx context.Context) *http.Client { return http.DefaultClient },
+		ProjectID:   func(ctx context.Context) string { return *project },
+		KeyProvider: *keyProvider,
+		CryptKey: backend.CryptKey{
+			LocationID: *keyLocation,
+			KeyRingID:  *keyRing,
+			KeyName:    *keyName,
+		},
+		RedundantCryptKeys: redundant,
+		ReplicationPeers:   backend.SplitList(*replicationPeers),
+	})
+	backend.DefaultWebhookQueue = &backend.SyncWebhookQueue{}
+	backend.DefaultReplicationQueue = &backend.SyncReplicationQueue{}
+
+	switch cmd {
+	case "backup":
+		err = runBackup(ctx, bf)
+	case "restore":
+		err = runRestore(ctx, bf)
+	}
+	if cmd != "" {
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// backendのinitで /api/ と画面がhttp.DefaultServeMuxに登録されている
+	http.Handle("/swagger-ui/", http.StripPrefix("/swagger-ui/", http.FileServer(http.Dir(*static+"/swagger-ui"))))
+
+	go expireLoop(ctx, *expireInterval)
+
+	server := &http.Server{
+		Addr:    *addr,
+		Handler: guard(id, http.DefaultServeMux),
+	}
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM)
+		<-sig
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	log.Printf("listening on %s. project=%s, store=%s, identity=%s", *addr, *project, *store, *identity)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// guard is App Engineのapp.yamlとFrontendが行っていることを代わりに行う
+// X-Appengine-で始まるHeaderを取り除き、adminPathsは管理者だけが利用できるようにする
+func guard(id backend.Identity, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for k := range r.Header {
+			if strings.HasPrefix(k, "X-Appengine-") {
+				r.Header.Del(k)
+			}
+		}
+		for _, p := range adminPaths {
+			if !strings.HasPrefix(r.URL.Path, p) {
+				continue
+			}
+			if u := id.CurrentUser(r.Context(), r); u == nil || !u.Admin {
+				http.Error(w, "You do not have permission.", http.StatusForbidden)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// expireLoop is cron.yamlの代わりに、期限切れのSecretChangeRequestとQuorumRecoveryを定期的に処理する
+func expireLoop(ctx context.Context, interval time.Duration) {
+	for range time.Tick(interval) {
+		ds, err := backend.FromContext(ctx)
+		if err != nil {
+			log.Printf("failed create datastore client. %v", err)
+			continue
+		}
+		tenants, err := backend.ListTenants(ctx, ds)
+		if err != nil {
+			log.Printf("failed list tenants. %v", err)
+			continue
+		}
+		for _, t := range append([]*backend.Tenant{backend.DefaultTenant(ctx)}, tenants...) {
+			if _, err := backend.ExpireSecretChangeRequests(ctx, ds, t); err != nil {
+				log.Printf("failed expire change requests. tenant=%s, %v", t.ID, err)
+			}
+			if _, err := backend.ExpireQuorumRecoveries(ctx, ds, t); err != nil {
+				log.Printf("failed expire quorum recoveries. tenant=%s, %v", t.ID, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,291 @@
+// k8s-standin is Kubernetes API ServerのSecretだけを実装した、gcpsm-k8s-syncの動作確認用のLocal Server
+//
+//	go run ./cmd/k8s-standin -addr localhost:8001 -token dev
+//	go run ./cmd/gcpsm-k8s-sync -kube-api http://localhost:8001 -kube-token-file /tmp/kube-token ...
+//	curl -H 'Authorization: Bearer dev' http://localhost:8001/api/v1/namespaces/payments/secrets
+//
+// /api/v1/namespaces/{namespace}/secrets の list (labelSelectorは = と , だけ), create と、
+// /api/v1/namespaces/{namespace}/secrets/{name} の get, update, delete を受け付ける
+// SecretはMemoryにだけ保持し、ResourceVersionが一致しないupdateとdeleteは409を返す
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// secret is v1.Secret. 知らない項目も保持できるようにmetadata以外はそのまま持つ
+type secret struct {
+	Metadata struct {
+		Name              string            `json:"name"`
+		Namespace         string            `json:"namespace"`
+		Labels            map[string]string `json:"labels,omitempty"`
+		Annotations       map[string]string `json:"annotations,omitempty"`
+		ResourceVersion   string            `json:"resourceVersion"`
+		UID               string            `json:"uid"`
+		CreationTimestamp time.Time         `json:"creationTimestamp"`
+	} `json:"metadata"`
+	Type string            `json:"type,omitempty"`
+	Data map[string][]byte `json:"data,omitempty"`
+}
+
+func (s *secret) MarshalJSON() ([]byte, error) {
+	type alias secret
+	return json.Marshal(&struct {
+		APIVersion string `json:"apiVersion"`
+		Kind       string `json:"kind"`
+		*alias
+	}{"v1", "Secret", (*alias)(s)})
+}
+
+// store is Namespace/Name毎のSecret
+type store struct {
+	mu      sync.Mutex
+	m       map[string]*secret
+	version int64
+}
+
+func (st *store) nextVersion() string {
+	st.version++
+	return strconv.FormatInt(st.version, 10)
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8001", "listen address")
+	token := flag.String("token", "", "bearer token required for requests. any token is accepted if empty")
+	flag.Parse()
+
+	st := &store{m: map[string]*secret{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/namespaces/", func(w http.ResponseWriter, r *http.Request) {
+		if *token != "" && r.Header.Get("Authorization") != "Bearer "+*token {
+			kubeError(w, http.StatusUnauthorized, "Unauthorized", "Unauthorized")
+			return
+		}
+		// {namespace}/secrets[/{name}]
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+		if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] != "secrets" {
+			kubeError(w, http.StatusNotFound, "NotFound", "the server could not find the requested resource")
+			return
+		}
+		namespace := parts[0]
+		if len(parts) == 2 {
+			switch r.Method {
+			case http.MethodGet:
+				st.list(w, r, namespace)
+			case http.MethodPost:
+				st.create(w, r, namespace)
+			default:
+				kubeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not supported")
+			}
+			return
+		}
+		name := parts[2]
+		switch r.Method {
+		case http.MethodGet:
+			st.get(w, namespace, name)
+		case http.MethodPut:
+			st.update(w, r, namespace, name)
+		case http.MethodDelete:
+			st.delete(w, r, namespace, name)
+		default:
+			kubeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", r.Method+" is not supported")
+		}
+	})
+
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+func (st *store) list(w http.ResponseWriter, r *http.Request, namespace string) {
+	selector := map[string]string{}
+	if q := r.URL.Query().Get("labelSelector"); q != "" {
+		for _, req := range strings.Split(q, ",") {
+			kv := strings.SplitN(req, "=", 2)
+			if len(kv) != 2 || strings.HasSuffix(kv[0], "!") {
+				kubeError(w, http.StatusBadRequest, "BadRequest", fmt.Sprintf("unsupported label selector: %q", req))
+				return
+			}
+			selector[kv[0]] = strings.TrimPrefix(kv[1], "=")
+		}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	items := []*secret{}
+	for _, s := range st.m {
+		if s.Metadata.Namespace != namespace {
+			continue
+		}
+		match := true
+		for k, v := range selector {
+			if l, ok := s.Metadata.Labels[k]; !ok || l != v {
+				match = false
+			}
+		}
+		if match {
+			items = append(items, s)
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Metadata.Name < items[j].Metadata.Name })
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "SecretList",
+		"metadata":   map[string]string{"resourceVersion": strconv.FormatInt(st.version, 10)},
+		"items":      items,
+	})
+}
+
+func (st *store) get(w http.ResponseWriter, namespace string, name string) {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	s, ok := st.m[namespace+"/"+name]
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (st *store) create(w http.ResponseWriter, r *http.Request, namespace string) {
+	s, ok := decodeSecret(w, r, namespace)
+	if !ok {
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if _, ok := st.m[namespace+"/"+s.Metadata.Name]; ok {
+		kubeError(w, http.StatusConflict, "AlreadyExists", fmt.Sprintf("secrets %q already exists", s.Metadata.Name))
+		return
+	}
+	s.Metadata.ResourceVersion = st.nextVersion()
+	s.Metadata.UID = fmt.Sprintf("standin-%d", st.version)
+	s.Metadata.CreationTimestamp = time.Now().UTC().Truncate(time.Second)
+	st.m[namespace+"/"+s.Metadata.Name] = s
+	log.Printf("created secret %s/%s", namespace, s.Metadata.Name)
+	writeJSON(w, http.StatusCreated, s)
+}
+
+func (st *store) update(w http.ResponseWriter, r *http.Request, namespace string, name string) {
+	s, ok := decodeSecret(w, r, namespace)
+	if !ok {
+		return
+	}
+	if s.Metadata.Name != name {
+		kubeError(w, http.StatusBadRequest, "BadRequest", "the name of the object does not match the name on the URL")
+		return
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	cur, ok := st.m[namespace+"/"+name]
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	if s.Metadata.ResourceVersion != "" && s.Metadata.ResourceVersion != cur.Metadata.ResourceVersion {
+		conflict(w, name)
+		return
+	}
+	s.Metadata.ResourceVersion = st.nextVersion()
+	s.Metadata.UID = cur.Metadata.UID
+	s.Metadata.CreationTimestamp = cur.Metadata.CreationTimestamp
+	st.m[namespace+"/"+name] = s
+	log.Printf("updated secret %s/%s", namespace, name)
+	writeJSON(w, http.StatusOK, s)
+}
+
+func (st *store) delete(w http.ResponseWriter, r *http.Request, namespace string, name string) {
+	var opts struct {
+		Preconditions struct {
+			ResourceVersion string `json:"resourceVersion"`
+		} `json:"preconditions"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+			kubeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+	}
+
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	cur, ok := st.m[namespace+"/"+name]
+	if !ok {
+		notFound(w, name)
+		return
+	}
+	if rv := opts.Preconditions.ResourceVersion; rv != "" && rv != cur.Metadata.ResourceVersion {
+		conflict(w, name)
+		return
+	}
+	delete(st.m, namespace+"/"+name)
+	log.Printf("deleted secret %s/%s", namespace, name)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Status",
+		"status":     "Success",
+		"details":    map[string]string{"name": name, "kind": "secrets"},
+	})
+}
+
+func decodeSecret(w http.ResponseWriter, r *http.Request, namespace string) (*secret, bool) {
+	s := &secret{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		kubeError(w, http.StatusBadRequest, "BadRequest", err.Error())
+		return nil, false
+	}
+	if s.Metadata.Name == "" {
+		kubeError(w, http.StatusUnprocessableEntity, "Invalid", "metadata.name: Required value")
+		return nil, false
+	}
+	if s.Metadata.Namespace != "" && s.Metadata.Namespace != namespace {
+		kubeError(w, http.StatusBadRequest, "BadRequest", "the namespace of the provided object does not match the namespace sent on the request")
+		return nil, false
+	}
+	s.Metadata.Namespace = namespace
+	return s, true
+}
+
+func notFound(w http.ResponseWriter, name string) {
+	kubeError(w, http.StatusNotFound, "NotFound", fmt.Sprintf("secrets %q not found", name))
+}
+
+func conflict(w http.ResponseWriter, name string) {
+	kubeError(w, http.StatusConflict, "Conflict", fmt.Sprintf("Operation cannot be fulfilled on secrets %q: the object has been modified; please apply your changes to the latest version and try again", name))
+}
+
+// kubeError is v1.Statusを返す
+func kubeError(w http.ResponseWriter, code int, reason string, message string) {
+	writeJSON(w, code, map[string]interface{}{
+		"apiVersion": "v1",
+		"kind":       "Status",
+		"status":     "Failure",
+		"message":    message,
+		"reason":     reason,
+		"code":       code,
+	})
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed write response. %v", err)
+	}
+}
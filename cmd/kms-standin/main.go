@@ -0,0 +1,293 @@
+// kms-standin is Vault TransitとAWS KMSのEncryptとDecryptだけを実装した、動作確認用のLocal Server
+//
+//	go run ./cmd/kms-standin -addr localhost:8200 -vault-token dev -aws-access-key dev -aws-secret-key dev
+//	go run ./cmd/gcpsm-server ... -key-provider vault -vault-addr http://localhost:8200
+//	AWS_ACCESS_KEY_ID=dev AWS_SECRET_ACCESS_KEY=dev go run ./cmd/gcpsm-server ... -key-provider awskms -aws-kms-endpoint http://localhost:8200/ -aws-region us-east-1
+//
+// Vaultは /v1/{mount}/encrypt/{name} と /v1/{mount}/decrypt/{name}、AWS KMSは / への TrentService.Encrypt と TrentService.Decrypt を受け付ける
+// KeyはEncryptで初めて使われた時に作成し、Memoryにだけ保持するので、再起動すると以前のCiphertextはDecryptできない
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+// keys is Keyの名前毎のAES-256 Key
+type keys struct {
+	mu sync.Mutex
+	m  map[string][]byte
+}
+
+func (ks *keys) get(name string, create bool) []byte {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	k, ok := ks.m[name]
+	if !ok && create {
+		k = make([]byte, 32)
+		if _, err := rand.Read(k); err != nil {
+			panic(err)
+		}
+		ks.m[name] = k
+		log.Printf("created key %s", name)
+	}
+	return k
+}
+
+func (ks *keys) seal(name string, plaintext []byte) ([]byte, error) {
+	aead, err := newAEAD(ks.get(name, true))
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(name)), nil
+}
+
+func (ks *keys) open(name string, ciphertext []byte) ([]byte, error) {
+	k := ks.get(name, false)
+	if k == nil {
+		return nil, fmt.Errorf("key %s is not found", name)
+	}
+	aead, err := newAEAD(k)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext is too short")
+	}
+	return aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], []byte(name))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func main() {
+	addr := flag.String("addr", "localhost:8200", "listen address")
+	vaultToken := flag.String("vault-token", "", "X-Vault-Token required for vault requests. any token is accepted if empty")
+	awsAccessKey := flag.String("aws-access-key", "", "access key id accepted for aws kms requests. signature is not verified if empty")
+	awsSecretKey := flag.String("aws-secret-key", "", "secret access key used to verify the signature")
+	flag.Parse()
+
+	vault := &keys{m: map[string][]byte{}}
+	aws := &keys{m: map[string][]byte{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/", func(w http.ResponseWriter, r *http.Request) {
+		if *vaultToken != "" && r.Header.Get("X-Vault-Token") != *vaultToken {
+			vaultError(w, http.StatusForbidden, "permission denied")
+			return
+		}
+		// /v1/{mount}/{op}/{name}. MountはSlashを含むことがある
+		path := strings.TrimPrefix(r.URL.Path, "/v1/")
+		i := strings.LastIndex(path, "/")
+		j := strings.LastIndex(path[:maxInt(i, 0)], "/")
+		if r.Method != http.MethodPost || i < 0 || j < 0 {
+			vaultError(w, http.StatusNotFound, "unsupported path")
+			return
+		}
+		mount, op, name := path[:j], path[j+1:i], path[i+1:]
+		keyName := mount + "/" + name
+
+		var req struct {
+			Plaintext  string `json:"plaintext"`
+			Ciphertext string `json:"ciphertext"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			vaultError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		switch op {
+		case "encrypt":
+			pt, err := base64.StdEncoding.DecodeString(req.Plaintext)
+			if err != nil {
+				vaultError(w, http.StatusBadRequest, "plaintext is not base64")
+				return
+			}
+			ct, err := vault.seal(keyName, pt)
+			if err != nil {
+				vaultError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, map[string]interface{}{"data": map[string]interface{}{
+				"ciphertext":  "vault:v1:" + base64.StdEncoding.EncodeToString(ct),
+				"key_version": 1,
+			}})
+		case "decrypt":
+			ct, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(req.Ciphertext, "vault:v1:"))
+			if err != nil || !strings.HasPrefix(req.Ciphertext, "vault:v1:") {
+				vaultError(w, http.StatusBadRequest, "invalid ciphertext")
+				return
+			}
+			pt, err := vault.open(keyName, ct)
+			if err != nil {
+				vaultError(w, http.StatusBadRequest, "cipher: message authentication failed")
+				return
+			}
+			writeJSON(w, map[string]interface{}{"data": map[string]interface{}{
+				"plaintext": base64.StdEncoding.EncodeToString(pt),
+			}})
+		default:
+			vaultError(w, http.StatusNotFound, "unsupported operation "+op)
+		}
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			awsError(w, http.StatusBadRequest, "SerializationException", err.Error())
+			return
+		}
+		region, err := verifyAWSSignature(r, body, *awsAccessKey, *awsSecretKey)
+		if err != nil {
+			awsError(w, http.StatusBadRequest, "InvalidSignatureException", err.Error())
+			return
+		}
+
+		var req struct {
+			KeyID          string `json:"KeyId"`
+			Plaintext      string
+			CiphertextBlob string
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			awsError(w, http.StatusBadRequest, "SerializationException", err.Error())
+			return
+		}
+		switch r.Header.Get("X-Amz-Target") {
+		case "TrentService.Encrypt":
+			pt, err := base64.StdEncoding.DecodeString(req.Plaintext)
+			if err != nil || req.KeyID == "" {
+				awsError(w, http.StatusBadRequest, "ValidationException", "KeyId and base64 Plaintext are required")
+				return
+			}
+			arn := req.KeyID
+			if !strings.HasPrefix(arn, "arn:") {
+				arn = fmt.Sprintf("arn:aws:kms:%s:000000000000:%s", region, strings.TrimPrefix(req.KeyID, "key/"))
+			}
+			ct, err := aws.seal(arn, pt)
+			if err != nil {
+				awsError(w, http.StatusInternalServerError, "KMSInternalException", err.Error())
+				return
+			}
+			// CiphertextBlobにKeyのARNを含め、DecryptではKeyIdを不要にする
+			blob := make([]byte, 2, 2+len(arn)+len(ct))
+			binary.BigEndian.PutUint16(blob, uint16(len(arn)))
+			blob = append(append(blob, arn...), ct...)
+			writeJSON(w, map[string]interface{}{
+				"CiphertextBlob":      base64.StdEncoding.EncodeToString(blob),
+				"KeyId":               arn,
+				"EncryptionAlgorithm": "SYMMETRIC_DEFAULT",
+			})
+		case "TrentService.Decrypt":
+			blob, err := base64.StdEncoding.DecodeString(req.CiphertextBlob)
+			if err != nil || len(blob) < 2 || len(blob) < 2+int(binary.BigEndian.Uint16(blob)) {
+				awsError(w, http.StatusBadRequest, "InvalidCiphertextException", "invalid ciphertext")
+				return
+			}
+			n := int(binary.BigEndian.Uint16(blob))
+			arn := string(blob[2 : 2+n])
+			pt, err := aws.open(arn, blob[2+n:])
+			if err != nil {
+				awsError(w, http.StatusBadRequest, "InvalidCiphertextException", err.Error())
+				return
+			}
+			writeJSON(w, map[string]interface{}{
+				"Plaintext":           base64.StdEncoding.EncodeToString(pt),
+				"KeyId":               arn,
+				"EncryptionAlgorithm": "SYMMETRIC_DEFAULT",
+			})
+		default:
+			awsError(w, http.StatusBadRequest, "UnknownOperationException", r.Header.Get("X-Amz-Target"))
+		}
+	})
+
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// verifyAWSSignature is 同じCredentialで署名し直して、Authorization Headerが一致するかを確認する. Regionを返す
+func verifyAWSSignature(r *http.Request, body []byte, accessKey string, secretKey string) (string, error) {
+	auth := r.Header.Get("Authorization")
+	// AWS4-HMAC-SHA256 Credential={access key}/{date}/{region}/{service}/aws4_request, ...
+	i := strings.Index(auth, "Credential=")
+	if i < 0 {
+		return "", fmt.Errorf("authorization header is missing")
+	}
+	scope := strings.Split(strings.SplitN(auth[i+len("Credential="):], ",", 2)[0], "/")
+	if len(scope) != 5 {
+		return "", fmt.Errorf("invalid credential scope")
+	}
+	region := scope[2]
+	if accessKey == "" {
+		return region, nil
+	}
+	if scope[0] != accessKey {
+		return "", fmt.Errorf("unknown access key %s", scope[0])
+	}
+	now, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+	if err != nil {
+		return "", fmt.Errorf("invalid X-Amz-Date")
+	}
+	req, err := http.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range r.Header {
+		if k == "Content-Type" || strings.HasPrefix(k, "X-Amz-") {
+			req.Header[k] = v
+		}
+	}
+	backend.SignAWSRequestV4(req, body, region, scope[3], accessKey, secretKey, now)
+	if req.Header.Get("Authorization") != auth {
+		return "", fmt.Errorf("signature does not match")
+	}
+	return region, nil
+}
+
+func vaultError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	writeJSON(w, map[string]interface{}{"errors": []string{msg}})
+}
+
+func awsError(w http.ResponseWriter, code int, typ string, msg string) {
+	w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(map[string]string{"__type": typ, "message": msg})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	json.NewEncoder(w).Encode(v)
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
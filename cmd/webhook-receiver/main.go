@@ -0,0 +1,66 @@
+// webhook-receiver is gcpsmのWebhookをLocalで受け取り、署名を確認して標準出力に書き出す
+//
+//	go run ./cmd/webhook-receiver -addr localhost:8081 -secret <signingSecret>
+//
+// WebhookSubscriptionのURLには http://localhost:8081/ を指定する
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:8081", "listen address")
+	secret := flag.String("secret", os.Getenv("GCPSM_WEBHOOK_SECRET"), "signing secret returned when the subscription is created")
+	status := flag.Int("status", http.StatusOK, "status code to respond. use 5xx to test retry")
+	flag.Parse()
+
+	mux := http.NewServeMux()
+	mux.Handle("/", newHandler(*secret, *status, os.Stdout))
+
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, mux))
+}
+
+// newHandler is Webhookを受け取るHandler. secretが空でなければ署名を確認し、Eventをoutに書き出してstatusを返す
+func newHandler(secret string, status int, out io.Writer) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if secret != "" {
+			err := backend.VerifyWebhookSignature(secret,
+				r.Header.Get(backend.WebhookHeaderTimestamp), body,
+				r.Header.Get(backend.WebhookHeaderSignature), 5*time.Minute)
+			if err != nil {
+				log.Printf("invalid signature. delivery=%s, err=%v", r.Header.Get(backend.WebhookHeaderDelivery), err)
+				http.Error(w, err.Error(), http.StatusUnauthorized)
+				return
+			}
+		}
+
+		var event backend.SecretEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(out, "%s delivery=%s type=%s tenant=%s key=%s version=%d actor=%s\n",
+			time.Now().Format(time.RFC3339), r.Header.Get(backend.WebhookHeaderDelivery),
+			event.Type, event.Tenant, event.Key, event.Version, event.Actor)
+
+		w.WriteHeader(status)
+	})
+}
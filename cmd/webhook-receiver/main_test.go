@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sinmetal/gcpsm/backend"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func post(t *testing.T, url string, timestamp string, body string, signature string) int {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(backend.WebhookHeaderDelivery, "delivery")
+	req.Header.Set(backend.WebhookHeaderTimestamp, timestamp)
+	req.Header.Set(backend.WebhookHeaderSignature, signature)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestHandler(t *testing.T) {
+	var out bytes.Buffer
+	srv := httptest.NewServer(newHandler("s", http.StatusOK, &out))
+	defer srv.Close()
+
+	body := `{"type":"secret.updated","tenant":"t","key":"prod/db","version":2,"actor":"a@example.com"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	cases := []struct {
+		name      string
+		timestamp string
+		body      string
+		signature string
+		want      int
+	}{
+		{"valid", now, body, backend.SignWebhook("s", now, []byte(body)), http.StatusOK},
+		{"other secret", now, body, backend.SignWebhook("x", now, []byte(body)), http.StatusUnauthorized},
+		{"tampered body", now, strings.Replace(body, "prod", "dev", 1), backend.SignWebhook("s", now, []byte(body)), http.StatusUnauthorized},
+		{"stale timestamp", stale, body, backend.SignWebhook("s", stale, []byte(body)), http.StatusUnauthorized},
+		{"not json", now, "x", backend.SignWebhook("s", now, []byte("x")), http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		out.Reset()
+		if g := post(t, srv.URL, c.timestamp, c.body, c.signature); g != c.want {
+			t.Errorf("%s: got %d, want %d", c.name, g, c.want)
+		}
+		if g := out.Len() > 0; g != (c.want == http.StatusOK) {
+			t.Errorf("%s: output %q", c.name, out.String())
+		}
+	}
+}
+
+func TestHandlerStatus(t *testing.T) {
+	srv := httptest.NewServer(newHandler("", http.StatusServiceUnavailable, ioutil.Discard))
+	defer srv.Close()
+
+	// secretを指定しない場合は署名を確認せず、指定したStatusを返す
+	if g, e := post(t, srv.URL, "", `{"type":"secret.deleted"}`, ""), http.StatusServiceUnavailable; g != e {
+		t.Errorf("status: got %d, want %d", g, e)
+	}
+}
+
+func TestHandlerDelivery(t *testing.T) {
+	var out bytes.Buffer
+	rc := httptest.NewServer(newHandler("signing-secret", http.StatusOK, &out))
+	defer rc.Close()
+
+	// backend.SignWebhookで署名したRequestを受け取れる
+	body := []byte(`{"type":"secret.rotated","key":"prod/db","version":5}`)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	if g, e := post(t, rc.URL, ts, string(body), backend.SignWebhook("signing-secret", ts, body)), http.StatusOK; g != e {
+		t.Fatalf("status: got %d, want %d", g, e)
+	}
+	if !strings.Contains(out.String(), "type=secret.rotated") || !strings.Contains(out.String(), "key=prod/db version=5") {
+		t.Errorf("output: got %q", out.String())
+	}
+}